@@ -0,0 +1,182 @@
+package mysocks
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// Formats of the access log.
+const (
+	accessLogFormatJSON   = "json"
+	accessLogFormatLogfmt = "logfmt"
+	accessLogFormatSquid  = "squid"
+)
+
+// accessRecord is the record written to the access log when a session ends.
+type accessRecord struct {
+	Time          time.Time `json:"time"`
+	SessionID     string    `json:"session_id"`
+	ClientAddress string    `json:"client_address"`
+	User          string    `json:"user"`
+	Command       string    `json:"command"`
+	Destination   string    `json:"destination"`
+	ResolvedIP    string    `json:"resolved_ip"`
+	Route         string    `json:"route"`
+	// Rep is the REP code of the reply, or -1 if no reply was sent.
+	Rep         int     `json:"rep"`
+	BytesUp     int64   `json:"bytes_up"`
+	BytesDown   int64   `json:"bytes_down"`
+	DurationMs  float64 `json:"duration_ms"`
+	CloseReason string  `json:"close_reason"`
+}
+
+// accessLogger writes one access record per session.
+type accessLogger struct {
+	mutex  sync.Mutex
+	writer io.Writer
+	format string
+}
+
+// newAccessLogger creates an access logger writing to stdout, stderr or a file
+// that is rotated when it reaches maxSizeMB.
+func newAccessLogger(output string, format string, maxSizeMB int, maxBackups int, maxAgeDays int) (*accessLogger, error) {
+	switch format {
+	case accessLogFormatJSON, accessLogFormatLogfmt, accessLogFormatSquid:
+	default:
+		return nil, fmt.Errorf("unknown access log format: %s", format)
+	}
+
+	var writer io.Writer
+	switch output {
+	case "stdout":
+		writer = os.Stdout
+	case "stderr":
+		writer = os.Stderr
+	default:
+		writer = &lumberjack.Logger{
+			Filename:   output,
+			MaxSize:    maxSizeMB,
+			MaxBackups: maxBackups,
+			MaxAge:     maxAgeDays,
+		}
+	}
+
+	return &accessLogger{
+		writer: writer,
+		format: format,
+	}, nil
+}
+
+func (accessLogger *accessLogger) write(record accessRecord) {
+	var line string
+	switch accessLogger.format {
+	case accessLogFormatLogfmt:
+		line = record.logfmt()
+	case accessLogFormatSquid:
+		line = record.squid()
+	default:
+		line = record.json()
+	}
+
+	accessLogger.mutex.Lock()
+	defer accessLogger.mutex.Unlock()
+	if _, err := io.WriteString(accessLogger.writer, line+"\n"); err != nil {
+		logError(fmt.Sprintf("Failed to write the access log: %v", err), nil)
+	}
+}
+
+func (accessLogger *accessLogger) close() {
+	accessLogger.mutex.Lock()
+	defer accessLogger.mutex.Unlock()
+	if closer, ok := accessLogger.writer.(*lumberjack.Logger); ok {
+		closer.Close()
+	}
+}
+
+func (record accessRecord) json() string {
+	bytes, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Sprintf(`{"error":%q}`, err.Error())
+	}
+	return string(bytes)
+}
+
+func (record accessRecord) logfmt() string {
+	pairs := []struct {
+		key   string
+		value string
+	}{
+		{"time", record.Time.Format(time.RFC3339Nano)},
+		{"session_id", record.SessionID},
+		{"client_address", record.ClientAddress},
+		{"user", record.User},
+		{"command", record.Command},
+		{"destination", record.Destination},
+		{"resolved_ip", record.ResolvedIP},
+		{"route", record.Route},
+		{"rep", strconv.Itoa(record.Rep)},
+		{"bytes_up", strconv.FormatInt(record.BytesUp, 10)},
+		{"bytes_down", strconv.FormatInt(record.BytesDown, 10)},
+		{"duration_ms", strconv.FormatFloat(record.DurationMs, 'f', 3, 64)},
+		{"close_reason", record.CloseReason},
+	}
+
+	var builder strings.Builder
+	for i, pair := range pairs {
+		if i > 0 {
+			builder.WriteByte(' ')
+		}
+		builder.WriteString(pair.key)
+		builder.WriteByte('=')
+		builder.WriteString(logfmtValue(pair.value))
+	}
+	return builder.String()
+}
+
+func logfmtValue(value string) string {
+	if value == "" || strings.ContainsAny(value, " =\"\\") || strings.IndexFunc(value, func(r rune) bool { return r < ' ' }) >= 0 {
+		return strconv.Quote(value)
+	}
+	return value
+}
+
+// squid formats the record like the native access log of Squid:
+// time elapsed client result/code bytes method destination user hierarchy/peer type
+func (record accessRecord) squid() string {
+	result := "NONE"
+	code := "-"
+	if record.Rep >= 0 {
+		result = strings.ToUpper(repName(byte(record.Rep)))
+		code = fmt.Sprintf("%02x", record.Rep)
+	}
+	hierarchy := "HIER_NONE/-"
+	if record.ResolvedIP != "" {
+		hierarchy = fmt.Sprintf("HIER_%s/%s", strings.ToUpper(record.Route), record.ResolvedIP)
+	}
+
+	return fmt.Sprintf("%d.%03d %6d %s %s/%s %d %s %s %s %s -",
+		record.Time.Unix(), record.Time.Nanosecond()/int(time.Millisecond),
+		int64(record.DurationMs),
+		squidValue(record.ClientAddress),
+		result, code,
+		record.BytesUp+record.BytesDown,
+		squidValue(strings.ToUpper(record.Command)),
+		squidValue(record.Destination),
+		squidValue(record.User),
+		hierarchy)
+}
+
+func squidValue(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return strings.ReplaceAll(value, " ", "%20")
+}
@@ -0,0 +1,328 @@
+package mysocks
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// Layouts of the keys of the usage periods, in the local time of the server.
+const (
+	usageDayLayout   = "2006-01-02"
+	usageMonthLayout = "2006-01"
+)
+
+// Periods of the usage reports.
+const (
+	UsagePeriodDay   = "day"
+	UsagePeriodMonth = "month"
+)
+
+// quota is the usage allowed to a user in a period. Zero means no limit.
+type quota struct {
+	// Bytes is the total of the bytes sent and received.
+	Bytes    int64 `json:"bytes"`
+	Sessions int64 `json:"sessions"`
+}
+
+// quotas are the usage allowed to each user. A new session is denied once one of them is reached.
+type quotas struct {
+	Daily   quota `json:"daily"`
+	Monthly quota `json:"monthly"`
+}
+
+// overriddenBy returns the quotas with the non-zero values of the given ones applied.
+func (q quotas) overriddenBy(other quotas) quotas {
+	if other.Daily.Bytes != 0 {
+		q.Daily.Bytes = other.Daily.Bytes
+	}
+	if other.Daily.Sessions != 0 {
+		q.Daily.Sessions = other.Daily.Sessions
+	}
+	if other.Monthly.Bytes != 0 {
+		q.Monthly.Bytes = other.Monthly.Bytes
+	}
+	if other.Monthly.Sessions != 0 {
+		q.Monthly.Sessions = other.Monthly.Sessions
+	}
+	return q
+}
+
+// usageCounters are the usage of a user in a period.
+type usageCounters struct {
+	BytesUp   int64 `json:"bytesUp"`
+	BytesDown int64 `json:"bytesDown"`
+	Sessions  int64 `json:"sessions"`
+}
+
+// exceeds reports whether the usage has reached the quota.
+func (counters *usageCounters) exceeds(quota quota) bool {
+	if counters == nil {
+		return false
+	}
+	return (quota.Bytes > 0 && counters.BytesUp+counters.BytesDown >= quota.Bytes) ||
+		(quota.Sessions > 0 && counters.Sessions >= quota.Sessions)
+}
+
+// userUsage is the usage of a user keyed by day and by month.
+type userUsage struct {
+	Days   map[string]*usageCounters `json:"days"`
+	Months map[string]*usageCounters `json:"months"`
+}
+
+// usageStore is the content of the accounting file.
+type usageStore struct {
+	Users map[string]*userUsage `json:"users"`
+}
+
+func newUsageStore() *usageStore {
+	return &usageStore{Users: map[string]*userUsage{}}
+}
+
+func loadUsageStore(path string) (*usageStore, error) {
+	store := newUsageStore()
+	bytes, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(bytes, store); err != nil {
+		return nil, fmt.Errorf("failed to parse the accounting file %s: %w", path, err)
+	}
+	if store.Users == nil {
+		store.Users = map[string]*userUsage{}
+	}
+	return store, nil
+}
+
+// counters returns the usage of the user in the day and the month of the time,
+// creating them if create is true. Otherwise they may be nil.
+func (store *usageStore) counters(userName string, now time.Time, create bool) (day *usageCounters, month *usageCounters) {
+	dayKey := now.Format(usageDayLayout)
+	monthKey := now.Format(usageMonthLayout)
+	usage, ok := store.Users[userName]
+	if !create {
+		if !ok {
+			return nil, nil
+		}
+		return usage.Days[dayKey], usage.Months[monthKey]
+	}
+
+	if !ok {
+		usage = &userUsage{}
+		store.Users[userName] = usage
+	}
+	if usage.Days == nil {
+		usage.Days = map[string]*usageCounters{}
+	}
+	if usage.Months == nil {
+		usage.Months = map[string]*usageCounters{}
+	}
+	if usage.Days[dayKey] == nil {
+		usage.Days[dayKey] = &usageCounters{}
+	}
+	if usage.Months[monthKey] == nil {
+		usage.Months[monthKey] = &usageCounters{}
+	}
+	return usage.Days[dayKey], usage.Months[monthKey]
+}
+
+// accounting counts the bytes and the sessions of each authenticated user.
+// If it has a path, the counts are kept in that file, which is written every flush interval
+// and when the accounting is closed.
+type accounting struct {
+	mutex sync.Mutex
+	path  string
+	store *usageStore
+	dirty bool
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// openAccounting loads the accounting file if path is not empty, and starts writing it regularly.
+// With an empty path, the counts are only kept in memory.
+func openAccounting(path string, flushInterval time.Duration) (*accounting, error) {
+	accounting := &accounting{
+		path:  path,
+		store: newUsageStore(),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	if path == "" {
+		close(accounting.done)
+		return accounting, nil
+	}
+
+	store, err := loadUsageStore(path)
+	if err != nil {
+		return nil, err
+	}
+	accounting.store = store
+
+	go func() {
+		defer close(accounting.done)
+		ticker := time.NewTicker(flushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := accounting.flush(); err != nil {
+					logError(fmt.Sprintf("Failed to write the accounting file: %v", err), nil)
+				}
+			case <-accounting.stop:
+				return
+			}
+		}
+	}()
+	return accounting, nil
+}
+
+func (accounting *accounting) addSession(userName string) {
+	accounting.mutex.Lock()
+	defer accounting.mutex.Unlock()
+	day, month := accounting.store.counters(userName, time.Now(), true)
+	day.Sessions++
+	month.Sessions++
+	accounting.dirty = true
+}
+
+func (accounting *accounting) addBytes(userName string, up int64, down int64) {
+	accounting.mutex.Lock()
+	defer accounting.mutex.Unlock()
+	day, month := accounting.store.counters(userName, time.Now(), true)
+	day.BytesUp += up
+	day.BytesDown += down
+	month.BytesUp += up
+	month.BytesDown += down
+	accounting.dirty = true
+}
+
+// exceededQuota returns the name of the quota the user has reached, or an empty string.
+func (accounting *accounting) exceededQuota(userName string, quotas quotas) string {
+	accounting.mutex.Lock()
+	defer accounting.mutex.Unlock()
+	day, month := accounting.store.counters(userName, time.Now(), false)
+	if day.exceeds(quotas.Daily) {
+		return "daily"
+	}
+	if month.exceeds(quotas.Monthly) {
+		return "monthly"
+	}
+	return ""
+}
+
+// flush writes the accounting file if the counts have changed since it was written last.
+// The file is replaced atomically so that a crash does not leave it half written.
+func (accounting *accounting) flush() error {
+	accounting.mutex.Lock()
+	if accounting.path == "" || !accounting.dirty {
+		accounting.mutex.Unlock()
+		return nil
+	}
+	bytes, err := json.MarshalIndent(accounting.store, "", "  ")
+	accounting.dirty = false
+	accounting.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileAtomically(accounting.path, bytes); err != nil {
+		// Try again at the next flush.
+		accounting.mutex.Lock()
+		accounting.dirty = true
+		accounting.mutex.Unlock()
+		return err
+	}
+	return nil
+}
+
+func writeFileAtomically(path string, bytes []byte) error {
+	temp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	if _, err := temp.Write(bytes); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), path)
+}
+
+// close stops writing the accounting file regularly and writes it for the last time.
+func (accounting *accounting) close() {
+	select {
+	case <-accounting.stop:
+		return
+	default:
+		close(accounting.stop)
+	}
+	<-accounting.done
+	if err := accounting.flush(); err != nil {
+		logError(fmt.Sprintf("Failed to write the accounting file: %v", err), nil)
+	}
+}
+
+// WriteUsageReport writes the usage of every user in a period read from an accounting file.
+// period is UsagePeriodDay or UsagePeriodMonth, and date is like "2006-01-02" or "2006-01" accordingly.
+// An empty date means the current one.
+func WriteUsageReport(w io.Writer, path string, period string, date string) error {
+	layout := usageDayLayout
+	switch period {
+	case UsagePeriodDay:
+	case UsagePeriodMonth:
+		layout = usageMonthLayout
+	default:
+		return fmt.Errorf("unknown period: %s", period)
+	}
+	if date == "" {
+		date = time.Now().Format(layout)
+	} else if _, err := time.Parse(layout, date); err != nil {
+		return fmt.Errorf("invalid date for the period %s: %s", period, date)
+	}
+
+	store, err := loadUsageStore(path)
+	if err != nil {
+		return err
+	}
+
+	userNames := make([]string, 0, len(store.Users))
+	for userName := range store.Users {
+		userNames = append(userNames, userName)
+	}
+	sort.Strings(userNames)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "USER\tSESSIONS\tBYTES UP\tBYTES DOWN\tBYTES TOTAL\t\n")
+	var total usageCounters
+	for _, userName := range userNames {
+		counters := store.Users[userName].Days[date]
+		if period == UsagePeriodMonth {
+			counters = store.Users[userName].Months[date]
+		}
+		if counters == nil {
+			continue
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t\n", userName, counters.Sessions,
+			counters.BytesUp, counters.BytesDown, counters.BytesUp+counters.BytesDown)
+		total.Sessions += counters.Sessions
+		total.BytesUp += counters.BytesUp
+		total.BytesDown += counters.BytesDown
+	}
+	fmt.Fprintf(tw, "TOTAL (%s)\t%d\t%d\t%d\t%d\t\n", date, total.Sessions,
+		total.BytesUp, total.BytesDown, total.BytesUp+total.BytesDown)
+	return tw.Flush()
+}
@@ -0,0 +1,85 @@
+package mysocks
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestQuotaAndUsageReport(t *testing.T) {
+	configPath := t.TempDir() + "/config.json"
+	writeConfig(t, configPath, `{
+		"quotas": {"daily": {"bytes": 1000000}},
+		"users": {"carol": {"password": "carol-password", "quotas": {"daily": {"sessions": 1}}}}
+	}`)
+	os.Setenv("MYSOCKS_CONFIG", configPath)
+	defer os.Setenv("MYSOCKS_CONFIG", "")
+	accountingPath := t.TempDir() + "/accounting.json"
+	os.Setenv("MYSOCKS_ACCOUNTING_FILE", accountingPath)
+	defer os.Setenv("MYSOCKS_ACCOUNTING_FILE", "")
+
+	StartServer()
+
+	echoServer := startEchoServer(t)
+	defer echoServer.Close()
+
+	dialer := dialerThrough("carol", "carol-password")
+	conn, err := dialer.Dial("tcp", echoServer.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("hello"))
+	io.ReadFull(conn, make([]byte, 5))
+	conn.Close()
+	waitForSessionsToEnd(t)
+
+	// The daily quota of 1 session has been used.
+	if _, err := dialer.Dial("tcp", echoServer.Addr().String()); err == nil {
+		t.Fatal("The session over the quota should be denied")
+	}
+	waitForSessionsToEnd(t)
+
+	// The accounting file is written when the server stops.
+	StopServer()
+	<-server.stopped
+
+	var report bytes.Buffer
+	if err := WriteUsageReport(&report, accountingPath, UsagePeriodDay, ""); err != nil {
+		t.Fatal(err)
+	}
+	fields := []string{}
+	for _, line := range strings.Split(report.String(), "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "carol") {
+			fields = strings.Fields(line)
+		}
+	}
+	// USER SESSIONS BYTES_UP BYTES_DOWN BYTES_TOTAL
+	if len(fields) != 5 || fields[1] != "1" || fields[2] != "5" || fields[3] != "5" || fields[4] != "10" {
+		t.Fatalf("Unexpected report:\n%s", report.String())
+	}
+}
+
+func TestUsageCountersExceeds(t *testing.T) {
+	counters := &usageCounters{BytesUp: 600, BytesDown: 400, Sessions: 2}
+	for _, test := range []struct {
+		quota    quota
+		expected bool
+	}{
+		{quota{}, false},
+		{quota{Bytes: 1001}, false},
+		{quota{Bytes: 1000}, true},
+		{quota{Sessions: 3}, false},
+		{quota{Sessions: 2}, true},
+	} {
+		if actual := counters.exceeds(test.quota); actual != test.expected {
+			t.Errorf("%+v: %v expected, but got %v", test.quota, test.expected, actual)
+		}
+	}
+
+	var noUsage *usageCounters
+	if noUsage.exceeds(quota{Bytes: 1, Sessions: 1}) {
+		t.Error("No usage should not exceed any quota")
+	}
+}
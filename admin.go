@@ -0,0 +1,226 @@
+package mysocks
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// adminSession is a session as shown by the admin API.
+type adminSession struct {
+	ID               string   `json:"id"`
+	ClientAddress    string   `json:"client_address"`
+	UDPClientAddress string   `json:"udp_client_address,omitempty"`
+	User             string   `json:"user"`
+	Groups           []string `json:"groups,omitempty"`
+	Command          string   `json:"command"`
+	Destination      string   `json:"destination"`
+	ResolvedIP       string   `json:"resolved_ip"`
+	Route            string   `json:"route"`
+	// Rep is the REP code of the last reply, or -1 if no reply has been sent.
+	Rep        int       `json:"rep"`
+	BytesUp    int64     `json:"bytes_up"`
+	BytesDown  int64     `json:"bytes_down"`
+	StartedAt  time.Time `json:"started_at"`
+	AgeSeconds float64   `json:"age_seconds"`
+}
+
+// adminListener is a listener of the server as shown by the admin API.
+type adminListener struct {
+	Name    string `json:"name"`
+	Network string `json:"network"`
+	Address string `json:"address"`
+}
+
+// adminStatus is the status of the server as shown by the admin API.
+type adminStatus struct {
+	StartedAt      time.Time       `json:"started_at"`
+	UptimeSeconds  float64         `json:"uptime_seconds"`
+	ActiveSessions int             `json:"active_sessions"`
+	Listeners      []adminListener `json:"listeners"`
+	ConfigVersion  string          `json:"config_version"`
+}
+
+// adminKillResult is the response of the admin API to a termination.
+type adminKillResult struct {
+	Killed int `json:"killed"`
+}
+
+func newAdminSession(socksConnection *socksConnection) adminSession {
+	info := socksConnection.getInfo()
+	session := adminSession{
+		ID:            socksConnection.id,
+		ClientAddress: socksConnection.acceptedConn.RemoteAddr().String(),
+		User:          info.userName,
+		Groups:        info.attributes.groups,
+		Destination:   info.destination,
+		ResolvedIP:    info.resolvedIP,
+		Route:         info.route,
+		Rep:           int(socksConnection.rep.Load()),
+		BytesUp:       socksConnection.bytesUp.Load(),
+		BytesDown:     socksConnection.bytesDown.Load(),
+		StartedAt:     socksConnection.startedAt,
+		AgeSeconds:    time.Since(socksConnection.startedAt).Seconds(),
+	}
+	if info.command != 0 {
+		session.Command = cmdName(info.command)
+	}
+	if udpAssociation := socksConnection.udpAssociation.Load(); udpAssociation != nil {
+		if clientAddr := udpAssociation.getClientAddr(); clientAddr != nil {
+			session.UDPClientAddress = clientAddr.String()
+		}
+	}
+	return session
+}
+
+// adminServer serves the admin API over HTTP.
+// Every request must have the header "Authorization: Bearer <token>".
+type adminServer struct {
+	httpServer *http.Server
+	listener   net.Listener
+	server     *Server
+	token      string
+}
+
+// listenAdmin binds the admin API to the address. It is served by serve.
+func listenAdmin(address string, token string, server *Server) (*adminServer, error) {
+	if token == "" {
+		return nil, errors.New("MYSOCKS_ADMIN_TOKEN must be set to enable the admin API")
+	}
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	adminServer := &adminServer{
+		listener: listener,
+		server:   server,
+		token:    token,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /sessions", adminServer.listSessions)
+	mux.HandleFunc("GET /sessions/{id}", adminServer.getSession)
+	mux.HandleFunc("DELETE /sessions/{id}", adminServer.killSession)
+	mux.HandleFunc("DELETE /users/{user}/sessions", adminServer.killUserSessions)
+	mux.HandleFunc("GET /status", adminServer.status)
+	mux.HandleFunc("POST /reload", adminServer.reload)
+
+	adminServer.httpServer = &http.Server{
+		Handler:           adminServer.authenticate(mux),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	return adminServer, nil
+}
+
+// serve serves the admin API until the server is closed.
+func (adminServer *adminServer) serve() {
+	logInfo(fmt.Sprintf("Admin server has been started on %s.", adminServer.listener.Addr()), nil)
+
+	if err := adminServer.httpServer.Serve(adminServer.listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logError(fmt.Sprintf("Failed to serve the admin API: %v", err), nil)
+	}
+}
+
+func (adminServer *adminServer) close() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := adminServer.httpServer.Shutdown(ctx); err != nil {
+		logError(fmt.Sprintf("Failed to close admin server: %v", err), nil)
+	}
+}
+
+func (adminServer *adminServer) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(adminServer.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="mysocks"`)
+			writeAdminError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// listSessions lists the active sessions, only those of a user if the query parameter "user" is given.
+func (adminServer *adminServer) listSessions(w http.ResponseWriter, r *http.Request) {
+	userName, filtered := r.URL.Query()["user"]
+	sessions := []adminSession{}
+	for _, socksConnection := range adminServer.server.socksConnections.list() {
+		session := newAdminSession(socksConnection)
+		if filtered && session.User != userName[0] {
+			continue
+		}
+		sessions = append(sessions, session)
+	}
+	writeAdminJSON(w, http.StatusOK, sessions)
+}
+
+func (adminServer *adminServer) getSession(w http.ResponseWriter, r *http.Request) {
+	socksConnection := adminServer.server.socksConnections.getByID(r.PathValue("id"))
+	if socksConnection == nil {
+		writeAdminError(w, http.StatusNotFound, "session not found")
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, newAdminSession(socksConnection))
+}
+
+func (adminServer *adminServer) killSession(w http.ResponseWriter, r *http.Request) {
+	socksConnection := adminServer.server.socksConnections.getByID(r.PathValue("id"))
+	if socksConnection == nil {
+		writeAdminError(w, http.StatusNotFound, "session not found")
+		return
+	}
+	socksConnection.kill(closeReasonKilledByAdmin)
+	socksConnection.logWithLevel(logLevelWarn, "The session has been killed through the admin API.")
+	writeAdminJSON(w, http.StatusOK, adminKillResult{Killed: 1})
+}
+
+func (adminServer *adminServer) killUserSessions(w http.ResponseWriter, r *http.Request) {
+	userName := r.PathValue("user")
+	killed := adminServer.server.socksConnections.closeByUser(userName, closeReasonKilledByAdmin)
+	logWarn(fmt.Sprintf("%d sessions of user %s have been killed through the admin API.", killed, userName), nil)
+	writeAdminJSON(w, http.StatusOK, adminKillResult{Killed: killed})
+}
+
+func (adminServer *adminServer) status(w http.ResponseWriter, r *http.Request) {
+	server := adminServer.server
+	listeners := append(server.listeners(),
+		adminListener{Name: "admin", Network: "tcp", Address: adminServer.listener.Addr().String()})
+	status := adminStatus{
+		StartedAt:      server.startedAt,
+		UptimeSeconds:  time.Since(server.startedAt).Seconds(),
+		ActiveSessions: server.socksConnections.count(),
+		Listeners:      listeners,
+		ConfigVersion:  server.config.Load().version,
+	}
+	writeAdminJSON(w, http.StatusOK, status)
+}
+
+func (adminServer *adminServer) reload(w http.ResponseWriter, r *http.Request) {
+	if err := adminServer.server.Reload(); err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	adminServer.status(w, r)
+}
+
+func writeAdminJSON(w http.ResponseWriter, statusCode int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		logError(fmt.Sprintf("Failed to write the admin API response: %v", err), nil)
+	}
+}
+
+func writeAdminError(w http.ResponseWriter, statusCode int, message string) {
+	writeAdminJSON(w, statusCode, map[string]string{"error": message})
+}
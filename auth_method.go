@@ -0,0 +1,47 @@
+package mysocks
+
+import (
+	"fmt"
+	"net"
+)
+
+// AuthMethod is an authentication method that can be negotiated in addition to
+// NO AUTHENTICATION REQUIRED and USERNAME/PASSWORD, such as GSSAPI or a private method.
+type AuthMethod interface {
+	// Authenticate performs the method-dependent sub-negotiation on conn after the method has been selected.
+	// It returns the authenticated user, which may be empty, and the connection to use for the rest
+	// of the session. The connection may wrap conn to encapsulate the following messages for integrity
+	// or confidentiality as RFC 1961 does, or be nil to keep using conn.
+	// ErrAuthenticationFailed should be returned, after the failure has been replied if the method does so,
+	// when the client is rejected.
+	Authenticate(conn net.Conn) (userName string, wrapped net.Conn, err error)
+}
+
+// RegisterAuthMethod makes the method selectable in the negotiation. It has to be called before Start.
+// The methods registered are preferred to the built-in ones.
+func (server *Server) RegisterAuthMethod(method byte, authMethod AuthMethod) error {
+	switch method {
+	case noAuthRequired, usernamePasswd, noAcceptable:
+		return fmt.Errorf("the method %#02x is built in", method)
+	}
+	server.authMethods[method] = authMethod
+	return nil
+}
+
+// authMethod returns the registered method, or the token authentication if the active configuration has tokens.
+func (server *Server) authMethod(method byte) (AuthMethod, bool) {
+	if authMethod, ok := server.authMethods[method]; ok {
+		return authMethod, true
+	}
+	if method == tokenAuth && server.config.Load().tokens {
+		return &tokenAuthenticator{server: server}, true
+	}
+	return nil, false
+}
+
+// authRequired reports whether the clients have to authenticate, which is the case when the active
+// configuration has passwords or tokens, or an external authenticator verifies the passwords.
+func (server *Server) authRequired() bool {
+	config := server.config.Load()
+	return len(config.credentials) > 0 || config.tokens || server.externalAuthenticator != nil
+}
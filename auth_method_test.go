@@ -0,0 +1,132 @@
+package mysocks
+
+import (
+	"io"
+	"net"
+	"os"
+	"testing"
+)
+
+func TestTokenAuth(t *testing.T) {
+	configPath := t.TempDir() + "/config.json"
+	writeConfig(t, configPath, `{"users": {"erin": {"tokens": ["erin-token"]}}}`)
+	os.Setenv("MYSOCKS_CONFIG", configPath)
+	defer os.Setenv("MYSOCKS_CONFIG", "")
+
+	StartServer()
+	defer StopServer()
+
+	echoServer := startEchoServer(t)
+	defer echoServer.Close()
+
+	authenticate := func(token string) (net.Conn, byte) {
+		conn, err := net.Dial("tcp", proxyAddress)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte{fiexedVer, 0x02, noAuthRequired, tokenAuth})
+		negotiationReply := make([]byte, 2)
+		if _, err := io.ReadFull(conn, negotiationReply); err != nil || negotiationReply[1] != tokenAuth {
+			t.Fatalf("The token method expected, but got %v: %v", negotiationReply, err)
+		}
+		conn.Write(append([]byte{fixedTokenAuthVer, byte(len(token))}, token...))
+		authReply := make([]byte, 2)
+		if _, err := io.ReadFull(conn, authReply); err != nil {
+			t.Fatal(err)
+		}
+		return conn, authReply[1]
+	}
+
+	conn, status := authenticate("erin-token")
+	defer conn.Close()
+	if status != tokenAuthStatusSuccess {
+		t.Fatalf("The token should be accepted, but the status is %#02x", status)
+	}
+	if rep, err := requestConnect(conn, echoServer.Addr().(*net.TCPAddr)); err != nil || rep != repSucceeded {
+		t.Fatalf("CONNECT failed: %v %#02x", err, rep)
+	}
+	if sessions := server.socksConnections.list(); len(sessions) != 1 || sessions[0].getInfo().userName != "erin" {
+		t.Fatalf("The session of erin expected, but got %d sessions", len(sessions))
+	}
+
+	wrongConn, status := authenticate("wrong-token")
+	defer wrongConn.Close()
+	if status != tokenAuthStatusFailure {
+		t.Fatalf("The wrong token should be rejected, but the status is %#02x", status)
+	}
+	if _, err := wrongConn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("The connection should be closed after the failure, but got %v", err)
+	}
+}
+
+// xorConn encapsulates the messages by XORing every byte with a key.
+type xorConn struct {
+	net.Conn
+	key byte
+}
+
+func (conn *xorConn) Read(b []byte) (int, error) {
+	n, err := conn.Conn.Read(b)
+	for i := range b[:n] {
+		b[i] ^= conn.key
+	}
+	return n, err
+}
+
+func (conn *xorConn) Write(b []byte) (int, error) {
+	encoded := make([]byte, len(b))
+	for i := range b {
+		encoded[i] = b[i] ^ conn.key
+	}
+	return conn.Conn.Write(encoded)
+}
+
+// xorAuthMethod receives the key from the client and encapsulates the rest of the session with it.
+type xorAuthMethod struct{}
+
+func (xorAuthMethod) Authenticate(conn net.Conn) (string, net.Conn, error) {
+	key := make([]byte, 1)
+	if _, err := io.ReadFull(conn, key); err != nil {
+		return "", nil, err
+	}
+	return "", &xorConn{Conn: conn, key: key[0]}, nil
+}
+
+func TestRegisteredAuthMethodWrapsConnection(t *testing.T) {
+	const xorAuth byte = 0xFE
+	os.Setenv("MYSOCKS_PORT", "0")
+	testServer := NewServer()
+	if err := testServer.RegisterAuthMethod(usernamePasswd, xorAuthMethod{}); err == nil {
+		t.Fatal("A built-in method should not be replaced")
+	}
+	if err := testServer.RegisterAuthMethod(xorAuth, xorAuthMethod{}); err != nil {
+		t.Fatal(err)
+	}
+	startTestServer(testServer)
+	defer StopServer()
+
+	echoServer := startEchoServer(t)
+	defer echoServer.Close()
+
+	conn, err := net.Dial("tcp", proxyAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte{fiexedVer, 0x02, noAuthRequired, xorAuth})
+	negotiationReply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, negotiationReply); err != nil || negotiationReply[1] != xorAuth {
+		t.Fatalf("The registered method expected, but got %v: %v", negotiationReply, err)
+	}
+	conn.Write([]byte{0x5A})
+
+	wrapped := &xorConn{Conn: conn, key: 0x5A}
+	if rep, err := requestConnect(wrapped, echoServer.Addr().(*net.TCPAddr)); err != nil || rep != repSucceeded {
+		t.Fatalf("CONNECT inside the encapsulation failed: %v %#02x", err, rep)
+	}
+	wrapped.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(wrapped, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("hello expected, but got %q: %v", buf, err)
+	}
+}
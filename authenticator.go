@@ -0,0 +1,44 @@
+package mysocks
+
+import "net"
+
+// credentialsCheck is what an authenticator is asked to verify in a USERNAME/PASSWORD authentication.
+type credentialsCheck struct {
+	userName string
+	password string
+	clientIP net.IP
+	// method is the method negotiated for the authentication.
+	method byte
+}
+
+// userAttributes are given to the sessions of a user by an external authenticator.
+type userAttributes struct {
+	groups []string
+	// rateLimit overrides the rate limit of each session of the user.
+	rateLimit rateLimit
+	// allowedDestinations restricts the destinations of the user unless it is empty.
+	allowedDestinations []destinationPattern
+}
+
+// authDecision is the result of an authentication.
+type authDecision struct {
+	allowed    bool
+	attributes userAttributes
+}
+
+// passwordAuthenticator verifies the credentials against an external identity service.
+type passwordAuthenticator interface {
+	// authenticate returns the decision on the credentials. When the service can not be consulted,
+	// the decision follows the failure policy of the authenticator, and the error tells what has happened.
+	authenticate(check credentialsCheck) (authDecision, error)
+}
+
+// authenticatePassword verifies the credentials with the local users first, and then with the external
+// authenticator if the user is not local.
+func (server *Server) authenticatePassword(check credentialsCheck) (authDecision, error) {
+	credentials := server.config.Load().credentials
+	if credentials.has(check.userName) || server.externalAuthenticator == nil {
+		return authDecision{allowed: credentials.authenticate(check.userName, check.password)}, nil
+	}
+	return server.externalAuthenticator.authenticate(check)
+}
@@ -0,0 +1,53 @@
+package client
+
+import (
+	"context"
+	"net"
+
+	"github.com/jfuruya/mysocks/socks5wire"
+)
+
+// BindConn is a connection waiting with BIND for the destination to connect to the server.
+type BindConn struct {
+	net.Conn
+	bound  *Addr
+	remote *Addr
+}
+
+// Bind asks the server to listen for a connection from the address, as protocols like FTP need.
+// The address to tell the destination is BoundAddr, and Accept waits for the connection.
+func (dialer *Dialer) Bind(ctx context.Context, address string) (*BindConn, error) {
+	destination, err := parseAddr(address)
+	if err != nil {
+		return nil, err
+	}
+	conn, bound, err := dialer.request(ctx, socks5wire.CmdBind, destination)
+	if err != nil {
+		return nil, err
+	}
+	return &BindConn{Conn: conn, bound: bound}, nil
+}
+
+// BoundAddr returns the address the server listens on.
+func (conn *BindConn) BoundAddr() *Addr {
+	return conn.bound
+}
+
+// Accept waits for the second reply of the server, which tells that the destination has connected.
+// Then the data are relayed over the connection.
+func (conn *BindConn) Accept() (net.Conn, error) {
+	remote, err := readReply(conn.Conn)
+	if err != nil {
+		return nil, err
+	}
+	conn.remote = remote
+	return conn, nil
+}
+
+// RemoteAddr returns the address of the destination once it has connected, or the address of the server.
+func (conn *BindConn) RemoteAddr() net.Addr {
+	if conn.remote != nil {
+		return conn.remote
+	}
+	return conn.Conn.RemoteAddr()
+}
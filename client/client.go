@@ -0,0 +1,167 @@
+// Package client dials through a SOCKS5 server such as mysocks.
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/jfuruya/mysocks/socks5wire"
+	"golang.org/x/net/proxy"
+)
+
+// Dialer connects to destinations through a SOCKS5 server.
+type Dialer struct {
+	// ProxyAddress is the address of the SOCKS5 server, like "127.0.0.1:1080".
+	ProxyAddress string
+	// Username and Password are used for USERNAME/PASSWORD if Username is not empty.
+	// Otherwise NO AUTHENTICATION REQUIRED is offered.
+	Username string
+	Password string
+	// ProxyDialer connects to the SOCKS5 server. A net.Dialer is used if it is nil.
+	ProxyDialer proxy.ContextDialer
+	// HandshakeTimeout limits the negotiation, the authentication and the request. Zero means no limit.
+	HandshakeTimeout time.Duration
+}
+
+var (
+	_ proxy.Dialer        = (*Dialer)(nil)
+	_ proxy.ContextDialer = (*Dialer)(nil)
+)
+
+// Dial connects to the address through the server with CONNECT.
+func (dialer *Dialer) Dial(network string, address string) (net.Conn, error) {
+	return dialer.DialContext(context.Background(), network, address)
+}
+
+// DialContext connects to the address through the server with CONNECT.
+// The address may have a domain name, which is resolved by the server.
+func (dialer *Dialer) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("socks5: unsupported network: %s", network)
+	}
+	destination, err := parseAddr(address)
+	if err != nil {
+		return nil, err
+	}
+	conn, _, err := dialer.request(ctx, socks5wire.CmdConnect, destination)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// request connects to the server, authenticates and sends the request.
+// It returns the connection and the address in the reply.
+func (dialer *Dialer) request(ctx context.Context, cmd byte, destination *Addr) (net.Conn, *Addr, error) {
+	proxyDialer := dialer.ProxyDialer
+	if proxyDialer == nil {
+		proxyDialer = &net.Dialer{}
+	}
+	conn, err := proxyDialer.DialContext(ctx, "tcp", dialer.ProxyAddress)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The handshake is interrupted when ctx is done.
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if dialer.HandshakeTimeout > 0 {
+		deadline := time.Now().Add(dialer.HandshakeTimeout)
+		if ctxDeadline, ok := ctx.Deadline(); !ok || deadline.Before(ctxDeadline) {
+			conn.SetDeadline(deadline)
+		}
+	}
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Unix(1, 0))
+	})
+	defer stop()
+
+	bound, err := dialer.handshake(conn, cmd, destination)
+	if err == nil && !stop() {
+		err = ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, bound, nil
+}
+
+func (dialer *Dialer) handshake(conn net.Conn, cmd byte, destination *Addr) (*Addr, error) {
+	method := socks5wire.MethodNoAuthRequired
+	if dialer.Username != "" {
+		method = socks5wire.MethodUsernamePassword
+	}
+	negotiationRequest, err := socks5wire.AppendNegotiationRequest(nil, socks5wire.NegotiationRequest{Methods: []byte{method}})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(negotiationRequest); err != nil {
+		return nil, err
+	}
+	negotiationReply, err := socks5wire.ReadNegotiationReply(conn, make([]byte, socks5wire.NegotiationReplyLen))
+	if err != nil {
+		return nil, err
+	}
+	if negotiationReply.Method != method {
+		return nil, ErrNoAcceptableMethod
+	}
+
+	if method == socks5wire.MethodUsernamePassword {
+		if err := dialer.authenticate(conn); err != nil {
+			return nil, err
+		}
+	}
+
+	request, err := socks5wire.AppendRequest(nil, socks5wire.Request{Cmd: cmd, Addr: destination.wireAddr()})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(request); err != nil {
+		return nil, err
+	}
+	return readReply(conn)
+}
+
+func (dialer *Dialer) authenticate(conn net.Conn) error {
+	request, err := socks5wire.AppendUserPasswordRequest(nil, socks5wire.UserPasswordRequest{
+		Username: []byte(dialer.Username),
+		Password: []byte(dialer.Password),
+	})
+	if err != nil {
+		return errors.New("socks5: the username and the password must be 1 to 255 bytes")
+	}
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+	reply, err := socks5wire.ReadUserPasswordReply(conn, make([]byte, socks5wire.UserPasswordReplyLen))
+	if err != nil {
+		return err
+	}
+	if reply.Status != socks5wire.UserPasswordStatusSuccess {
+		return ErrAuthenticationFailed
+	}
+	return nil
+}
+
+// readReply reads a reply and returns BND.ADDR and BND.PORT, or a *ReplyError if it is a failure.
+func readReply(conn net.Conn) (*Addr, error) {
+	reply, err := socks5wire.ReadReply(conn, make([]byte, socks5wire.MaxReplyLen))
+	if err != nil {
+		return nil, err
+	}
+	if reply.Rep != socks5wire.RepSucceeded {
+		return nil, &ReplyError{Rep: reply.Rep}
+	}
+	return addrOf(reply.Addr), nil
+}
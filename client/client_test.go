@@ -0,0 +1,195 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jfuruya/mysocks"
+	"github.com/jfuruya/mysocks/socks5wire"
+)
+
+// proxyAddress is the address of mysocks started by TestMain on an ephemeral port.
+var proxyAddress string
+
+func TestMain(m *testing.M) {
+	os.Setenv("MYSOCKS_LISTEN", "127.0.0.1:0")
+	os.Setenv("MYSOCKS_USER", "alice")
+	os.Setenv("MYSOCKS_PASSWORD", "alice-password")
+	server := mysocks.NewServer()
+	go server.Start(context.Background())
+	<-server.Ready()
+	proxyAddress = server.Addrs()[0].String()
+	code := m.Run()
+	server.Close()
+	os.Exit(code)
+}
+
+func startEchoServer(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener
+}
+
+func TestDialContext(t *testing.T) {
+	echoServer := startEchoServer(t)
+	defer echoServer.Close()
+
+	dialer := &Dialer{ProxyAddress: proxyAddress, Username: "alice", Password: "alice-password"}
+	conn, err := dialer.DialContext(context.Background(), "tcp", echoServer.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("hello expected, but got %q: %v", buf, err)
+	}
+	conn.Close()
+
+	// The server has a user, so NO AUTHENTICATION REQUIRED is not accepted.
+	if _, err := (&Dialer{ProxyAddress: proxyAddress}).Dial("tcp", echoServer.Addr().String()); !errors.Is(err, ErrNoAcceptableMethod) {
+		t.Fatalf("ErrNoAcceptableMethod expected, but got %v", err)
+	}
+
+	wrongDialer := &Dialer{ProxyAddress: proxyAddress, Username: "alice", Password: "wrong-password"}
+	if _, err := wrongDialer.Dial("tcp", echoServer.Addr().String()); !errors.Is(err, ErrAuthenticationFailed) {
+		t.Fatalf("ErrAuthenticationFailed expected, but got %v", err)
+	}
+
+	// Nothing listens on the port of the closed listener.
+	closedListener := startEchoServer(t)
+	closedListener.Close()
+	var replyErr *ReplyError
+	if _, err := dialer.Dial("tcp", closedListener.Addr().String()); !errors.As(err, &replyErr) {
+		t.Fatalf("ReplyError expected, but got %v", err)
+	}
+}
+
+func TestDialContextCanceled(t *testing.T) {
+	// The server accepts the connection but never replies.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			defer conn.Close()
+			io.Copy(io.Discard, conn)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	dialer := &Dialer{ProxyAddress: listener.Addr().String()}
+	if _, err := dialer.DialContext(ctx, "tcp", "example.com:80"); err == nil {
+		t.Fatal("The dial should be interrupted by the context")
+	}
+}
+
+func TestListenPacket(t *testing.T) {
+	echoServer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echoServer.Close()
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, from, err := echoServer.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			echoServer.WriteToUDP(buf[:n], from)
+		}
+	}()
+
+	dialer := &Dialer{ProxyAddress: proxyAddress, Username: "alice", Password: "alice-password"}
+	packetConn, err := dialer.ListenPacket(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer packetConn.Close()
+
+	if _, err := packetConn.WriteTo([]byte("hello"), echoServer.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	packetConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 2048)
+	n, from, err := packetConn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "hello" || from.String() != echoServer.LocalAddr().String() {
+		t.Fatalf("hello from %v expected, but got %q from %v", echoServer.LocalAddr(), buf[:n], from)
+	}
+}
+
+func TestBind(t *testing.T) {
+	// mysocks does not support BIND.
+	var replyErr *ReplyError
+	dialer := &Dialer{ProxyAddress: proxyAddress, Username: "alice", Password: "alice-password"}
+	if _, err := dialer.Bind(context.Background(), "127.0.0.1:21"); !errors.As(err, &replyErr) || replyErr.Rep != 0x07 {
+		t.Fatalf("Command not supported expected, but got %v", err)
+	}
+
+	// A server that sends the two replies of BIND.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.ReadFull(conn, make([]byte, 3))
+		conn.Write([]byte{socks5wire.Version, socks5wire.MethodNoAuthRequired})
+		io.ReadFull(conn, make([]byte, 10))
+		conn.Write([]byte{socks5wire.Version, socks5wire.RepSucceeded, 0x00, socks5wire.AtypIPv4, 192, 0, 2, 1, 0x30, 0x39})
+		conn.Write([]byte{socks5wire.Version, socks5wire.RepSucceeded, 0x00, socks5wire.AtypIPv4, 192, 0, 2, 2, 0x00, 0x14})
+		conn.Write([]byte("data"))
+	}()
+
+	bindConn, err := (&Dialer{ProxyAddress: listener.Addr().String()}).Bind(context.Background(), "192.0.2.2:20")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bindConn.Close()
+	if bound := bindConn.BoundAddr().String(); bound != "192.0.2.1:12345" {
+		t.Fatalf("192.0.2.1:12345 expected, but got %s", bound)
+	}
+	conn, err := bindConn.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if remote := conn.RemoteAddr().String(); remote != "192.0.2.2:20" {
+		t.Fatalf("192.0.2.2:20 expected, but got %s", remote)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "data" {
+		t.Fatalf("data expected, but got %q: %v", buf, err)
+	}
+}
@@ -0,0 +1,54 @@
+package client
+
+import (
+	"context"
+	"net"
+
+	"github.com/jfuruya/mysocks/socks5wire"
+	"github.com/jfuruya/mysocks/tunnel"
+)
+
+// Listener accepts the connections to a port the server listens on for the client, like `ssh -R`.
+type Listener struct {
+	session *tunnel.Session
+	bound   *Addr
+}
+
+var _ net.Listener = (*Listener)(nil)
+
+// Listen asks the server to listen on the address with the REVERSE BIND command of mysocks.
+// The host is usually empty or an IP address of the server, and the port 0 lets the server choose one.
+// The user must be allowed to bind the port by the configuration of the server.
+func (dialer *Dialer) Listen(ctx context.Context, address string) (*Listener, error) {
+	destination, err := parseAddr(address)
+	if err != nil {
+		return nil, err
+	}
+	if destination.Host == "" {
+		destination.Host = "0.0.0.0"
+	}
+	conn, bound, err := dialer.request(ctx, socks5wire.CmdReverseBind, destination)
+	if err != nil {
+		return nil, err
+	}
+	return &Listener{session: tunnel.Client(conn), bound: bound}, nil
+}
+
+// Accept waits for a connection to the port. Its RemoteAddr is the address of the peer connecting to the server.
+func (listener *Listener) Accept() (net.Conn, error) {
+	stream, err := listener.session.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+// Close stops the server listening and closes the connections accepted.
+func (listener *Listener) Close() error {
+	return listener.session.Close()
+}
+
+// Addr returns the address the server listens on.
+func (listener *Listener) Addr() net.Addr {
+	return listener.bound
+}
@@ -0,0 +1,148 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/jfuruya/mysocks/socks5wire"
+)
+
+// maxDatagramSize is the size of the buffer for a datagram from the server.
+const maxDatagramSize = 65535
+
+// datagramBufferPool keeps the buffers of ReadFrom, which may be called concurrently.
+var datagramBufferPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, maxDatagramSize)
+		return &buf
+	},
+}
+
+// PacketConn sends and receives UDP datagrams through the server with UDP ASSOCIATE.
+// The association lasts while the PacketConn is open.
+type PacketConn struct {
+	controlConn net.Conn
+	udpConn     *net.UDPConn
+	relayAddr   *net.UDPAddr
+
+	closeOnce sync.Once
+}
+
+var _ net.PacketConn = (*PacketConn)(nil)
+
+// ListenPacket starts a UDP association. The datagrams can be sent to any destination,
+// including the ones with a domain name given as *Addr.
+func (dialer *Dialer) ListenPacket(ctx context.Context) (*PacketConn, error) {
+	udpConn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// The address the datagrams are sent from is not known before they are sent, since it may be
+	// translated on the way, so the server is told that it is unknown.
+	controlConn, bound, err := dialer.request(ctx, socks5wire.CmdAssociate, &Addr{Host: "0.0.0.0", Port: 0})
+	if err != nil {
+		udpConn.Close()
+		return nil, err
+	}
+
+	relayAddr, err := relayAddrOf(bound, controlConn.RemoteAddr())
+	if err != nil {
+		controlConn.Close()
+		udpConn.Close()
+		return nil, err
+	}
+
+	packetConn := &PacketConn{
+		controlConn: controlConn,
+		udpConn:     udpConn,
+		relayAddr:   relayAddr,
+	}
+	// The association ends when the control connection is closed by the server.
+	go func() {
+		io.Copy(io.Discard, controlConn)
+		packetConn.Close()
+	}()
+	return packetConn, nil
+}
+
+// relayAddrOf returns the address to send the datagrams to. An unspecified address in the reply
+// means the address of the server.
+func relayAddrOf(bound *Addr, proxyAddr net.Addr) (*net.UDPAddr, error) {
+	if ip := net.ParseIP(bound.Host); ip != nil && ip.IsUnspecified() {
+		proxyHost, _, err := net.SplitHostPort(proxyAddr.String())
+		if err != nil {
+			return nil, err
+		}
+		return &net.UDPAddr{IP: net.ParseIP(proxyHost), Port: bound.Port}, nil
+	}
+	return net.ResolveUDPAddr("udp", bound.String())
+}
+
+// ReadFrom reads a datagram relayed by the server and returns the address of its sender,
+// which is *net.UDPAddr, or *Addr if it has a domain name.
+func (conn *PacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	pooled := datagramBufferPool.Get().(*[]byte)
+	defer datagramBufferPool.Put(pooled)
+	buf := *pooled
+	for {
+		n, from, err := conn.udpConn.ReadFromUDP(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		// Datagrams from others than the server, or fragmented ones, are discarded.
+		if !from.IP.Equal(conn.relayAddr.IP) || from.Port != conn.relayAddr.Port {
+			continue
+		}
+		header, headerLength, err := socks5wire.ParseUDPHeader(buf[:n])
+		if err != nil || header.Frag != 0x00 {
+			continue
+		}
+		return copy(b, buf[headerLength:n]), addrOf(header.Addr).udpAddr(), nil
+	}
+}
+
+// WriteTo sends a datagram to addr through the server.
+func (conn *PacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	destination, err := parseAddr(addr.String())
+	if err != nil {
+		return 0, err
+	}
+	datagram, err := socks5wire.AppendUDPHeader(nil, socks5wire.UDPHeader{Addr: destination.wireAddr()})
+	if err != nil {
+		return 0, err
+	}
+	if _, err := conn.udpConn.WriteToUDP(append(datagram, b...), conn.relayAddr); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close ends the association.
+func (conn *PacketConn) Close() error {
+	var err error
+	conn.closeOnce.Do(func() {
+		err = errors.Join(conn.controlConn.Close(), conn.udpConn.Close())
+	})
+	return err
+}
+
+func (conn *PacketConn) LocalAddr() net.Addr {
+	return conn.udpConn.LocalAddr()
+}
+
+func (conn *PacketConn) SetDeadline(t time.Time) error {
+	return conn.udpConn.SetDeadline(t)
+}
+
+func (conn *PacketConn) SetReadDeadline(t time.Time) error {
+	return conn.udpConn.SetReadDeadline(t)
+}
+
+func (conn *PacketConn) SetWriteDeadline(t time.Time) error {
+	return conn.udpConn.SetWriteDeadline(t)
+}
@@ -0,0 +1,91 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+
+	"golang.org/x/net/proxy"
+	"golang.org/x/net/websocket"
+)
+
+// WebSocketDialer connects to a SOCKS5 server over WebSocket, such as the WebSocket listener of mysocks,
+// from behind firewalls that only pass HTTP. The binary messages carry the bytes of the SOCKS5 session.
+//
+// It is the ProxyDialer of a Dialer in Go, and Serve exposes a plain SOCKS5 port to the other applications.
+type WebSocketDialer struct {
+	// URL is the endpoint, like "ws://proxy.example.com/socks" or "wss://proxy.example.com/socks".
+	URL string
+	// Origin is sent in the Origin header. The origin of URL is sent if it is empty.
+	Origin string
+	// TLSConfig is used for the wss scheme. The default configuration is used if it is nil.
+	TLSConfig *tls.Config
+}
+
+var _ proxy.ContextDialer = (*WebSocketDialer)(nil)
+
+// DialContext connects to the endpoint. The network and the address are ignored, since the URL tells the server.
+func (dialer *WebSocketDialer) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	origin := dialer.Origin
+	if origin == "" {
+		endpoint, err := url.Parse(dialer.URL)
+		if err != nil {
+			return nil, err
+		}
+		scheme := "http"
+		if endpoint.Scheme == "wss" {
+			scheme = "https"
+		}
+		origin = scheme + "://" + endpoint.Host
+	}
+	config, err := websocket.NewConfig(dialer.URL, origin)
+	if err != nil {
+		return nil, err
+	}
+	config.TlsConfig = dialer.TLSConfig
+	conn, err := config.DialContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	conn.PayloadType = websocket.BinaryFrame
+	return conn, nil
+}
+
+// Serve accepts the connections of SOCKS5 clients on the listener and relays each of them to the endpoint
+// over its own WebSocket connection, until the listener is closed.
+func (dialer *WebSocketDialer) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go dialer.relay(conn)
+	}
+}
+
+// relay relays the connection until either side closes, since WebSocket can not close one direction.
+func (dialer *WebSocketDialer) relay(conn net.Conn) {
+	defer conn.Close()
+	ws, err := dialer.DialContext(context.Background(), "tcp", "")
+	if err != nil {
+		return
+	}
+	defer ws.Close()
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(ws, conn)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, ws)
+		done <- struct{}{}
+	}()
+	<-done
+}
@@ -0,0 +1,86 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/jfuruya/mysocks/socks5wire"
+)
+
+var repMessages = map[byte]string{
+	socks5wire.RepGeneralFailure:   "general SOCKS server failure",
+	socks5wire.RepNotAllowed:       "connection not allowed by ruleset",
+	socks5wire.RepNetUnreachable:   "network unreachable",
+	socks5wire.RepHostUnreachable:  "host unreachable",
+	socks5wire.RepConnRefused:      "connection refused",
+	socks5wire.RepTTLExpired:       "TTL expired",
+	socks5wire.RepCmdNotSupported:  "command not supported",
+	socks5wire.RepAddrNotSupported: "address type not supported",
+}
+
+// ReplyError is returned when the server replies to a request with a failure.
+type ReplyError struct {
+	// Rep is the REP field of the reply.
+	Rep byte
+}
+
+func (err *ReplyError) Error() string {
+	if message, ok := repMessages[err.Rep]; ok {
+		return "socks5: " + message
+	}
+	return fmt.Sprintf("socks5: unknown failure %#02x", err.Rep)
+}
+
+// ErrAuthenticationFailed is returned when the server rejects the username and the password.
+var ErrAuthenticationFailed = errors.New("socks5: authentication failed")
+
+// ErrNoAcceptableMethod is returned when the server accepts none of the methods offered.
+var ErrNoAcceptableMethod = errors.New("socks5: no acceptable authentication method")
+
+// Addr is an address sent to or received from the server, whose host may be a domain name.
+type Addr struct {
+	Host string
+	Port int
+}
+
+func (addr *Addr) Network() string {
+	return "socks5"
+}
+
+func (addr *Addr) String() string {
+	return net.JoinHostPort(addr.Host, strconv.Itoa(addr.Port))
+}
+
+// udpAddr returns the address as *net.UDPAddr if the host is an IP address, or addr itself.
+func (addr *Addr) udpAddr() net.Addr {
+	if ip := net.ParseIP(addr.Host); ip != nil {
+		return &net.UDPAddr{IP: ip, Port: addr.Port}
+	}
+	return addr
+}
+
+// wireAddr returns the address in the wire format.
+func (addr *Addr) wireAddr() socks5wire.Addr {
+	if ip := net.ParseIP(addr.Host); ip != nil {
+		return socks5wire.IPAddr(ip, addr.Port)
+	}
+	return socks5wire.DomainAddr(addr.Host, addr.Port)
+}
+
+func addrOf(wireAddr socks5wire.Addr) *Addr {
+	return &Addr{Host: wireAddr.HostString(), Port: int(wireAddr.Port)}
+}
+
+func parseAddr(address string) (*Addr, error) {
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("socks5: invalid port: %s", address)
+	}
+	return &Addr{Host: host, Port: port}, nil
+}
@@ -4,8 +4,10 @@ const (
 	cmdConnect   byte = 0x01
 	cmdBind      byte = 0x02
 	cmdAssociate byte = 0x03
+	// cmdReverseBind is the private command that opens a reverse tunnel.
+	cmdReverseBind byte = 0xF0
 )
 
 func supportedCmd(cmd byte) bool {
-	return cmd == cmdConnect || cmd == cmdAssociate
+	return cmd == cmdConnect || cmd == cmdAssociate || cmd == cmdReverseBind
 }
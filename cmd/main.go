@@ -1,13 +1,94 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
 	"github.com/jfuruya/mysocks"
+	"github.com/jfuruya/mysocks/client"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "usage" {
+		printUsageReport(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "websocket-client" {
+		serveWebSocketClient(os.Args[2:])
+		return
+	}
+
 	socksServer := mysocks.NewServer()
-	err := socksServer.Start()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		<-signals
+		ctx, cancel := context.WithTimeout(context.Background(), socksServer.ShutdownTimeout())
+		defer cancel()
+		socksServer.Shutdown(ctx)
+	}()
+
+	reloadSignals := make(chan os.Signal, 1)
+	signal.Notify(reloadSignals, syscall.SIGHUP)
+	go func() {
+		for range reloadSignals {
+			// The error has been logged, and the current configuration is kept.
+			socksServer.Reload()
+		}
+	}()
+
+	err := socksServer.Start(context.Background())
 	if err != nil {
 		panic(err)
 	}
 }
+
+// printUsageReport prints the usage of every user recorded in the accounting file.
+func printUsageReport(args []string) {
+	flags := flag.NewFlagSet("usage", flag.ExitOnError)
+	file := flags.String("file", os.Getenv("MYSOCKS_ACCOUNTING_FILE"), "path of the accounting file")
+	period := flags.String("period", mysocks.UsagePeriodMonth, "period of the report: day or month")
+	date := flags.String("date", "", "day (2006-01-02) or month (2006-01) of the report, the current one if empty")
+	flags.Parse(args)
+
+	if *file == "" {
+		fmt.Fprintln(os.Stderr, "The accounting file is not specified. Use -file or MYSOCKS_ACCOUNTING_FILE.")
+		os.Exit(2)
+	}
+	if err := mysocks.WriteUsageReport(os.Stdout, *file, *period, *date); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// serveWebSocketClient exposes a local SOCKS5 port whose connections are tunneled to a WebSocket endpoint of mysocks.
+func serveWebSocketClient(args []string) {
+	flags := flag.NewFlagSet("websocket-client", flag.ExitOnError)
+	listen := flags.String("listen", "127.0.0.1:1080", "local address for the SOCKS5 clients")
+	url := flags.String("url", "", "WebSocket endpoint of the server, like wss://proxy.example.com/socks")
+	origin := flags.String("origin", "", "Origin header sent to the server, the origin of -url if empty")
+	flags.Parse(args)
+
+	if *url == "" {
+		fmt.Fprintln(os.Stderr, "The WebSocket endpoint is not specified. Use -url.")
+		os.Exit(2)
+	}
+	listener, err := net.Listen("tcp", *listen)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "Tunneling the SOCKS5 clients on %s to %s.\n", listener.Addr(), *url)
+
+	dialer := &client.WebSocketDialer{URL: *url, Origin: *origin}
+	if err := dialer.Serve(listener); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,85 @@
+package mysocks
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+)
+
+// defaultConfigVersion is the version of the configuration when no file is specified.
+const defaultConfigVersion = "default"
+
+// config is the configuration loaded from the JSON file specified by MYSOCKS_CONFIG.
+// Environment variables take precedence over the values in the file.
+type config struct {
+	Timeouts   timeouts              `json:"timeouts"`
+	RateLimits rateLimits            `json:"rateLimits"`
+	Quotas     quotas                `json:"quotas"`
+	Users      map[string]userConfig `json:"users"`
+	// Forwards are bound at startup, and are not changed by a reload.
+	Forwards []forwardConfig `json:"forwards"`
+	// version identifies the content of the file, so that it can be told which configuration is in use.
+	version string
+}
+
+// userConfig is the configuration of one user.
+// Zero values mean that the global configuration applies.
+type userConfig struct {
+	Password string `json:"password"`
+	// Tokens authenticate the user with the token method in place of the password.
+	Tokens     []string       `json:"tokens"`
+	Timeouts   timeouts       `json:"timeouts"`
+	RateLimits userRateLimits `json:"rateLimits"`
+	Quotas     quotas         `json:"quotas"`
+	// BindablePorts are the ports and the ranges of ports like "9000-9100" that the user may listen on
+	// with a reverse tunnel. "0" allows an ephemeral port.
+	BindablePorts []string `json:"bindablePorts"`
+}
+
+func loadConfig(path string) (*config, error) {
+	config := &config{
+		Users:   map[string]userConfig{},
+		version: defaultConfigVersion,
+	}
+	if path == "" {
+		return config, nil
+	}
+
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(bytes, config); err != nil {
+		return nil, err
+	}
+	if config.Users == nil {
+		config.Users = map[string]userConfig{}
+	}
+	hash := sha256.Sum256(bytes)
+	config.version = hex.EncodeToString(hash[:6])
+	return config, nil
+}
+
+func (config *config) userConfig(userName string) userConfig {
+	return config.Users[userName]
+}
+
+// userRateLimit returns the rate limit shared by the sessions of the user.
+func (config *config) userRateLimit(userName string) rateLimit {
+	return config.RateLimits.User.overriddenBy(config.userConfig(userName).RateLimits.User)
+}
+
+// sessionRateLimit returns the rate limit of each session of the user.
+// An empty user name means an unauthenticated session.
+func (config *config) sessionRateLimit(userName string) rateLimit {
+	if userName == "" {
+		return config.RateLimits.Session
+	}
+	return config.RateLimits.Session.overriddenBy(config.userConfig(userName).RateLimits.Session)
+}
+
+// userQuotas returns the quotas of the user.
+func (config *config) userQuotas(userName string) quotas {
+	return config.Quotas.overriddenBy(config.userConfig(userName).Quotas)
+}
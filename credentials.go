@@ -1,12 +1,37 @@
 package mysocks
 
-var credentials = map[string]string{}
+import "errors"
 
-func addCredential(username, password string) {
-	credentials[username] = password
+// ErrAuthenticationFailed is returned by an AuthMethod when the client has been rejected.
+var ErrAuthenticationFailed = errors.New("the authentication has failed")
+
+// credentials are the passwords of the local users by user name.
+// They are part of the active configuration, so a reload adds, changes and revokes them.
+type credentials map[string]string
+
+// newCredentials collects the passwords of the users in the configuration and the one of MYSOCKS_USER.
+func newCredentials(config *config) credentials {
+	credentials := credentials{}
+	for userName, userConfig := range config.Users {
+		if userConfig.Password != "" {
+			credentials[userName] = userConfig.Password
+		}
+	}
+
+	userName := userNameFromEnv()
+	password := passwordFromEnv()
+	if userName != "" && password != "" {
+		credentials[userName] = password
+	}
+	return credentials
+}
+
+func (credentials credentials) has(username string) bool {
+	_, ok := credentials[username]
+	return ok
 }
 
-func authenticate(username, password string) bool {
+func (credentials credentials) authenticate(username, password string) bool {
 	if storedPassword, ok := credentials[username]; ok {
 		return storedPassword == password
 	}
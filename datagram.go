@@ -1,9 +1,16 @@
 package mysocks
 
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
+
+	"github.com/jfuruya/mysocks/socks5wire"
 )
 
+// maxUDPPayloadSize is the largest payload of a UDP datagram over IPv4, which the receive buffers are sized to.
+const maxUDPPayloadSize = 65507
+
 type datagram struct {
 	rsv  []byte // 0x00 0x00
 	frag byte
@@ -11,41 +18,35 @@ type datagram struct {
 	data []byte
 }
 
+// newDatagramFrom parses a datagram from a client. The datagram refers to the bytes,
+// and any bytes, including short or malformed ones, result in a datagram or an error.
 func newDatagramFrom(bytes []byte) (*datagram, error) {
-	rsv := bytes[:2]
-	if rsv[0] != 0x00 || rsv[1] != 0x00 {
-		return nil, fmt.Errorf("the value of the RSV field in the request is invalid: %d", rsv)
-	}
-
-	frag := bytes[2]
-	// Fragmentation is not supported
-	if frag != 0x00 {
-		return nil, fmt.Errorf("the value of the FRAG field in the request is invalid: %d", frag)
-	}
-
-	atyp := bytes[3]
-	if !supportedAtyp(atyp) {
+	header, headerLength, err := socks5wire.ParseUDPHeader(bytes)
+	var fieldErr *socks5wire.FieldError
+	if errors.As(err, &fieldErr) && fieldErr.Field == "ATYP" {
 		return nil, errRequestAtypNotSupported
 	}
-
-	dstAddr, dstAddrLength, err := readDestAddrFromBytes(bytes[4:], atyp)
+	if err == socks5wire.ErrShortBuffer {
+		return nil, fmt.Errorf("the datagram is too short: %d bytes", len(bytes))
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	dstPort := bytes[4+dstAddrLength : 4+dstAddrLength+2]
-
-	data := bytes[4+dstAddrLength+2:]
+	// Fragmentation is not supported
+	if header.Frag != 0x00 {
+		return nil, fmt.Errorf("the value of the FRAG field in the request is invalid: %d", header.Frag)
+	}
 
 	return &datagram{
-		rsv:  rsv,
-		frag: frag,
+		rsv:  bytes[:2],
+		frag: header.Frag,
 		dst: dst{
-			atyp: atyp,
-			addr: dstAddr,
-			port: dstPort,
+			atyp: header.Addr.Atyp,
+			addr: header.Addr.Host,
+			port: bytes[headerLength-2 : headerLength],
 		},
-		data: data,
+		data: bytes[headerLength:],
 	}, nil
 }
 
@@ -58,13 +59,13 @@ func newDatagram(dst dst, data []byte) *datagram {
 	}
 }
 
-func (d *datagram) bytes() []byte {
-	bytes := make([]byte, 0)
-	bytes = append(bytes, d.rsv...)
-	bytes = append(bytes, d.frag)
-	bytes = append(bytes, d.dst.atyp)
-	bytes = append(bytes, d.dst.addr...)
-	bytes = append(bytes, d.dst.port...)
-	bytes = append(bytes, d.data...)
-	return bytes
+func (d *datagram) bytes() ([]byte, error) {
+	bytes, err := socks5wire.AppendUDPHeader(make([]byte, 0, socks5wire.MaxUDPHeaderLen+len(d.data)), socks5wire.UDPHeader{
+		Frag: d.frag,
+		Addr: socks5wire.Addr{Atyp: d.dst.atyp, Host: d.dst.addr, Port: binary.BigEndian.Uint16(d.dst.port)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return append(bytes, d.data...), nil
 }
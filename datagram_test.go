@@ -0,0 +1,138 @@
+package mysocks
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNewDatagramFrom(t *testing.T) {
+	valid := [][]byte{
+		{0x00, 0x00, 0x00, atypIPv4, 8, 8, 8, 8, 0x00, 0x35, 'd', 'a', 't', 'a'},
+		{0x00, 0x00, 0x00, atypDomain, 0x09, '1', '2', '7', '.', '0', '.', '0', '.', '1', 0x00, 0x35, 'd', 'a', 't', 'a'},
+		{0x00, 0x00, 0x00, atypIPv6, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x00, 0x35, 'd', 'a', 't', 'a'},
+	}
+	for _, b := range valid {
+		datagram, err := newDatagramFrom(b)
+		if err != nil {
+			t.Fatalf("%#v: %v", b, err)
+		}
+		if string(datagram.data) != "data" || binary.BigEndian.Uint16(datagram.port) != 53 {
+			t.Fatalf("%#v: unexpected datagram: %+v", b, datagram)
+		}
+		encoded, err := datagram.bytes()
+		if err != nil || !bytes.Equal(encoded, b) {
+			t.Fatalf("%#v: encoded into %#v: %v", b, encoded, err)
+		}
+
+		// Every truncated header is an error rather than a panic.
+		for i := 0; i < len(b)-len("data"); i++ {
+			if _, err := newDatagramFrom(b[:i]); err == nil {
+				t.Fatalf("%#v: an error expected", b[:i])
+			}
+		}
+	}
+
+	malformed := [][]byte{
+		{0x00, 0x01, 0x00, atypIPv4, 8, 8, 8, 8, 0x00, 0x35},
+		{0x00, 0x00, 0x01, atypIPv4, 8, 8, 8, 8, 0x00, 0x35},
+		{0x00, 0x00, 0x00, atypDomain, 0x00, 0x00, 0x35},
+		{0x00, 0x00, 0x00, atypDomain, 0xff, 'a', 0x00, 0x35},
+	}
+	for _, b := range malformed {
+		if _, err := newDatagramFrom(b); err == nil {
+			t.Fatalf("%#v: an error expected", b)
+		}
+	}
+
+	if _, err := newDatagramFrom([]byte{0x00, 0x00, 0x00, 0x02, 8, 8, 8, 8, 0x00, 0x35}); err != errRequestAtypNotSupported {
+		t.Fatalf("errRequestAtypNotSupported expected, but got %v", err)
+	}
+}
+
+func TestRecoverDatagram(t *testing.T) {
+	// The panic would fail the test if it were not recovered.
+	func() {
+		defer recoverDatagram(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1080})
+		panic("malformed datagram")
+	}()
+}
+
+func TestMalformedDatagramsKeepUDPService(t *testing.T) {
+	StartServer()
+	defer StopServer()
+
+	echoServer := startUDPEchoServer(t)
+	defer echoServer.Close()
+	echoAddr := echoServer.LocalAddr().(*net.UDPAddr)
+
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpConn.Close()
+
+	tcpConn, err := associateUDP(udpConn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpConn.Close()
+
+	proxyUDPAddr, err := net.ResolveUDPAddr("udp", proxyAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, b := range [][]byte{
+		{},
+		{0x00},
+		{0x00, 0x00, 0x00},
+		{0x00, 0x00, 0x00, atypDomain},
+		{0x00, 0x00, 0x00, atypDomain, 0x05, 'a'},
+		{0x00, 0x00, 0x00, atypIPv6, 0x00},
+	} {
+		if _, err := udpConn.WriteToUDP(b, proxyUDPAddr); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The domain name is resolved by the server, and the reply has the same header.
+	header := []byte{0x00, 0x00, 0x00, atypDomain, 0x09}
+	header = append(header, "127.0.0.1"...)
+	header = binary.BigEndian.AppendUint16(header, uint16(echoAddr.Port))
+	datagram := append(header, "after the malformed ones"...)
+	if _, err := udpConn.WriteToUDP(datagram, proxyUDPAddr); err != nil {
+		t.Fatal(err)
+	}
+
+	udpConn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	buf := make([]byte, 1024)
+	n, _, err := udpConn.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf[:n], datagram) {
+		t.Fatalf("unexpected datagram: %#v", buf[:n])
+	}
+}
+
+func FuzzNewDatagramFrom(f *testing.F) {
+	f.Add([]byte{0x00, 0x00, 0x00, atypIPv4, 8, 8, 8, 8, 0x00, 0x35, 'd', 'a', 't', 'a'})
+	f.Add([]byte{0x00, 0x00, 0x00, atypDomain, 0x01, 'a', 0x00, 0x35})
+	f.Add([]byte{0x00, 0x00, 0x00, atypIPv6})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		datagram, err := newDatagramFrom(b)
+		if err != nil {
+			return
+		}
+		encoded, err := datagram.bytes()
+		if err != nil {
+			t.Fatalf("%#v: failed to encode the parsed datagram: %v", b, err)
+		}
+		if !bytes.Equal(encoded, b) {
+			t.Fatalf("%#v: encoded into %#v", b, encoded)
+		}
+	})
+}
@@ -0,0 +1,107 @@
+package mysocks
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// destinationPattern matches the destinations of requests. It is written as HOST or HOST:PORT,
+// where HOST is a domain name, an IP address, a CIDR block, "*" for any host, or "*.example.com"
+// for the subdomains of example.com. IPv6 addresses with a port are written in brackets.
+// A CIDR block does not match a domain name, because the pattern is checked before name resolution.
+type destinationPattern struct {
+	// host is the domain name or the IP address in lower case, "*", or a suffix beginning with ".".
+	host    string
+	network *net.IPNet
+	// port is 0 if any port matches.
+	port int
+}
+
+func parseDestinationPattern(pattern string) (destinationPattern, error) {
+	host, port := pattern, ""
+	if splitHost, splitPort, err := net.SplitHostPort(pattern); err == nil {
+		host, port = splitHost, splitPort
+	}
+	if host == "" {
+		return destinationPattern{}, fmt.Errorf("invalid destination pattern: %q", pattern)
+	}
+
+	var parsed destinationPattern
+	if port != "" && port != "*" {
+		portNumber, err := strconv.Atoi(port)
+		if err != nil || portNumber <= 0 || portNumber > 65535 {
+			return destinationPattern{}, fmt.Errorf("invalid port in the destination pattern: %q", pattern)
+		}
+		parsed.port = portNumber
+	}
+
+	switch {
+	case strings.Contains(host, "/"):
+		_, network, err := net.ParseCIDR(host)
+		if err != nil {
+			return destinationPattern{}, fmt.Errorf("invalid CIDR block in the destination pattern: %q", pattern)
+		}
+		parsed.network = network
+	case strings.HasPrefix(host, "*."):
+		parsed.host = strings.ToLower(host[1:])
+	default:
+		parsed.host = strings.ToLower(host)
+		if ip := net.ParseIP(host); ip != nil {
+			parsed.host = ip.String()
+		}
+	}
+	return parsed, nil
+}
+
+func parseDestinationPatterns(patterns []string) ([]destinationPattern, error) {
+	parsed := make([]destinationPattern, 0, len(patterns))
+	for _, pattern := range patterns {
+		destinationPattern, err := parseDestinationPattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, destinationPattern)
+	}
+	return parsed, nil
+}
+
+// matches reports whether the destination written as HOST:PORT matches the pattern.
+func (pattern destinationPattern) matches(destAddress string) bool {
+	host, port, err := net.SplitHostPort(destAddress)
+	if err != nil {
+		return false
+	}
+	if pattern.port != 0 && strconv.Itoa(pattern.port) != port {
+		return false
+	}
+
+	ip := net.ParseIP(host)
+	switch {
+	case pattern.network != nil:
+		return ip != nil && pattern.network.Contains(ip)
+	case pattern.host == "*":
+		return true
+	case strings.HasPrefix(pattern.host, "."):
+		return ip == nil && strings.HasSuffix(strings.ToLower(host), pattern.host)
+	case ip != nil:
+		return pattern.host == ip.String()
+	default:
+		return pattern.host == strings.ToLower(host)
+	}
+}
+
+// destinationAllowed reports whether the destination matches one of the patterns.
+// No pattern means that every destination is allowed.
+func destinationAllowed(patterns []destinationPattern, destAddress string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if pattern.matches(destAddress) {
+			return true
+		}
+	}
+	return false
+}
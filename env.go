@@ -3,6 +3,8 @@ package mysocks
 import (
 	"os"
 	"strconv"
+	"strings"
+	"time"
 )
 
 func env(name string, defaultValue string) string {
@@ -25,10 +27,93 @@ func intEnv(name string, defaultValue int) int {
 	return value
 }
 
+func durationEnv(name string, defaultValue time.Duration) time.Duration {
+	stringValue := env(name, "")
+	if stringValue == "" {
+		return defaultValue
+	}
+	value, err := time.ParseDuration(stringValue)
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
 func portFromEnv() int {
 	return intEnv("MYSOCKS_PORT", 1080)
 }
 
+// listenAddressesFromEnv returns the comma-separated addresses of the SOCKS listeners.
+// MYSOCKS_PORT is used on all the addresses unless MYSOCKS_LISTEN is given.
+func listenAddressesFromEnv() []string {
+	value := env("MYSOCKS_LISTEN", "")
+	if value == "" {
+		return []string{":" + strconv.Itoa(portFromEnv())}
+	}
+	var addresses []string
+	for _, address := range strings.Split(value, ",") {
+		if address = strings.TrimSpace(address); address != "" {
+			addresses = append(addresses, address)
+		}
+	}
+	return addresses
+}
+
+func ipv6OnlyFromEnv() bool {
+	return env("MYSOCKS_IPV6_ONLY", "") == "true"
+}
+
+func transparentAddressFromEnv() string {
+	return env("MYSOCKS_TRANSPARENT_ADDRESS", "")
+}
+
+func transparentModeFromEnv() string {
+	return env("MYSOCKS_TRANSPARENT_MODE", transparentModeRedirect)
+}
+
+func transparentUDPAddressFromEnv() string {
+	return env("MYSOCKS_TRANSPARENT_UDP_ADDRESS", "")
+}
+
+// transparentAllowedDestinationsFromEnv returns the comma-separated destination patterns
+// the transparent connections are allowed to.
+func transparentAllowedDestinationsFromEnv() []string {
+	value := env("MYSOCKS_TRANSPARENT_ALLOWED_DESTINATIONS", "")
+	if value == "" {
+		return nil
+	}
+	var patterns []string
+	for _, pattern := range strings.Split(value, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			patterns = append(patterns, pattern)
+		}
+	}
+	return patterns
+}
+
+func webSocketAddressFromEnv() string {
+	return env("MYSOCKS_WEBSOCKET_ADDRESS", "")
+}
+
+func webSocketPathFromEnv() string {
+	return env("MYSOCKS_WEBSOCKET_PATH", "/")
+}
+
+// webSocketAllowedOriginsFromEnv returns the comma-separated origins the WebSocket connections are allowed from.
+func webSocketAllowedOriginsFromEnv() []string {
+	value := env("MYSOCKS_WEBSOCKET_ALLOWED_ORIGINS", "")
+	if value == "" {
+		return nil
+	}
+	var origins []string
+	for _, origin := range strings.Split(value, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			origins = append(origins, origin)
+		}
+	}
+	return origins
+}
+
 func hostNameFromEnv() string {
 	return env("MYSOCKS_HOSTNAME", "localhost")
 }
@@ -40,3 +125,151 @@ func userNameFromEnv() string {
 func passwordFromEnv() string {
 	return env("MYSOCKS_PASSWORD", "")
 }
+
+func configPathFromEnv() string {
+	return env("MYSOCKS_CONFIG", "")
+}
+
+func shutdownTimeoutFromEnv() time.Duration {
+	return durationEnv("MYSOCKS_SHUTDOWN_TIMEOUT", 30*time.Second)
+}
+
+func metricsAddressFromEnv() string {
+	return env("MYSOCKS_METRICS_ADDRESS", "")
+}
+
+func tlsAddressFromEnv() string {
+	return env("MYSOCKS_TLS_ADDRESS", "")
+}
+
+func tlsCertFileFromEnv() string {
+	return env("MYSOCKS_TLS_CERT_FILE", "")
+}
+
+func tlsKeyFileFromEnv() string {
+	return env("MYSOCKS_TLS_KEY_FILE", "")
+}
+
+func tlsMinVersionFromEnv() string {
+	return env("MYSOCKS_TLS_MIN_VERSION", "1.2")
+}
+
+func tlsClientAuthFromEnv() string {
+	return env("MYSOCKS_TLS_CLIENT_AUTH", tlsClientAuthNone)
+}
+
+func tlsClientCAFileFromEnv() string {
+	return env("MYSOCKS_TLS_CLIENT_CA_FILE", "")
+}
+
+func tlsCRLFileFromEnv() string {
+	return env("MYSOCKS_TLS_CRL_FILE", "")
+}
+
+func tlsClientIdentityFromEnv() string {
+	return env("MYSOCKS_TLS_CLIENT_IDENTITY", certificateIdentityCN)
+}
+
+// tlsALPNFromEnv returns the comma-separated protocols offered in the ALPN extension.
+func tlsALPNFromEnv() []string {
+	value := env("MYSOCKS_TLS_ALPN", "")
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
+
+func adminAddressFromEnv() string {
+	return env("MYSOCKS_ADMIN_ADDRESS", "")
+}
+
+// adminTokenFromEnv returns the bearer token required by the admin API.
+func adminTokenFromEnv() string {
+	return env("MYSOCKS_ADMIN_TOKEN", "")
+}
+
+func authWebhookURLFromEnv() string {
+	return env("MYSOCKS_AUTH_WEBHOOK_URL", "")
+}
+
+// authWebhookTokenFromEnv returns the bearer token sent to the authentication webhook, if any.
+func authWebhookTokenFromEnv() string {
+	return env("MYSOCKS_AUTH_WEBHOOK_TOKEN", "")
+}
+
+func authWebhookTimeoutFromEnv() time.Duration {
+	return durationEnv("MYSOCKS_AUTH_WEBHOOK_TIMEOUT", 5*time.Second)
+}
+
+func authWebhookCacheTTLFromEnv() time.Duration {
+	return durationEnv("MYSOCKS_AUTH_WEBHOOK_CACHE_TTL", time.Minute)
+}
+
+func authWebhookDenyCacheTTLFromEnv() time.Duration {
+	return durationEnv("MYSOCKS_AUTH_WEBHOOK_DENY_CACHE_TTL", 10*time.Second)
+}
+
+func authWebhookFailurePolicyFromEnv() string {
+	return env("MYSOCKS_AUTH_WEBHOOK_FAILURE_POLICY", webhookFailClosed)
+}
+
+// ldapSettingsFromEnv returns the settings of the LDAP authenticator, which is enabled by MYSOCKS_LDAP_URL.
+func ldapSettingsFromEnv() ldapSettings {
+	var requiredGroups []string
+	if value := env("MYSOCKS_LDAP_REQUIRED_GROUPS", ""); value != "" {
+		requiredGroups = strings.Split(value, ",")
+	}
+	return ldapSettings{
+		url:                env("MYSOCKS_LDAP_URL", ""),
+		startTLS:           env("MYSOCKS_LDAP_START_TLS", "") == "true",
+		caFile:             env("MYSOCKS_LDAP_CA_FILE", ""),
+		bindDN:             env("MYSOCKS_LDAP_BIND_DN", ""),
+		bindPassword:       env("MYSOCKS_LDAP_BIND_PASSWORD", ""),
+		userDNTemplate:     env("MYSOCKS_LDAP_USER_DN_TEMPLATE", ""),
+		baseDN:             env("MYSOCKS_LDAP_BASE_DN", ""),
+		userFilter:         env("MYSOCKS_LDAP_USER_FILTER", "(uid=%s)"),
+		groupBaseDN:        env("MYSOCKS_LDAP_GROUP_BASE_DN", ""),
+		groupFilter:        env("MYSOCKS_LDAP_GROUP_FILTER", "(member=%s)"),
+		groupNameAttribute: env("MYSOCKS_LDAP_GROUP_ATTRIBUTE", "cn"),
+		requiredGroups:     requiredGroups,
+		poolSize:           intEnv("MYSOCKS_LDAP_POOL_SIZE", 4),
+		timeout:            durationEnv("MYSOCKS_LDAP_TIMEOUT", 5*time.Second),
+	}
+}
+
+func accessLogFromEnv() string {
+	return env("MYSOCKS_ACCESS_LOG", "")
+}
+
+func accessLogFormatFromEnv() string {
+	return env("MYSOCKS_ACCESS_LOG_FORMAT", accessLogFormatJSON)
+}
+
+func accessLogMaxSizeFromEnv() int {
+	return intEnv("MYSOCKS_ACCESS_LOG_MAX_SIZE", 100)
+}
+
+func accessLogMaxBackupsFromEnv() int {
+	return intEnv("MYSOCKS_ACCESS_LOG_MAX_BACKUPS", 0)
+}
+
+func accessLogMaxAgeFromEnv() int {
+	return intEnv("MYSOCKS_ACCESS_LOG_MAX_AGE", 0)
+}
+
+func accountingFileFromEnv() string {
+	return env("MYSOCKS_ACCOUNTING_FILE", "")
+}
+
+func accountingFlushIntervalFromEnv() time.Duration {
+	return durationEnv("MYSOCKS_ACCOUNTING_FLUSH_INTERVAL", 10*time.Second)
+}
+
+func logFormatFromEnv() string {
+	return env("MYSOCKS_LOG_FORMAT", "console")
+}
+
+// logOutputsFromEnv returns the comma-separated outputs of the logs.
+func logOutputsFromEnv() []string {
+	return strings.Split(env("MYSOCKS_LOG_OUTPUT", "stderr"), ",")
+}
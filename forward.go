@@ -0,0 +1,211 @@
+package mysocks
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/jfuruya/mysocks/socks5wire"
+)
+
+// forwardConfig is a static forward of a local address to a target, which is reached from the server
+// as the destinations of CONNECT are. It replaces a tunnel such as `socat TCP-LISTEN:5432 TCP:db.internal:5432`.
+type forwardConfig struct {
+	// Name tells the forward in the logs.
+	Name string `json:"name"`
+	// Network is "tcp" or "udp".
+	Network string `json:"network"`
+	Listen  string `json:"listen"`
+	// Target is HOST:PORT, where HOST is resolved when a connection is made, or once when a UDP forward is bound.
+	Target string `json:"target"`
+	// AllowedClients are the IP addresses and the CIDR blocks of the clients allowed to use the forward.
+	// Every client is allowed if it is empty.
+	AllowedClients []string `json:"allowedClients"`
+}
+
+// forward is a forward listening for its clients.
+type forward struct {
+	name          string
+	network       string
+	listenAddress string
+	target        socks5wire.Addr
+	// udpTarget is the target resolved when the UDP forward is bound.
+	udpTarget      string
+	allowedClients []*net.IPNet
+	// Either listener or udp is set by listen, as the network tells.
+	listener net.Listener
+	udp      *udpFlowRelay
+}
+
+// Networks of the forwards.
+const (
+	forwardNetworkTCP = "tcp"
+	forwardNetworkUDP = "udp"
+)
+
+func newForward(config forwardConfig) (*forward, error) {
+	if config.Name == "" {
+		return nil, errors.New("a forward has no name")
+	}
+	if config.Network != forwardNetworkTCP && config.Network != forwardNetworkUDP {
+		return nil, fmt.Errorf("the network of the forward %s must be tcp or udp: %q", config.Name, config.Network)
+	}
+	target, err := socks5wire.HostPortAddr(config.Target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid target of the forward %s: %w", config.Name, err)
+	}
+	allowedClients, err := parseClientNetworks(config.AllowedClients)
+	if err != nil {
+		return nil, fmt.Errorf("invalid allowed clients of the forward %s: %w", config.Name, err)
+	}
+	return &forward{
+		name:           config.Name,
+		network:        config.Network,
+		listenAddress:  config.Listen,
+		target:         target,
+		allowedClients: allowedClients,
+	}, nil
+}
+
+// parseClientNetworks parses IP addresses and CIDR blocks. An IP address is a block of the address alone.
+func parseClientNetworks(patterns []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(patterns))
+	for _, pattern := range patterns {
+		if !strings.Contains(pattern, "/") {
+			ip := net.ParseIP(pattern)
+			if ip == nil {
+				return nil, fmt.Errorf("neither an IP address nor a CIDR block: %q", pattern)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(pattern)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// clientAllowed reports whether the client at the IP address may use the forward.
+func (forward *forward) clientAllowed(ip net.IP) bool {
+	if len(forward.allowedClients) == 0 {
+		return true
+	}
+	for _, network := range forward.allowedClients {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// listen binds the forward to its address.
+func (forward *forward) listen(server *Server) error {
+	if forward.network == forwardNetworkTCP {
+		listener, err := net.Listen("tcp", forward.listenAddress)
+		if err != nil {
+			return fmt.Errorf("failed to listen for the forward %s: %w", forward.name, err)
+		}
+		forward.listener = listener
+		return nil
+	}
+
+	// The target is resolved once, so that no lookup holds up the datagrams of the clients.
+	udpTarget, err := net.ResolveUDPAddr("udp", forward.target.String())
+	if err != nil {
+		return fmt.Errorf("failed to resolve the target of the forward %s: %w", forward.name, err)
+	}
+	forward.udpTarget = udpTarget.String()
+	conn, err := net.ListenPacket("udp", forward.listenAddress)
+	if err != nil {
+		return fmt.Errorf("failed to listen for the forward %s: %w", forward.name, err)
+	}
+	forward.udp = newUDPFlowRelay(server, conn.(*net.UDPConn), "forward", map[string]interface{}{"forward": forward.name}, func(client *net.UDPAddr, destination string) bool {
+		if !forward.clientAllowed(client.IP) {
+			metricACLDenials.WithLabelValues("client").Inc()
+			return false
+		}
+		return true
+	}, nil)
+	return nil
+}
+
+func (forward *forward) addr() net.Addr {
+	if forward.listener != nil {
+		return forward.listener.Addr()
+	}
+	return forward.udp.conn.LocalAddr()
+}
+
+// serve relays the clients of the forward to the target until the listener is closed.
+func (forward *forward) serve(server *Server) {
+	if forward.udp != nil {
+		forward.udp.serve(func(buf []byte) (int, *net.UDPAddr, string, error) {
+			n, client, err := forward.udp.conn.ReadFromUDP(buf)
+			return n, client, forward.udpTarget, err
+		})
+		return
+	}
+
+	for {
+		conn, err := forward.listener.Accept()
+		if err != nil {
+			if server.isStopping() {
+				logInfo(fmt.Sprintf("The forward %s has stopped accepting connections.", forward.name), nil)
+			} else {
+				logError(fmt.Sprintf("Failed to accept a connection of the forward %s: %v", forward.name, err), nil)
+			}
+			return
+		}
+
+		logInfo(fmt.Sprintf("A new connection of the forward %s has been received from: %v", forward.name, conn.RemoteAddr()), nil)
+
+		socksConnection := newSocksConnection(&conn, server, nil)
+		socksConnection.withoutSocks = true
+		socksConnection.forward = forward
+
+		server.socksConnections.add(socksConnection)
+
+		go func() {
+			defer server.socksConnections.remove(socksConnection)
+			socksConnection.handleForward()
+		}()
+	}
+}
+
+// stopAccepting closes the TCP listener of the forward. The UDP socket is kept open until closeUDP.
+func (forward *forward) stopAccepting() {
+	if forward.listener != nil {
+		forward.listener.Close()
+	}
+}
+
+func (forward *forward) closeUDP() {
+	if forward.udp != nil {
+		forward.udp.close()
+	}
+}
+
+// handleForward relays the connection to the target of its forward as a CONNECT request.
+func (socksConnection *socksConnection) handleForward() {
+	defer socksConnection.end()
+
+	forward := socksConnection.forward
+	if !forward.clientAllowed(socksConnection.remoteIP()) {
+		metricACLDenials.WithLabelValues("client").Inc()
+		socksConnection.setCloseReason(closeReasonNotAllowed)
+		socksConnection.logWithLevel(logLevelWarn, fmt.Sprintf("The client is not allowed to use the forward %s.", forward.name))
+		socksConnection.resetUnlessConnected()
+		return
+	}
+
+	socksConnection.process(newConnectRequestTo(forward.target, socksConnection))
+	socksConnection.resetUnlessConnected()
+}
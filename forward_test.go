@@ -0,0 +1,223 @@
+package mysocks
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// forwardAddr returns the address the forward of the name is bound to.
+func forwardAddr(t *testing.T, name string) string {
+	for _, forward := range server.forwards {
+		if forward.name == name {
+			return forward.addr().String()
+		}
+	}
+	t.Fatalf("No forward named %s", name)
+	return ""
+}
+
+func TestForwards(t *testing.T) {
+	echoServer := startEchoServer(t)
+	defer echoServer.Close()
+	udpEchoServer := startUDPEchoServer(t)
+	defer udpEchoServer.Close()
+	closedListener := startEchoServer(t)
+	closedListener.Close()
+
+	configPath := t.TempDir() + "/config.json"
+	writeConfig(t, configPath, fmt.Sprintf(`{
+		"forwards": [
+			{"name": "echo", "network": "tcp", "listen": "127.0.0.1:0", "target": "%s", "allowedClients": ["127.0.0.0/8"]},
+			{"name": "denied", "network": "tcp", "listen": "127.0.0.1:0", "target": "%s", "allowedClients": ["192.0.2.1"]},
+			{"name": "refused", "network": "tcp", "listen": "127.0.0.1:0", "target": "%s"},
+			{"name": "udp-echo", "network": "udp", "listen": "127.0.0.1:0", "target": "%s", "allowedClients": ["127.0.0.1"]},
+			{"name": "udp-denied", "network": "udp", "listen": "127.0.0.1:0", "target": "%s", "allowedClients": ["192.0.2.0/24"]}
+		]
+	}`, echoServer.Addr(), echoServer.Addr(), closedListener.Addr(), udpEchoServer.LocalAddr(), udpEchoServer.LocalAddr()))
+	os.Setenv("MYSOCKS_CONFIG", configPath)
+	defer os.Setenv("MYSOCKS_CONFIG", "")
+
+	StartServer()
+	defer StopServer()
+
+	conn, err := net.Dial("tcp", forwardAddr(t, "echo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	conn.Write([]byte("forwarded"))
+	echoed := make([]byte, len("forwarded"))
+	if _, err := io.ReadFull(conn, echoed); err != nil || string(echoed) != "forwarded" {
+		t.Fatalf("The message expected to be echoed, but got %q %v", echoed, err)
+	}
+	conn.Close()
+
+	for _, name := range []string{"denied", "refused"} {
+		conn, err := net.Dial("tcp", forwardAddr(t, name))
+		if errors.Is(err, syscall.ECONNRESET) {
+			// The connection has been reset before the dial returned.
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		if n, err := conn.Read(make([]byte, 1)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("%s: the connection expected to be closed, but read %d bytes: %v", name, n, err)
+		}
+	}
+
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	udpForwardAddr, err := net.ResolveUDPAddr("udp", forwardAddr(t, "udp-echo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64)
+	for _, message := range []string{"first", "second"} {
+		client.WriteToUDP([]byte(message), udpForwardAddr)
+		client.SetReadDeadline(time.Now().Add(10 * time.Second))
+		n, from, err := client.ReadFromUDP(buf)
+		if err != nil || string(buf[:n]) != message || from.String() != udpForwardAddr.String() {
+			t.Fatalf("%q expected to be echoed from %v, but got %q from %v: %v", message, udpForwardAddr, buf[:n], from, err)
+		}
+	}
+
+	deniedAddr, err := net.ResolveUDPAddr("udp", forwardAddr(t, "udp-denied"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.WriteToUDP([]byte("denied"), deniedAddr)
+	client.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if n, _, err := client.ReadFromUDP(buf); err == nil {
+		t.Fatalf("No reply expected from the forward not allowed, but got %q", buf[:n])
+	}
+
+	waitForSessionsToEnd(t)
+}
+
+func TestUDPForwardLogs(t *testing.T) {
+	udpEchoServer := startUDPEchoServer(t)
+	defer udpEchoServer.Close()
+
+	configPath := t.TempDir() + "/config.json"
+	writeConfig(t, configPath, fmt.Sprintf(`{
+		"timeouts": {"udpIdle": "300ms"},
+		"forwards": [{"name": "udp-echo", "network": "udp", "listen": "127.0.0.1:0", "target": "%s"}]
+	}`, udpEchoServer.LocalAddr()))
+	os.Setenv("MYSOCKS_CONFIG", configPath)
+	defer os.Setenv("MYSOCKS_CONFIG", "")
+	accessLogPath := t.TempDir() + "/access.log"
+	os.Setenv("MYSOCKS_ACCESS_LOG", accessLogPath)
+	defer os.Setenv("MYSOCKS_ACCESS_LOG", "")
+
+	previous := loggers.Load()
+	defer loggers.Store(previous)
+	var logs lockedBuffer
+	SetSlogHandler(slog.NewTextHandler(&logs, nil))
+
+	StartServer()
+	defer StopServer()
+
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	udpForwardAddr, err := net.ResolveUDPAddr("udp", forwardAddr(t, "udp-echo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.WriteToUDP([]byte("hello"), udpForwardAddr)
+	client.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, _, err := client.ReadFromUDP(make([]byte, 64)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The flow is recorded when it expires.
+	var content []byte
+	deadline := time.Now().Add(10 * time.Second)
+	for len(content) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("The flow expected to be recorded in the access log")
+		}
+		time.Sleep(50 * time.Millisecond)
+		content, _ = os.ReadFile(accessLogPath)
+	}
+	var record accessRecord
+	if err := json.Unmarshal(bytes.TrimSpace(content), &record); err != nil {
+		t.Fatal(err)
+	}
+	if record.Command != cmdName(cmdAssociate) || record.Destination != udpEchoServer.LocalAddr().String() ||
+		record.ClientAddress != client.LocalAddr().String() || record.BytesUp != 5 || record.BytesDown != 5 ||
+		record.CloseReason != closeReasonUDPIdleTimeout || record.SessionID == "" {
+		t.Fatalf("Unexpected record: %+v", record)
+	}
+
+	flowLogs := 0
+	for _, line := range strings.Split(logs.String(), "\n") {
+		if !strings.Contains(line, "forward UDP flow") {
+			continue
+		}
+		if !strings.Contains(line, "forward=udp-echo") || !strings.Contains(line, "sessionID="+record.SessionID) {
+			t.Fatalf("The name of the forward and the session ID expected in the logs of its flows: %s", line)
+		}
+		flowLogs++
+	}
+	if flowLogs != 2 {
+		t.Fatalf("The creation and the closure of the flow expected to be logged: %s", logs.String())
+	}
+}
+
+func TestNewForward(t *testing.T) {
+	invalid := []forwardConfig{
+		{Network: "tcp", Listen: ":0", Target: "127.0.0.1:80"},
+		{Name: "sctp", Network: "sctp", Listen: ":0", Target: "127.0.0.1:80"},
+		{Name: "no-port", Network: "tcp", Listen: ":0", Target: "127.0.0.1"},
+		{Name: "bad-client", Network: "udp", Listen: ":0", Target: "127.0.0.1:53", AllowedClients: []string{"10.0.0.0/33"}},
+		{Name: "bad-client", Network: "udp", Listen: ":0", Target: "127.0.0.1:53", AllowedClients: []string{"localhost"}},
+	}
+	for _, config := range invalid {
+		if _, err := newForward(config); err == nil {
+			t.Fatalf("An error expected for %+v", config)
+		}
+	}
+
+	forward, err := newForward(forwardConfig{Name: "db", Network: "tcp", Listen: ":0", Target: "db.internal:5432",
+		AllowedClients: []string{"10.0.0.0/8", "192.0.2.1", "2001:db8::1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target := forward.target.String(); target != "db.internal:5432" {
+		t.Fatalf("Unexpected target: %s", target)
+	}
+	tests := []struct {
+		ip      string
+		allowed bool
+	}{
+		{"10.1.2.3", true},
+		{"192.0.2.1", true},
+		{"192.0.2.2", false},
+		{"2001:db8::1", true},
+		{"2001:db8::2", false},
+	}
+	for _, test := range tests {
+		if allowed := forward.clientAllowed(net.ParseIP(test.ip)); allowed != test.allowed {
+			t.Fatalf("%s: %v expected, but got %v", test.ip, test.allowed, allowed)
+		}
+	}
+}
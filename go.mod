@@ -2,12 +2,24 @@ module github.com/jfuruya/mysocks
 
 go 1.22.1
 
-require golang.org/x/net v0.33.0
+require (
+	github.com/go-asn1-ber/asn1-ber v1.5.1
+	github.com/go-ldap/ldap/v3 v3.4.1
+	github.com/prometheus/client_golang v1.19.1
+	go.uber.org/zap v1.27.0
+	golang.org/x/net v0.33.0
+	golang.org/x/sys v0.28.0
+	gopkg.in/natefinch/lumberjack.v2 v2.2.1
+)
 
 require (
-	github.com/patrickmn/go-cache v2.1.0+incompatible // indirect
-	github.com/txthinking/runnergroup v0.0.0-20210608031112-152c7c4432bf // indirect
-	github.com/txthinking/socks5 v0.0.0-20230325130024-4230056ae301 // indirect
+	github.com/Azure/go-ntlmssp v0.0.0-20200615164410-66371956d46c // indirect
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/prometheus/client_model v0.5.0 // indirect
+	github.com/prometheus/common v0.48.0 // indirect
+	github.com/prometheus/procfs v0.12.0 // indirect
 	go.uber.org/multierr v1.11.0 // indirect
-	go.uber.org/zap v1.27.0 // indirect
+	golang.org/x/crypto v0.31.0 // indirect
+	google.golang.org/protobuf v1.33.0 // indirect
 )
@@ -0,0 +1,369 @@
+package mysocks
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jfuruya/mysocks/client"
+	"github.com/jfuruya/mysocks/socks5wire"
+)
+
+// The tests do not depend on the network outside the host. The destinations are the
+// stand-ins below, and the failures of connections are made by fakeDial.
+
+// startHTTPServer starts an HTTP server that responds with the IP address of the client.
+func startHTTPServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			t.Error(err)
+		}
+		fmt.Fprintln(w, host)
+	}))
+}
+
+// dnsStandInAnswer is the address in the A record the DNS stand-in answers with.
+var dnsStandInAnswer = net.IPv4(192, 0, 2, 1).To4()
+
+// startDNSServer starts a DNS server that answers any query with an A record of dnsStandInAnswer.
+func startDNSServer(t *testing.T) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if response := dnsResponseTo(buf[:n]); response != nil {
+				conn.WriteToUDP(response, addr)
+			}
+		}
+	}()
+	return conn
+}
+
+// dnsResponseTo returns the response to a query with a question, or nil if the query is malformed.
+func dnsResponseTo(query []byte) []byte {
+	if len(query) < 12 {
+		return nil
+	}
+	questionEnd := 12
+	for questionEnd < len(query) && query[questionEnd] != 0 {
+		questionEnd += int(query[questionEnd]) + 1
+	}
+	questionEnd += 5 // The terminating byte, QTYPE and QCLASS
+	if questionEnd > len(query) {
+		return nil
+	}
+
+	response := append([]byte{}, query[:2]...) // ID
+	response = append(response,
+		0x81, 0x80, // Flags: a response with recursion available
+		0x00, 0x01, // Questions
+		0x00, 0x01, // Answer RRs
+		0x00, 0x00, // Authority RRs
+		0x00, 0x00, // Additional RRs
+	)
+	response = append(response, query[12:questionEnd]...)
+	response = append(response,
+		0xc0, 0x0c, // The name in the question
+		0x00, 0x01, // Type: A
+		0x00, 0x01, // Class: IN
+		0x00, 0x00, 0x00, 0x3c, // TTL
+		0x00, 0x04, // RDLENGTH
+	)
+	return append(response, dnsStandInAnswer...)
+}
+
+// dialerThrough returns a dialer through the server started by StartServer.
+// An empty user offers NO AUTHENTICATION REQUIRED.
+func dialerThrough(user string, password string) *client.Dialer {
+	return &client.Dialer{ProxyAddress: proxyAddress, Username: user, Password: password, HandshakeTimeout: 10 * time.Second}
+}
+
+// httpClientThrough returns an HTTP client that connects through the SOCKS5 dialer.
+// The connections are not kept alive, so that the sessions end with the requests.
+func httpClientThrough(dialer *client.Dialer) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext:       dialer.DialContext,
+			DisableKeepAlives: true,
+		},
+		Timeout: 10 * time.Second,
+	}
+}
+
+// fakeDial fails to connect to the hosts in the .test domain as the name tells,
+// and connects to the others.
+func fakeDial(network string, address string, timeout time.Duration) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	switch host {
+	case "general-failure.test":
+		return nil, errors.New("an unexpected failure")
+	case "net-unreachable.test":
+		return nil, &net.OpError{Op: "dial", Net: network, Err: os.NewSyscallError("connect", syscall.ENETUNREACH)}
+	case "host-unreachable.test":
+		return nil, &net.OpError{Op: "dial", Net: network, Err: &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}}
+	case "timeout.test":
+		return nil, &net.OpError{Op: "dial", Net: network, Err: os.ErrDeadlineExceeded}
+	}
+	return net.DialTimeout(network, address, timeout)
+}
+
+// requestThrough authenticates with USERNAME/PASSWORD, sends the request and returns the REP of the reply.
+func requestThrough(user string, password string, request []byte) (byte, error) {
+	conn, rep, err := sessionThrough(user, password, request)
+	if err != nil {
+		return 0, err
+	}
+	conn.Close()
+	return rep, nil
+}
+
+// sessionThrough authenticates with USERNAME/PASSWORD and sends the request.
+// It returns the connection of the session, which the caller closes, and the REP of the reply.
+func sessionThrough(user string, password string, request []byte) (net.Conn, byte, error) {
+	conn, err := net.Dial("tcp", proxyAddress)
+	if err != nil {
+		return nil, 0, err
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	rep, err := authenticateAndRequest(conn, user, password, request)
+	if err != nil {
+		conn.Close()
+		return nil, 0, err
+	}
+	return conn, rep, nil
+}
+
+func authenticateAndRequest(conn net.Conn, user string, password string, request []byte) (byte, error) {
+	if _, err := conn.Write([]byte{fiexedVer, 0x01, usernamePasswd}); err != nil {
+		return 0, err
+	}
+	negotiationReply, err := socks5wire.ReadNegotiationReply(conn, make([]byte, socks5wire.NegotiationReplyLen))
+	if err != nil {
+		return 0, err
+	}
+	if negotiationReply.Method != usernamePasswd {
+		return 0, fmt.Errorf("unexpected method: %#x", negotiationReply.Method)
+	}
+
+	authRequest, err := socks5wire.AppendUserPasswordRequest(nil, socks5wire.UserPasswordRequest{
+		Username: []byte(user),
+		Password: []byte(password),
+	})
+	if err != nil {
+		return 0, err
+	}
+	if _, err := conn.Write(authRequest); err != nil {
+		return 0, err
+	}
+	authReply, err := socks5wire.ReadUserPasswordReply(conn, make([]byte, socks5wire.UserPasswordReplyLen))
+	if err != nil {
+		return 0, err
+	}
+	if authReply.Status != socks5wire.UserPasswordStatusSuccess {
+		return 0, ErrAuthenticationFailed
+	}
+
+	if _, err := conn.Write(request); err != nil {
+		return 0, err
+	}
+	reply, err := socks5wire.ReadReply(conn, make([]byte, socks5wire.MaxReplyLen))
+	if err != nil {
+		return 0, err
+	}
+	return reply.Rep, nil
+}
+
+func connectRequestTo(t *testing.T, address string) []byte {
+	addr, err := socks5wire.HostPortAddr(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, err := socks5wire.AppendRequest(nil, socks5wire.Request{Cmd: cmdConnect, Addr: addr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return request
+}
+
+func TestErrorReplies(t *testing.T) {
+	configPath := t.TempDir() + "/config.json"
+	writeConfig(t, configPath, `{
+		"users": {
+			"grace": {"password": "grace-password"},
+			"heidi": {"password": "heidi-password", "quotas": {"daily": {"sessions": 1}}}
+		}
+	}`)
+	os.Setenv("MYSOCKS_CONFIG", configPath)
+	defer os.Setenv("MYSOCKS_CONFIG", "")
+
+	os.Setenv("MYSOCKS_PORT", "0")
+	testServer := NewServer()
+	testServer.dial = fakeDial
+	startTestServer(testServer)
+	defer StopServer()
+
+	echoServer := startEchoServer(t)
+	defer echoServer.Close()
+	closedListener := startEchoServer(t)
+	closedListener.Close()
+
+	// The daily quota of heidi is used up by the first session.
+	if rep, err := requestThrough("heidi", "heidi-password", connectRequestTo(t, echoServer.Addr().String())); err != nil || rep != repSucceeded {
+		t.Fatalf("Unexpected reply: %#x %v", rep, err)
+	}
+	waitForSessionsToEnd(t)
+
+	bindRequest := connectRequestTo(t, echoServer.Addr().String())
+	bindRequest[1] = cmdBind
+
+	tests := []struct {
+		name    string
+		user    string
+		request []byte
+		rep     byte
+	}{
+		{"general failure", "grace", connectRequestTo(t, "general-failure.test:80"), repGeneral},
+		{"quota exceeded", "heidi", connectRequestTo(t, echoServer.Addr().String()), repDenied},
+		{"network unreachable", "grace", connectRequestTo(t, "net-unreachable.test:80"), repNetUnreach},
+		{"host unreachable", "grace", connectRequestTo(t, "host-unreachable.test:80"), repHostUnreach},
+		{"connection refused", "grace", connectRequestTo(t, closedListener.Addr().String()), repConnRefused},
+		{"connect timeout", "grace", connectRequestTo(t, "timeout.test:80"), repHostUnreach},
+		{"BIND", "grace", bindRequest, repCmdNotSupported},
+		{"unknown command", "grace", []byte{fiexedVer, 0x09, fixedRsv, atypIPv4, 127, 0, 0, 1, 0x00, 0x50}, repCmdNotSupported},
+		{"unknown address type", "grace", []byte{fiexedVer, cmdConnect, fixedRsv, 0x02, 127, 0, 0, 1, 0x00, 0x50}, repAddrNotSupported},
+	}
+	for _, test := range tests {
+		user := test.user
+		rep, err := requestThrough(user, user+"-password", test.request)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if rep != test.rep {
+			t.Fatalf("%s: REP %#x expected, but got %#x", test.name, test.rep, rep)
+		}
+	}
+
+	if _, err := requestThrough("grace", "wrong-password", connectRequestTo(t, echoServer.Addr().String())); err != ErrAuthenticationFailed {
+		t.Fatalf("ErrAuthenticationFailed expected, but got %v", err)
+	}
+	waitForSessionsToEnd(t)
+}
+
+func TestConcurrentSessions(t *testing.T) {
+	user := "ivan"
+	password := "ivan-password"
+	os.Setenv("MYSOCKS_USER", user)
+	os.Setenv("MYSOCKS_PASSWORD", password)
+	defer func() {
+		os.Setenv("MYSOCKS_USER", "")
+		os.Setenv("MYSOCKS_PASSWORD", "")
+	}()
+
+	StartServer()
+	defer StopServer()
+
+	httpServer := startHTTPServer(t)
+	defer httpServer.Close()
+	dnsServer := startDNSServer(t)
+	defer dnsServer.Close()
+
+	request := connectRequestTo(t, httpServer.Listener.Addr().String())
+
+	// CONNECT, UDP ASSOCIATE and failed authentications run at the same time.
+	runConcurrently(t, 60, func(i int) error {
+		switch i % 3 {
+		case 0:
+			dialer := dialerThrough(user, password)
+			res, err := httpClientThrough(dialer).Get(httpServer.URL)
+			if err != nil {
+				return err
+			}
+			defer res.Body.Close()
+			body, err := io.ReadAll(res.Body)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(strings.TrimSpace(string(body))); ip == nil {
+				return fmt.Errorf("unexpected response: %q", body)
+			}
+		case 1:
+			// The associations from the same IP run at once, so each of them tells the address
+			// it sends datagrams from, unlike client.Dialer.ListenPacket.
+			udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			if err != nil {
+				return err
+			}
+			defer udpConn.Close()
+			clientAddr := udpConn.LocalAddr().(*net.UDPAddr)
+			associateRequest := []byte{fiexedVer, cmdAssociate, fixedRsv, atypIPv4}
+			associateRequest = append(associateRequest, clientAddr.IP.To4()...)
+			associateRequest = binary.BigEndian.AppendUint16(associateRequest, uint16(clientAddr.Port))
+			conn, rep, err := sessionThrough(user, password, associateRequest)
+			if err != nil {
+				return err
+			}
+			defer conn.Close()
+			if rep != repSucceeded {
+				return fmt.Errorf("unexpected reply: %#x", rep)
+			}
+			proxyUDPAddr, err := net.ResolveUDPAddr("udp", proxyAddress)
+			if err != nil {
+				return err
+			}
+
+			dnsAddr := dnsServer.LocalAddr().(*net.UDPAddr)
+			header := []byte{0x00, 0x00, 0x00, atypIPv4}
+			header = append(header, dnsAddr.IP.To4()...)
+			header = binary.BigEndian.AppendUint16(header, uint16(dnsAddr.Port))
+			query := []byte{0x12, 0x34, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+				0x07, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 0x04, 't', 'e', 's', 't', 0x00, 0x00, 0x01, 0x00, 0x01}
+			if _, err := udpConn.WriteToUDP(append(header, query...), proxyUDPAddr); err != nil {
+				return err
+			}
+			udpConn.SetReadDeadline(time.Now().Add(10 * time.Second))
+			datagram := make([]byte, 512)
+			n, _, err := udpConn.ReadFromUDP(datagram)
+			if err != nil {
+				return err
+			}
+			if n < len(header) || !bytes.Equal(datagram[:len(header)], header) {
+				return fmt.Errorf("unexpected datagram: %v", datagram[:n])
+			}
+			response := datagram[len(header):n]
+			if err := parseDNSResponse(response); err != nil {
+				return err
+			}
+			if answer := response[len(response)-4:]; !net.IP(answer).Equal(dnsStandInAnswer) {
+				return fmt.Errorf("unexpected answer: %v", net.IP(answer))
+			}
+		case 2:
+			if _, err := requestThrough(user, "wrong-password", request); err != ErrAuthenticationFailed {
+				return fmt.Errorf("ErrAuthenticationFailed expected, but got %v", err)
+			}
+		}
+		return nil
+	})
+
+	waitForSessionsToEnd(t)
+}
@@ -0,0 +1,287 @@
+package mysocks
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// ldapSettings are the settings of the LDAP authenticator.
+type ldapSettings struct {
+	// url is like ldap://ldap.example.com or ldaps://ldap.example.com:636.
+	url      string
+	startTLS bool
+	// caFile is the PEM bundle of the CAs of the LDAP server. The system roots are used if it is empty.
+	caFile string
+	// bindDN and bindPassword are the service account that searches the users and the groups.
+	// An empty bindDN means an anonymous search.
+	bindDN       string
+	bindPassword string
+	// userDNTemplate, if not empty, is the DN of the users with %s replaced by the user name,
+	// and the users are bound without a search.
+	userDNTemplate string
+	// baseDN and userFilter find the user to bind, with %s in the filter replaced by the user name.
+	baseDN     string
+	userFilter string
+	// groupBaseDN and groupFilter find the groups of the user, with %s in the filter replaced by the DN
+	// of the user. The groups are not looked up if groupBaseDN is empty.
+	groupBaseDN        string
+	groupFilter        string
+	groupNameAttribute string
+	// requiredGroups, if not empty, are the groups one of which the users must belong to.
+	requiredGroups []string
+	poolSize       int
+	timeout        time.Duration
+}
+
+// ldapAuthenticator verifies the passwords by binding to an LDAP server as the users.
+type ldapAuthenticator struct {
+	settings  ldapSettings
+	tlsConfig *tls.Config
+	pool      *ldapPool
+}
+
+func newLDAPAuthenticator(settings ldapSettings) (*ldapAuthenticator, error) {
+	serverURL, err := url.Parse(settings.url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid LDAP URL: %w", err)
+	}
+	if serverURL.Scheme != "ldap" && serverURL.Scheme != "ldaps" {
+		return nil, fmt.Errorf("the scheme of the LDAP URL must be ldap or ldaps: %s", settings.url)
+	}
+	if settings.startTLS && serverURL.Scheme == "ldaps" {
+		return nil, errors.New("StartTLS can not be used with ldaps")
+	}
+	if settings.userDNTemplate == "" && settings.baseDN == "" {
+		return nil, errors.New("MYSOCKS_LDAP_USER_DN_TEMPLATE or MYSOCKS_LDAP_BASE_DN must be set")
+	}
+
+	tlsConfig := &tls.Config{ServerName: serverURL.Hostname()}
+	if settings.caFile != "" {
+		caBytes, err := os.ReadFile(settings.caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the LDAP CA bundle: %w", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caBytes) {
+			return nil, fmt.Errorf("no certificate has been found in the LDAP CA bundle: %s", settings.caFile)
+		}
+	}
+
+	authenticator := &ldapAuthenticator{
+		settings:  settings,
+		tlsConfig: tlsConfig,
+	}
+	authenticator.pool = newLDAPPool(settings.poolSize, authenticator.dial)
+	return authenticator, nil
+}
+
+func (authenticator *ldapAuthenticator) dial() (*ldap.Conn, error) {
+	conn, err := ldap.DialURL(authenticator.settings.url, ldap.DialWithTLSConfig(authenticator.tlsConfig))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(authenticator.settings.timeout)
+	if authenticator.settings.startTLS {
+		if err := conn.StartTLS(authenticator.tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (authenticator *ldapAuthenticator) authenticate(check credentialsCheck) (authDecision, error) {
+	// An empty password would be an unauthenticated bind, which many servers accept.
+	if check.password == "" {
+		return authDecision{}, nil
+	}
+
+	conn, err := authenticator.pool.get()
+	if err != nil {
+		metricAuthBackendErrors.WithLabelValues("ldap").Inc()
+		return authDecision{}, fmt.Errorf("failed to connect to the LDAP server: %w", err)
+	}
+	decision, err := authenticator.authenticateOn(conn, check)
+	authenticator.pool.put(conn, err == nil || !isLDAPNetworkError(err))
+	if err != nil {
+		metricAuthBackendErrors.WithLabelValues("ldap").Inc()
+		return authDecision{}, err
+	}
+	return decision, nil
+}
+
+func (authenticator *ldapAuthenticator) authenticateOn(conn *ldap.Conn, check credentialsCheck) (authDecision, error) {
+	settings := authenticator.settings
+
+	userDN := ""
+	if settings.userDNTemplate != "" {
+		userDN = fmt.Sprintf(settings.userDNTemplate, escapeDNValue(check.userName))
+	} else {
+		if err := authenticator.bindServiceAccount(conn); err != nil {
+			return authDecision{}, err
+		}
+		result, err := conn.Search(ldap.NewSearchRequest(settings.baseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+			2, 0, false, fmt.Sprintf(settings.userFilter, ldap.EscapeFilter(check.userName)), []string{"dn"}, nil))
+		if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+			return authDecision{}, fmt.Errorf("failed to search the LDAP user: %w", err)
+		}
+		// The user name must identify exactly one user.
+		if result == nil || len(result.Entries) != 1 {
+			return authDecision{}, nil
+		}
+		userDN = result.Entries[0].DN
+	}
+
+	if err := conn.Bind(userDN, check.password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return authDecision{}, nil
+		}
+		return authDecision{}, fmt.Errorf("failed to bind to the LDAP server as the user: %w", err)
+	}
+
+	var groups []string
+	if settings.groupBaseDN != "" {
+		if err := authenticator.bindServiceAccount(conn); err != nil {
+			return authDecision{}, err
+		}
+		result, err := conn.Search(ldap.NewSearchRequest(settings.groupBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+			0, 0, false, strings.ReplaceAll(settings.groupFilter, "%s", ldap.EscapeFilter(userDN)), []string{settings.groupNameAttribute}, nil))
+		if err != nil {
+			return authDecision{}, fmt.Errorf("failed to search the LDAP groups: %w", err)
+		}
+		for _, entry := range result.Entries {
+			groups = append(groups, entry.GetAttributeValue(settings.groupNameAttribute))
+		}
+	}
+	if len(settings.requiredGroups) > 0 && !containsAny(groups, settings.requiredGroups) {
+		return authDecision{}, nil
+	}
+
+	return authDecision{allowed: true, attributes: userAttributes{groups: groups}}, nil
+}
+
+// bindServiceAccount binds as the service account, or anonymously if there is none,
+// because the connection may be bound as a user by a previous authentication.
+func (authenticator *ldapAuthenticator) bindServiceAccount(conn *ldap.Conn) error {
+	var err error
+	if authenticator.settings.bindDN == "" {
+		err = conn.UnauthenticatedBind("")
+	} else {
+		err = conn.Bind(authenticator.settings.bindDN, authenticator.settings.bindPassword)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to bind to the LDAP server as the service account: %w", err)
+	}
+	return nil
+}
+
+func (authenticator *ldapAuthenticator) close() {
+	authenticator.pool.close()
+}
+
+// isLDAPNetworkError reports whether the connection can not be used any more after the error.
+func isLDAPNetworkError(err error) bool {
+	var ldapErr *ldap.Error
+	return !errors.As(err, &ldapErr) || ldapErr.ResultCode == ldap.ErrorNetwork
+}
+
+// escapeDNValue escapes the special characters of an attribute value in a DN as RFC 4514 does.
+func escapeDNValue(value string) string {
+	var builder strings.Builder
+	for i, r := range value {
+		switch {
+		case strings.ContainsRune(`,+"\<>;=`, r),
+			(r == ' ' || r == '#') && i == 0,
+			r == ' ' && i == len(value)-1:
+			builder.WriteByte('\\')
+			builder.WriteRune(r)
+		case r == 0:
+			builder.WriteString(`\00`)
+		default:
+			builder.WriteRune(r)
+		}
+	}
+	return builder.String()
+}
+
+func containsAny(values []string, candidates []string) bool {
+	for _, value := range values {
+		for _, candidate := range candidates {
+			if strings.EqualFold(value, candidate) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ldapPool keeps the connections to the LDAP server for reuse, and limits their number.
+type ldapPool struct {
+	dial func() (*ldap.Conn, error)
+	// slots has a value for each connection in use.
+	slots chan struct{}
+
+	idleMutex sync.Mutex
+	idle      []*ldap.Conn
+}
+
+func newLDAPPool(size int, dial func() (*ldap.Conn, error)) *ldapPool {
+	return &ldapPool{
+		dial:  dial,
+		slots: make(chan struct{}, max(size, 1)),
+	}
+}
+
+// get returns an idle connection or a new one, waiting while all of them are in use.
+func (pool *ldapPool) get() (*ldap.Conn, error) {
+	pool.slots <- struct{}{}
+
+	pool.idleMutex.Lock()
+	for len(pool.idle) > 0 {
+		conn := pool.idle[len(pool.idle)-1]
+		pool.idle = pool.idle[:len(pool.idle)-1]
+		if !conn.IsClosing() {
+			pool.idleMutex.Unlock()
+			return conn, nil
+		}
+		conn.Close()
+	}
+	pool.idleMutex.Unlock()
+
+	conn, err := pool.dial()
+	if err != nil {
+		<-pool.slots
+		return nil, err
+	}
+	return conn, nil
+}
+
+// put returns the connection to the pool, or closes it if it is not reusable.
+func (pool *ldapPool) put(conn *ldap.Conn, reusable bool) {
+	if reusable {
+		pool.idleMutex.Lock()
+		pool.idle = append(pool.idle, conn)
+		pool.idleMutex.Unlock()
+	} else {
+		conn.Close()
+	}
+	<-pool.slots
+}
+
+func (pool *ldapPool) close() {
+	pool.idleMutex.Lock()
+	defer pool.idleMutex.Unlock()
+	for _, conn := range pool.idle {
+		conn.Close()
+	}
+	pool.idle = nil
+}
@@ -0,0 +1,247 @@
+package mysocks
+
+import (
+	"crypto/tls"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+type testLDAPEntry struct {
+	dn         string
+	password   string
+	attributes map[string][]string
+}
+
+// testLDAPServer is an in-process LDAP server that understands simple binds, searches with
+// an equality filter and StartTLS, which are what the authenticator uses.
+type testLDAPServer struct {
+	listener    net.Listener
+	tlsConfig   *tls.Config
+	entries     []testLDAPEntry
+	connections atomic.Int32
+}
+
+func startTestLDAPServer(t *testing.T, tlsConfig *tls.Config, entries []testLDAPEntry) *testLDAPServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &testLDAPServer{listener: listener, tlsConfig: tlsConfig, entries: entries}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			server.connections.Add(1)
+			go server.serve(conn)
+		}
+	}()
+	return server
+}
+
+func (server *testLDAPServer) url() string {
+	return "ldap://" + server.listener.Addr().String()
+}
+
+func (server *testLDAPServer) serve(conn net.Conn) {
+	defer func() { conn.Close() }()
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		messageID := packet.Children[0].Value.(int64)
+		operation := packet.Children[1]
+		switch operation.Tag {
+		case ldap.ApplicationBindRequest:
+			dn := operation.Children[1].Data.String()
+			password := operation.Children[2].Data.String()
+			code := ldap.LDAPResultInvalidCredentials
+			if dn == "" && password == "" {
+				code = ldap.LDAPResultSuccess
+			}
+			for _, entry := range server.entries {
+				if entry.dn == dn && entry.password == password {
+					code = ldap.LDAPResultSuccess
+				}
+			}
+			conn.Write(testLDAPResponse(messageID, ldap.ApplicationBindResponse, code).Bytes())
+		case ldap.ApplicationSearchRequest:
+			baseDN := operation.Children[0].Data.String()
+			filter, _ := ldap.DecompileFilter(operation.Children[6])
+			attribute, value, _ := strings.Cut(strings.Trim(filter, "()"), "=")
+			for _, entry := range server.entries {
+				if !strings.HasSuffix(entry.dn, baseDN) || !containsAny(entry.attributes[attribute], []string{value}) {
+					continue
+				}
+				conn.Write(testLDAPEntryPacket(messageID, entry).Bytes())
+			}
+			conn.Write(testLDAPResponse(messageID, ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess).Bytes())
+		case ldap.ApplicationExtendedRequest:
+			conn.Write(testLDAPResponse(messageID, ldap.ApplicationExtendedResponse, ldap.LDAPResultSuccess).Bytes())
+			tlsConn := tls.Server(conn, server.tlsConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn = tlsConn
+		default:
+			return
+		}
+	}
+}
+
+func testLDAPResponse(messageID int64, tag ber.Tag, code int) *ber.Packet {
+	envelope := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	envelope.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, ""))
+	response := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+	response.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), ""))
+	response.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	response.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	envelope.AppendChild(response)
+	return envelope
+}
+
+func testLDAPEntryPacket(messageID int64, entry testLDAPEntry) *ber.Packet {
+	envelope := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	envelope.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, ""))
+	result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "")
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, entry.dn, ""))
+	attributes := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	for name, values := range entry.attributes {
+		attribute := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+		attribute.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, ""))
+		set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "")
+		for _, value := range values {
+			set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, ""))
+		}
+		attribute.AppendChild(set)
+		attributes.AppendChild(attribute)
+	}
+	result.AppendChild(attributes)
+	envelope.AppendChild(result)
+	return envelope
+}
+
+func TestLDAPAuth(t *testing.T) {
+	dir := t.TempDir()
+	_, certPath, keyPath := newServerCertificate(t, dir, 1)
+	certificate, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const daveDN = "uid=dave,ou=people,dc=example,dc=com"
+	const erinDN = "uid=erin,ou=people,dc=example,dc=com"
+	ldapServer := startTestLDAPServer(t, &tls.Config{Certificates: []tls.Certificate{certificate}}, []testLDAPEntry{
+		{dn: "cn=mysocks,ou=services,dc=example,dc=com", password: "service-password"},
+		{dn: daveDN, password: "dave-password", attributes: map[string][]string{"uid": {"dave"}}},
+		{dn: erinDN, password: "erin-password", attributes: map[string][]string{"uid": {"erin"}}},
+		{dn: "cn=vpn,ou=groups,dc=example,dc=com", attributes: map[string][]string{"cn": {"vpn"}, "member": {daveDN}}},
+		{dn: "cn=staff,ou=groups,dc=example,dc=com", attributes: map[string][]string{"cn": {"staff"}, "member": {daveDN, erinDN}}},
+	})
+	defer ldapServer.listener.Close()
+
+	authenticator, err := newLDAPAuthenticator(ldapSettings{
+		url:                ldapServer.url(),
+		startTLS:           true,
+		caFile:             certPath,
+		bindDN:             "cn=mysocks,ou=services,dc=example,dc=com",
+		bindPassword:       "service-password",
+		baseDN:             "ou=people,dc=example,dc=com",
+		userFilter:         "(uid=%s)",
+		groupBaseDN:        "ou=groups,dc=example,dc=com",
+		groupFilter:        "(member=%s)",
+		groupNameAttribute: "cn",
+		requiredGroups:     []string{"vpn"},
+		poolSize:           1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer authenticator.close()
+
+	for _, test := range []struct {
+		userName string
+		password string
+		allowed  bool
+	}{
+		{"dave", "dave-password", true},
+		{"dave", "wrong-password", false},
+		{"dave", "", false},
+		// erin is not in the required group.
+		{"erin", "erin-password", false},
+		{"nobody", "dave-password", false},
+		{"dave", "dave-password", true},
+	} {
+		decision, err := authenticator.authenticate(credentialsCheck{userName: test.userName, password: test.password})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decision.allowed != test.allowed {
+			t.Errorf("%s/%s: %v expected, but got %v", test.userName, test.password, test.allowed, decision.allowed)
+		}
+		if decision.allowed && len(decision.attributes.groups) != 2 {
+			t.Errorf("The groups vpn and staff expected, but got %v", decision.attributes.groups)
+		}
+	}
+	if connections := ldapServer.connections.Load(); connections != 1 {
+		t.Errorf("The connection should be reused, but %d connections have been made", connections)
+	}
+
+	ldapServer.listener.Close()
+	authenticator.close()
+	if _, err := authenticator.authenticate(credentialsCheck{userName: "dave", password: "dave-password"}); err == nil {
+		t.Error("An error expected when the LDAP server is down")
+	}
+}
+
+func TestLDAPAuthThroughServer(t *testing.T) {
+	ldapServer := startTestLDAPServer(t, nil, []testLDAPEntry{
+		{dn: "uid=dave,ou=people,dc=example,dc=com", password: "dave-password"},
+	})
+	defer ldapServer.listener.Close()
+
+	os.Setenv("MYSOCKS_LDAP_URL", ldapServer.url())
+	os.Setenv("MYSOCKS_LDAP_USER_DN_TEMPLATE", "uid=%s,ou=people,dc=example,dc=com")
+	defer os.Setenv("MYSOCKS_LDAP_URL", "")
+	defer os.Setenv("MYSOCKS_LDAP_USER_DN_TEMPLATE", "")
+
+	StartServer()
+	defer StopServer()
+
+	echoServer := startEchoServer(t)
+	defer echoServer.Close()
+
+	dialer := dialerThrough("dave", "dave-password")
+	conn, err := dialer.Dial("tcp", echoServer.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	wrongDialer := dialerThrough("dave", "wrong-password")
+	if _, err := wrongDialer.Dial("tcp", echoServer.Addr().String()); err == nil {
+		t.Fatal("The wrong password should be denied")
+	}
+}
+
+func TestEscapeDNValue(t *testing.T) {
+	for value, expected := range map[string]string{
+		"dave":       "dave",
+		"a,b=c":      `a\,b\=c`,
+		" #x ":       `\ #x\ `,
+		"#lead":      `\#lead`,
+		"o'neil+co;": `o'neil\+co\;`,
+	} {
+		if actual := escapeDNValue(value); actual != expected {
+			t.Errorf("%q: %q expected, but got %q", value, expected, actual)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package mysocks
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// socksListener is a pair of the TCP listener and the UDP socket bound to the same address.
+// The UDP ASSOCIATE requests to the TCP listener are relayed on the UDP socket.
+type socksListener struct {
+	tcpListener net.Listener
+	udpConn     *net.UDPConn
+}
+
+// listenAttempts is the number of the ports tried when the port is 0, since the port chosen
+// for TCP may be in use for UDP.
+const listenAttempts = 5
+
+// listenSocks binds the TCP listener and the UDP socket to the address. When the port is 0,
+// an ephemeral port is chosen for both. With ipv6Only, the IPv6 and wildcard addresses
+// do not accept IPv4; otherwise the wildcard addresses accept both IPv4 and IPv6.
+func listenSocks(address string, ipv6Only bool) (*socksListener, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	tcpNetwork, udpNetwork := listenNetworks(host, ipv6Only)
+
+	attempts := 1
+	if port == "0" {
+		attempts = listenAttempts
+	}
+	for attempt := 1; ; attempt++ {
+		tcpListener, err := net.Listen(tcpNetwork, address)
+		if err != nil {
+			return nil, err
+		}
+		tcpAddr := tcpListener.Addr().(*net.TCPAddr)
+		udpConn, err := net.ListenUDP(udpNetwork, &net.UDPAddr{IP: tcpAddr.IP, Port: tcpAddr.Port, Zone: tcpAddr.Zone})
+		if err == nil {
+			return &socksListener{tcpListener: tcpListener, udpConn: udpConn}, nil
+		}
+		tcpListener.Close()
+		if attempt >= attempts || !errors.Is(err, syscall.EADDRINUSE) {
+			return nil, fmt.Errorf("failed to bind UDP to the port of TCP %s: %w", tcpAddr, err)
+		}
+	}
+}
+
+// listenNetworks returns the networks to listen on the host with.
+func listenNetworks(host string, ipv6Only bool) (string, string) {
+	ip := net.ParseIP(host)
+	switch {
+	case ip != nil && ip.To4() != nil:
+		return "tcp4", "udp4"
+	case ipv6Only && (host == "" || ip != nil):
+		return "tcp6", "udp6"
+	default:
+		return "tcp", "udp"
+	}
+}
+
+func (listener *socksListener) close() {
+	listener.tcpListener.Close()
+	listener.udpConn.Close()
+}
+
+// Addrs returns the addresses the server is listening on for SOCKS, as *net.TCPAddr and *net.UDPAddr
+// with the ports chosen for port 0. The TLS listener is not included. It returns nil until Ready.
+func (server *Server) Addrs() []net.Addr {
+	select {
+	case <-server.ready:
+	default:
+		return nil
+	}
+	server.listenersMutex.Lock()
+	defer server.listenersMutex.Unlock()
+	var addrs []net.Addr
+	for _, listener := range server.socksListeners {
+		addrs = append(addrs, listener.tcpListener.Addr(), listener.udpConn.LocalAddr())
+	}
+	return addrs
+}
@@ -0,0 +1,114 @@
+package mysocks
+
+import (
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jfuruya/mysocks/socks5wire"
+)
+
+// skipWithoutIPv6 skips the test when the host has no IPv6 loopback address.
+func skipWithoutIPv6(t *testing.T) {
+	listener, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skip("IPv6 is not available")
+	}
+	listener.Close()
+}
+
+func TestListenNetworks(t *testing.T) {
+	tests := []struct {
+		host       string
+		ipv6Only   bool
+		tcpNetwork string
+	}{
+		{"", false, "tcp"},
+		{"", true, "tcp6"},
+		{"127.0.0.1", false, "tcp4"},
+		{"0.0.0.0", true, "tcp4"},
+		{"::", false, "tcp"},
+		{"::", true, "tcp6"},
+		{"localhost", true, "tcp"},
+	}
+	for _, test := range tests {
+		tcpNetwork, udpNetwork := listenNetworks(test.host, test.ipv6Only)
+		if tcpNetwork != test.tcpNetwork || udpNetwork != "udp"+tcpNetwork[3:] {
+			t.Fatalf("%q %v: unexpected networks: %s %s", test.host, test.ipv6Only, tcpNetwork, udpNetwork)
+		}
+	}
+}
+
+func TestListenAddresses(t *testing.T) {
+	skipWithoutIPv6(t)
+
+	os.Setenv("MYSOCKS_LISTEN", "127.0.0.1:0, [::1]:0")
+	defer os.Setenv("MYSOCKS_LISTEN", "")
+	testServer := NewServer()
+	if addrs := testServer.Addrs(); addrs != nil {
+		t.Fatalf("No address expected before Ready, but got %v", addrs)
+	}
+	startTestServer(testServer)
+	defer StopServer()
+
+	addrs := testServer.Addrs()
+	if len(addrs) != 4 {
+		t.Fatalf("4 addresses expected, but got %v", addrs)
+	}
+	for i, ip := range []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback} {
+		tcpAddr := addrs[2*i].(*net.TCPAddr)
+		udpAddr := addrs[2*i+1].(*net.UDPAddr)
+		if !tcpAddr.IP.Equal(ip) || !udpAddr.IP.Equal(ip) || tcpAddr.Port == 0 || tcpAddr.Port != udpAddr.Port {
+			t.Fatalf("Unexpected addresses: %v %v", tcpAddr, udpAddr)
+		}
+	}
+
+	// The UDP ASSOCIATE reply tells the UDP socket of the listener the request came to.
+	for i := 0; i < 2; i++ {
+		tcpAddr := addrs[2*i].(*net.TCPAddr)
+		udpAddr := addrs[2*i+1].(*net.UDPAddr)
+
+		conn, err := net.Dial("tcp", tcpAddr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		conn.Write([]byte{fiexedVer, 0x01, noAuthRequired})
+		if _, err := socks5wire.ReadNegotiationReply(conn, make([]byte, socks5wire.NegotiationReplyLen)); err != nil {
+			t.Fatal(err)
+		}
+		request, _ := socks5wire.AppendRequest(nil, socks5wire.Request{Cmd: cmdAssociate, Addr: socks5wire.IPAddr(net.IPv4zero, 0)})
+		conn.Write(request)
+		reply, err := socks5wire.ReadReply(conn, make([]byte, socks5wire.MaxReplyLen))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reply.Rep != repSucceeded || !reply.Addr.IP().Equal(udpAddr.IP) || int(reply.Addr.Port) != udpAddr.Port {
+			t.Fatalf("The address of %v expected, but got %v", udpAddr, reply.Addr)
+		}
+	}
+}
+
+func TestListenIPv6Only(t *testing.T) {
+	skipWithoutIPv6(t)
+
+	os.Setenv("MYSOCKS_LISTEN", "[::]:0")
+	os.Setenv("MYSOCKS_IPV6_ONLY", "true")
+	defer os.Setenv("MYSOCKS_LISTEN", "")
+	defer os.Setenv("MYSOCKS_IPV6_ONLY", "")
+	startTestServer(NewServer())
+	defer StopServer()
+
+	port := server.Addrs()[0].(*net.TCPAddr).Port
+	conn, err := net.Dial("tcp6", (&net.TCPAddr{IP: net.IPv6loopback, Port: port}).String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if conn, err := net.Dial("tcp4", (&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}).String()); err == nil {
+		conn.Close()
+		t.Fatal("The IPv6-only listener should not accept IPv4")
+	}
+}
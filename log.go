@@ -1,16 +1,18 @@
 package mysocks
 
 import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
 
-var logger *zap.Logger
-
-func init() {
-	logger, _ = zap.NewDevelopment()
-}
-
 // ログレベルを定義
 const (
 	logLevelDebug = iota
@@ -20,27 +22,240 @@ const (
 	logLevelFatal
 )
 
+// Subsystems whose log levels can be configured separately.
+const (
+	logSubsystemServer    = "server"
+	logSubsystemHandshake = "handshake"
+	logSubsystemRelay     = "relay"
+	logSubsystemUDP       = "udp"
+)
+
+var logSubsystems = []string{logSubsystemServer, logSubsystemHandshake, logSubsystemRelay, logSubsystemUDP}
+
+// sampledLogSubsystems log per packet, so their repeated messages are sampled.
+var sampledLogSubsystems = map[string]bool{
+	logSubsystemRelay: true,
+	logSubsystemUDP:   true,
+}
+
+// logSettings is how the logs are filtered and sampled.
+type logSettings struct {
+	level           zapcore.Level
+	subsystemLevels map[string]zapcore.Level
+	// samplingInitial messages with the same level and text are logged every second,
+	// and then every samplingThereafter-th one. Zero disables the sampling.
+	samplingInitial    int
+	samplingThereafter int
+}
+
+// subsystemLoggers holds one logger per subsystem.
+type subsystemLoggers map[string]*zap.Logger
+
+var loggers atomic.Pointer[subsystemLoggers]
+
+var currentLogSettings logSettings
+
+func init() {
+	currentLogSettings = logSettingsFromEnv()
+	core, err := newLogCore(logFormatFromEnv(), logOutputsFromEnv())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to configure the logs, falling back to stderr: %v\n", err)
+		core, _ = newLogCore("console", []string{"stderr"})
+	}
+	setLogCore(core)
+}
+
+func logSettingsFromEnv() logSettings {
+	settings := logSettings{
+		level:              logLevelFromString(env("MYSOCKS_LOG_LEVEL", "info"), zap.InfoLevel),
+		subsystemLevels:    map[string]zapcore.Level{},
+		samplingInitial:    intEnv("MYSOCKS_LOG_SAMPLING_INITIAL", 100),
+		samplingThereafter: intEnv("MYSOCKS_LOG_SAMPLING_THEREAFTER", 100),
+	}
+	for _, subsystem := range logSubsystems {
+		name := "MYSOCKS_LOG_LEVEL_" + strings.ToUpper(subsystem)
+		settings.subsystemLevels[subsystem] = logLevelFromString(env(name, ""), settings.level)
+	}
+	return settings
+}
+
+func logLevelFromString(value string, defaultLevel zapcore.Level) zapcore.Level {
+	if value == "" {
+		return defaultLevel
+	}
+	level, err := zapcore.ParseLevel(value)
+	if err != nil {
+		return defaultLevel
+	}
+	return level
+}
+
+// newLogCore creates a core that writes every level in the format ("json" or "console")
+// to the outputs ("stdout", "stderr" or file paths).
+func newLogCore(format string, outputs []string) (zapcore.Core, error) {
+	var encoder zapcore.Encoder
+	switch format {
+	case "json":
+		encoder = zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig())
+	case "console":
+		encoderConfig := zap.NewDevelopmentEncoderConfig()
+		encoder = zapcore.NewConsoleEncoder(encoderConfig)
+	default:
+		return nil, fmt.Errorf("unknown log format: %s", format)
+	}
+
+	sink, _, err := zap.Open(outputs...)
+	if err != nil {
+		return nil, err
+	}
+	return zapcore.NewCore(encoder, sink, zap.DebugLevel), nil
+}
+
+// setLogCore builds the subsystem loggers on the core.
+func setLogCore(core zapcore.Core) {
+	settings := currentLogSettings
+	core = &redactingCore{Core: core}
+	newLoggers := subsystemLoggers{}
+	for _, subsystem := range logSubsystems {
+		var subsystemCore zapcore.Core = &levelFilterCore{
+			Core:  core,
+			level: settings.subsystemLevels[subsystem],
+		}
+		if sampledLogSubsystems[subsystem] && settings.samplingInitial > 0 {
+			subsystemCore = zapcore.NewSamplerWithOptions(subsystemCore, time.Second,
+				settings.samplingInitial, settings.samplingThereafter)
+		}
+		// Skip logSubsystemWithLevel and the helper that called it.
+		subsystemLogger := zap.New(subsystemCore, zap.AddCaller(), zap.AddCallerSkip(2))
+		if subsystem != logSubsystemServer {
+			subsystemLogger = subsystemLogger.Named(subsystem)
+		}
+		newLoggers[subsystem] = subsystemLogger
+	}
+	loggers.Store(&newLoggers)
+}
+
+// SetLogger makes the package write its logs to the given logger.
+// The levels and the sampling configured with the environment variables still apply.
+func SetLogger(logger *zap.Logger) {
+	setLogCore(logger.Core())
+}
+
+// SetSlogHandler makes the package write its logs to the given slog handler.
+// The levels and the sampling configured with the environment variables still apply.
+func SetSlogHandler(handler slog.Handler) {
+	setLogCore(&slogCore{handler: handler})
+}
+
+// levelFilterCore drops the entries below its level before they reach the wrapped core.
+type levelFilterCore struct {
+	zapcore.Core
+	level zapcore.LevelEnabler
+}
+
+func (core *levelFilterCore) Enabled(level zapcore.Level) bool {
+	return core.level.Enabled(level) && core.Core.Enabled(level)
+}
+
+func (core *levelFilterCore) With(fields []zapcore.Field) zapcore.Core {
+	return &levelFilterCore{Core: core.Core.With(fields), level: core.level}
+}
+
+func (core *levelFilterCore) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if !core.level.Enabled(entry.Level) {
+		return checked
+	}
+	return core.Core.Check(entry, checked)
+}
+
+// slogCore is a zap core that writes to a slog handler.
+type slogCore struct {
+	handler slog.Handler
+}
+
+func (core *slogCore) Enabled(level zapcore.Level) bool {
+	return core.handler.Enabled(context.Background(), slogLevel(level))
+}
+
+func (core *slogCore) With(fields []zapcore.Field) zapcore.Core {
+	return &slogCore{handler: core.handler.WithAttrs(slogAttrs(fields))}
+}
+
+func (core *slogCore) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if core.Enabled(entry.Level) {
+		return checked.AddCore(entry, core)
+	}
+	return checked
+}
+
+func (core *slogCore) Write(entry zapcore.Entry, fields []zapcore.Field) error {
+	record := slog.NewRecord(entry.Time, slogLevel(entry.Level), entry.Message, entry.Caller.PC)
+	if entry.LoggerName != "" {
+		record.AddAttrs(slog.String("logger", entry.LoggerName))
+	}
+	record.AddAttrs(slogAttrs(fields)...)
+	return core.handler.Handle(context.Background(), record)
+}
+
+func (core *slogCore) Sync() error {
+	return nil
+}
+
+func slogLevel(level zapcore.Level) slog.Level {
+	switch {
+	case level <= zap.DebugLevel:
+		return slog.LevelDebug
+	case level == zap.InfoLevel:
+		return slog.LevelInfo
+	case level == zap.WarnLevel:
+		return slog.LevelWarn
+	default:
+		return slog.LevelError
+	}
+}
+
+func slogAttrs(fields []zapcore.Field) []slog.Attr {
+	encoder := zapcore.NewMapObjectEncoder()
+	for _, field := range fields {
+		field.AddTo(encoder)
+	}
+	attrs := make([]slog.Attr, 0, len(encoder.Fields))
+	for key, value := range encoder.Fields {
+		attrs = append(attrs, slog.Any(key, value))
+	}
+	return attrs
+}
+
 func logDebug(message string, fields map[string]interface{}) {
-	logWithLevel(logLevelDebug, message, fields)
+	logSubsystemWithLevel(logSubsystemServer, logLevelDebug, message, fields)
 }
 
 func logInfo(message string, fields map[string]interface{}) {
-	logWithLevel(logLevelInfo, message, fields)
+	logSubsystemWithLevel(logSubsystemServer, logLevelInfo, message, fields)
 }
 
 func logWarn(message string, fields map[string]interface{}) {
-	logWithLevel(logLevelWarn, message, fields)
+	logSubsystemWithLevel(logSubsystemServer, logLevelWarn, message, fields)
 }
 
 func logError(message string, fields map[string]interface{}) {
-	logWithLevel(logLevelError, message, fields)
+	logSubsystemWithLevel(logSubsystemServer, logLevelError, message, fields)
 }
 
 func logFatal(message string, fields map[string]interface{}) {
-	logWithLevel(logLevelFatal, message, fields)
+	logSubsystemWithLevel(logSubsystemServer, logLevelFatal, message, fields)
 }
 
 func logWithLevel(level int, message string, fields map[string]interface{}) {
+	logSubsystemWithLevel(logSubsystemServer, level, message, fields)
+}
+
+// logSubsystem logs a message of the subsystem.
+func logSubsystem(subsystem string, level int, message string, fields map[string]interface{}) {
+	logSubsystemWithLevel(subsystem, level, message, fields)
+}
+
+func logSubsystemWithLevel(subsystem string, level int, message string, fields map[string]interface{}) {
 	var zapLevel zapcore.Level
 	switch level {
 	case logLevelDebug:
@@ -54,8 +269,13 @@ func logWithLevel(level int, message string, fields map[string]interface{}) {
 	case logLevelFatal:
 		zapLevel = zap.FatalLevel
 	}
-	zapFields := toZapFields(fields)
-	logger.Log(zapLevel, message, zapFields...)
+	logger := (*loggers.Load())[subsystem]
+	if logger == nil {
+		logger = (*loggers.Load())[logSubsystemServer]
+	}
+	if checked := logger.Check(zapLevel, message); checked != nil {
+		checked.Write(toZapFields(fields)...)
+	}
 }
 
 func toZapFields(fields map[string]interface{}) []zap.Field {
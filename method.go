@@ -6,14 +6,30 @@ const (
 	usernamePasswd byte = 0x02
 	ianaAssigned   byte = 0x03
 	reserved       byte = 0x80
-	noAcceptable   byte = 0xFF
+	// tokenAuth is the private method authenticating with a bearer token. See token_auth.go.
+	tokenAuth    byte = 0x80
+	noAcceptable byte = 0xFF
 )
 
-func methodToUseIn(methods []byte) byte {
+// methodToUseIn selects the method from the ones offered by the client.
+// The registered methods are preferred in the order offered by the client.
+// NO AUTHENTICATION REQUIRED is selected only if the server does not require authentication,
+// or the user has already been identified by the TLS client certificate.
+func (socksConnection *socksConnection) methodToUseIn(methods []byte) byte {
+	if socksConnection.authenticatedByCertificate && methodExists(methods, noAuthRequired) {
+		// The user is already known, so RFC 1929 is skipped.
+		return noAuthRequired
+	}
+	server := socksConnection.server
+	for _, method := range methods {
+		if _, ok := server.authMethod(method); ok {
+			return method
+		}
+	}
 	if methodExists(methods, usernamePasswd) {
 		return usernamePasswd
 	}
-	if methodExists(methods, noAuthRequired) {
+	if methodExists(methods, noAuthRequired) && !server.authRequired() {
 		return noAuthRequired
 	}
 	return noAcceptable
@@ -0,0 +1,192 @@
+package mysocks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metricsRegistry holds the metrics of all the servers in the process.
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	metricActiveSessions = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mysocks_active_sessions",
+		Help: "Number of sessions currently processing a command.",
+	}, []string{"command"})
+
+	metricHandshakes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mysocks_handshakes_total",
+		Help: "Number of handshakes by the negotiated method and the result.",
+	}, []string{"method", "result"})
+
+	metricReplies = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mysocks_replies_total",
+		Help: "Number of replies sent by REP code.",
+	}, []string{"rep"})
+
+	metricBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mysocks_bytes_total",
+		Help: "Number of bytes relayed by command and direction (up: client to destination, down: destination to client).",
+	}, []string{"command", "direction"})
+
+	metricConnectDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "mysocks_connect_duration_seconds",
+		Help:    "Time taken to connect to the destination of a CONNECT by result.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 2, 15),
+	}, []string{"result"})
+
+	metricUDPDatagrams = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mysocks_udp_datagrams_total",
+		Help: "Number of UDP datagrams by direction and result.",
+	}, []string{"direction", "result"})
+
+	metricAuthFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mysocks_auth_failures_total",
+		Help: "Number of failed authentications.",
+	})
+
+	metricACLDenials = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mysocks_acl_denials_total",
+		Help: "Number of requests denied by access rules by rule kind.",
+	}, []string{"rule"})
+
+	metricAuthBackendErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mysocks_auth_backend_errors_total",
+		Help: "Number of failures to consult an external authentication backend by backend.",
+	}, []string{"backend"})
+)
+
+// Label values of the metrics.
+const (
+	metricDirectionUp   = "up"
+	metricDirectionDown = "down"
+
+	metricResultSuccess = "success"
+	metricResultFailure = "failure"
+	metricResultTimeout = "timeout"
+
+	metricUDPRelayed = "relayed"
+	metricUDPDropped = "dropped"
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		metricActiveSessions,
+		metricHandshakes,
+		metricReplies,
+		metricBytes,
+		metricConnectDuration,
+		metricUDPDatagrams,
+		metricAuthFailures,
+		metricACLDenials,
+		metricAuthBackendErrors,
+	)
+}
+
+func cmdName(cmd byte) string {
+	switch cmd {
+	case cmdConnect:
+		return "connect"
+	case cmdBind:
+		return "bind"
+	case cmdAssociate:
+		return "udp_associate"
+	case cmdReverseBind:
+		return "reverse_bind"
+	default:
+		return fmt.Sprintf("%#02x", cmd)
+	}
+}
+
+func methodName(method byte) string {
+	switch method {
+	case noAuthRequired:
+		return "no_auth"
+	case gssAPI:
+		return "gssapi"
+	case usernamePasswd:
+		return "username_password"
+	case tokenAuth:
+		return "token"
+	case noAcceptable:
+		return "no_acceptable"
+	default:
+		return fmt.Sprintf("%#02x", method)
+	}
+}
+
+func repName(rep byte) string {
+	switch rep {
+	case repSucceeded:
+		return "succeeded"
+	case repGeneral:
+		return "general_failure"
+	case repDenied:
+		return "not_allowed"
+	case repNetUnreach:
+		return "network_unreachable"
+	case repHostUnreach:
+		return "host_unreachable"
+	case repConnRefused:
+		return "connection_refused"
+	case repTTLExpired:
+		return "ttl_expired"
+	case repCmdNotSupported:
+		return "command_not_supported"
+	case repAddrNotSupported:
+		return "address_type_not_supported"
+	default:
+		return fmt.Sprintf("%#02x", rep)
+	}
+}
+
+// metricsServer serves the metrics over HTTP.
+type metricsServer struct {
+	httpServer *http.Server
+	listener   net.Listener
+}
+
+// listenMetrics binds the metrics server to the address. It is served by serve.
+func listenMetrics(address string) (*metricsServer, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+
+	metricsServer := &metricsServer{
+		httpServer: &http.Server{
+			Handler:           mux,
+			ReadHeaderTimeout: 10 * time.Second,
+		},
+		listener: listener,
+	}
+
+	return metricsServer, nil
+}
+
+// serve serves the metrics until the server is closed.
+func (metricsServer *metricsServer) serve() {
+	logInfo(fmt.Sprintf("Metrics server has been started on %s.", metricsServer.listener.Addr()), nil)
+
+	if err := metricsServer.httpServer.Serve(metricsServer.listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logError(fmt.Sprintf("Failed to serve metrics: %v", err), nil)
+	}
+}
+
+func (metricsServer *metricsServer) close() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := metricsServer.httpServer.Shutdown(ctx); err != nil {
+		logError(fmt.Sprintf("Failed to close metrics server: %v", err), nil)
+	}
+}
@@ -3,6 +3,8 @@ package mysocks
 import (
 	"fmt"
 	"io"
+
+	"github.com/jfuruya/mysocks/socks5wire"
 )
 
 type negotiationReply struct {
@@ -20,13 +22,13 @@ func newNegotiationReply(method byte, socksConnection *socksConnection) *negotia
 }
 
 func (negotiationReply *negotiationReply) WriteTo(w io.Writer) (int64, error) {
-	n, err := w.Write([]byte{negotiationReply.ver, negotiationReply.method})
+	n, err := w.Write(socks5wire.AppendNegotiationReply(nil, socks5wire.NegotiationReply{Method: negotiationReply.method}))
 	if err != nil {
 		return 0, err
 	}
 
-	negotiationReply.socksConnection.logWithLevel(logLevelInfo,
-		fmt.Sprintf("Negotiation reply sent. VER: %#v METHOD: %#v", negotiationReply.ver, negotiationReply.method))
+	negotiationReply.socksConnection.logSubsystem(logSubsystemHandshake, logLevelInfo,
+		fmt.Sprintf("Negotiation reply sent. VER: %#v METHOD: %#v", negotiationReply.ver, negotiationReply.method), nil)
 
 	return int64(n), nil
 }
@@ -3,7 +3,8 @@ package mysocks
 import (
 	"errors"
 	"fmt"
-	"io"
+
+	"github.com/jfuruya/mysocks/socks5wire"
 )
 
 var errNegotiationMethodNotSupported = errors.New("the method is not supported")
@@ -16,34 +17,18 @@ type negotiationRequest struct {
 }
 
 func newNegotiationRequestFrom(socksConnection *socksConnection) (*negotiationRequest, error) {
-	reader := *socksConnection.clientTCPConn
-
-	verBytes := make([]byte, 1)
-	if _, err := io.ReadFull(reader, verBytes); err != nil {
-		return nil, err
-	}
-	ver := verBytes[0]
-	if ver != fiexedVer {
-		return nil, fmt.Errorf("the value of the VER field in the negotiation request is invalid: %d", ver)
-	}
-
-	nmethodsBytes := make([]byte, 1)
-	if _, err := io.ReadFull(reader, nmethodsBytes); err != nil {
-		return nil, err
-	}
-	nmethods := nmethodsBytes[0]
-	if nmethods == 0 {
-		return nil, fmt.Errorf("the value of the NMETHODS field in the negotiation request is invalid: %d", nmethods)
-	}
-	methods := make([]byte, int(nmethods))
-	if _, err := io.ReadFull(reader, methods); err != nil {
+	message, err := socks5wire.ReadNegotiationRequest(*socksConnection.clientTCPConn, make([]byte, socks5wire.MaxNegotiationRequestLen))
+	if err != nil {
 		return nil, err
 	}
+	ver := socks5wire.Version
+	nmethods := byte(len(message.Methods))
+	methods := message.Methods
 
-	socksConnection.logWithLevel(logLevelInfo,
-		fmt.Sprintf("A negotiation request has been received. VER: %#v NMETHODS: %#v METHOS: %#v", ver, nmethods, methods))
+	socksConnection.logSubsystem(logSubsystemHandshake, logLevelInfo,
+		fmt.Sprintf("A negotiation request has been received. VER: %#v NMETHODS: %#v METHOS: %#v", ver, nmethods, methods), nil)
 
-	methodToUse := methodToUseIn(methods)
+	methodToUse := socksConnection.methodToUseIn(methods)
 
 	if methodToUse == noAcceptable {
 		return nil, errNegotiationMethodNotSupported
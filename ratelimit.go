@@ -0,0 +1,353 @@
+package mysocks
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimit is a bandwidth limit in bytes per second. Zero means no limit.
+type rateLimit struct {
+	Upload   int64 `json:"upload"`
+	Download int64 `json:"download"`
+	// UploadBurst and DownloadBurst are the bytes that can be sent at once after an idle period.
+	// Zero means one second worth of the rate.
+	UploadBurst   int64 `json:"uploadBurst"`
+	DownloadBurst int64 `json:"downloadBurst"`
+}
+
+// rateLimits are the bandwidth limits of the configuration file.
+// Each of them is shared by the sessions in its scope.
+type rateLimits struct {
+	// Global is shared by all the sessions.
+	Global rateLimit `json:"global"`
+	// ClientIP is shared by the sessions from the same client IP.
+	ClientIP rateLimit `json:"clientIP"`
+	// User is shared by the sessions of the same authenticated user.
+	User rateLimit `json:"user"`
+	// Session applies to each session.
+	Session rateLimit `json:"session"`
+}
+
+// userRateLimits are the bandwidth limits overridden for one user.
+type userRateLimits struct {
+	User    rateLimit `json:"user"`
+	Session rateLimit `json:"session"`
+}
+
+// overriddenBy returns the limit with the non-zero values of the given one applied.
+func (limit rateLimit) overriddenBy(other rateLimit) rateLimit {
+	if other.Upload != 0 {
+		limit.Upload = other.Upload
+	}
+	if other.Download != 0 {
+		limit.Download = other.Download
+	}
+	if other.UploadBurst != 0 {
+		limit.UploadBurst = other.UploadBurst
+	}
+	if other.DownloadBurst != 0 {
+		limit.DownloadBurst = other.DownloadBurst
+	}
+	return limit
+}
+
+// relayDirection is the direction of the data: up is from the client to the destination,
+// and down is from the destination to the client.
+type relayDirection int
+
+const (
+	relayUp relayDirection = iota
+	relayDown
+)
+
+// tokenBucket limits the rate of bytes. The tokens may become negative so that a chunk larger than
+// the available tokens can be sent, and the debt is paid by waiting afterwards.
+type tokenBucket struct {
+	mutex sync.Mutex
+	// rate is in bytes per second. Zero means no limit.
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int64, burst int64) *tokenBucket {
+	bucket := &tokenBucket{last: time.Now()}
+	bucket.set(rate, burst)
+	bucket.tokens = bucket.burst
+	return bucket
+}
+
+// set changes the rate and the burst, keeping the tokens already accumulated up to the new burst.
+func (bucket *tokenBucket) set(rate int64, burst int64) {
+	bucket.mutex.Lock()
+	defer bucket.mutex.Unlock()
+	bucket.refillLocked(time.Now())
+	if burst <= 0 {
+		burst = rate
+	}
+	bucket.rate = float64(rate)
+	bucket.burst = float64(burst)
+	if bucket.tokens > bucket.burst {
+		bucket.tokens = bucket.burst
+	}
+}
+
+func (bucket *tokenBucket) refillLocked(now time.Time) {
+	bucket.tokens += now.Sub(bucket.last).Seconds() * bucket.rate
+	if bucket.tokens > bucket.burst {
+		bucket.tokens = bucket.burst
+	}
+	bucket.last = now
+}
+
+// take removes n tokens and returns how long to wait until the bucket is out of debt.
+func (bucket *tokenBucket) take(n int64) time.Duration {
+	bucket.mutex.Lock()
+	defer bucket.mutex.Unlock()
+	if bucket.rate <= 0 {
+		return 0
+	}
+	bucket.refillLocked(time.Now())
+	bucket.tokens -= float64(n)
+	return bucket.delayLocked()
+}
+
+// delay returns how long to wait until the bucket is out of debt.
+func (bucket *tokenBucket) delay() time.Duration {
+	bucket.mutex.Lock()
+	defer bucket.mutex.Unlock()
+	if bucket.rate <= 0 {
+		return 0
+	}
+	bucket.refillLocked(time.Now())
+	return bucket.delayLocked()
+}
+
+func (bucket *tokenBucket) delayLocked() time.Duration {
+	if bucket.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-bucket.tokens / bucket.rate * float64(time.Second))
+}
+
+// tryTake removes n tokens if they are available, and reports whether they were.
+// n larger than the burst is taken when the bucket is full, going into debt, since it would never be available otherwise.
+func (bucket *tokenBucket) tryTake(n int64) bool {
+	bucket.mutex.Lock()
+	defer bucket.mutex.Unlock()
+	if bucket.rate <= 0 {
+		return true
+	}
+	bucket.refillLocked(time.Now())
+	if bucket.tokens < min(float64(n), bucket.burst) {
+		return false
+	}
+	bucket.tokens -= float64(n)
+	return true
+}
+
+// refund gives back n tokens taken by tryTake.
+func (bucket *tokenBucket) refund(n int64) {
+	bucket.mutex.Lock()
+	defer bucket.mutex.Unlock()
+	if bucket.rate <= 0 {
+		return
+	}
+	bucket.tokens = min(bucket.tokens+float64(n), bucket.burst)
+}
+
+// chunkSize returns the largest amount of data worth sending at once, or 0 if there is no limit.
+// It is bounded by one second worth of the rate so that the wait after a chunk stays short.
+func (bucket *tokenBucket) chunkSize() int64 {
+	bucket.mutex.Lock()
+	defer bucket.mutex.Unlock()
+	if bucket.rate <= 0 {
+		return 0
+	}
+	size := min(bucket.burst, bucket.rate)
+	return max(int64(size), 1)
+}
+
+// bandwidthBuckets are the buckets of both directions of a rate limit.
+type bandwidthBuckets struct {
+	up   *tokenBucket
+	down *tokenBucket
+}
+
+func newBandwidthBuckets(limit rateLimit) *bandwidthBuckets {
+	return &bandwidthBuckets{
+		up:   newTokenBucket(limit.Upload, limit.UploadBurst),
+		down: newTokenBucket(limit.Download, limit.DownloadBurst),
+	}
+}
+
+func (buckets *bandwidthBuckets) set(limit rateLimit) {
+	buckets.up.set(limit.Upload, limit.UploadBurst)
+	buckets.down.set(limit.Download, limit.DownloadBurst)
+}
+
+func (buckets *bandwidthBuckets) bucket(direction relayDirection) *tokenBucket {
+	if direction == relayUp {
+		return buckets.up
+	}
+	return buckets.down
+}
+
+// sharedBandwidthBuckets are buckets shared by sessions, removed when the last of them ends.
+type sharedBandwidthBuckets struct {
+	buckets  *bandwidthBuckets
+	sessions int
+}
+
+// rateLimiters is the registry of the buckets of the active sessions.
+// The rate limits can be changed at runtime with apply.
+type rateLimiters struct {
+	mutex      sync.Mutex
+	config     *config
+	global     *bandwidthBuckets
+	byClientIP map[string]*sharedBandwidthBuckets
+	byUser     map[string]*sharedBandwidthBuckets
+	sessions   map[*sessionRateLimiter]struct{}
+}
+
+func newRateLimiters(config *config) *rateLimiters {
+	return &rateLimiters{
+		config:     config,
+		global:     newBandwidthBuckets(config.RateLimits.Global),
+		byClientIP: make(map[string]*sharedBandwidthBuckets),
+		byUser:     make(map[string]*sharedBandwidthBuckets),
+		sessions:   make(map[*sessionRateLimiter]struct{}),
+	}
+}
+
+// apply changes the rate limits of all the buckets, including the ones of the active sessions.
+func (rateLimiters *rateLimiters) apply(config *config) {
+	rateLimiters.mutex.Lock()
+	defer rateLimiters.mutex.Unlock()
+	rateLimiters.config = config
+	rateLimiters.global.set(config.RateLimits.Global)
+	for _, shared := range rateLimiters.byClientIP {
+		shared.buckets.set(config.RateLimits.ClientIP)
+	}
+	for userName, shared := range rateLimiters.byUser {
+		shared.buckets.set(config.userRateLimit(userName))
+	}
+	for limiter := range rateLimiters.sessions {
+		limiter.session.set(config.sessionRateLimit(limiter.userName).overriddenBy(limiter.override))
+	}
+}
+
+// newSessionRateLimiter returns the limiter of a session. It must be released when the session ends.
+// An empty user name means an unauthenticated session, to which no user limit applies.
+// override is the session limit given by an external authenticator, which takes precedence over the configuration.
+func (rateLimiters *rateLimiters) newSessionRateLimiter(userName string, clientIP string, override rateLimit) *sessionRateLimiter {
+	rateLimiters.mutex.Lock()
+	defer rateLimiters.mutex.Unlock()
+	config := rateLimiters.config
+	limiter := &sessionRateLimiter{
+		userName: userName,
+		clientIP: clientIP,
+		override: override,
+		session:  newBandwidthBuckets(config.sessionRateLimit(userName).overriddenBy(override)),
+	}
+	limiter.buckets = []*bandwidthBuckets{
+		limiter.session,
+		acquireSharedBuckets(rateLimiters.byClientIP, clientIP, config.RateLimits.ClientIP),
+		rateLimiters.global,
+	}
+	if userName != "" {
+		limiter.buckets = append(limiter.buckets, acquireSharedBuckets(rateLimiters.byUser, userName, config.userRateLimit(userName)))
+	}
+	rateLimiters.sessions[limiter] = struct{}{}
+	return limiter
+}
+
+func (rateLimiters *rateLimiters) release(limiter *sessionRateLimiter) {
+	rateLimiters.mutex.Lock()
+	defer rateLimiters.mutex.Unlock()
+	if _, ok := rateLimiters.sessions[limiter]; !ok {
+		return
+	}
+	delete(rateLimiters.sessions, limiter)
+	releaseSharedBuckets(rateLimiters.byClientIP, limiter.clientIP)
+	if limiter.userName != "" {
+		releaseSharedBuckets(rateLimiters.byUser, limiter.userName)
+	}
+}
+
+func acquireSharedBuckets(sharedBuckets map[string]*sharedBandwidthBuckets, key string, limit rateLimit) *bandwidthBuckets {
+	shared, ok := sharedBuckets[key]
+	if !ok {
+		shared = &sharedBandwidthBuckets{buckets: newBandwidthBuckets(limit)}
+		sharedBuckets[key] = shared
+	}
+	shared.sessions++
+	return shared.buckets
+}
+
+func releaseSharedBuckets(sharedBuckets map[string]*sharedBandwidthBuckets, key string) {
+	shared, ok := sharedBuckets[key]
+	if !ok {
+		return
+	}
+	shared.sessions--
+	if shared.sessions <= 0 {
+		delete(sharedBuckets, key)
+	}
+}
+
+// sessionRateLimiter applies all the rate limits concerning one session.
+type sessionRateLimiter struct {
+	userName string
+	clientIP string
+	override rateLimit
+	session  *bandwidthBuckets
+	// buckets are the buckets of the session, the client IP, the whole server and the user if any.
+	buckets []*bandwidthBuckets
+}
+
+// rateLimitCheckInterval is how often a waiting session checks whether the rate limits have been changed.
+const rateLimitCheckInterval = 100 * time.Millisecond
+
+// wait takes n bytes from every bucket and sleeps until all of them are out of debt.
+// It is used for TCP, where the data is slowed down.
+func (limiter *sessionRateLimiter) wait(direction relayDirection, n int64) {
+	var delay time.Duration
+	for _, buckets := range limiter.buckets {
+		delay = max(delay, buckets.bucket(direction).take(n))
+	}
+	for delay > 0 {
+		time.Sleep(min(delay, rateLimitCheckInterval))
+		delay = 0
+		for _, buckets := range limiter.buckets {
+			delay = max(delay, buckets.bucket(direction).delay())
+		}
+	}
+}
+
+// allow takes n bytes from every bucket if all of them have enough, and reports whether they had.
+// When a bucket does not have enough, the bytes already taken from the others are refunded.
+// It is used for UDP, where the datagrams over the limit are dropped.
+func (limiter *sessionRateLimiter) allow(direction relayDirection, n int64) bool {
+	for i, buckets := range limiter.buckets {
+		if !buckets.bucket(direction).tryTake(n) {
+			for _, taken := range limiter.buckets[:i] {
+				taken.bucket(direction).refund(n)
+			}
+			return false
+		}
+	}
+	return true
+}
+
+// chunkSize returns the largest amount of data worth sending at once, or 0 if there is no limit.
+func (limiter *sessionRateLimiter) chunkSize(direction relayDirection) int64 {
+	var size int64
+	for _, buckets := range limiter.buckets {
+		if bucketSize := buckets.bucket(direction).chunkSize(); bucketSize > 0 && (size == 0 || bucketSize < size) {
+			size = bucketSize
+		}
+	}
+	return size
+}
@@ -0,0 +1,168 @@
+package mysocks
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	bucket := newTokenBucket(1000, 500)
+
+	if delay := bucket.take(500); delay != 0 {
+		t.Fatalf("The burst should be available at once, but the delay is %v", delay)
+	}
+	if delay := bucket.take(500); delay < 450*time.Millisecond || delay > 500*time.Millisecond {
+		t.Fatalf("About 500ms of delay expected, but got %v", delay)
+	}
+	if bucket.tryTake(1) {
+		t.Fatal("No token is expected while the bucket is in debt")
+	}
+
+	bucket.set(0, 0)
+	if delay := bucket.take(1 << 30); delay != 0 || !bucket.tryTake(1<<30) {
+		t.Fatalf("No limit is expected with a zero rate, but the delay is %v", delay)
+	}
+
+	if size := newTokenBucket(1000, 0).chunkSize(); size != 1000 {
+		t.Fatalf("The burst should default to the rate, but the chunk size is %d", size)
+	}
+}
+
+func TestSessionRateLimiterAllow(t *testing.T) {
+	var config config
+	config.RateLimits.Session = rateLimit{Upload: 1000, UploadBurst: 1000}
+	config.RateLimits.ClientIP = rateLimit{Upload: 1000, UploadBurst: 300}
+	rateLimiters := newRateLimiters(&config)
+	limiter := rateLimiters.newSessionRateLimiter("", "192.0.2.1", rateLimit{})
+	defer rateLimiters.release(limiter)
+
+	// The client IP bucket denies, and the session bucket taken before it is refunded.
+	if !limiter.allow(relayUp, 200) {
+		t.Fatal("200 bytes expected to be allowed")
+	}
+	if limiter.allow(relayUp, 200) {
+		t.Fatal("200 bytes expected to be denied by the client IP limit")
+	}
+	if delay := limiter.session.up.take(800); delay != 0 {
+		t.Fatalf("The session bucket expected to have been refunded, but the delay is %v", delay)
+	}
+
+	// A datagram larger than the burst passes once the bucket is full, instead of being dropped forever.
+	oversized := newTokenBucket(1000, 100)
+	if !oversized.tryTake(maxUDPPayloadSize) {
+		t.Fatal("A datagram larger than the burst expected to be allowed when the bucket is full")
+	}
+	if oversized.tryTake(1) {
+		t.Fatal("No token is expected while the bucket is in debt")
+	}
+}
+
+func writeConfig(t *testing.T, path string, content string) {
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// transferTime returns the time taken to echo size bytes through conn.
+func transferTime(t *testing.T, conn net.Conn, size int) time.Duration {
+	startedAt := time.Now()
+	go conn.Write(make([]byte, size))
+	if _, err := io.ReadFull(conn, make([]byte, size)); err != nil {
+		t.Fatal(err)
+	}
+	return time.Since(startedAt)
+}
+
+func TestRateLimitedConnectAndReload(t *testing.T) {
+	configPath := t.TempDir() + "/config.json"
+	writeConfig(t, configPath, `{"rateLimits": {"session": {"download": 100000}}}`)
+	os.Setenv("MYSOCKS_CONFIG", configPath)
+	defer os.Setenv("MYSOCKS_CONFIG", "")
+
+	StartServer()
+	defer StopServer()
+
+	echoServer := startEchoServer(t)
+	defer echoServer.Close()
+
+	dialer := dialerThrough("", "")
+	conn, err := dialer.Dial("tcp", echoServer.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// The burst of 100KB and the first chunk of 100KB are sent at once, and the next 100KB take a second.
+	if elapsed := transferTime(t, conn, 300000); elapsed < 800*time.Millisecond {
+		t.Fatalf("The download should be limited, but it took %v", elapsed)
+	}
+
+	writeConfig(t, configPath, `{}`)
+	if err := server.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The debt left by the previous transfer is forgiven when the limit is removed.
+	if elapsed := transferTime(t, conn, 1000000); elapsed > 500*time.Millisecond {
+		t.Fatalf("The limit should be removed by the reload, but it took %v", elapsed)
+	}
+}
+
+func TestRateLimitedUDPAssociate(t *testing.T) {
+	configPath := t.TempDir() + "/config.json"
+	writeConfig(t, configPath, `{"rateLimits": {"clientIP": {"upload": 1000}}}`)
+	os.Setenv("MYSOCKS_CONFIG", configPath)
+	defer os.Setenv("MYSOCKS_CONFIG", "")
+
+	StartServer()
+	defer StopServer()
+
+	echoServer := startUDPEchoServer(t)
+	defer echoServer.Close()
+	echoAddr := echoServer.LocalAddr().(*net.UDPAddr)
+
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpConn.Close()
+
+	tcpConn, err := associateUDP(udpConn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpConn.Close()
+
+	proxyUDPAddr, err := net.ResolveUDPAddr("udp", proxyAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header := []byte{0x00, 0x00, 0x00, atypIPv4}
+	header = append(header, echoAddr.IP.To4()...)
+	header = binary.BigEndian.AppendUint16(header, uint16(echoAddr.Port))
+
+	// Only the first datagram fits in the burst of 1000 bytes.
+	for i := 0; i < 3; i++ {
+		if _, err := udpConn.WriteToUDP(append(header, make([]byte, 600)...), proxyUDPAddr); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	received := 0
+	buf := make([]byte, 2048)
+	for {
+		udpConn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		if _, _, err := udpConn.ReadFromUDP(buf); err != nil {
+			break
+		}
+		received++
+	}
+	if received != 1 {
+		t.Fatalf("1 datagram expected within the rate limit, but got %d", received)
+	}
+}
@@ -0,0 +1,173 @@
+package mysocks
+
+import (
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+const redacted = "[REDACTED]"
+
+// sensitiveLogKeys are the field keys whose values are never logged.
+var sensitiveLogKeys = []string{"passwd", "password", "token", "secret", "authorization", "credential"}
+
+// secretPatterns match the secrets written in the messages and in the values of the other fields,
+// such as "password=..." echoed by an authentication backend or the password in a URL.
+// The first group of each pattern is kept.
+var secretPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)((?:` + strings.Join(sensitiveLogKeys, "|") + `)\w*["']?\s*[:=]\s*["']?(?:bearer\s+|basic\s+)?)[^\s"'&,;]+`),
+	regexp.MustCompile(`(://[^/\s:@]+:)[^/\s@]+@`),
+}
+
+// payloadLogKeys are the field keys holding the contents of the relayed data.
+var payloadLogKeys = map[string]bool{"data": true, "payload": true}
+
+// payloadLogSettings controls whether payloads are logged.
+// Payloads are redacted unless MYSOCKS_LOG_PAYLOADS is "true", which is meant only for troubleshooting.
+type payloadLogSettings struct {
+	enabled  bool
+	maxBytes int
+}
+
+var currentPayloadLogSettings = payloadLogSettingsFromEnv()
+
+func payloadLogSettingsFromEnv() payloadLogSettings {
+	return payloadLogSettings{
+		enabled:  env("MYSOCKS_LOG_PAYLOADS", "") == "true",
+		maxBytes: intEnv("MYSOCKS_LOG_PAYLOAD_MAX_BYTES", 256),
+	}
+}
+
+// warnIfPayloadsAreLogged makes it obvious in the logs that payloads are being captured.
+func warnIfPayloadsAreLogged() {
+	if currentPayloadLogSettings.enabled {
+		logWarn(fmt.Sprintf("PAYLOAD LOGGING IS ENABLED. Up to %d bytes of every relayed payload are written to the logs. "+
+			"Unset MYSOCKS_LOG_PAYLOADS when the troubleshooting is over.", currentPayloadLogSettings.maxBytes), nil)
+	}
+}
+
+func isSensitiveLogKey(key string) bool {
+	lowerKey := strings.ToLower(key)
+	for _, sensitiveKey := range sensitiveLogKeys {
+		if strings.Contains(lowerKey, sensitiveKey) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactSecrets replaces the secrets matched by secretPatterns in the text.
+func redactSecrets(text string) string {
+	for _, pattern := range secretPatterns {
+		text = pattern.ReplaceAllString(text, "${1}"+redacted)
+	}
+	return text
+}
+
+// redactSecret replaces the secret, such as the password given by the client, everywhere in the text.
+func redactSecret(text string, secret string) string {
+	if secret == "" {
+		return text
+	}
+	return strings.ReplaceAll(text, secret, redacted)
+}
+
+// payloadForLog returns the size of the payload, or a hex dump of it capped to the maximum size
+// if payload logging is enabled.
+func payloadForLog(payload []byte) string {
+	settings := currentPayloadLogSettings
+	if !settings.enabled {
+		return fmt.Sprintf("%s (%d bytes)", redacted, len(payload))
+	}
+	if len(payload) > settings.maxBytes {
+		return fmt.Sprintf("%s... (%d of %d bytes)", hex.EncodeToString(payload[:settings.maxBytes]), settings.maxBytes, len(payload))
+	}
+	return hex.EncodeToString(payload)
+}
+
+func redactLogField(field zapcore.Field) zapcore.Field {
+	if isSensitiveLogKey(field.Key) {
+		return zap.String(field.Key, redacted)
+	}
+	if payloadLogKeys[strings.ToLower(field.Key)] {
+		switch field.Type {
+		case zapcore.BinaryType, zapcore.ByteStringType:
+			if payload, ok := field.Interface.([]byte); ok {
+				return zap.String(field.Key, payloadForLog(payload))
+			}
+		}
+		return zap.String(field.Key, redacted)
+	}
+	switch field.Type {
+	case zapcore.StringType:
+		field.String = redactSecrets(field.String)
+	case zapcore.ErrorType:
+		if err, ok := field.Interface.(error); ok {
+			return zap.String(field.Key, redactSecrets(err.Error()))
+		}
+	}
+	return field
+}
+
+func redactLogFields(fields []zapcore.Field) []zapcore.Field {
+	redactedFields := make([]zapcore.Field, len(fields))
+	for i, field := range fields {
+		redactedFields[i] = redactLogField(field)
+	}
+	return redactedFields
+}
+
+// redactingCore removes the secrets and the payloads from the messages and the fields before they reach the wrapped core.
+type redactingCore struct {
+	zapcore.Core
+}
+
+func (core *redactingCore) With(fields []zapcore.Field) zapcore.Core {
+	return &redactingCore{Core: core.Core.With(redactLogFields(fields))}
+}
+
+// Check lets the wrapped core decide, so that the levels and the sampling of its own cores apply,
+// and redacts the fields before the entry is written to the cores it has chosen.
+func (core *redactingCore) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	entry.Message = redactSecrets(entry.Message)
+	inner := core.Core.Check(entry, nil)
+	if inner == nil {
+		return checked
+	}
+	return checked.AddCore(entry, &redactedEntryCore{checked: inner})
+}
+
+func (core *redactingCore) Write(entry zapcore.Entry, fields []zapcore.Field) error {
+	entry.Message = redactSecrets(entry.Message)
+	return core.Core.Write(entry, redactLogFields(fields))
+}
+
+// redactedEntryCore writes an entry checked by the core wrapped by redactingCore, with the fields redacted.
+type redactedEntryCore struct {
+	checked *zapcore.CheckedEntry
+}
+
+func (core *redactedEntryCore) Enabled(zapcore.Level) bool {
+	return true
+}
+
+func (core *redactedEntryCore) With([]zapcore.Field) zapcore.Core {
+	return core
+}
+
+func (core *redactedEntryCore) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	return checked.AddCore(entry, core)
+}
+
+func (core *redactedEntryCore) Write(_ zapcore.Entry, fields []zapcore.Field) error {
+	core.checked.Write(redactLogFields(fields)...)
+	return nil
+}
+
+func (core *redactedEntryCore) Sync() error {
+	return nil
+}
@@ -0,0 +1,214 @@
+package mysocks
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// relayBufferSize is the size of the buffers used when the kernel can not
+// splice between the two connections.
+const relayBufferSize = 32 * 1024
+
+// relayChunkSize is the amount of data copied between two checks of the idle timeout.
+const relayChunkSize = 1024 * 1024
+
+// relayProgressInterval is how often the progress of a relay is reported while data is flowing slowly.
+const relayProgressInterval = time.Second
+
+var relayBufferPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, relayBufferSize)
+		return &buf
+	},
+}
+
+var errRelayIdleTimeout = errors.New("the relay has been idle for too long")
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// relayResult is the outcome of one direction of a relay.
+type relayResult struct {
+	written int64
+	err     error
+}
+
+// relayState is shared by both directions of a relay.
+type relayState struct {
+	idleTimeout time.Duration
+	// rateLimiter slows the data down if it is not nil.
+	rateLimiter *sessionRateLimiter
+	// progress is called with the number of bytes copied up and down since the last call.
+	progress func(up int64, down int64)
+	// lastActivity is the time of the last data in any direction, in Unix nanoseconds.
+	lastActivity atomic.Int64
+}
+
+func (state *relayState) touch() {
+	state.lastActivity.Store(time.Now().UnixNano())
+}
+
+func (state *relayState) idleFor() time.Duration {
+	return time.Since(time.Unix(0, state.lastActivity.Load()))
+}
+
+// relay copies data between the client and the destination in both directions
+// until both of them are done. When one side finishes sending, the write side
+// of the other is closed so that the half-close is propagated.
+// If idleTimeout is positive, the relay fails with errRelayIdleTimeout once no data
+// has been transferred in either direction for that long.
+// If rateLimiter is not nil, the data is slowed down to its rate limits.
+// If progress is not nil, it is called while the relay runs with the bytes copied since the last call,
+// at least every relayProgressInterval while data is flowing.
+// It returns the number of bytes sent from the client to the destination (up)
+// and from the destination to the client (down).
+func relay(clientConn net.Conn, destConn net.Conn, idleTimeout time.Duration, rateLimiter *sessionRateLimiter,
+	progress func(up int64, down int64)) (up int64, down int64, err error) {
+	if progress == nil {
+		progress = func(int64, int64) {}
+	}
+	state := &relayState{idleTimeout: idleTimeout, rateLimiter: rateLimiter, progress: progress}
+	state.touch()
+
+	upResult := make(chan relayResult, 1)
+	downResult := make(chan relayResult, 1)
+
+	go func() {
+		upResult <- state.relayOneWay(destConn, clientConn, relayUp)
+	}()
+	go func() {
+		downResult <- state.relayOneWay(clientConn, destConn, relayDown)
+	}()
+
+	for i := 0; i < 2; i++ {
+		var result relayResult
+		select {
+		case result = <-upResult:
+			upResult = nil
+			up = result.written
+		case result = <-downResult:
+			downResult = nil
+			down = result.written
+		}
+		if result.err != nil && err == nil {
+			err = result.err
+			// The other direction can not complete anymore.
+			clientConn.Close()
+			destConn.Close()
+		}
+	}
+	return up, down, err
+}
+
+func (state *relayState) relayOneWay(dst net.Conn, src net.Conn, direction relayDirection) relayResult {
+	written, err := state.copy(dst, src, direction)
+	if err == nil {
+		if cw, ok := dst.(closeWriter); ok {
+			err = cw.CloseWrite()
+		} else {
+			err = dst.Close()
+		}
+		if errors.Is(err, net.ErrClosed) {
+			err = nil
+		}
+	}
+	return relayResult{written: written, err: err}
+}
+
+// copy copies from src to dst until EOF.
+// The data is copied in chunks, and the read deadline of src is extended before each of them,
+// so that the idle timeout is checked, the progress is reported and the rate limits are applied regularly.
+func (state *relayState) copy(dst net.Conn, src net.Conn, direction relayDirection) (int64, error) {
+	// The activity is recorded only when a chunk returns, so each direction wakes up at least twice in the idle
+	// timeout. Otherwise the idle direction could see the activity of the other one too late.
+	readTimeout := relayProgressInterval
+	if state.idleTimeout > 0 && state.idleTimeout/2 < readTimeout {
+		readTimeout = state.idleTimeout / 2
+	}
+
+	var written int64
+	for {
+		if err := src.SetReadDeadline(time.Now().Add(readTimeout)); err != nil {
+			return written, err
+		}
+		n, err := copyConn(dst, src, state.chunkSize(direction))
+		written += n
+		if n > 0 {
+			state.touch()
+			state.reportProgress(direction, n)
+			if state.rateLimiter != nil {
+				state.rateLimiter.wait(direction, n)
+				// Waiting for the rate limit is not idling.
+				state.touch()
+			}
+		}
+		if err == io.EOF {
+			return written, nil
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			// Only this direction is idle. Keep waiting while the other one is active.
+			if n > 0 || state.idleTimeout <= 0 || state.idleFor() < state.idleTimeout {
+				continue
+			}
+			return written, errRelayIdleTimeout
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+// chunkSize returns the amount of data copied at most before the next check.
+// The rate limits may make it smaller than relayChunkSize.
+func (state *relayState) chunkSize(direction relayDirection) int64 {
+	if state.rateLimiter != nil {
+		if size := state.rateLimiter.chunkSize(direction); size > 0 && size < relayChunkSize {
+			return size
+		}
+	}
+	return relayChunkSize
+}
+
+func (state *relayState) reportProgress(direction relayDirection, n int64) {
+	if direction == relayUp {
+		state.progress(n, 0)
+	} else {
+		state.progress(0, n)
+	}
+}
+
+// copyConn copies from src to dst until EOF, or at most limit bytes if limit is not negative.
+// When limit is reached, the returned error is nil, otherwise reaching EOF is reported as io.EOF
+// if limit is not negative. Between two TCP connections the runtime can use splice(2) on Linux;
+// otherwise a pooled buffer is used.
+func copyConn(dst net.Conn, src net.Conn, limit int64) (int64, error) {
+	var reader io.Reader = src
+	if limit >= 0 {
+		reader = io.LimitReader(src, limit)
+	}
+
+	var written int64
+	var err error
+
+	_, dstIsTCP := dst.(*net.TCPConn)
+	_, srcIsTCP := src.(*net.TCPConn)
+	if dstIsTCP && srcIsTCP {
+		written, err = io.Copy(dst, reader)
+	} else {
+		buf := relayBufferPool.Get().(*[]byte)
+		// Hide ReadFrom and WriteTo so that io.CopyBuffer really uses the pooled buffer.
+		written, err = io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{reader}, *buf)
+		relayBufferPool.Put(buf)
+	}
+
+	if limit >= 0 && err == nil && written < limit {
+		return written, io.EOF
+	}
+	return written, err
+}
@@ -0,0 +1,127 @@
+package mysocks
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// tcpConnPair returns the two ends of a TCP connection over the loopback.
+func tcpConnPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	dialed, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		dialed.Close()
+		accepted.Close()
+	})
+	return dialed.(*net.TCPConn), accepted.(*net.TCPConn)
+}
+
+// bufferedConn hides *net.TCPConn from copyConn, so that the pooled buffer is used instead of splice(2).
+type bufferedConn struct {
+	*net.TCPConn
+}
+
+type relayOutcome struct {
+	up   int64
+	down int64
+	err  error
+}
+
+// startRelay relays between two new connections, and returns the ends of the client and the destination.
+func startRelay(t *testing.T, spliced bool, idleTimeout time.Duration) (*net.TCPConn, *net.TCPConn, chan relayOutcome) {
+	clientApp, clientConn := tcpConnPair(t)
+	destConn, destApp := tcpConnPair(t)
+	var relayedClient, relayedDest net.Conn = clientConn, destConn
+	if !spliced {
+		relayedClient, relayedDest = bufferedConn{clientConn}, bufferedConn{destConn}
+	}
+	outcome := make(chan relayOutcome, 1)
+	go func() {
+		up, down, err := relay(relayedClient, relayedDest, idleTimeout, nil, nil)
+		outcome <- relayOutcome{up, down, err}
+	}()
+	return clientApp, destApp, outcome
+}
+
+func TestRelayHalfClose(t *testing.T) {
+	for _, spliced := range []bool{true, false} {
+		clientApp, destApp, outcome := startRelay(t, spliced, 0)
+		clientApp.SetDeadline(time.Now().Add(10 * time.Second))
+		destApp.SetDeadline(time.Now().Add(10 * time.Second))
+
+		// The destination finishes sending. The data buffered before CloseWrite still reach the client.
+		destApp.Write([]byte("buffered data"))
+		destApp.CloseWrite()
+		received, err := io.ReadAll(clientApp)
+		if err != nil || string(received) != "buffered data" {
+			t.Fatalf("spliced %v: the data and EOF expected, but got %q: %v", spliced, received, err)
+		}
+
+		// The other direction stays open.
+		clientApp.Write([]byte("still open"))
+		clientApp.CloseWrite()
+		received, err = io.ReadAll(destApp)
+		if err != nil || string(received) != "still open" {
+			t.Fatalf("spliced %v: the data and EOF expected, but got %q: %v", spliced, received, err)
+		}
+
+		select {
+		case result := <-outcome:
+			if result.err != nil || result.up != int64(len("still open")) || result.down != int64(len("buffered data")) {
+				t.Fatalf("spliced %v: unexpected result: %+v", spliced, result)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("spliced %v: the relay expected to finish", spliced)
+		}
+	}
+}
+
+func TestRelayIdleTimeout(t *testing.T) {
+	const idleTimeout = 300 * time.Millisecond
+	for _, spliced := range []bool{true, false} {
+		clientApp, destApp, outcome := startRelay(t, spliced, idleTimeout)
+
+		// Each chunk re-arms the deadline, so the relay outlives the idle timeout while data are flowing,
+		// although the client sends nothing.
+		go io.Copy(io.Discard, clientApp)
+		for i := 0; i < 8; i++ {
+			destApp.Write([]byte("chunk"))
+			time.Sleep(idleTimeout / 3)
+			select {
+			case result := <-outcome:
+				t.Fatalf("spliced %v: the relay expected to be active, but finished: %+v", spliced, result)
+			default:
+			}
+		}
+
+		startedIdling := time.Now()
+		select {
+		case result := <-outcome:
+			if !errors.Is(result.err, errRelayIdleTimeout) {
+				t.Fatalf("spliced %v: the idle timeout expected, but got %v", spliced, result.err)
+			}
+			if idle := time.Since(startedIdling); idle > 2*idleTimeout {
+				t.Fatalf("spliced %v: the relay expected to time out after %v, but took %v", spliced, idleTimeout, idle)
+			}
+			if result.down != 8*int64(len("chunk")) {
+				t.Fatalf("spliced %v: %d bytes expected down, but got %d", spliced, 8*len("chunk"), result.down)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("spliced %v: the relay expected to time out", spliced)
+		}
+	}
+}
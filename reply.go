@@ -1,9 +1,12 @@
 package mysocks
 
 import (
+	"encoding/binary"
 	"fmt"
 	"io"
 	"net"
+
+	"github.com/jfuruya/mysocks/socks5wire"
 )
 
 // reply is the reply packet
@@ -36,9 +39,6 @@ const (
 )
 
 func newReply(rep byte, atype byte, bndAddr []byte, bndPort []byte, socksConnection *socksConnection) *reply {
-	if atype == atypDomain {
-		bndAddr = append([]byte{byte(len(bndAddr))}, bndAddr...)
-	}
 	return &reply{
 		ver:             fiexedVer,
 		rep:             rep,
@@ -52,10 +52,12 @@ func newReply(rep byte, atype byte, bndAddr []byte, bndPort []byte, socksConnect
 
 func newErrorReply(rep byte, atype byte, socksConnection *socksConnection) *reply {
 	var bndAddr []byte
-	if atype == atypDomain || atype == atypIPv4 {
-		bndAddr = []byte{0x00, 0x00, 0x00, 0x00}
-	} else {
+	if atype == atypIPv6 {
 		bndAddr = []byte(net.IPv6zero)
+	} else {
+		// A domain name cannot be empty, so the zero IPv4 address is used instead.
+		atype = atypIPv4
+		bndAddr = []byte(net.IPv4zero.To4())
 	}
 
 	bndPort := []byte{0x00, 0x00}
@@ -71,15 +73,32 @@ func newErrorReply(rep byte, atype byte, socksConnection *socksConnection) *repl
 	}
 }
 
+// WriteTo writes the reply. The reply to a client that does not speak SOCKS is only recorded.
 func (reply *reply) WriteTo(w io.Writer) (int64, error) {
-	n, err := w.Write(append(append([]byte{reply.ver, reply.rep, reply.rsv, reply.atyp}, reply.bndAddr...), reply.bndPort...))
+	if reply.socksConnection.withoutSocks {
+		metricReplies.WithLabelValues(repName(reply.rep)).Inc()
+		reply.socksConnection.rep.Store(int32(reply.rep))
+		return 0, nil
+	}
+
+	b, err := socks5wire.AppendReply(make([]byte, 0, socks5wire.MaxReplyLen), socks5wire.Reply{
+		Rep:  reply.rep,
+		Addr: socks5wire.Addr{Atyp: reply.atyp, Host: reply.bndAddr, Port: binary.BigEndian.Uint16(reply.bndPort)},
+	})
 	if err != nil {
 		return 0, err
 	}
+	n, err := w.Write(b)
+	if err != nil {
+		return 0, err
+	}
+
+	metricReplies.WithLabelValues(repName(reply.rep)).Inc()
+	reply.socksConnection.rep.Store(int32(reply.rep))
 
-	reply.socksConnection.logWithLevel(logLevelInfo,
+	reply.socksConnection.logSubsystem(logSubsystemHandshake, logLevelInfo,
 		fmt.Sprintf("Reply sent. VER: %#v REP: %#v RSV: %#v ATYPE: %#v BND.ARRR: %#v BND.PORT: %#v",
-			reply.ver, reply.rep, reply.rsv, reply.atyp, reply.bndAddr, reply.bndPort))
+			reply.ver, reply.rep, reply.rsv, reply.atyp, reply.bndAddr, reply.bndPort), nil)
 
 	return int64(n), nil
 }
@@ -3,18 +3,35 @@ package mysocks
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"syscall"
 	"time"
+
+	"github.com/jfuruya/mysocks/socks5wire"
 )
 
 var (
 	errRequestNotReacheble     = fmt.Errorf("the destination is not reachable")
 	errRequestCmdNotSupported  = fmt.Errorf("the command is not supported")
 	errRequestAtypNotSupported = fmt.Errorf("the address type is not supported")
+	errRequestConnectTimeout   = fmt.Errorf("the connection to the destination has timed out")
+	errRequestNetUnreachable   = fmt.Errorf("the network of the destination is not reachable")
+	errRequestConnRefused      = fmt.Errorf("the connection to the destination has been refused")
+	errRequestConnectFailed    = fmt.Errorf("the connection to the destination has failed")
 )
 
+// repOfConnectErrors are the REPs replied when the connection to the destination has failed.
+var repOfConnectErrors = map[error]byte{
+	errRequestConnectFailed:  repGeneral,
+	errRequestNetUnreachable: repNetUnreach,
+	errRequestNotReacheble:   repHostUnreach,
+	errRequestConnRefused:    repConnRefused,
+	errRequestConnectTimeout: repHostUnreach,
+}
+
 type request struct {
 	ver byte
 	cmd byte
@@ -23,60 +40,29 @@ type request struct {
 	socksConnection *socksConnection
 }
 
-const tcpTimeout = 60
-
 func newRequestFrom(socksConnection *socksConnection) (*request, error) {
-	reader := *socksConnection.clientTCPConn
-	verBytes := make([]byte, 1)
-	if _, err := io.ReadFull(reader, verBytes); err != nil {
-		return nil, err
-	}
-	ver := verBytes[0]
-	if ver != fiexedVer {
-		return nil, fmt.Errorf("the value of the VER field in the negotiation request is invalid: %d %v", ver, socksConnection)
-	}
-
-	cmdBytes := make([]byte, 1)
-	if _, err := io.ReadFull(reader, cmdBytes); err != nil {
-		return nil, err
-	}
-	cmd := cmdBytes[0]
-	if !supportedCmd(cmd) {
-		return nil, errRequestCmdNotSupported
-	}
-
-	rsvBytes := make([]byte, 1)
-	if _, err := io.ReadFull(reader, rsvBytes); err != nil {
-		return nil, err
-	}
-	rsv := rsvBytes[0]
-	if rsv != fixedRsv {
-		return nil, fmt.Errorf("the value of the RSV field in the request is invalid: %d %v", rsv, socksConnection)
-	}
-
-	atypBytes := make([]byte, 1)
-	if _, err := io.ReadFull(reader, atypBytes); err != nil {
-		return nil, err
-	}
-	atyp := atypBytes[0]
-	if !supportedAtyp(atyp) {
+	message, err := socks5wire.ReadRequest(*socksConnection.clientTCPConn, make([]byte, socks5wire.MaxRequestLen))
+	var fieldErr *socks5wire.FieldError
+	if errors.As(err, &fieldErr) && fieldErr.Field == "ATYP" {
 		return nil, errRequestAtypNotSupported
 	}
-
-	dstAddr, err := readDestAddr(reader, atyp)
 	if err != nil {
 		return nil, err
 	}
-
-	dstPort := make([]byte, 2)
-	if _, err := io.ReadFull(reader, dstPort); err != nil {
-		return nil, err
+	ver := socks5wire.Version
+	cmd := message.Cmd
+	if !supportedCmd(cmd) {
+		return nil, errRequestCmdNotSupported
 	}
+	rsv := fixedRsv
+	atyp := message.Addr.Atyp
+	dstAddr := message.Addr.Host
+	dstPort := binary.BigEndian.AppendUint16(nil, message.Addr.Port)
 
-	socksConnection.logWithLevel(logLevelInfo,
+	socksConnection.logSubsystem(logSubsystemHandshake, logLevelInfo,
 		fmt.Sprintf("A request has been received. "+
 			"VER: %#v CMD: %#v RSV: %#v ATYP: %#v DST.ADDR: %#v DST.PORT: %#v",
-			ver, cmd, rsv, atyp, dstAddr, dstPort))
+			ver, cmd, rsv, atyp, dstAddr, dstPort), nil)
 
 	return &request{
 		ver: ver,
@@ -91,12 +77,33 @@ func newRequestFrom(socksConnection *socksConnection) (*request, error) {
 	}, nil
 }
 
+// newConnectRequestTo returns the CONNECT request to the address for a client that does not send SOCKS requests.
+func newConnectRequestTo(addr socks5wire.Addr, socksConnection *socksConnection) *request {
+	return &request{
+		ver: fiexedVer,
+		cmd: cmdConnect,
+		rsv: fixedRsv,
+		dst: dst{
+			atyp: addr.Atyp,
+			addr: addr.Host,
+			port: binary.BigEndian.AppendUint16(nil, addr.Port),
+		},
+		socksConnection: socksConnection,
+	}
+}
+
 func (request *request) processCmd() error {
+	activeSessions := metricActiveSessions.WithLabelValues(cmdName(request.cmd))
+	activeSessions.Inc()
+	defer activeSessions.Dec()
+
 	switch request.cmd {
 	case cmdConnect:
 		return request.handleConnect()
 	case cmdAssociate:
 		return request.handleUDPAssociate()
+	case cmdReverseBind:
+		return request.handleReverseBind()
 	default:
 		return errRequestCmdNotSupported
 	}
@@ -119,35 +126,18 @@ func (request *request) handleConnect() error {
 
 	clientConn := *request.socksConnection.clientTCPConn
 
-	go func() {
-		var bf [1024 * 2]byte
-		for {
-			if err := conn.SetDeadline(time.Now().Add(time.Duration(tcpTimeout) * time.Second)); err != nil {
-				return
-			}
-			i, err := conn.Read(bf[:])
-			if err != nil {
-				return
-			}
-			if _, err := clientConn.Write(bf[0:i]); err != nil {
-				return
-			}
-		}
-	}()
-
-	var bf [1024 * 2]byte
-	for {
-		if err := clientConn.SetDeadline(time.Now().Add(time.Duration(tcpTimeout) * time.Second)); err != nil {
-			return err
-		}
-		i, err := clientConn.Read(bf[:])
-		if err != nil {
-			return err
-		}
-		if _, err := conn.Write(bf[0:i]); err != nil {
-			return err
-		}
+	// The bytes are counted while relaying so that the admin API, the metrics and the accounting show the live traffic.
+	up, down, err := relay(clientConn, conn, request.socksConnection.timeouts().TCPIdle.value(), request.socksConnection.rateLimiter.Load(), func(up int64, down int64) {
+		request.socksConnection.countBytes(cmdConnect, up, down)
+	})
+	if err == errRelayIdleTimeout {
+		request.socksConnection.setCloseReason(closeReasonTCPIdleTimeout)
 	}
+
+	request.socksConnection.logSubsystem(logSubsystemRelay, logLevelInfo,
+		fmt.Sprintf("The relay to %s has been finished. Sent: %d bytes, received: %d bytes", request.destAddress(), up, down), nil)
+
+	return err
 }
 
 func (request *request) replySuccess(ip net.IP, port int) error {
@@ -172,44 +162,114 @@ func (request *request) replySuccess(ip net.IP, port int) error {
 }
 
 func (request *request) connect() (net.Conn, error) {
-	conn, err := net.Dial("tcp", request.destAddress())
+	startedAt := time.Now()
+	conn, err := request.socksConnection.server.dial("tcp", request.destAddress(), request.socksConnection.timeouts().Connect.value())
+	observeConnect(time.Since(startedAt), err)
 	if err != nil {
-		return nil, errRequestNotReacheble
-
+		connectErr := connectErrorOf(err)
+		if connectErr == errRequestConnectTimeout {
+			request.socksConnection.logSubsystem(logSubsystemRelay, logLevelWarn,
+				fmt.Sprintf("The connection to %s has timed out.", request.destAddress()), nil)
+		} else {
+			request.socksConnection.logSubsystem(logSubsystemRelay, logLevelWarn,
+				fmt.Sprintf("Failed to connect to %s.", request.destAddress()), map[string]interface{}{"error": err.Error()})
+		}
+		return nil, connectErr
 	}
-	request.socksConnection.logWithLevel(logLevelInfo,
-		fmt.Sprintf("A TCP connection has been established to: %s", request.destAddress()))
+	request.socksConnection.logSubsystem(logSubsystemRelay, logLevelInfo,
+		fmt.Sprintf("A TCP connection has been established to: %s", request.destAddress()), nil)
+
+	request.socksConnection.setRoute(routeDirect, conn.RemoteAddr().(*net.TCPAddr).IP.String())
 
 	return conn, nil
 }
 
-func (request *request) handleUDPAssociate() error {
-	var clientAddrForAccessLimit *net.UDPAddr
-	var err error
-	if bytes.Equal(request.dst.port, []byte{0x00, 0x00}) {
-		clientAddrForAccessLimit, err = net.ResolveUDPAddr("udp", (*request.socksConnection.clientTCPConn).RemoteAddr().String())
-	} else {
-		clientAddrForAccessLimit, err = net.ResolveUDPAddr("udp", request.destAddress())
+// connectErrorOf returns the error of the request for the error of the dial,
+// which tells the REP to reply with.
+func connectErrorOf(err error) error {
+	var dnsErr *net.DNSError
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return errRequestConnectTimeout
 	}
-	if err != nil {
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return errRequestConnRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return errRequestNetUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.As(err, &dnsErr):
 		return errRequestNotReacheble
+	default:
+		return errRequestConnectFailed
 	}
+}
 
-	serverAddrAsUDP := (*request.socksConnection.server.udpConn).LocalAddr().(*net.UDPAddr)
-	err = request.replySuccess(net.IP(request.socksConnection.server.hostName), serverAddrAsUDP.Port)
+// observeConnect records the time taken to connect to a destination in the metrics.
+func observeConnect(elapsed time.Duration, err error) {
+	result := metricResultSuccess
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		result = metricResultTimeout
+	} else if err != nil {
+		result = metricResultFailure
+	}
+	metricConnectDuration.WithLabelValues(result).Observe(elapsed.Seconds())
+}
+
+func (request *request) handleUDPAssociate() error {
+	clientAddrForAccessLimit, err := request.udpClientAddr()
 	if err != nil {
-		return err
+		return errRequestNotReacheble
 	}
 
-	udpAssociation := *newUDPAssociation(clientAddrForAccessLimit)
+	udpAssociation := newUDPAssociation(clientAddrForAccessLimit)
+	udpAssociation.startIdleTimer(request.socksConnection.timeouts().UDPIdle.value(), func() {
+		request.socksConnection.setCloseReason(closeReasonUDPIdleTimeout)
+		request.socksConnection.logSubsystem(logSubsystemUDP, logLevelWarn, "The UDP association has been idle for too long.", nil)
+		request.socksConnection.acceptedConn.Close()
+	})
 	defer udpAssociation.end()
 
-	request.socksConnection.udpAssociation = &udpAssociation
+	request.socksConnection.setRoute(routeDirect, "")
+
+	// Register the association before replying so that no datagram from the client is dropped.
+	request.socksConnection.udpAssociation.Store(udpAssociation)
+	request.socksConnection.server.socksConnections.addUDPAssociation(request.socksConnection)
+	defer request.socksConnection.server.socksConnections.removeUDPAssociation(request.socksConnection)
+
+	// The host name is told unless the UDP socket is bound to a specific address.
+	serverAddrAsUDP := request.socksConnection.udpConn.LocalAddr().(*net.UDPAddr)
+	serverIP := serverAddrAsUDP.IP
+	if serverIP.IsUnspecified() {
+		serverIP = net.IP(request.socksConnection.server.hostName)
+	}
+	err = request.replySuccess(serverIP, serverAddrAsUDP.Port)
+	if err != nil {
+		return err
+	}
 
 	io.Copy(io.Discard, *request.socksConnection.clientTCPConn)
 
-	request.socksConnection.logWithLevel(logLevelInfo,
-		fmt.Sprintf("A TCP connection that associated with UDP has been closed. %s", clientAddrForAccessLimit))
+	request.socksConnection.logSubsystem(logSubsystemUDP, logLevelInfo,
+		fmt.Sprintf("A TCP connection that associated with UDP has been closed. %s", clientAddrForAccessLimit), nil)
 
 	return nil
 }
+
+// udpClientAddr returns the address the client will send datagrams from.
+// The IP of the TCP connection is used unless the request tells a specific one,
+// and the port is 0 unless the request tells it.
+func (request *request) udpClientAddr() (*net.UDPAddr, error) {
+	clientAddr := &net.UDPAddr{IP: request.socksConnection.remoteIP()}
+	if bytes.Equal(request.dst.port, []byte{0x00, 0x00}) {
+		return clientAddr, nil
+	}
+
+	requestedAddr, err := net.ResolveUDPAddr("udp", request.destAddress())
+	if err != nil {
+		return nil, err
+	}
+	if !requestedAddr.IP.IsUnspecified() {
+		clientAddr.IP = requestedAddr.IP
+	}
+	clientAddr.Port = requestedAddr.Port
+	return clientAddr, nil
+}
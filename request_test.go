@@ -0,0 +1,34 @@
+package mysocks
+
+import (
+	"net"
+	"testing"
+
+	"github.com/jfuruya/mysocks/socks5wire"
+)
+
+func FuzzNewRequestFrom(f *testing.F) {
+	f.Add([]byte{fiexedVer, cmdConnect, fixedRsv, atypIPv4, 127, 0, 0, 1, 0x00, 0x50})
+	f.Add([]byte{fiexedVer, cmdReverseBind, fixedRsv, atypIPv4, 0, 0, 0, 0, 0x00, 0x00})
+	f.Add([]byte{fiexedVer, cmdBind, fixedRsv, atypIPv4, 0, 0, 0, 0, 0x00, 0x00})
+	f.Add([]byte{fiexedVer, 0x09, fixedRsv, atypDomain, 0x01, 'a', 0x00, 0x35})
+	testServer := NewServer()
+	f.Fuzz(func(t *testing.T, b []byte) {
+		clientConn, serverConn := net.Pipe()
+		defer serverConn.Close()
+		go func() {
+			clientConn.Write(b)
+			clientConn.Close()
+		}()
+
+		request, err := newRequestFrom(newSocksConnection(&serverConn, testServer, nil))
+		if message, _, parseErr := socks5wire.ParseRequest(b); parseErr == nil && !supportedCmd(message.Cmd) {
+			if err != errRequestCmdNotSupported {
+				t.Fatalf("%#v: the command expected not to be supported, but got %v", b, err)
+			}
+		}
+		if err == nil && !supportedCmd(request.cmd) {
+			t.Fatalf("%#v: the unsupported command %#v has been accepted", b, request.cmd)
+		}
+	})
+}
@@ -0,0 +1,164 @@
+package mysocks
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/jfuruya/mysocks/tunnel"
+)
+
+// handleReverseBind listens on the address of the request for the client, like `ssh -R`.
+// After the reply, the session is a tunnel over which each connection accepted is relayed to the client as a stream.
+// It ends when the client closes the session.
+func (request *request) handleReverseBind() error {
+	socksConnection := request.socksConnection
+	userName := socksConnection.getInfo().userName
+	port := int(binary.BigEndian.Uint16(request.dst.port))
+
+	allowed, err := bindablePortAllowed(socksConnection.server.config.Load().userConfig(userName).BindablePorts, port)
+	if err != nil {
+		socksConnection.logWithLevel(logLevelError, fmt.Sprintf("Invalid bindable ports of user %s: %v", userName, err))
+	}
+	var bindIP net.IP
+	hostAllowed := false
+	if request.atyp != atypDomain {
+		bindIP, hostAllowed = socksConnection.server.reverseBindIP(net.IP(request.addr))
+	}
+	if userName == "" || !allowed || !hostAllowed {
+		metricACLDenials.WithLabelValues("bind").Inc()
+		socksConnection.setCloseReason(closeReasonNotAllowed)
+		socksConnection.logWithLevel(logLevelWarn, fmt.Sprintf("The address is not allowed to be bound: %s", request.destAddress()))
+		return request.replyError(repDenied)
+	}
+
+	bindAddress := net.JoinHostPort(bindIP.String(), strconv.Itoa(port))
+	listener, err := net.Listen("tcp", bindAddress)
+	if err != nil {
+		socksConnection.setCloseReason(closeReasonBindFailed)
+		socksConnection.logSubsystem(logSubsystemRelay, logLevelWarn, fmt.Sprintf("Failed to listen on %s.", bindAddress),
+			map[string]interface{}{"error": err.Error()})
+		return request.replyError(repGeneral)
+	}
+	defer listener.Close()
+
+	// The host name is told unless the listener is bound to a specific address.
+	listenerAddr := listener.Addr().(*net.TCPAddr)
+	boundIP := listenerAddr.IP
+	if boundIP.IsUnspecified() {
+		boundIP = net.IP(socksConnection.server.hostName)
+	}
+	if err := request.replySuccess(boundIP, listenerAddr.Port); err != nil {
+		return err
+	}
+
+	session := tunnel.Server(*socksConnection.clientTCPConn)
+	defer session.Close()
+	go func() {
+		<-session.Done()
+		listener.Close()
+	}()
+
+	socksConnection.logSubsystem(logSubsystemRelay, logLevelInfo,
+		fmt.Sprintf("A reverse tunnel is listening on %s.", listenerAddr), nil)
+
+	var waitGroup sync.WaitGroup
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			break
+		}
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			request.relayReverse(session, conn)
+		}()
+	}
+	session.Close()
+	waitGroup.Wait()
+
+	socksConnection.logSubsystem(logSubsystemRelay, logLevelInfo,
+		fmt.Sprintf("The reverse tunnel on %s has been closed.", listenerAddr), nil)
+	return nil
+}
+
+// reverseBindIP returns the IP to listen on for the one requested by a reverse bind, and whether it is allowed.
+// A tunnel is bound only where the SOCKS listeners are: on any IP if one of them listens on all the interfaces,
+// and otherwise on the IP of one of them, which an unspecified IP is replaced with.
+func (server *Server) reverseBindIP(requested net.IP) (net.IP, bool) {
+	server.listenersMutex.Lock()
+	defer server.listenersMutex.Unlock()
+	var listenIPs []net.IP
+	for _, listener := range server.socksListeners {
+		addr, ok := listener.tcpListener.Addr().(*net.TCPAddr)
+		if !ok {
+			continue
+		}
+		if addr.IP.IsUnspecified() {
+			return requested, true
+		}
+		listenIPs = append(listenIPs, addr.IP)
+	}
+	for _, ip := range listenIPs {
+		if requested.IsUnspecified() || ip.Equal(requested) {
+			return ip, true
+		}
+	}
+	return nil, false
+}
+
+// relayReverse relays a connection accepted by a reverse tunnel to the client over a new stream.
+func (request *request) relayReverse(session *tunnel.Session, conn net.Conn) {
+	defer conn.Close()
+	socksConnection := request.socksConnection
+
+	stream, err := session.Open(conn.RemoteAddr())
+	if err != nil {
+		return
+	}
+	defer stream.Close()
+
+	socksConnection.logSubsystem(logSubsystemRelay, logLevelInfo,
+		fmt.Sprintf("A connection to the reverse tunnel has been accepted from: %s", conn.RemoteAddr()), nil)
+
+	up, down, err := relay(stream, conn, socksConnection.timeouts().TCPIdle.value(), socksConnection.rateLimiter.Load(), func(up int64, down int64) {
+		socksConnection.countBytes(cmdReverseBind, up, down)
+	})
+	fields := map[string]interface{}{}
+	if err != nil {
+		fields["error"] = err.Error()
+	}
+	socksConnection.logSubsystem(logSubsystemRelay, logLevelInfo,
+		fmt.Sprintf("The relay from %s over the reverse tunnel has been finished. Sent: %d bytes, received: %d bytes", conn.RemoteAddr(), up, down), fields)
+}
+
+func (request *request) replyError(rep byte) error {
+	reply := newErrorReply(rep, atypIPv4, request.socksConnection)
+	if _, err := reply.WriteTo(*request.socksConnection.clientTCPConn); err != nil {
+		request.socksConnection.logWithLevel(logLevelError, "Failed to write the reply.")
+		return err
+	}
+	return nil
+}
+
+// bindablePortAllowed reports whether the port matches one of the patterns, which are ports or ranges like "9000-9100".
+func bindablePortAllowed(patterns []string, port int) (bool, error) {
+	for _, pattern := range patterns {
+		low, high, isRange := strings.Cut(pattern, "-")
+		if !isRange {
+			high = low
+		}
+		lowPort, lowErr := strconv.Atoi(strings.TrimSpace(low))
+		highPort, highErr := strconv.Atoi(strings.TrimSpace(high))
+		if lowErr != nil || highErr != nil || lowPort < 0 || highPort > 65535 || lowPort > highPort {
+			return false, fmt.Errorf("invalid port or range of ports: %q", pattern)
+		}
+		if lowPort <= port && port <= highPort {
+			return true, nil
+		}
+	}
+	return false, nil
+}
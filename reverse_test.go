@@ -0,0 +1,158 @@
+package mysocks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jfuruya/mysocks/client"
+	"github.com/jfuruya/mysocks/socks5wire"
+)
+
+func TestReverseBind(t *testing.T) {
+	// A port that is free but not bindable.
+	closedListener := startEchoServer(t)
+	closedListener.Close()
+	notBindable := closedListener.Addr().(*net.TCPAddr).Port
+
+	configPath := t.TempDir() + "/config.json"
+	writeConfig(t, configPath, `{
+		"users": {
+			"ivan": {"password": "ivan-password", "bindablePorts": ["0"]},
+			"judy": {"password": "judy-password"}
+		}
+	}`)
+	os.Setenv("MYSOCKS_CONFIG", configPath)
+	defer os.Setenv("MYSOCKS_CONFIG", "")
+
+	StartServer()
+	defer StopServer()
+
+	dialer := &client.Dialer{ProxyAddress: proxyAddress, Username: "ivan", Password: "ivan-password", HandshakeTimeout: 10 * time.Second}
+	listener, err := dialer.Listen(context.Background(), "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				fmt.Fprintf(conn, "%s ", conn.RemoteAddr())
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	for _, message := range []string{"first", "second"} {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		conn.Write([]byte(message))
+		conn.(*net.TCPConn).CloseWrite()
+		echoed, err := io.ReadAll(conn)
+		conn.Close()
+		if expected := conn.LocalAddr().String() + " " + message; err != nil || string(echoed) != expected {
+			t.Fatalf("%q expected to be echoed through the tunnel, but got %q: %v", expected, echoed, err)
+		}
+	}
+
+	listener.Close()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			break
+		}
+		conn.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("The port expected to be closed with the tunnel")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	denied := []struct {
+		dialer  *client.Dialer
+		address string
+	}{
+		{dialer, fmt.Sprintf("127.0.0.1:%d", notBindable)},
+		{dialer, fmt.Sprintf("localhost:%d", 0)},
+		{&client.Dialer{ProxyAddress: proxyAddress, Username: "judy", Password: "judy-password"}, "127.0.0.1:0"},
+	}
+	for _, test := range denied {
+		var replyErr *client.ReplyError
+		if _, err := test.dialer.Listen(context.Background(), test.address); !errors.As(err, &replyErr) || replyErr.Rep != socks5wire.RepNotAllowed {
+			t.Fatalf("%s of %s: not allowed expected, but got %v", test.address, test.dialer.Username, err)
+		}
+	}
+
+	waitForSessionsToEnd(t)
+}
+
+func TestReverseBindHost(t *testing.T) {
+	configPath := t.TempDir() + "/config.json"
+	writeConfig(t, configPath, `{"users": {"ivan": {"password": "ivan-password", "bindablePorts": ["0"]}}}`)
+	os.Setenv("MYSOCKS_CONFIG", configPath)
+	defer os.Setenv("MYSOCKS_CONFIG", "")
+	os.Setenv("MYSOCKS_LISTEN", "127.0.0.1:0")
+	defer os.Setenv("MYSOCKS_LISTEN", "")
+
+	startTestServer(NewServer())
+	defer StopServer()
+
+	dialer := &client.Dialer{ProxyAddress: proxyAddress, Username: "ivan", Password: "ivan-password", HandshakeTimeout: 10 * time.Second}
+
+	// An unspecified host is bound where the SOCKS listener is.
+	listener, err := dialer.Listen(context.Background(), "0.0.0.0:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host, _, err := net.SplitHostPort(listener.Addr().String()); err != nil || host != "127.0.0.1" {
+		t.Fatalf("The tunnel expected to be bound to 127.0.0.1, but got %s", listener.Addr())
+	}
+	listener.Close()
+
+	var replyErr *client.ReplyError
+	if _, err := dialer.Listen(context.Background(), "127.0.0.2:0"); !errors.As(err, &replyErr) || replyErr.Rep != socks5wire.RepNotAllowed {
+		t.Fatalf("A host other than the one of the listener expected not to be allowed, but got %v", err)
+	}
+
+	waitForSessionsToEnd(t)
+}
+
+func TestBindablePortAllowed(t *testing.T) {
+	patterns := []string{"0", "8080", "9000-9100"}
+	tests := []struct {
+		port    int
+		allowed bool
+	}{
+		{0, true},
+		{8080, true},
+		{8081, false},
+		{9000, true},
+		{9050, true},
+		{9100, true},
+		{9101, false},
+	}
+	for _, test := range tests {
+		if allowed, err := bindablePortAllowed(patterns, test.port); err != nil || allowed != test.allowed {
+			t.Fatalf("%d: %v expected, but got %v: %v", test.port, test.allowed, allowed, err)
+		}
+	}
+
+	for _, pattern := range []string{"http", "100-10", "65536", "1-2-3"} {
+		if _, err := bindablePortAllowed([]string{pattern}, 1); err == nil {
+			t.Fatalf("An error expected for %q", pattern)
+		}
+	}
+}
@@ -1,138 +1,661 @@
 package mysocks
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net"
-	"strconv"
+	"runtime/debug"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Server struct {
-	port             int
-	hostName         string
-	ready            chan struct{}
-	tcpListener      *net.Listener
-	udpConn          *net.UDPConn
-	socksConnections socksConnections
+	listenAddresses []string
+	ipv6Only        bool
+	hostName        string
+	ready           chan struct{}
+	// listenersMutex guards the listeners and the servers bound by Start, which Shutdown or Close may be closing meanwhile.
+	listenersMutex sync.Mutex
+	socksListeners []*socksListener
+	tlsAddress     string
+	tlsListener    net.Listener
+	// The WebSocket listener accepts the sessions carried by WebSocket connections.
+	webSocketAddress  string
+	webSocketListener net.Listener
+	// The transparent listeners accept the connections and the datagrams diverted by the firewall.
+	transparentAddress             string
+	transparentMode                string
+	transparentListener            net.Listener
+	transparentUDPAddress          string
+	transparentUDP                 *udpFlowRelay
+	transparentAllowedDestinations []destinationPattern
+	forwards                       []*forward
+	certificates                   *certificateReloader
+	// clientCertificates is nil unless the clients of the TLS listener are authenticated by certificate.
+	clientCertificates *clientCertificateVerifier
+	socksConnections   socksConnections
+	// authMethods are the methods negotiated in addition to the built-in ones.
+	authMethods map[byte]AuthMethod
+	// dial connects to the destinations of CONNECT.
+	dial func(network string, address string, timeout time.Duration) (net.Conn, error)
+	// externalAuthenticator verifies the passwords of the users not in the configuration. It may be nil.
+	externalAuthenticator passwordAuthenticator
+	configPath            string
+	config                atomic.Pointer[activeConfig]
+	configErr             error
+	rateLimiters          *rateLimiters
+	shutdownTimeout       time.Duration
+	metricsAddress        string
+	metricsServer         *metricsServer
+	adminAddress          string
+	adminToken            string
+	adminServer           *adminServer
+	accessLog             *accessLogger
+	accounting            *accounting
+	startedAt             time.Time
+	// stopping is closed when the server stops accepting new sessions.
+	stopping     chan struct{}
+	stoppingOnce sync.Once
+	// stopped is closed when Start returns.
+	stopped chan struct{}
 }
 
-func NewServer() *Server {
-	userName := userNameFromEnv()
-	password := passwordFromEnv()
-	if userName != "" && password != "" {
-		addCredential(userName, password)
+// activeConfig is the configuration in effect with the environment variables applied.
+// It is replaced as a whole when the configuration is reloaded.
+type activeConfig struct {
+	*config
+	timeouts    timeouts
+	credentials credentials
+	// tokens tells whether the token authentication is offered.
+	tokens bool
+}
+
+func newActiveConfig(config *config) *activeConfig {
+	return &activeConfig{
+		config:      config,
+		timeouts:    globalTimeouts(config.Timeouts),
+		credentials: newCredentials(config),
+		tokens:      config.hasTokens(),
 	}
+}
+
+// ShutdownResult reports how the sessions alive at the time of a shutdown have ended.
+type ShutdownResult struct {
+	// Drained is the number of sessions that finished by themselves.
+	Drained int
+	// Killed is the number of sessions that were closed by the server.
+	Killed int
+}
 
-	return &Server{
-		port:             portFromEnv(),
-		ready:            make(chan struct{}),
-		socksConnections: *newSocksConnections(),
-		hostName:         hostNameFromEnv(),
+func NewServer() *Server {
+	configPath := configPathFromEnv()
+	config, configErr := loadConfig(configPath)
+	if configErr != nil {
+		config, _ = loadConfig("")
+	}
+	server := &Server{
+		listenAddresses:       listenAddressesFromEnv(),
+		ipv6Only:              ipv6OnlyFromEnv(),
+		ready:                 make(chan struct{}),
+		socksConnections:      *newSocksConnections(),
+		authMethods:           map[byte]AuthMethod{},
+		dial:                  net.DialTimeout,
+		hostName:              hostNameFromEnv(),
+		configPath:            configPath,
+		configErr:             configErr,
+		rateLimiters:          newRateLimiters(config),
+		shutdownTimeout:       shutdownTimeoutFromEnv(),
+		metricsAddress:        metricsAddressFromEnv(),
+		tlsAddress:            tlsAddressFromEnv(),
+		webSocketAddress:      webSocketAddressFromEnv(),
+		transparentAddress:    transparentAddressFromEnv(),
+		transparentMode:       transparentModeFromEnv(),
+		transparentUDPAddress: transparentUDPAddressFromEnv(),
+		adminAddress:          adminAddressFromEnv(),
+		adminToken:            adminTokenFromEnv(),
+		stopping:              make(chan struct{}),
+		stopped:               make(chan struct{}),
 	}
+	server.config.Store(newActiveConfig(config))
+	return server
 }
 
-func (server *Server) Start() error {
-	var waitGroup sync.WaitGroup
+// Start listens and serves until the server is closed or shut down.
+// When ctx is done, the server is closed as Close does.
+func (server *Server) Start(ctx context.Context) error {
+	defer close(server.stopped)
+
+	if server.configErr != nil {
+		return fmt.Errorf("failed to load the configuration: %w", server.configErr)
+	}
 
-	waitGroup.Add(2)
+	if output := accessLogFromEnv(); output != "" {
+		accessLog, err := newAccessLogger(output, accessLogFormatFromEnv(),
+			accessLogMaxSizeFromEnv(), accessLogMaxBackupsFromEnv(), accessLogMaxAgeFromEnv())
+		if err != nil {
+			return err
+		}
+		server.accessLog = accessLog
+		defer accessLog.close()
+	}
+
+	if url := authWebhookURLFromEnv(); url != "" {
+		webhook, err := newWebhookAuthenticator(url, authWebhookTokenFromEnv(), authWebhookTimeoutFromEnv(),
+			authWebhookCacheTTLFromEnv(), authWebhookDenyCacheTTLFromEnv(), authWebhookFailurePolicyFromEnv())
+		if err != nil {
+			return err
+		}
+		server.externalAuthenticator = webhook
+	}
+	if settings := ldapSettingsFromEnv(); settings.url != "" {
+		if server.externalAuthenticator != nil {
+			return errors.New("MYSOCKS_AUTH_WEBHOOK_URL and MYSOCKS_LDAP_URL can not be used together")
+		}
+		ldapAuthenticator, err := newLDAPAuthenticator(settings)
+		if err != nil {
+			return err
+		}
+		server.externalAuthenticator = ldapAuthenticator
+		defer ldapAuthenticator.close()
+	}
 
-	tcpListener, err := net.Listen("tcp", ":"+strconv.Itoa(server.port))
+	accounting, err := openAccounting(accountingFileFromEnv(), accountingFlushIntervalFromEnv())
 	if err != nil {
 		return err
 	}
-	defer tcpListener.Close()
+	server.accounting = accounting
+	defer accounting.close()
 
-	server.tcpListener = &tcpListener
+	warnIfPayloadsAreLogged()
 
-	logInfo(fmt.Sprintf("TCP server has been started on port %d.", server.port), nil)
+	server.startedAt = time.Now()
 
-	go func() {
-		for {
-			conn, err := tcpListener.Accept()
-			if err != nil {
-				logError(fmt.Sprintf("Failed to accept TCP connection: %v", err), nil)
-				break
-			}
+	// Every listener is bound before any of them is served, so that Start fails without serving anything
+	// when one of them can not be bound. What has been bound is closed by the deferred calls.
+	var serves []func()
 
-			logInfo(fmt.Sprintf("A new TCP connection has been received from: %v", conn.RemoteAddr()), nil)
+	// The UDP sockets are needed by the sessions, so they are opened before accepting them.
+	var socksListeners []*socksListener
+	for _, address := range server.listenAddresses {
+		listener, err := listenSocks(address, server.ipv6Only)
+		if err != nil {
+			return err
+		}
+		defer listener.close()
+		socksListeners = append(socksListeners, listener)
+
+		serves = append(serves, func() {
+			logInfo(fmt.Sprintf("TCP server has been started on %s.", listener.tcpListener.Addr()), nil)
+			server.serve(listener.tcpListener, "TCP", listener.udpConn)
+		}, func() {
+			logInfo(fmt.Sprintf("UDP server has been started on %s.", listener.udpConn.LocalAddr()), nil)
+			server.receiveDatagrams(listener.udpConn)
+		})
+	}
+	if len(socksListeners) == 0 {
+		return errors.New("no listen address is given")
+	}
 
-			socksConnection := newSocksConnection(&conn, server)
+	var tlsListener net.Listener
+	if server.tlsAddress != "" {
+		certificates, err := newCertificateReloader(tlsCertFileFromEnv(), tlsKeyFileFromEnv())
+		if err != nil {
+			return err
+		}
+		server.certificates = certificates
 
-			server.socksConnections.add(socksConnection)
+		if mode := tlsClientAuthFromEnv(); mode != tlsClientAuthNone {
+			clientCertificates, err := newClientCertificateVerifier(mode, tlsClientIdentityFromEnv(),
+				tlsClientCAFileFromEnv(), tlsCRLFileFromEnv())
+			if err != nil {
+				return err
+			}
+			server.clientCertificates = clientCertificates
+		}
 
-			go func() {
-				socksConnection.handle()
-				defer server.socksConnections.remove(socksConnection)
-			}()
+		tlsConfig, err := newTLSConfig(certificates, server.clientCertificates, tlsMinVersionFromEnv(), tlsALPNFromEnv())
+		if err != nil {
+			return err
 		}
-		server.socksConnections.closeAll()
-		waitGroup.Done()
-	}()
 
-	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{Port: server.port})
-	if err != nil {
-		return err
+		tlsListener, err = listenTLS(server.tlsAddress, tlsConfig)
+		if err != nil {
+			return err
+		}
+		defer tlsListener.Close()
+
+		serves = append(serves, func() {
+			logInfo(fmt.Sprintf("TLS server has been started on %s.", tlsListener.Addr()), nil)
+			// The UDP associations of the TLS sessions are relayed on the first UDP socket.
+			server.serve(tlsListener, "TLS", socksListeners[0].udpConn)
+		})
 	}
-	defer udpConn.Close()
 
-	server.udpConn = udpConn
+	var webSocketListener net.Listener
+	if server.webSocketAddress != "" {
+		webSocketListener, err = listenWebSocket(server.webSocketAddress, webSocketPathFromEnv(), webSocketAllowedOriginsFromEnv())
+		if err != nil {
+			return err
+		}
+		defer webSocketListener.Close()
 
-	logInfo(fmt.Sprintf("UDP server has been started on port %d.", server.port), nil)
+		serves = append(serves, func() {
+			logInfo(fmt.Sprintf("WebSocket server has been started on %s.", webSocketListener.Addr()), nil)
+			// The UDP associations of the WebSocket sessions are relayed on the first UDP socket.
+			server.serve(webSocketListener, "WebSocket", socksListeners[0].udpConn)
+		})
+	}
 
-	go func() {
-		for {
-			buf := make([]byte, 65507) // 65507 is the maximum UDP payload size
-			n, addr, err := udpConn.ReadFromUDP(buf)
-			if err != nil {
-				logError(fmt.Sprintf("Failed to read UDP datagram: %v", err), nil)
-				break
-			}
+	if server.transparentAddress != "" || server.transparentUDPAddress != "" {
+		allowedDestinations, err := parseDestinationPatterns(transparentAllowedDestinationsFromEnv())
+		if err != nil {
+			return err
+		}
+		server.transparentAllowedDestinations = allowedDestinations
+	}
 
-			logInfo(fmt.Sprintf("A UDP data received from %s: %v", addr.String(), buf[:n]), nil)
+	var transparentListener net.Listener
+	if server.transparentAddress != "" {
+		listener, destinationOf, err := listenTransparent(server.transparentAddress, server.transparentMode)
+		if err != nil {
+			return err
+		}
+		defer listener.Close()
+		transparentListener = listener
 
-			socksConnection := server.socksConnections.get(addr.IP)
-			if socksConnection == nil {
-				logError(fmt.Sprintf("There is no UDP association related to this remote address: %s", addr.String()), nil)
-				continue
-			}
+		serves = append(serves, func() {
+			logInfo(fmt.Sprintf("Transparent server has been started on %s in %s mode.", listener.Addr(), server.transparentMode), nil)
+			server.serveTransparent(listener, destinationOf)
+		})
+	}
 
-			socksConnection.udpAssociation.clientAddr = addr
+	var transparentUDP *udpFlowRelay
+	if server.transparentUDPAddress != "" {
+		udpConn, err := listenTransparentUDP(server.transparentUDPAddress)
+		if err != nil {
+			return err
+		}
+		transparentUDP = newTransparentUDPRelay(server, udpConn, transparentReplyConn)
+		defer transparentUDP.close()
+
+		serves = append(serves, func() {
+			logInfo(fmt.Sprintf("Transparent UDP server has been started on %s.", udpConn.LocalAddr()), nil)
+			transparentUDP.serve(func(buf []byte) (int, *net.UDPAddr, string, error) {
+				n, client, destination, err := readTransparentDatagram(udpConn, buf)
+				if err != nil {
+					return 0, nil, "", err
+				}
+				return n, client, destination.String(), nil
+			})
+		})
+	}
 
-			datagram, err := newDatagramFrom(buf[:n])
-			if err != nil {
-				socksConnection.logWithLevel(logLevelError, fmt.Sprintf("Failed to create socks5 datagram: %v", err))
-				continue
-			}
+	var forwards []*forward
+	for _, forwardConfig := range server.config.Load().Forwards {
+		forward, err := newForward(forwardConfig)
+		if err != nil {
+			return err
+		}
+		if err := forward.listen(server); err != nil {
+			return err
+		}
+		defer forward.stopAccepting()
+		defer forward.closeUDP()
+		forwards = append(forwards, forward)
+
+		serves = append(serves, func() {
+			logInfo(fmt.Sprintf("The forward %s has been started on %s/%s to %s.", forward.name, forward.network, forward.addr(), forward.target), nil)
+			forward.serve(server)
+		})
+	}
 
-			socksConnection.logWithLevel(logLevelInfo, fmt.Sprintf("A UDP datagram received from %s: %v", addr.String(), datagram))
+	var metricsServer *metricsServer
+	if server.metricsAddress != "" {
+		metricsServer, err = listenMetrics(server.metricsAddress)
+		if err != nil {
+			return err
+		}
+		defer metricsServer.listener.Close()
+		serves = append(serves, metricsServer.serve)
+	}
 
-			go socksConnection.handleUDP(datagram)
+	var adminServer *adminServer
+	if server.adminAddress != "" {
+		adminServer, err = listenAdmin(server.adminAddress, server.adminToken, server)
+		if err != nil {
+			return err
 		}
+		defer adminServer.listener.Close()
+		serves = append(serves, adminServer.serve)
+	}
 
-		waitGroup.Done()
-	}()
+	server.listenersMutex.Lock()
+	if server.isStopping() {
+		server.listenersMutex.Unlock()
+		// Shutdown or Close has been called while binding.
+		return nil
+	}
+	server.socksListeners = socksListeners
+	server.tlsListener = tlsListener
+	server.webSocketListener = webSocketListener
+	server.transparentListener = transparentListener
+	server.transparentUDP = transparentUDP
+	server.forwards = forwards
+	server.metricsServer = metricsServer
+	server.adminServer = adminServer
+	server.listenersMutex.Unlock()
+
+	var waitGroup sync.WaitGroup
+	for _, serve := range serves {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			serve()
+		}()
+	}
 
 	close(server.ready)
 
+	go func() {
+		select {
+		case <-ctx.Done():
+			server.Close()
+		case <-server.stopped:
+		}
+	}()
+
 	waitGroup.Wait()
 
 	return nil
 }
 
+// serve accepts the sessions from the listener until it is closed.
+// The UDP associations of the sessions are relayed on udpConn.
+func (server *Server) serve(listener net.Listener, name string, udpConn *net.UDPConn) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if server.isStopping() {
+				logInfo(fmt.Sprintf("%s server has stopped accepting connections.", name), nil)
+			} else {
+				logError(fmt.Sprintf("Failed to accept %s connection: %v", name, err), nil)
+			}
+			return
+		}
+
+		logInfo(fmt.Sprintf("A new %s connection has been received from: %v", name, conn.RemoteAddr()), nil)
+
+		socksConnection := newSocksConnection(&conn, server, udpConn)
+
+		server.socksConnections.add(socksConnection)
+
+		go func() {
+			defer server.socksConnections.remove(socksConnection)
+			socksConnection.handle()
+		}()
+	}
+}
+
 func (server *Server) Ready() <-chan struct{} {
 	return server.ready
 }
 
-func (server *Server) Close() {
+// ShutdownTimeout is the time given to the sessions to finish when the process is terminated.
+func (server *Server) ShutdownTimeout() time.Duration {
+	return server.shutdownTimeout
+}
+
+// Shutdown stops accepting new sessions and waits for the active ones to finish.
+// When ctx is done before that, the remaining sessions are closed.
+// The UDP listener is kept open until then so that UDP associations can keep relaying.
+func (server *Server) Shutdown(ctx context.Context) (ShutdownResult, error) {
+	server.stopAccepting()
+
+	active := server.socksConnections.count()
+	logInfo(fmt.Sprintf("Shutting down. Waiting for %d sessions to finish.", active), nil)
+
 	var err error
+	select {
+	case <-server.socksConnections.drained():
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
 
-	err = (*server.tcpListener).Close()
+	killed := server.socksConnections.closeAll()
+
+	result := ShutdownResult{Drained: active - killed, Killed: killed}
+	if result.Drained < 0 {
+		// Sessions accepted just before the listener was closed.
+		result.Drained = 0
+	}
+	logInfo(fmt.Sprintf("The server has been shut down. Drained sessions: %d, killed sessions: %d",
+		result.Drained, result.Killed), nil)
+
+	server.closeUDP()
+	server.closeMetrics()
+	server.closeAdmin()
+
+	return result, err
+}
+
+// Close stops the server immediately, closing all the active sessions.
+func (server *Server) Close() {
+	server.stopAccepting()
+	server.socksConnections.closeAll()
+	server.closeUDP()
+	server.closeMetrics()
+	server.closeAdmin()
+}
+
+func (server *Server) stopAccepting() {
+	server.stoppingOnce.Do(func() {
+		close(server.stopping)
+
+		server.listenersMutex.Lock()
+		defer server.listenersMutex.Unlock()
+
+		if server.tlsListener != nil {
+			if err := server.tlsListener.Close(); err != nil {
+				logError(fmt.Sprintf("Failed to close TLS listener: %v", err), nil)
+			}
+		}
+
+		if server.webSocketListener != nil {
+			if err := server.webSocketListener.Close(); err != nil {
+				logError(fmt.Sprintf("Failed to close WebSocket listener: %v", err), nil)
+			}
+		}
+
+		if server.transparentListener != nil {
+			if err := server.transparentListener.Close(); err != nil {
+				logError(fmt.Sprintf("Failed to close transparent listener: %v", err), nil)
+			}
+		}
+
+		for _, forward := range server.forwards {
+			forward.stopAccepting()
+		}
+
+		for _, listener := range server.socksListeners {
+			err := listener.tcpListener.Close()
+			if err != nil {
+				logError(fmt.Sprintf("Faild to close TCP listener: %v", err), nil)
+			}
+		}
+	})
+}
+
+// handleDatagram relays a datagram from a client. A panic while handling it is recovered
+// so that a malformed datagram cannot stop the UDP service.
+func (server *Server) handleDatagram(bytes []byte, addr *net.UDPAddr) {
+	defer recoverDatagram(addr)
+
+	logSubsystem(logSubsystemUDP, logLevelDebug, "A UDP datagram has been received from a client.",
+		map[string]interface{}{"from": addr.String(), "size": len(bytes)})
+
+	socksConnection := server.socksConnections.getByUDPClientAddr(addr)
+	if socksConnection == nil {
+		metricUDPDatagrams.WithLabelValues(metricDirectionUp, metricUDPDropped).Inc()
+		logSubsystem(logSubsystemUDP, logLevelWarn, "There is no UDP association related to the remote address.",
+			map[string]interface{}{"from": addr.String()})
+		return
+	}
+
+	socksConnection.udpAssociation.Load().touch()
+
+	datagram, err := newDatagramFrom(bytes)
 	if err != nil {
-		logError(fmt.Sprintf("Faild to close TCP listener: %v", err), nil)
+		metricUDPDatagrams.WithLabelValues(metricDirectionUp, metricUDPDropped).Inc()
+		socksConnection.logSubsystem(logSubsystemUDP, logLevelWarn, "Failed to create socks5 datagram.",
+			map[string]interface{}{"from": addr.String(), "error": err.Error()})
+		return
+	}
+
+	socksConnection.logSubsystem(logSubsystemUDP, logLevelDebug, "A UDP datagram has been parsed.",
+		map[string]interface{}{"from": addr.String(), "to": datagram.destAddress(), "data": datagram.data})
+
+	go socksConnection.handleUDP(datagram)
+}
+
+func recoverDatagram(from *net.UDPAddr) {
+	if r := recover(); r != nil {
+		metricUDPDatagrams.WithLabelValues(metricDirectionUp, metricUDPDropped).Inc()
+		logSubsystem(logSubsystemUDP, logLevelError, "A panic has occurred while handling a UDP datagram.",
+			map[string]interface{}{"from": from.String(), "panic": fmt.Sprint(r), "stack": string(debug.Stack())})
+	}
+}
+
+// receiveDatagrams relays the datagrams from the clients on udpConn until it is closed.
+func (server *Server) receiveDatagrams(udpConn *net.UDPConn) {
+	for {
+		buf := make([]byte, maxUDPPayloadSize)
+		n, addr, err := udpConn.ReadFromUDP(buf)
+		if err != nil {
+			if server.isStopping() {
+				logInfo("UDP server has been stopped.", nil)
+			} else {
+				logError(fmt.Sprintf("Failed to read UDP datagram: %v", err), nil)
+			}
+			return
+		}
+
+		server.handleDatagram(buf[:n], addr)
+	}
+}
+
+func (server *Server) closeUDP() {
+	server.listenersMutex.Lock()
+	defer server.listenersMutex.Unlock()
+	for _, listener := range server.socksListeners {
+		err := listener.udpConn.Close()
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			logError(fmt.Sprintf("Failed to close UDP listener: %v", err), nil)
+		}
+	}
+	if server.transparentUDP != nil {
+		server.transparentUDP.close()
 	}
+	for _, forward := range server.forwards {
+		forward.closeUDP()
+	}
+}
+
+func (server *Server) closeMetrics() {
+	server.listenersMutex.Lock()
+	metricsServer := server.metricsServer
+	server.listenersMutex.Unlock()
+	if metricsServer != nil {
+		metricsServer.close()
+	}
+}
 
-	err = server.udpConn.Close()
+func (server *Server) closeAdmin() {
+	server.listenersMutex.Lock()
+	adminServer := server.adminServer
+	server.listenersMutex.Unlock()
+	if adminServer != nil {
+		adminServer.close()
+	}
+}
+
+// listeners returns the addresses the server is listening on, except the one of the admin API.
+func (server *Server) listeners() []adminListener {
+	server.listenersMutex.Lock()
+	defer server.listenersMutex.Unlock()
+	var listeners []adminListener
+	for _, listener := range server.socksListeners {
+		listeners = append(listeners,
+			adminListener{Name: "socks", Network: "tcp", Address: listener.tcpListener.Addr().String()},
+			adminListener{Name: "socks", Network: "udp", Address: listener.udpConn.LocalAddr().String()})
+	}
+	if server.tlsListener != nil {
+		listeners = append(listeners, adminListener{Name: "socks-tls", Network: "tcp", Address: server.tlsListener.Addr().String()})
+	}
+	if server.webSocketListener != nil {
+		listeners = append(listeners, adminListener{Name: "socks-websocket", Network: "tcp", Address: server.webSocketListener.Addr().String()})
+	}
+	if server.transparentListener != nil {
+		listeners = append(listeners, adminListener{Name: "transparent", Network: "tcp", Address: server.transparentListener.Addr().String()})
+	}
+	if server.transparentUDP != nil {
+		listeners = append(listeners, adminListener{Name: "transparent", Network: "udp", Address: server.transparentUDP.conn.LocalAddr().String()})
+	}
+	for _, forward := range server.forwards {
+		listeners = append(listeners, adminListener{Name: "forward:" + forward.name, Network: forward.network, Address: forward.addr().String()})
+	}
+	if server.metricsServer != nil {
+		listeners = append(listeners, adminListener{Name: "metrics", Network: "tcp", Address: server.metricsServer.listener.Addr().String()})
+	}
+	return listeners
+}
+
+func (server *Server) isStopping() bool {
+	select {
+	case <-server.stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// Reload reads the configuration file and the TLS files again. The rate limits apply to the
+// active sessions at once, and the timeouts apply from the next time a session looks them up.
+// If a file can not be loaded, what was loaded from it is kept.
+func (server *Server) Reload() error {
+	if server.certificates != nil {
+		if err := server.certificates.reload(); err != nil {
+			logError(fmt.Sprintf("Failed to reload the TLS certificate, keeping the current one: %v", err), nil)
+			return err
+		}
+		logInfo("The TLS certificate has been reloaded.", nil)
+	}
+	if server.clientCertificates != nil {
+		if err := server.clientCertificates.reload(); err != nil {
+			logError(fmt.Sprintf("Failed to reload the client CA bundle or the CRL, keeping the current ones: %v", err), nil)
+			return err
+		}
+		logInfo("The client CA bundle and the CRL have been reloaded.", nil)
+	}
+
+	config, err := loadConfig(server.configPath)
 	if err != nil {
-		logError(fmt.Sprintf("Failed to close UDP listener: %v", err), nil)
+		logError(fmt.Sprintf("Failed to reload the configuration, keeping the current one: %v", err), nil)
+		return fmt.Errorf("failed to reload the configuration: %w", err)
+	}
+	server.config.Store(newActiveConfig(config))
+	server.rateLimiters.apply(config)
+	logInfo(fmt.Sprintf("The configuration has been reloaded. Version: %s", config.version), nil)
+	return nil
+}
+
+// timeoutsFor returns the timeouts applied to the sessions of the user.
+// An empty user name means an unauthenticated session.
+func (server *Server) timeoutsFor(userName string) timeouts {
+	config := server.config.Load()
+	if userName == "" {
+		return config.timeouts
 	}
+	return config.timeouts.overriddenBy(config.userConfig(userName).Timeouts)
 }
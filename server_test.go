@@ -2,37 +2,48 @@ package mysocks
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
-
-	"github.com/txthinking/socks5"
 )
 
-const portOfTestServer = 9000
-
-var proxyAddress = "127.0.0.1:" + strconv.Itoa(portOfTestServer)
+// proxyAddress is the address of the server started by StartServer, which listens on an ephemeral port.
+var proxyAddress string
 
 var server *Server
 
 func StartServer() {
-	os.Setenv("MYSOCKS_PORT", strconv.Itoa(portOfTestServer))
+	os.Setenv("MYSOCKS_PORT", "0")
+	startTestServer(NewServer())
+}
 
-	server = NewServer()
+// startTestServer starts the server created by the test and sets server and proxyAddress.
+func startTestServer(testServer *Server) {
+	server = testServer
 	go func() {
-		err := server.Start()
+		err := testServer.Start(context.Background())
 		if err != nil {
 			log.Printf("Error(Ignored): %v", err)
 		}
 	}()
-	<-server.Ready()
+	select {
+	case <-testServer.Ready():
+	case <-testServer.stopped:
+		return
+	}
+	port := testServer.Addrs()[0].(*net.TCPAddr).Port
+	proxyAddress = "127.0.0.1:" + strconv.Itoa(port)
 }
 
 func StopServer() {
@@ -43,34 +54,25 @@ func TestConnect(t *testing.T) {
 	StartServer()
 	defer StopServer()
 
-	socks5.Debug = true
+	httpServer := startHTTPServer(t)
+	defer httpServer.Close()
 
-	client, err := socks5.NewClient(proxyAddress, "", "", 0, 60)
-	if err != nil {
-		t.Fatal(err)
-	}
+	dialer := dialerThrough("", "")
 
-	httpClient := &http.Client{
-		Transport: &http.Transport{
-			Dial: func(network, addr string) (net.Conn, error) {
-				return client.Dial(network, addr)
-			},
-		},
-	}
-	res, err := httpClient.Get("https://ifconfig.co")
+	res, err := httpClientThrough(dialer).Get(httpServer.URL)
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer res.Body.Close()
-	responseBytes, err := ioutil.ReadAll(res.Body)
+	responseBytes, err := io.ReadAll(res.Body)
 	if err != nil {
 		t.Fatal(err)
 	}
 
+	// The HTTP server sees the connection from the server.
 	ipString := string(bytes.TrimSpace(responseBytes))
-	ip := net.ParseIP(ipString)
-	if ip == nil {
-		t.Fatalf("Failed to parse the IP address: %s", ipString)
+	if ip := net.ParseIP(ipString); ip == nil || !ip.IsLoopback() {
+		t.Fatalf("Unexpected IP address: %s", ipString)
 	}
 }
 
@@ -78,18 +80,14 @@ func TestUDPAssociate(t *testing.T) {
 	StartServer()
 	defer StopServer()
 
-	socks5.Debug = true
+	dnsServer := startDNSServer(t)
+	defer dnsServer.Close()
 
-	client, err := socks5.NewClient(proxyAddress, "", "", 0, 60)
+	packetConn, err := dialerThrough("", "").ListenPacket(context.Background())
 	if err != nil {
 		t.Fatal(err)
 	}
-
-	conn, err := client.Dial("udp", "8.8.8.8:53")
-	if err != nil {
-		t.Fatal(err)
-	}
-	defer conn.Close()
+	defer packetConn.Close()
 
 	message := []byte{
 		0x12, 0x34, // ID
@@ -105,20 +103,20 @@ func TestUDPAssociate(t *testing.T) {
 		0x00, 0x01, // Class: IN
 	}
 
-	_, err = conn.Write(message)
+	_, err = packetConn.WriteTo(message, dnsServer.LocalAddr())
 	if err != nil {
-		log.Fatalf("Failed to send request: %v", err)
+		t.Fatalf("Failed to send request: %v", err)
 	}
 
 	buffer := make([]byte, 512)
-	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
-	n, err := conn.Read(buffer)
+	packetConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := packetConn.ReadFrom(buffer)
 	if err != nil {
-		log.Fatalf("Failed to read response: %v", err)
+		t.Fatalf("Failed to read response: %v", err)
 	}
 
 	if err := parseDNSResponse(buffer[:n]); err != nil {
-		log.Fatalf("DNS response validation failed: %v", err)
+		t.Fatalf("DNS response validation failed: %v", err)
 	}
 }
 
@@ -202,26 +200,17 @@ func TestUserAndPasswordAuthOK(t *testing.T) {
 	}()
 	defer StopServer()
 
-	socks5.Debug = true
+	httpServer := startHTTPServer(t)
+	defer httpServer.Close()
 
-	client, err := socks5.NewClient(proxyAddress, user, password, 0, 60)
-	if err != nil {
-		t.Fatal(err)
-	}
+	dialer := dialerThrough(user, password)
 
-	httpClient := &http.Client{
-		Transport: &http.Transport{
-			Dial: func(network, addr string) (net.Conn, error) {
-				return client.Dial(network, addr)
-			},
-		},
-	}
-	res, err := httpClient.Get("https://ifconfig.co")
+	res, err := httpClientThrough(dialer).Get(httpServer.URL)
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer res.Body.Close()
-	responseBytes, err := ioutil.ReadAll(res.Body)
+	responseBytes, err := io.ReadAll(res.Body)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -247,22 +236,378 @@ func TestUserAndPasswordAuthFail(t *testing.T) {
 	}()
 	defer StopServer()
 
-	socks5.Debug = true
+	httpServer := startHTTPServer(t)
+	defer httpServer.Close()
+
+	dialer := dialerThrough(user, "invalid_password")
+
+	_, err := httpClientThrough(dialer).Get(httpServer.URL)
+	if err == nil {
+		t.Fatalf("Error expected, but got nil")
+	}
+}
+
+func TestNoAuthRejectedWithUsers(t *testing.T) {
+	configPath := t.TempDir() + "/config.json"
+	writeConfig(t, configPath, `{"users": {"heidi": {"password": "heidi-password"}}}`)
+	os.Setenv("MYSOCKS_CONFIG", configPath)
+	defer os.Setenv("MYSOCKS_CONFIG", "")
+
+	StartServer()
+	defer StopServer()
 
-	client, err := socks5.NewClient(proxyAddress, user, "invalid_password", 0, 60)
+	conn, err := net.Dial("tcp", proxyAddress)
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	conn.Write([]byte{fiexedVer, 0x01, noAuthRequired})
+	negotiationReply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, negotiationReply); err != nil || negotiationReply[1] != noAcceptable {
+		t.Fatalf("NO ACCEPTABLE METHODS expected, but got %v: %v", negotiationReply, err)
+	}
+}
+
+func TestReloadCredentials(t *testing.T) {
+	configPath := t.TempDir() + "/config.json"
+	writeConfig(t, configPath, `{"users": {"frank": {"password": "frank-password"}}}`)
+	os.Setenv("MYSOCKS_CONFIG", configPath)
+	defer os.Setenv("MYSOCKS_CONFIG", "")
 
-	httpClient := &http.Client{
-		Transport: &http.Transport{
-			Dial: func(network, addr string) (net.Conn, error) {
-				return client.Dial(network, addr)
-			},
-		},
+	StartServer()
+	defer StopServer()
+
+	echoServer := startEchoServer(t)
+	defer echoServer.Close()
+
+	tokenMethodSelected := func() bool {
+		conn, err := net.Dial("tcp", proxyAddress)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.Write([]byte{fiexedVer, 0x01, tokenAuth})
+		negotiationReply := make([]byte, 2)
+		if _, err := io.ReadFull(conn, negotiationReply); err != nil {
+			t.Fatal(err)
+		}
+		return negotiationReply[1] == tokenAuth
 	}
-	_, err = httpClient.Get("https://ifconfig.co")
-	if err == nil {
-		t.Fatalf("Error expected, but got nil")
+
+	if rep, err := requestThrough("frank", "frank-password", connectRequestTo(t, echoServer.Addr().String())); err != nil || rep != repSucceeded {
+		t.Fatalf("frank expected to be accepted, but got %#x %v", rep, err)
+	}
+	if tokenMethodSelected() {
+		t.Fatal("The token method expected not to be offered without tokens")
 	}
+
+	// The password of frank is revoked, and grace is added with a password and a token.
+	writeConfig(t, configPath, `{"users": {"grace": {"password": "grace-password", "tokens": ["grace-token"]}}}`)
+	if err := server.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := requestThrough("frank", "frank-password", connectRequestTo(t, echoServer.Addr().String())); err == nil {
+		t.Fatal("The revoked password of frank expected to be rejected")
+	}
+	if rep, err := requestThrough("grace", "grace-password", connectRequestTo(t, echoServer.Addr().String())); err != nil || rep != repSucceeded {
+		t.Fatalf("grace expected to be accepted, but got %#x %v", rep, err)
+	}
+	if !tokenMethodSelected() {
+		t.Fatal("The token method expected to be offered after the reload")
+	}
+	waitForSessionsToEnd(t)
+}
+
+func startEchoServer(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener
+}
+
+func TestShutdownDrainsAndKillsSessions(t *testing.T) {
+	StartServer()
+	defer StopServer()
+
+	echoServer := startEchoServer(t)
+	defer echoServer.Close()
+
+	dialer := dialerThrough("", "")
+
+	finishingConn, err := dialer.Dial("tcp", echoServer.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stuckConn, err := dialer.Dial("tcp", echoServer.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stuckConn.Close()
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		finishingConn.Close()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	result, err := server.Shutdown(ctx)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("DeadlineExceeded expected, but got %v", err)
+	}
+	if result.Drained != 1 || result.Killed != 1 {
+		t.Fatalf("1 drained and 1 killed session expected, but got %+v", result)
+	}
+
+	stuckConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := stuckConn.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("The killed session is expected to be closed")
+	}
+}
+
+func TestShutdownWhileStarting(t *testing.T) {
+	os.Setenv("MYSOCKS_PORT", "0")
+	for i := 0; i < 20; i++ {
+		testServer := NewServer()
+		go testServer.Start(context.Background())
+		if i%2 == 1 {
+			// Sometimes in the middle of binding.
+			time.Sleep(time.Duration(i) * 100 * time.Microsecond)
+		}
+		if _, err := testServer.Shutdown(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-testServer.stopped:
+		case <-time.After(10 * time.Second):
+			t.Fatal("Start expected to return after Shutdown")
+		}
+	}
+}
+
+func TestStartFailsWithoutServing(t *testing.T) {
+	// The metrics address is taken, so the last listener to be bound fails.
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+	os.Setenv("MYSOCKS_METRICS_ADDRESS", taken.Addr().String())
+	defer os.Setenv("MYSOCKS_METRICS_ADDRESS", "")
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	socksAddress := free.Addr().String()
+	free.Close()
+	os.Setenv("MYSOCKS_LISTEN", socksAddress)
+	defer os.Setenv("MYSOCKS_LISTEN", "")
+
+	previous := loggers.Load()
+	defer loggers.Store(previous)
+	var logs bytes.Buffer
+	SetSlogHandler(slog.NewTextHandler(&logs, nil))
+
+	testServer := NewServer()
+	if err := testServer.Start(context.Background()); err == nil {
+		t.Fatal("Start expected to fail")
+	}
+	if strings.Contains(logs.String(), "has been started") {
+		t.Fatalf("No listener expected to be served: %s", logs.String())
+	}
+	select {
+	case <-testServer.Ready():
+		t.Fatal("The server expected not to be ready")
+	default:
+	}
+
+	// The SOCKS listener bound before has been closed.
+	listener, err := net.Listen("tcp", socksAddress)
+	if err != nil {
+		t.Fatalf("The SOCKS address expected to be released: %v", err)
+	}
+	listener.Close()
+}
+
+func TestMetrics(t *testing.T) {
+	os.Setenv("MYSOCKS_METRICS_ADDRESS", "127.0.0.1:0")
+	defer os.Setenv("MYSOCKS_METRICS_ADDRESS", "")
+
+	StartServer()
+	defer StopServer()
+
+	echoServer := startEchoServer(t)
+	defer echoServer.Close()
+
+	dialer := dialerThrough("", "")
+	conn, err := dialer.Dial("tcp", echoServer.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	res, err := http.Get("http://" + server.metricsServer.listener.Addr().String() + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{
+		`mysocks_handshakes_total{method="no_auth",result="success"}`,
+		`mysocks_replies_total{rep="succeeded"}`,
+		`mysocks_connect_duration_seconds_count{result="success"}`,
+	} {
+		if !bytes.Contains(body, []byte(expected)) {
+			t.Errorf("%s is expected in the metrics", expected)
+		}
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	accessLogPath := t.TempDir() + "/access.log"
+	os.Setenv("MYSOCKS_ACCESS_LOG", accessLogPath)
+	defer os.Setenv("MYSOCKS_ACCESS_LOG", "")
+
+	StartServer()
+	defer StopServer()
+
+	echoServer := startEchoServer(t)
+	defer echoServer.Close()
+
+	dialer := dialerThrough("", "")
+	conn, err := dialer.Dial("tcp", echoServer.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("hello"))
+	io.ReadFull(conn, make([]byte, 5))
+	conn.Close()
+
+	waitForSessionsToEnd(t)
+
+	content, err := os.ReadFile(accessLogPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := bytes.Split(bytes.TrimSpace(content), []byte("\n"))
+	if len(lines) != 1 {
+		t.Fatalf("1 record expected, but got %d: %s", len(lines), content)
+	}
+
+	var record accessRecord
+	if err := json.Unmarshal(lines[0], &record); err != nil {
+		t.Fatal(err)
+	}
+	if record.Command != "connect" || record.Destination != echoServer.Addr().String() ||
+		record.Rep != int(repSucceeded) || record.BytesUp != 5 || record.BytesDown != 5 ||
+		record.CloseReason != closeReasonCompleted || record.SessionID == "" {
+		t.Fatalf("Unexpected record: %+v", record)
+	}
+}
+
+func TestAdminAPI(t *testing.T) {
+	os.Setenv("MYSOCKS_ADMIN_ADDRESS", "127.0.0.1:0")
+	os.Setenv("MYSOCKS_ADMIN_TOKEN", "admin-token")
+	defer os.Setenv("MYSOCKS_ADMIN_ADDRESS", "")
+	defer os.Setenv("MYSOCKS_ADMIN_TOKEN", "")
+
+	StartServer()
+	defer StopServer()
+
+	echoServer := startEchoServer(t)
+	defer echoServer.Close()
+
+	dialer := dialerThrough("", "")
+	conn, err := dialer.Dial("tcp", echoServer.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("hello"))
+	io.ReadFull(conn, make([]byte, 5))
+
+	adminURL := "http://" + server.adminServer.listener.Addr().String()
+	call := func(method string, path string, token string, response interface{}) int {
+		req, err := http.NewRequest(method, adminURL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		if response != nil {
+			if err := json.NewDecoder(res.Body).Decode(response); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return res.StatusCode
+	}
+
+	if statusCode := call("GET", "/sessions", "wrong-token", nil); statusCode != http.StatusUnauthorized {
+		t.Fatalf("401 expected without the token, but got %d", statusCode)
+	}
+
+	// The bytes are reported by the relay at least every relayProgressInterval.
+	var sessions []adminSession
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+		if statusCode := call("GET", "/sessions", "admin-token", &sessions); statusCode != http.StatusOK {
+			t.Fatalf("200 expected, but got %d", statusCode)
+		}
+		if len(sessions) == 1 && sessions[0].BytesDown == 5 {
+			break
+		}
+	}
+	if len(sessions) != 1 || sessions[0].Command != "connect" || sessions[0].Destination != echoServer.Addr().String() ||
+		sessions[0].BytesUp != 5 || sessions[0].BytesDown != 5 {
+		t.Fatalf("Unexpected sessions: %+v", sessions)
+	}
+
+	var session adminSession
+	if statusCode := call("GET", "/sessions/"+sessions[0].ID, "admin-token", &session); statusCode != http.StatusOK || session.ID != sessions[0].ID {
+		t.Fatalf("Unexpected session: %d %+v", statusCode, session)
+	}
+	if statusCode := call("GET", "/sessions/unknown", "admin-token", nil); statusCode != http.StatusNotFound {
+		t.Fatalf("404 expected for an unknown session, but got %d", statusCode)
+	}
+
+	var status adminStatus
+	if statusCode := call("GET", "/status", "admin-token", &status); statusCode != http.StatusOK {
+		t.Fatalf("200 expected, but got %d", statusCode)
+	}
+	if status.ActiveSessions != 1 || status.ConfigVersion != defaultConfigVersion || len(status.Listeners) != 3 {
+		t.Fatalf("Unexpected status: %+v", status)
+	}
+
+	var result adminKillResult
+	if statusCode := call("DELETE", "/sessions/"+sessions[0].ID, "admin-token", &result); statusCode != http.StatusOK || result.Killed != 1 {
+		t.Fatalf("Unexpected result: %d %+v", statusCode, result)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("EOF expected from the killed session, but got %v", err)
+	}
+
+	waitForSessionsToEnd(t)
 }
@@ -0,0 +1,125 @@
+package socks5wire
+
+import (
+	"encoding/binary"
+	"net"
+	"strconv"
+)
+
+// Addr is the ATYP, ADDR and PORT fields of a request, a reply or a UDP request header.
+type Addr struct {
+	Atyp byte
+	// Host is the 4 or 16 bytes of the IP address, or the domain name.
+	Host []byte
+	Port uint16
+}
+
+// IPAddr returns the address of the IP address, in IPv4 if it is an IPv4 address.
+func IPAddr(ip net.IP, port int) Addr {
+	if ip4 := ip.To4(); ip4 != nil {
+		return Addr{Atyp: AtypIPv4, Host: ip4, Port: uint16(port)}
+	}
+	return Addr{Atyp: AtypIPv6, Host: ip.To16(), Port: uint16(port)}
+}
+
+// DomainAddr returns the address of the domain name.
+func DomainAddr(name string, port int) Addr {
+	return Addr{Atyp: AtypDomain, Host: []byte(name), Port: uint16(port)}
+}
+
+// HostPortAddr returns the address of HOST:PORT, where HOST is an IP address or a domain name.
+func HostPortAddr(address string) (Addr, error) {
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return Addr{}, err
+	}
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		return Addr{}, err
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return IPAddr(ip, int(port)), nil
+	}
+	return DomainAddr(host, int(port)), nil
+}
+
+// IP returns the IP address, or nil if the address is a domain name.
+func (addr Addr) IP() net.IP {
+	if addr.Atyp == AtypDomain {
+		return nil
+	}
+	return net.IP(addr.Host)
+}
+
+// HostString returns the IP address or the domain name as a string.
+func (addr Addr) HostString() string {
+	if ip := addr.IP(); ip != nil {
+		return ip.String()
+	}
+	return string(addr.Host)
+}
+
+// String returns the address as HOST:PORT.
+func (addr Addr) String() string {
+	return net.JoinHostPort(addr.HostString(), strconv.Itoa(int(addr.Port)))
+}
+
+func (addr Addr) appendTo(b []byte, message string, prefix string) ([]byte, error) {
+	switch addr.Atyp {
+	case AtypIPv4:
+		if len(addr.Host) != net.IPv4len {
+			return nil, fieldError(message, prefix+".ADDR", len(addr.Host))
+		}
+		b = append(b, AtypIPv4)
+	case AtypIPv6:
+		if len(addr.Host) != net.IPv6len {
+			return nil, fieldError(message, prefix+".ADDR", len(addr.Host))
+		}
+		b = append(b, AtypIPv6)
+	case AtypDomain:
+		if len(addr.Host) == 0 || len(addr.Host) > 255 {
+			return nil, fieldError(message, prefix+".ADDR", len(addr.Host))
+		}
+		b = append(b, AtypDomain, byte(len(addr.Host)))
+	default:
+		return nil, fieldError(message, "ATYP", int(addr.Atyp))
+	}
+	b = append(b, addr.Host...)
+	return binary.BigEndian.AppendUint16(b, addr.Port), nil
+}
+
+// parseAddr parses the address at the beginning of b. When b is too short, it returns
+// ErrShortBuffer with the length needed so far.
+func parseAddr(b []byte, message string, prefix string) (Addr, int, error) {
+	if len(b) < 1 {
+		return Addr{}, 1, ErrShortBuffer
+	}
+	hostStart := 1
+	var hostLength int
+	switch b[0] {
+	case AtypIPv4:
+		hostLength = net.IPv4len
+	case AtypIPv6:
+		hostLength = net.IPv6len
+	case AtypDomain:
+		if len(b) < 2 {
+			return Addr{}, 2, ErrShortBuffer
+		}
+		hostStart = 2
+		hostLength = int(b[1])
+		if hostLength == 0 {
+			return Addr{}, 0, fieldError(message, prefix+".ADDR", 0)
+		}
+	default:
+		return Addr{}, 0, fieldError(message, "ATYP", int(b[0]))
+	}
+	end := hostStart + hostLength + 2
+	if len(b) < end {
+		return Addr{}, end, ErrShortBuffer
+	}
+	return Addr{
+		Atyp: b[0],
+		Host: b[hostStart : hostStart+hostLength],
+		Port: binary.BigEndian.Uint16(b[end-2 : end]),
+	}, end, nil
+}
@@ -0,0 +1,87 @@
+package socks5wire
+
+import (
+	"bytes"
+	"testing"
+)
+
+// checkParsed checks that a parsed message is encoded back into the bytes it was parsed from,
+// and that ErrShortBuffer asks for more bytes than given.
+func checkParsed(t *testing.T, b []byte, n int, err error, appendMessage func() ([]byte, error)) {
+	if err == ErrShortBuffer {
+		if n <= len(b) {
+			t.Fatalf("%#v: the length needed is not longer than the bytes: %d", b, n)
+		}
+		return
+	}
+	if err != nil {
+		return
+	}
+	if n > len(b) {
+		t.Fatalf("%#v: the length is longer than the bytes: %d", b, n)
+	}
+	encoded, err := appendMessage()
+	if err != nil {
+		t.Fatalf("%#v: failed to encode the parsed message: %v", b, err)
+	}
+	if !bytes.Equal(encoded, b[:n]) {
+		t.Fatalf("%#v: encoded into %#v", b[:n], encoded)
+	}
+}
+
+func FuzzParseNegotiationRequest(f *testing.F) {
+	f.Add([]byte{0x05, 0x02, 0x00, 0x02})
+	f.Add([]byte{0x05, 0x00})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		request, n, err := ParseNegotiationRequest(b)
+		checkParsed(t, b, n, err, func() ([]byte, error) {
+			return AppendNegotiationRequest(nil, request)
+		})
+	})
+}
+
+func FuzzParseUserPasswordRequest(f *testing.F) {
+	f.Add([]byte{0x01, 0x05, 'a', 'l', 'i', 'c', 'e', 0x01, 'p'})
+	f.Add([]byte{0x01, 0x00, 0x00})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		request, n, err := ParseUserPasswordRequest(b)
+		checkParsed(t, b, n, err, func() ([]byte, error) {
+			return AppendUserPasswordRequest(nil, request)
+		})
+	})
+}
+
+func FuzzParseRequest(f *testing.F) {
+	f.Add([]byte{0x05, 0x01, 0x00, 0x01, 127, 0, 0, 1, 0x00, 0x50})
+	f.Add([]byte{0x05, 0x03, 0x00, 0x03, 0x01, 'a', 0x00, 0x35})
+	f.Add([]byte{0x05, 0x01, 0x00, 0x04, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x01, 0xbb})
+	f.Add([]byte{0x05, 0xF0, 0x00, 0x01, 0, 0, 0, 0, 0x00, 0x00})
+	f.Add([]byte{0x05, 0x09, 0x00, 0x01, 127, 0, 0, 1, 0x00, 0x50})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		request, n, err := ParseRequest(b)
+		checkParsed(t, b, n, err, func() ([]byte, error) {
+			return AppendRequest(nil, request)
+		})
+	})
+}
+
+func FuzzParseReply(f *testing.F) {
+	f.Add([]byte{0x05, 0x00, 0x00, 0x01, 127, 0, 0, 1, 0x00, 0x50})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		reply, n, err := ParseReply(b)
+		checkParsed(t, b, n, err, func() ([]byte, error) {
+			return AppendReply(nil, reply)
+		})
+	})
+}
+
+func FuzzParseUDPHeader(f *testing.F) {
+	f.Add([]byte{0x00, 0x00, 0x00, 0x01, 8, 8, 8, 8, 0x00, 0x35, 'd', 'a', 't', 'a'})
+	f.Add([]byte{0x00, 0x00, 0x00, 0x03, 0x0b, 'e', 'x', 'a', 'm', 'p', 'l', 'e', '.', 'c', 'o', 'm', 0x00, 0x35})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		header, n, err := ParseUDPHeader(b)
+		checkParsed(t, b, n, err, func() ([]byte, error) {
+			return AppendUDPHeader(nil, header)
+		})
+	})
+}
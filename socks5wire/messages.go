@@ -0,0 +1,272 @@
+package socks5wire
+
+import "io"
+
+// NegotiationRequest is the version identifier/method selection message of the client.
+type NegotiationRequest struct {
+	Methods []byte
+}
+
+// ParseNegotiationRequest parses the message at the beginning of b and returns its length.
+// When b is too short, it returns ErrShortBuffer with the length needed so far.
+func ParseNegotiationRequest(b []byte) (NegotiationRequest, int, error) {
+	if len(b) < 2 {
+		return NegotiationRequest{}, 2, ErrShortBuffer
+	}
+	if b[0] != Version {
+		return NegotiationRequest{}, 0, fieldError(MessageNegotiationRequest, "VER", int(b[0]))
+	}
+	if b[1] == 0 {
+		return NegotiationRequest{}, 0, fieldError(MessageNegotiationRequest, "NMETHODS", 0)
+	}
+	end := 2 + int(b[1])
+	if len(b) < end {
+		return NegotiationRequest{}, end, ErrShortBuffer
+	}
+	return NegotiationRequest{Methods: b[2:end]}, end, nil
+}
+
+// AppendNegotiationRequest appends the message to b, or returns a FieldError if it can not be encoded.
+func AppendNegotiationRequest(b []byte, request NegotiationRequest) ([]byte, error) {
+	if len(request.Methods) == 0 || len(request.Methods) > 255 {
+		return nil, fieldError(MessageNegotiationRequest, "NMETHODS", len(request.Methods))
+	}
+	b = append(b, Version, byte(len(request.Methods)))
+	return append(b, request.Methods...), nil
+}
+
+// ReadNegotiationRequest reads the message into buf, which should be MaxNegotiationRequestLen bytes.
+func ReadNegotiationRequest(r io.Reader, buf []byte) (NegotiationRequest, error) {
+	var request NegotiationRequest
+	_, err := readMessage(r, buf, 2, func(b []byte) (n int, err error) {
+		request, n, err = ParseNegotiationRequest(b)
+		return
+	})
+	return request, err
+}
+
+// NegotiationReply is the method selection message of the server.
+type NegotiationReply struct {
+	Method byte
+}
+
+// ParseNegotiationReply parses the message at the beginning of b and returns its length, as ParseNegotiationRequest does.
+func ParseNegotiationReply(b []byte) (NegotiationReply, int, error) {
+	if len(b) < NegotiationReplyLen {
+		return NegotiationReply{}, NegotiationReplyLen, ErrShortBuffer
+	}
+	if b[0] != Version {
+		return NegotiationReply{}, 0, fieldError(MessageNegotiationReply, "VER", int(b[0]))
+	}
+	return NegotiationReply{Method: b[1]}, NegotiationReplyLen, nil
+}
+
+// AppendNegotiationReply appends the message to b.
+func AppendNegotiationReply(b []byte, reply NegotiationReply) []byte {
+	return append(b, Version, reply.Method)
+}
+
+// ReadNegotiationReply reads the message into buf, which should be NegotiationReplyLen bytes.
+func ReadNegotiationReply(r io.Reader, buf []byte) (NegotiationReply, error) {
+	var reply NegotiationReply
+	_, err := readMessage(r, buf, NegotiationReplyLen, func(b []byte) (n int, err error) {
+		reply, n, err = ParseNegotiationReply(b)
+		return
+	})
+	return reply, err
+}
+
+// UserPasswordRequest is the USERNAME/PASSWORD request of RFC 1929.
+type UserPasswordRequest struct {
+	Username []byte
+	Password []byte
+}
+
+// ParseUserPasswordRequest parses the message at the beginning of b and returns its length, as ParseNegotiationRequest does.
+func ParseUserPasswordRequest(b []byte) (UserPasswordRequest, int, error) {
+	if len(b) < 2 {
+		return UserPasswordRequest{}, 2, ErrShortBuffer
+	}
+	if b[0] != UserPasswordVersion {
+		return UserPasswordRequest{}, 0, fieldError(MessageUserPasswordRequest, "VER", int(b[0]))
+	}
+	if b[1] == 0 {
+		return UserPasswordRequest{}, 0, fieldError(MessageUserPasswordRequest, "ULEN", 0)
+	}
+	passwordLengthAt := 2 + int(b[1])
+	if len(b) < passwordLengthAt+1 {
+		return UserPasswordRequest{}, passwordLengthAt + 1, ErrShortBuffer
+	}
+	if b[passwordLengthAt] == 0 {
+		return UserPasswordRequest{}, 0, fieldError(MessageUserPasswordRequest, "PLEN", 0)
+	}
+	end := passwordLengthAt + 1 + int(b[passwordLengthAt])
+	if len(b) < end {
+		return UserPasswordRequest{}, end, ErrShortBuffer
+	}
+	return UserPasswordRequest{
+		Username: b[2:passwordLengthAt],
+		Password: b[passwordLengthAt+1 : end],
+	}, end, nil
+}
+
+// AppendUserPasswordRequest appends the message to b, or returns a FieldError if it can not be encoded.
+func AppendUserPasswordRequest(b []byte, request UserPasswordRequest) ([]byte, error) {
+	if len(request.Username) == 0 || len(request.Username) > 255 {
+		return nil, fieldError(MessageUserPasswordRequest, "ULEN", len(request.Username))
+	}
+	if len(request.Password) == 0 || len(request.Password) > 255 {
+		return nil, fieldError(MessageUserPasswordRequest, "PLEN", len(request.Password))
+	}
+	b = append(b, UserPasswordVersion, byte(len(request.Username)))
+	b = append(b, request.Username...)
+	b = append(b, byte(len(request.Password)))
+	return append(b, request.Password...), nil
+}
+
+// ReadUserPasswordRequest reads the message into buf, which should be MaxUserPasswordRequestLen bytes.
+func ReadUserPasswordRequest(r io.Reader, buf []byte) (UserPasswordRequest, error) {
+	var request UserPasswordRequest
+	_, err := readMessage(r, buf, 2, func(b []byte) (n int, err error) {
+		request, n, err = ParseUserPasswordRequest(b)
+		return
+	})
+	return request, err
+}
+
+// UserPasswordReply is the USERNAME/PASSWORD reply of RFC 1929.
+type UserPasswordReply struct {
+	Status byte
+}
+
+// ParseUserPasswordReply parses the message at the beginning of b and returns its length, as ParseNegotiationRequest does.
+func ParseUserPasswordReply(b []byte) (UserPasswordReply, int, error) {
+	if len(b) < UserPasswordReplyLen {
+		return UserPasswordReply{}, UserPasswordReplyLen, ErrShortBuffer
+	}
+	if b[0] != UserPasswordVersion {
+		return UserPasswordReply{}, 0, fieldError(MessageUserPasswordReply, "VER", int(b[0]))
+	}
+	return UserPasswordReply{Status: b[1]}, UserPasswordReplyLen, nil
+}
+
+// AppendUserPasswordReply appends the message to b.
+func AppendUserPasswordReply(b []byte, reply UserPasswordReply) []byte {
+	return append(b, UserPasswordVersion, reply.Status)
+}
+
+// ReadUserPasswordReply reads the message into buf, which should be UserPasswordReplyLen bytes.
+func ReadUserPasswordReply(r io.Reader, buf []byte) (UserPasswordReply, error) {
+	var reply UserPasswordReply
+	_, err := readMessage(r, buf, UserPasswordReplyLen, func(b []byte) (n int, err error) {
+		reply, n, err = ParseUserPasswordReply(b)
+		return
+	})
+	return reply, err
+}
+
+// Request is the request of the client. CMD is returned as it is, and whether a command,
+// including a private one, is supported is up to the server.
+type Request struct {
+	Cmd  byte
+	Addr Addr
+}
+
+// ParseRequest parses the message at the beginning of b and returns its length, as ParseNegotiationRequest does.
+func ParseRequest(b []byte) (Request, int, error) {
+	if len(b) < 4 {
+		return Request{}, 4, ErrShortBuffer
+	}
+	if b[0] != Version {
+		return Request{}, 0, fieldError(MessageRequest, "VER", int(b[0]))
+	}
+	if b[2] != 0x00 {
+		return Request{}, 0, fieldError(MessageRequest, "RSV", int(b[2]))
+	}
+	addr, n, err := parseAddr(b[3:], MessageRequest, "DST")
+	if err != nil && err != ErrShortBuffer {
+		return Request{}, 0, err
+	}
+	return Request{Cmd: b[1], Addr: addr}, 3 + n, err
+}
+
+// AppendRequest appends the message to b, or returns a FieldError if it can not be encoded.
+func AppendRequest(b []byte, request Request) ([]byte, error) {
+	return request.Addr.appendTo(append(b, Version, request.Cmd, 0x00), MessageRequest, "DST")
+}
+
+// ReadRequest reads the message into buf, which should be MaxRequestLen bytes.
+func ReadRequest(r io.Reader, buf []byte) (Request, error) {
+	var request Request
+	_, err := readMessage(r, buf, 4, func(b []byte) (n int, err error) {
+		request, n, err = ParseRequest(b)
+		return
+	})
+	return request, err
+}
+
+// Reply is the reply of the server to a request.
+type Reply struct {
+	Rep  byte
+	Addr Addr
+}
+
+// ParseReply parses the message at the beginning of b and returns its length, as ParseNegotiationRequest does.
+func ParseReply(b []byte) (Reply, int, error) {
+	if len(b) < 4 {
+		return Reply{}, 4, ErrShortBuffer
+	}
+	if b[0] != Version {
+		return Reply{}, 0, fieldError(MessageReply, "VER", int(b[0]))
+	}
+	if b[2] != 0x00 {
+		return Reply{}, 0, fieldError(MessageReply, "RSV", int(b[2]))
+	}
+	addr, n, err := parseAddr(b[3:], MessageReply, "BND")
+	if err != nil && err != ErrShortBuffer {
+		return Reply{}, 0, err
+	}
+	return Reply{Rep: b[1], Addr: addr}, 3 + n, err
+}
+
+// AppendReply appends the message to b, or returns a FieldError if it can not be encoded.
+func AppendReply(b []byte, reply Reply) ([]byte, error) {
+	return reply.Addr.appendTo(append(b, Version, reply.Rep, 0x00), MessageReply, "BND")
+}
+
+// ReadReply reads the message into buf, which should be MaxReplyLen bytes.
+func ReadReply(r io.Reader, buf []byte) (Reply, error) {
+	var reply Reply
+	_, err := readMessage(r, buf, 4, func(b []byte) (n int, err error) {
+		reply, n, err = ParseReply(b)
+		return
+	})
+	return reply, err
+}
+
+// UDPHeader is the header of a UDP datagram relayed by the server.
+type UDPHeader struct {
+	Frag byte
+	Addr Addr
+}
+
+// ParseUDPHeader parses the header at the beginning of the datagram and returns its length,
+// from which the data start.
+func ParseUDPHeader(b []byte) (UDPHeader, int, error) {
+	if len(b) < 4 {
+		return UDPHeader{}, 4, ErrShortBuffer
+	}
+	if b[0] != 0x00 || b[1] != 0x00 {
+		return UDPHeader{}, 0, fieldError(MessageUDPHeader, "RSV", int(b[0])<<8|int(b[1]))
+	}
+	addr, n, err := parseAddr(b[3:], MessageUDPHeader, "DST")
+	if err != nil && err != ErrShortBuffer {
+		return UDPHeader{}, 0, err
+	}
+	return UDPHeader{Frag: b[2], Addr: addr}, 3 + n, err
+}
+
+// AppendUDPHeader appends the header to b, or returns a FieldError if it can not be encoded.
+func AppendUDPHeader(b []byte, header UDPHeader) ([]byte, error) {
+	return header.Addr.appendTo(append(b, 0x00, 0x00, header.Frag), MessageUDPHeader, "DST")
+}
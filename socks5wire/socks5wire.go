@@ -0,0 +1,127 @@
+// Package socks5wire encodes and decodes the messages of SOCKS5 (RFC 1928) and of its
+// USERNAME/PASSWORD authentication (RFC 1929).
+//
+// The Parse functions do not allocate: the messages they return refer to the bytes given to them.
+// The Append functions append the encoded message to a slice, so that a buffer can be reused.
+package socks5wire
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Version is the VER field of the SOCKS5 messages.
+const Version byte = 0x05
+
+// Authentication methods.
+const (
+	MethodNoAuthRequired   byte = 0x00
+	MethodGSSAPI           byte = 0x01
+	MethodUsernamePassword byte = 0x02
+	MethodNoAcceptable     byte = 0xFF
+)
+
+// Commands of the requests.
+const (
+	CmdConnect   byte = 0x01
+	CmdBind      byte = 0x02
+	CmdAssociate byte = 0x03
+	// CmdReverseBind is the private command of mysocks that asks the server to listen for the client
+	// and to multiplex the connections accepted over the rest of the session.
+	CmdReverseBind byte = 0xF0
+)
+
+// Address types.
+const (
+	AtypIPv4   byte = 0x01
+	AtypDomain byte = 0x03
+	AtypIPv6   byte = 0x04
+)
+
+// REP codes of the replies.
+const (
+	RepSucceeded        byte = 0x00
+	RepGeneralFailure   byte = 0x01
+	RepNotAllowed       byte = 0x02
+	RepNetUnreachable   byte = 0x03
+	RepHostUnreachable  byte = 0x04
+	RepConnRefused      byte = 0x05
+	RepTTLExpired       byte = 0x06
+	RepCmdNotSupported  byte = 0x07
+	RepAddrNotSupported byte = 0x08
+)
+
+// UserPasswordVersion is the VER field of the USERNAME/PASSWORD messages.
+const UserPasswordVersion byte = 0x01
+
+// STATUS of the USERNAME/PASSWORD reply. Any other value than success is a failure.
+const (
+	UserPasswordStatusSuccess byte = 0x00
+	UserPasswordStatusFailure byte = 0x01
+)
+
+// Maximum lengths of the messages, which are enough for the buffers given to the Read functions.
+const (
+	MaxNegotiationRequestLen  = 2 + 255
+	NegotiationReplyLen       = 2
+	MaxUserPasswordRequestLen = 1 + 1 + 255 + 1 + 255
+	UserPasswordReplyLen      = 2
+	MaxRequestLen             = 4 + 1 + 255 + 2
+	MaxReplyLen               = MaxRequestLen
+	MaxUDPHeaderLen           = MaxRequestLen
+)
+
+// Names of the messages in the errors.
+const (
+	MessageNegotiationRequest  = "negotiation request"
+	MessageNegotiationReply    = "negotiation reply"
+	MessageUserPasswordRequest = "username/password request"
+	MessageUserPasswordReply   = "username/password reply"
+	MessageRequest             = "request"
+	MessageReply               = "reply"
+	MessageUDPHeader           = "UDP request header"
+)
+
+// ErrShortBuffer is returned when the bytes given end before the message does,
+// or when the buffer given to a Read function is too small for the message.
+var ErrShortBuffer = errors.New("socks5wire: short buffer")
+
+// FieldError is returned when a field of a message has an invalid value.
+type FieldError struct {
+	// Message is one of the Message constants.
+	Message string
+	// Field is the name of the field in the RFC, like "VER" or "ATYP".
+	Field string
+	Value int
+}
+
+func (err *FieldError) Error() string {
+	return fmt.Sprintf("socks5wire: invalid %s in the %s: %#x", err.Field, err.Message, err.Value)
+}
+
+func fieldError(message string, field string, value int) error {
+	return &FieldError{Message: message, Field: field, Value: value}
+}
+
+// readMessage reads a message with parse, which returns ErrShortBuffer with the length needed
+// so far when the bytes are not enough. It never reads beyond the message.
+func readMessage(r io.Reader, buf []byte, minLength int, parse func([]byte) (int, error)) (int, error) {
+	have := 0
+	need := minLength
+	for {
+		if need > len(buf) {
+			return 0, ErrShortBuffer
+		}
+		if _, err := io.ReadFull(r, buf[have:need]); err != nil {
+			return 0, err
+		}
+		have = need
+		n, err := parse(buf[:have])
+		if err == ErrShortBuffer && n > have {
+			need = n
+			continue
+		}
+		return n, err
+	}
+}
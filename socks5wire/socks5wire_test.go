@@ -0,0 +1,252 @@
+package socks5wire
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	addrs := []Addr{
+		IPAddr(net.ParseIP("192.0.2.1"), 80),
+		IPAddr(net.ParseIP("2001:db8::1"), 443),
+		DomainAddr("example.com", 8080),
+	}
+
+	for _, addr := range addrs {
+		b, err := AppendRequest(nil, Request{Cmd: CmdConnect, Addr: addr})
+		if err != nil {
+			t.Fatal(err)
+		}
+		request, n, err := ParseRequest(b)
+		if err != nil || n != len(b) {
+			t.Fatalf("%s: %d %v", addr, n, err)
+		}
+		if request.Cmd != CmdConnect || !reflect.DeepEqual(request.Addr, addr) {
+			t.Fatalf("%s expected, but got %s", addr, request.Addr)
+		}
+
+		b, err = AppendReply(nil, Reply{Rep: RepHostUnreachable, Addr: addr})
+		if err != nil {
+			t.Fatal(err)
+		}
+		reply, n, err := ParseReply(b)
+		if err != nil || n != len(b) || reply.Rep != RepHostUnreachable || !reflect.DeepEqual(reply.Addr, addr) {
+			t.Fatalf("%s: %+v %d %v", addr, reply, n, err)
+		}
+
+		b, err = AppendUDPHeader(nil, UDPHeader{Addr: addr})
+		if err != nil {
+			t.Fatal(err)
+		}
+		b = append(b, "data"...)
+		header, n, err := ParseUDPHeader(b)
+		if err != nil || string(b[n:]) != "data" || !reflect.DeepEqual(header.Addr, addr) {
+			t.Fatalf("%s: %+v %q %v", addr, header, b[n:], err)
+		}
+	}
+
+	b, err := AppendNegotiationRequest(nil, NegotiationRequest{Methods: []byte{MethodNoAuthRequired, MethodUsernamePassword}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, []byte{0x05, 0x02, 0x00, 0x02}) {
+		t.Fatalf("unexpected bytes: %#v", b)
+	}
+	negotiationRequest, _, err := ParseNegotiationRequest(b)
+	if err != nil || !bytes.Equal(negotiationRequest.Methods, []byte{0x00, 0x02}) {
+		t.Fatalf("%+v %v", negotiationRequest, err)
+	}
+
+	negotiationReply, _, err := ParseNegotiationReply(AppendNegotiationReply(nil, NegotiationReply{Method: MethodUsernamePassword}))
+	if err != nil || negotiationReply.Method != MethodUsernamePassword {
+		t.Fatalf("%+v %v", negotiationReply, err)
+	}
+
+	b, err = AppendUserPasswordRequest(nil, UserPasswordRequest{Username: []byte("alice"), Password: []byte("secret")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	userPasswordRequest, n, err := ParseUserPasswordRequest(b)
+	if err != nil || n != len(b) || string(userPasswordRequest.Username) != "alice" || string(userPasswordRequest.Password) != "secret" {
+		t.Fatalf("%+v %d %v", userPasswordRequest, n, err)
+	}
+
+	userPasswordReply, _, err := ParseUserPasswordReply(AppendUserPasswordReply(nil, UserPasswordReply{Status: UserPasswordStatusFailure}))
+	if err != nil || userPasswordReply.Status != UserPasswordStatusFailure {
+		t.Fatalf("%+v %v", userPasswordReply, err)
+	}
+}
+
+func TestFieldError(t *testing.T) {
+	tests := []struct {
+		parse   func([]byte) (int, error)
+		b       []byte
+		message string
+		field   string
+		value   int
+	}{
+		{parseNegotiationRequest, []byte{0x04, 0x01, 0x00}, MessageNegotiationRequest, "VER", 0x04},
+		{parseNegotiationRequest, []byte{0x05, 0x00}, MessageNegotiationRequest, "NMETHODS", 0},
+		{parseNegotiationReply, []byte{0x01, 0x00}, MessageNegotiationReply, "VER", 0x01},
+		{parseUserPasswordRequest, []byte{0x05, 0x01, 'a', 0x01, 'b'}, MessageUserPasswordRequest, "VER", 0x05},
+		{parseUserPasswordRequest, []byte{0x01, 0x00, 0x01, 'b'}, MessageUserPasswordRequest, "ULEN", 0},
+		{parseUserPasswordRequest, []byte{0x01, 0x01, 'a', 0x00}, MessageUserPasswordRequest, "PLEN", 0},
+		{parseUserPasswordReply, []byte{0x05, 0x00}, MessageUserPasswordReply, "VER", 0x05},
+		{parseRequest, []byte{0x04, 0x01, 0x00, 0x01, 1, 2, 3, 4, 0, 80}, MessageRequest, "VER", 0x04},
+		{parseRequest, []byte{0x05, 0x01, 0x01, 0x01, 1, 2, 3, 4, 0, 80}, MessageRequest, "RSV", 0x01},
+		{parseRequest, []byte{0x05, 0x01, 0x00, 0x02, 1, 2, 3, 4, 0, 80}, MessageRequest, "ATYP", 0x02},
+		{parseRequest, []byte{0x05, 0x01, 0x00, 0x03, 0x00, 0, 80}, MessageRequest, "DST.ADDR", 0},
+		{parseReply, []byte{0x04, 0x00, 0x00, 0x01, 1, 2, 3, 4, 0, 80}, MessageReply, "VER", 0x04},
+		{parseReply, []byte{0x05, 0x00, 0x00, 0x03, 0x00, 0, 80}, MessageReply, "BND.ADDR", 0},
+		{parseUDPHeader, []byte{0x00, 0x01, 0x00, 0x01, 1, 2, 3, 4, 0, 80}, MessageUDPHeader, "RSV", 0x0001},
+		{parseUDPHeader, []byte{0x00, 0x00, 0x00, 0x05, 1, 2, 3, 4, 0, 80}, MessageUDPHeader, "ATYP", 0x05},
+	}
+
+	for _, test := range tests {
+		_, err := test.parse(test.b)
+		var fieldErr *FieldError
+		if !errors.As(err, &fieldErr) {
+			t.Fatalf("%#v: a FieldError expected, but got %v", test.b, err)
+		}
+		if fieldErr.Message != test.message || fieldErr.Field != test.field || fieldErr.Value != test.value {
+			t.Fatalf("%#v: unexpected error: %v", test.b, err)
+		}
+	}
+
+	// CMD is left to the server, so that an unknown command can be replied to with REP X'07'.
+	if request, _, err := ParseRequest([]byte{0x05, 0x09, 0x00, 0x01, 1, 2, 3, 4, 0, 80}); err != nil || request.Cmd != 0x09 {
+		t.Fatalf("an unknown CMD expected to be returned, but got %#v: %v", request.Cmd, err)
+	}
+
+	if _, err := AppendRequest(nil, Request{Cmd: CmdConnect, Addr: DomainAddr("", 80)}); err == nil {
+		t.Fatal("an error expected for the empty domain name")
+	}
+	if _, err := AppendUserPasswordRequest(nil, UserPasswordRequest{Username: make([]byte, 256), Password: []byte("p")}); err == nil {
+		t.Fatal("an error expected for the long user name")
+	}
+}
+
+func TestShortBuffer(t *testing.T) {
+	messages := []struct {
+		parse func([]byte) (int, error)
+		b     []byte
+	}{
+		{parseNegotiationRequest, []byte{0x05, 0x02, 0x00, 0x02}},
+		{parseNegotiationReply, []byte{0x05, 0x00}},
+		{parseUserPasswordRequest, []byte{0x01, 0x01, 'a', 0x02, 'b', 'c'}},
+		{parseUserPasswordReply, []byte{0x01, 0x00}},
+		{parseRequest, []byte{0x05, 0x01, 0x00, 0x03, 0x03, 'a', '.', 'b', 0, 80}},
+		{parseRequest, []byte{0x05, 0x01, 0x00, 0x04, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 80}},
+		{parseReply, []byte{0x05, 0x00, 0x00, 0x01, 1, 2, 3, 4, 0, 80}},
+		{parseUDPHeader, []byte{0x00, 0x00, 0x00, 0x01, 1, 2, 3, 4, 0, 80}},
+	}
+
+	for _, message := range messages {
+		for i := 0; i < len(message.b); i++ {
+			n, err := message.parse(message.b[:i])
+			if err != ErrShortBuffer {
+				t.Fatalf("%#v: ErrShortBuffer expected, but got %v", message.b[:i], err)
+			}
+			if n <= i || n > len(message.b) {
+				t.Fatalf("%#v: unexpected length needed: %d", message.b[:i], n)
+			}
+		}
+		if n, err := message.parse(message.b); err != nil || n != len(message.b) {
+			t.Fatalf("%#v: %d %v", message.b, n, err)
+		}
+	}
+}
+
+func TestReadMessage(t *testing.T) {
+	b, _ := AppendRequest(nil, Request{Cmd: CmdAssociate, Addr: DomainAddr("example.com", 53)})
+	b = append(b, "after the request"...)
+	reader := bytes.NewReader(b)
+
+	// The message is read byte by byte so that every partial read is exercised.
+	request, err := ReadRequest(io.LimitReader(oneByteReader{reader}, int64(len(b))), make([]byte, MaxRequestLen))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if request.Cmd != CmdAssociate || request.Addr.String() != "example.com:53" {
+		t.Fatalf("unexpected request: %+v", request)
+	}
+	rest, _ := io.ReadAll(reader)
+	if string(rest) != "after the request" {
+		t.Fatalf("the bytes after the request have been read: %q", rest)
+	}
+
+	if _, err := ReadRequest(bytes.NewReader(b), make([]byte, 8)); err != ErrShortBuffer {
+		t.Fatalf("ErrShortBuffer expected, but got %v", err)
+	}
+	if _, err := ReadRequest(bytes.NewReader(b[:6]), make([]byte, MaxRequestLen)); err != io.ErrUnexpectedEOF {
+		t.Fatalf("io.ErrUnexpectedEOF expected, but got %v", err)
+	}
+}
+
+func TestParseDoesNotAllocate(t *testing.T) {
+	request, _ := AppendRequest(nil, Request{Cmd: CmdConnect, Addr: DomainAddr("example.com", 443)})
+	userPasswordRequest, _ := AppendUserPasswordRequest(nil, UserPasswordRequest{Username: []byte("alice"), Password: []byte("secret")})
+	udpHeader, _ := AppendUDPHeader(nil, UDPHeader{Addr: IPAddr(net.ParseIP("2001:db8::1"), 53)})
+	buf := make([]byte, 0, MaxRequestLen)
+
+	allocs := testing.AllocsPerRun(100, func() {
+		ParseRequest(request)
+		ParseUserPasswordRequest(userPasswordRequest)
+		ParseUDPHeader(udpHeader)
+		ParseNegotiationRequest([]byte{0x05, 0x01, 0x00})
+		AppendReply(buf[:0], Reply{Addr: IPAddr(net.IPv4(192, 0, 2, 1), 80)})
+	})
+	if allocs != 0 {
+		t.Fatalf("no allocations expected, but got %v", allocs)
+	}
+}
+
+type oneByteReader struct {
+	r io.Reader
+}
+
+func (reader oneByteReader) Read(p []byte) (int, error) {
+	if len(p) > 1 {
+		p = p[:1]
+	}
+	return reader.r.Read(p)
+}
+
+func parseNegotiationRequest(b []byte) (int, error) {
+	_, n, err := ParseNegotiationRequest(b)
+	return n, err
+}
+
+func parseNegotiationReply(b []byte) (int, error) {
+	_, n, err := ParseNegotiationReply(b)
+	return n, err
+}
+
+func parseUserPasswordRequest(b []byte) (int, error) {
+	_, n, err := ParseUserPasswordRequest(b)
+	return n, err
+}
+
+func parseUserPasswordReply(b []byte) (int, error) {
+	_, n, err := ParseUserPasswordReply(b)
+	return n, err
+}
+
+func parseRequest(b []byte) (int, error) {
+	_, n, err := ParseRequest(b)
+	return n, err
+}
+
+func parseReply(b []byte) (int, error) {
+	_, n, err := ParseReply(b)
+	return n, err
+}
+
+func parseUDPHeader(b []byte) (int, error) {
+	_, n, err := ParseUDPHeader(b)
+	return n, err
+}
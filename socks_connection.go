@@ -1,49 +1,372 @@
 package mysocks
 
 import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"net"
+	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type socksConnection struct {
-	clientTCPConn  *net.Conn
-	server         *Server
-	udpAssociation *udpAssociation
+	// id identifies the session in the logs.
+	id string
+	// clientTCPConn is the connection the session reads and writes, which may be replaced
+	// by an authentication method that encapsulates the rest of the session.
+	clientTCPConn *net.Conn
+	// acceptedConn is the connection as accepted. It is never replaced, so other goroutines use it
+	// to close the session and to get the address of the client.
+	acceptedConn net.Conn
+	server       *Server
+	// udpConn is the UDP socket of the listener that accepted the session.
+	udpConn *net.UDPConn
+	// udpAssociation is set once by the session goroutine and read by the UDP goroutine.
+	udpAssociation atomic.Pointer[udpAssociation]
+	// rateLimiter is set once the user is known, before the command is processed.
+	rateLimiter atomic.Pointer[sessionRateLimiter]
+	startedAt   time.Time
+	// authenticatedByCertificate is true if the user has been identified by the TLS client certificate.
+	authenticatedByCertificate bool
+	// forward is the forward that accepted the session, or nil.
+	forward *forward
+	// withoutSocks is true if the client does not speak SOCKS, as the connections diverted by the firewall.
+	// No SOCKS message is exchanged.
+	withoutSocks bool
+
+	closeReasonMutex sync.Mutex
+	closeReason      string
+
+	// info is written by the session goroutine and read by the admin API.
+	infoMutex sync.Mutex
+	info      sessionInfo
+
+	// The following are recorded in the access log along with info.
+	// rep is the REP code of the last reply sent, or -1.
+	rep       atomic.Int32
+	bytesUp   atomic.Int64
+	bytesDown atomic.Int64
+}
+
+// sessionInfo is what is known about a session so far.
+type sessionInfo struct {
+	// userName is the authenticated user, or empty if no authentication has been done.
+	userName    string
+	command     byte
+	destination string
+	resolvedIP  string
+	route       string
+	// attributes are given to the user by an external authenticator.
+	attributes userAttributes
 }
 
-const udpTimeout = 60
+// Reasons why a session is closed by the server.
+const (
+	closeReasonHandshakeTimeout = "handshake timeout"
+	closeReasonConnectTimeout   = "connect timeout"
+	closeReasonTCPIdleTimeout   = "TCP idle timeout"
+	closeReasonUDPIdleTimeout   = "UDP idle timeout"
+	closeReasonLifetimeExceeded = "session lifetime exceeded"
+	closeReasonServerClosed     = "server closed"
+	closeReasonNoAcceptable     = "no acceptable method"
+	closeReasonAuthFailed       = "authentication failed"
+	closeReasonProtocolError    = "protocol error"
+	closeReasonConnectFailed    = "connect failed"
+	closeReasonCompleted        = "completed"
+	closeReasonKilledByAdmin    = "killed by admin"
+	closeReasonQuotaExceeded    = "quota exceeded"
+	closeReasonTLSHandshake     = "TLS handshake failed"
+	closeReasonNotAllowed       = "destination not allowed"
+	closeReasonNoOriginalDst    = "original destination unknown"
+	closeReasonBindFailed       = "bind failed"
+)
+
+// routeDirect means that the destination is connected from this server.
+const routeDirect = "direct"
 
-func newSocksConnection(tcpConn *net.Conn, server *Server) *socksConnection {
-	return &socksConnection{
+func newSocksConnection(tcpConn *net.Conn, server *Server, udpConn *net.UDPConn) *socksConnection {
+	socksConnection := &socksConnection{
+		id:            newSessionID(),
 		clientTCPConn: tcpConn,
+		acceptedConn:  *tcpConn,
 		server:        server,
+		udpConn:       udpConn,
+		startedAt:     time.Now(),
 	}
+	socksConnection.rep.Store(-1)
+	return socksConnection
 }
 
-func (socksConnection *socksConnection) logWithLevel(level int, message string) {
-	fields := map[string]interface{}{
-		"clientAddressOfTCPConnection": (*socksConnection.clientTCPConn).RemoteAddr().String(),
+func newSessionID() string {
+	bytes := make([]byte, 8)
+	if _, err := rand.Read(bytes); err != nil {
+		return fmt.Sprintf("%016x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(bytes)
+}
+
+// accessRecord returns the record of the session for the access log.
+func (socksConnection *socksConnection) accessRecord() accessRecord {
+	info := socksConnection.getInfo()
+	record := accessRecord{
+		Time:          time.Now(),
+		SessionID:     socksConnection.id,
+		ClientAddress: socksConnection.acceptedConn.RemoteAddr().String(),
+		User:          info.userName,
+		Destination:   info.destination,
+		ResolvedIP:    info.resolvedIP,
+		Route:         info.route,
+		Rep:           int(socksConnection.rep.Load()),
+		BytesUp:       socksConnection.bytesUp.Load(),
+		BytesDown:     socksConnection.bytesDown.Load(),
+		DurationMs:    float64(time.Since(socksConnection.startedAt)) / float64(time.Millisecond),
+		CloseReason:   socksConnection.getCloseReason(),
+	}
+	if info.command != 0 {
+		record.Command = cmdName(info.command)
+	}
+	if record.CloseReason == "" {
+		record.CloseReason = closeReasonCompleted
+	}
+	return record
+}
+
+func (socksConnection *socksConnection) timeouts() timeouts {
+	return socksConnection.server.timeoutsFor(socksConnection.getInfo().userName)
+}
+
+func (socksConnection *socksConnection) getInfo() sessionInfo {
+	socksConnection.infoMutex.Lock()
+	defer socksConnection.infoMutex.Unlock()
+	return socksConnection.info
+}
+
+func (socksConnection *socksConnection) setUserName(userName string) {
+	socksConnection.infoMutex.Lock()
+	defer socksConnection.infoMutex.Unlock()
+	socksConnection.info.userName = userName
+}
+
+func (socksConnection *socksConnection) setAttributes(attributes userAttributes) {
+	socksConnection.infoMutex.Lock()
+	defer socksConnection.infoMutex.Unlock()
+	socksConnection.info.attributes = attributes
+}
+
+func (socksConnection *socksConnection) setRequest(command byte, destination string) {
+	socksConnection.infoMutex.Lock()
+	defer socksConnection.infoMutex.Unlock()
+	socksConnection.info.command = command
+	socksConnection.info.destination = destination
+}
+
+// setRoute records how the destination is reached. resolvedIP is empty if it is not known.
+func (socksConnection *socksConnection) setRoute(route string, resolvedIP string) {
+	socksConnection.infoMutex.Lock()
+	defer socksConnection.infoMutex.Unlock()
+	socksConnection.info.route = route
+	socksConnection.info.resolvedIP = resolvedIP
+}
+
+// authenticateByCertificate identifies the user by the client certificate verified in the TLS handshake, if any.
+func (socksConnection *socksConnection) authenticateByCertificate(state tls.ConnectionState) {
+	clientCertificates := socksConnection.server.clientCertificates
+	if clientCertificates == nil || len(state.PeerCertificates) == 0 {
+		return
+	}
+	userName := clientCertificates.identityOf(state.PeerCertificates[0])
+	socksConnection.setUserName(userName)
+	socksConnection.authenticatedByCertificate = true
+	socksConnection.logSubsystem(logSubsystemHandshake, logLevelInfo, "The user has been authenticated by the client certificate.", nil)
+}
+
+// authenticateWith performs the sub-negotiation of a registered authentication method.
+// It returns false if the session has to be closed.
+func (socksConnection *socksConnection) authenticateWith(method byte, authMethod AuthMethod) bool {
+	userName, conn, err := authMethod.Authenticate(*socksConnection.clientTCPConn)
+	if err != nil {
+		socksConnection.checkHandshakeTimeout(err)
+		observeHandshake(methodName(method), err)
+		if errors.Is(err, ErrAuthenticationFailed) {
+			metricAuthFailures.Inc()
+			socksConnection.setCloseReason(closeReasonAuthFailed)
+			socksConnection.logWithLevel(logLevelWarn, fmt.Sprintf("Authentication failed with the method: %s", methodName(method)))
+		} else {
+			socksConnection.setCloseReason(closeReasonProtocolError)
+			socksConnection.logWithLevel(logLevelError, fmt.Sprintf("Failed the sub-negotiation of the method %s: %v", methodName(method), err))
+		}
+		return false
+	}
+
+	if conn != nil {
+		// The following messages are encapsulated by the method.
+		*socksConnection.clientTCPConn = conn
+	}
+	if userName != "" {
+		socksConnection.setUserName(userName)
+	}
+
+	// The user may have a different handshake timeout.
+	if err := socksConnection.setHandshakeDeadline(); err != nil {
+		socksConnection.logWithLevel(logLevelError, "Failed to set the handshake deadline.")
+		return false
 	}
-	if socksConnection.udpAssociation != nil {
-		fields["addressOfClientUDPSocket"] = socksConnection.udpAssociation.clientAddr.String()
+	return true
+}
+
+// countBytes records the bytes relayed for the command in the session, the metrics and the accounting.
+func (socksConnection *socksConnection) countBytes(command byte, up int64, down int64) {
+	socksConnection.bytesUp.Add(up)
+	socksConnection.bytesDown.Add(down)
+	metricBytes.WithLabelValues(cmdName(command), metricDirectionUp).Add(float64(up))
+	metricBytes.WithLabelValues(cmdName(command), metricDirectionDown).Add(float64(down))
+	if userName := socksConnection.getInfo().userName; userName != "" {
+		socksConnection.server.accounting.addBytes(userName, up, down)
+	}
+}
+
+// kill closes the client connection, which ends the session.
+func (socksConnection *socksConnection) kill(reason string) {
+	socksConnection.setCloseReason(reason)
+	socksConnection.acceptedConn.Close()
+}
+
+// setCloseReason remembers why the session is being closed. Only the first reason is kept.
+func (socksConnection *socksConnection) setCloseReason(reason string) {
+	socksConnection.closeReasonMutex.Lock()
+	defer socksConnection.closeReasonMutex.Unlock()
+	if socksConnection.closeReason == "" {
+		socksConnection.closeReason = reason
+	}
+}
+
+func (socksConnection *socksConnection) getCloseReason() string {
+	socksConnection.closeReasonMutex.Lock()
+	defer socksConnection.closeReasonMutex.Unlock()
+	return socksConnection.closeReason
+}
+
+// setHandshakeDeadline limits the handshake with the timeout of the current user,
+// counted from the start of the session.
+func (socksConnection *socksConnection) setHandshakeDeadline() error {
+	deadline := deadlineAfter(socksConnection.startedAt, socksConnection.timeouts().Handshake.value())
+	return (*socksConnection.clientTCPConn).SetDeadline(deadline)
+}
+
+// checkHandshakeTimeout records the handshake timeout if err was caused by it.
+// No reply is sent because the client has not finished its message.
+func (socksConnection *socksConnection) checkHandshakeTimeout(err error) {
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		socksConnection.setCloseReason(closeReasonHandshakeTimeout)
+		socksConnection.logWithLevel(logLevelWarn, "The handshake has timed out.")
+	}
+}
+
+// observeHandshake records the outcome of a handshake in the metrics.
+func observeHandshake(method string, err error) {
+	result := metricResultSuccess
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		result = metricResultTimeout
+	} else if err != nil {
+		result = metricResultFailure
 	}
+	metricHandshakes.WithLabelValues(method, result).Inc()
+}
 
-	logWithLevel(level, message, fields)
+// startLifetimeTimer closes the client connection when the lifetime of the session is exceeded.
+// The returned function stops the timer.
+func (socksConnection *socksConnection) startLifetimeTimer() func() {
+	lifetime := socksConnection.timeouts().Lifetime.value()
+	if lifetime <= 0 {
+		return func() {}
+	}
+	timer := time.AfterFunc(time.Until(socksConnection.startedAt.Add(lifetime)), func() {
+		socksConnection.setCloseReason(closeReasonLifetimeExceeded)
+		socksConnection.logWithLevel(logLevelWarn, "The session lifetime has been exceeded.")
+		socksConnection.acceptedConn.Close()
+	})
+	return func() {
+		timer.Stop()
+	}
+}
+
+func (socksConnection *socksConnection) logWithLevel(level int, message string) {
+	logSubsystemWithLevel(logSubsystemServer, level, message, socksConnection.logFields(nil))
+}
+
+// logSubsystem logs a message of the subsystem with the fields of the session added to the given ones.
+func (socksConnection *socksConnection) logSubsystem(subsystem string, level int, message string, fields map[string]interface{}) {
+	logSubsystemWithLevel(subsystem, level, message, socksConnection.logFields(fields))
+}
+
+func (socksConnection *socksConnection) logFields(fields map[string]interface{}) map[string]interface{} {
+	if fields == nil {
+		fields = map[string]interface{}{}
+	}
+	fields["sessionID"] = socksConnection.id
+	fields["clientAddressOfTCPConnection"] = socksConnection.acceptedConn.RemoteAddr().String()
+	if userName := socksConnection.getInfo().userName; userName != "" {
+		fields["user"] = userName
+	}
+	if socksConnection.forward != nil {
+		fields["forward"] = socksConnection.forward.name
+	}
+	if udpAssociation := socksConnection.udpAssociation.Load(); udpAssociation != nil {
+		fields["addressOfClientUDPSocket"] = udpAssociation.getClientAddr().String()
+	}
+	return fields
 }
 
 func (socksConnection *socksConnection) remoteIP() net.IP {
-	return (*socksConnection.clientTCPConn).RemoteAddr().(*net.TCPAddr).IP
+	return socksConnection.acceptedConn.RemoteAddr().(*net.TCPAddr).IP
 }
 
-func (socksConnection *socksConnection) handle() {
-	defer func() {
-		(*socksConnection.clientTCPConn).Close()
+// end closes the connection of the session and records it.
+func (socksConnection *socksConnection) end() {
+	(*socksConnection.clientTCPConn).Close()
+	if reason := socksConnection.getCloseReason(); reason != "" {
+		socksConnection.logWithLevel(logLevelInfo, fmt.Sprintf("TCP connection has been closed. Reason: %s", reason))
+	} else {
 		socksConnection.logWithLevel(logLevelInfo, "TCP connection has been closed.")
-	}()
+	}
+	if socksConnection.server.accessLog != nil {
+		socksConnection.server.accessLog.write(socksConnection.accessRecord())
+	}
+}
+
+func (socksConnection *socksConnection) handle() {
+	defer socksConnection.end()
+
+	if err := socksConnection.setHandshakeDeadline(); err != nil {
+		socksConnection.logWithLevel(logLevelError, "Failed to set the handshake deadline.")
+		return
+	}
+
+	if tlsConn, ok := socksConnection.acceptedConn.(*tls.Conn); ok {
+		if err := tlsConn.Handshake(); err != nil {
+			socksConnection.checkHandshakeTimeout(err)
+			socksConnection.setCloseReason(closeReasonTLSHandshake)
+			socksConnection.logSubsystem(logSubsystemHandshake, logLevelWarn, "The TLS handshake has failed.",
+				map[string]interface{}{"error": err.Error()})
+			return
+		}
+		socksConnection.authenticateByCertificate(tlsConn.ConnectionState())
+	}
 
 	negotiationRequest, err := newNegotiationRequestFrom(socksConnection)
 	if err != nil {
+		socksConnection.checkHandshakeTimeout(err)
+		if err == errNegotiationMethodNotSupported {
+			socksConnection.setCloseReason(closeReasonNoAcceptable)
+			observeHandshake(methodName(noAcceptable), err)
+		} else {
+			socksConnection.setCloseReason(closeReasonProtocolError)
+			observeHandshake("unknown", err)
+		}
 		if err == errNegotiationMethodNotSupported {
 			negotiationReply := newNegotiationReply(noAcceptable, socksConnection)
 			if _, err := negotiationReply.WriteTo(*socksConnection.clientTCPConn); err != nil {
@@ -56,15 +379,23 @@ func (socksConnection *socksConnection) handle() {
 		return
 	}
 
-	negotiationReply := newNegotiationReply(methodToUseIn(negotiationRequest.methods), socksConnection)
+	method := socksConnection.methodToUseIn(negotiationRequest.methods)
+	negotiationReply := newNegotiationReply(method, socksConnection)
 	if _, err := negotiationReply.WriteTo(*socksConnection.clientTCPConn); err != nil {
 		socksConnection.logWithLevel(logLevelError, "Failed to write the negotiation reply.")
 		return
 	}
 
-	if methodNeedsUserPasswordAuth(negotiationReply.method) {
+	if authMethod, ok := socksConnection.server.authMethod(negotiationReply.method); ok {
+		if !socksConnection.authenticateWith(negotiationReply.method, authMethod) {
+			return
+		}
+	} else if methodNeedsUserPasswordAuth(negotiationReply.method) {
 		userPasswordAuthRequest, err := newUserPasswordAuthRequestFrom(socksConnection)
 		if err != nil {
+			socksConnection.checkHandshakeTimeout(err)
+			socksConnection.setCloseReason(closeReasonProtocolError)
+			observeHandshake(methodName(negotiationReply.method), err)
 			socksConnection.logWithLevel(logLevelError, "Failed to read the user password authentication request.")
 			return
 		}
@@ -72,17 +403,49 @@ func (socksConnection *socksConnection) handle() {
 		userName := userPasswordAuthRequest.usernameAsString()
 		password := userPasswordAuthRequest.passwordAsString()
 
-		authSuccess := authenticate(userName, password)
+		decision, err := socksConnection.server.authenticatePassword(credentialsCheck{
+			userName: userName,
+			password: password,
+			clientIP: socksConnection.remoteIP(),
+			method:   negotiationReply.method,
+		})
+		if err != nil {
+			socksConnection.logSubsystem(logSubsystemHandshake, logLevelError,
+				"Failed to consult the authentication backend. The failure policy has been applied.",
+				map[string]interface{}{"error": redactSecret(err.Error(), password), "allowed": decision.allowed})
+		}
+		authSuccess := decision.allowed
 
 		userPasswordAuthReply := newUserPasswordAuthReply(authSuccess, socksConnection)
 		if _, err := userPasswordAuthReply.WriteTo(*socksConnection.clientTCPConn); err != nil {
 			socksConnection.logWithLevel(logLevelError, "Failed to write the authentication reply.")
 			return
 		}
+		if !authSuccess {
+			metricAuthFailures.Inc()
+			socksConnection.setCloseReason(closeReasonAuthFailed)
+			observeHandshake(methodName(negotiationReply.method), ErrAuthenticationFailed)
+			// The user name is given as a field, since some clients send a password in it by mistake.
+			socksConnection.logSubsystem(logSubsystemServer, logLevelWarn, "Authentication failed for the user.",
+				map[string]interface{}{"user": userName})
+			return
+		}
+
+		socksConnection.setUserName(userName)
+		socksConnection.setAttributes(decision.attributes)
+
+		// The user may have a different handshake timeout.
+		if err := socksConnection.setHandshakeDeadline(); err != nil {
+			socksConnection.logWithLevel(logLevelError, "Failed to set the handshake deadline.")
+			return
+		}
 	}
 
 	request, err := newRequestFrom(socksConnection)
+	observeHandshake(methodName(negotiationReply.method), err)
 	if err != nil {
+		socksConnection.checkHandshakeTimeout(err)
+		socksConnection.setCloseReason(closeReasonProtocolError)
 		if err == errRequestCmdNotSupported {
 			reply := newErrorReply(repCmdNotSupported, atypIPv4, socksConnection)
 			if _, err := reply.WriteTo(*socksConnection.clientTCPConn); err != nil {
@@ -103,93 +466,195 @@ func (socksConnection *socksConnection) handle() {
 		return
 	}
 
-	err = request.processCmd()
-	if err != nil {
-		if err == errRequestNotReacheble {
-			reply := newErrorReply(repHostUnreach, atypIPv4, socksConnection)
+	if err := (*socksConnection.clientTCPConn).SetDeadline(time.Time{}); err != nil {
+		socksConnection.logWithLevel(logLevelError, "Failed to clear the handshake deadline.")
+		return
+	}
+
+	socksConnection.process(request)
+}
+
+// process applies the quotas, the ACL and the rate limits to the request and carries it out.
+func (socksConnection *socksConnection) process(request *request) {
+	stopLifetimeTimer := socksConnection.startLifetimeTimer()
+	defer stopLifetimeTimer()
+
+	socksConnection.setRequest(request.cmd, request.destAddress())
+
+	if userName := socksConnection.getInfo().userName; userName != "" {
+		accounting := socksConnection.server.accounting
+		if exceeded := accounting.exceededQuota(userName, socksConnection.server.config.Load().userQuotas(userName)); exceeded != "" {
+			metricACLDenials.WithLabelValues("quota").Inc()
+			socksConnection.setCloseReason(closeReasonQuotaExceeded)
+			socksConnection.logWithLevel(logLevelWarn, fmt.Sprintf("The %s quota of user %s has been exceeded.", exceeded, userName))
+			reply := newErrorReply(repDenied, atypIPv4, socksConnection)
 			if _, err := reply.WriteTo(*socksConnection.clientTCPConn); err != nil {
 				socksConnection.logWithLevel(logLevelError, "Failed to write the reply.")
-				return
 			}
+			return
+		}
+		accounting.addSession(userName)
+	}
+
+	if request.cmd != cmdAssociate && request.cmd != cmdReverseBind && !destinationAllowed(socksConnection.getInfo().attributes.allowedDestinations, request.destAddress()) {
+		metricACLDenials.WithLabelValues("destination").Inc()
+		socksConnection.setCloseReason(closeReasonNotAllowed)
+		socksConnection.logWithLevel(logLevelWarn, fmt.Sprintf("The destination is not allowed to the user: %s", request.destAddress()))
+		reply := newErrorReply(repDenied, atypIPv4, socksConnection)
+		if _, err := reply.WriteTo(*socksConnection.clientTCPConn); err != nil {
+			socksConnection.logWithLevel(logLevelError, "Failed to write the reply.")
+		}
+		return
+	}
+
+	info := socksConnection.getInfo()
+	rateLimiters := socksConnection.server.rateLimiters
+	rateLimiter := rateLimiters.newSessionRateLimiter(info.userName, socksConnection.remoteIP().String(), info.attributes.rateLimit)
+	socksConnection.rateLimiter.Store(rateLimiter)
+	defer rateLimiters.release(rateLimiter)
+
+	err := request.processCmd()
+	if rep, ok := repOfConnectErrors[err]; ok {
+		if err == errRequestConnectTimeout {
+			socksConnection.setCloseReason(closeReasonConnectTimeout)
+		} else {
+			socksConnection.setCloseReason(closeReasonConnectFailed)
+		}
+		reply := newErrorReply(rep, atypIPv4, socksConnection)
+		if _, err := reply.WriteTo(*socksConnection.clientTCPConn); err != nil {
+			socksConnection.logWithLevel(logLevelError, "Failed to write the reply.")
+			return
 		}
 	}
 }
 
+// resetUnlessConnected makes the client connection be reset when it is closed, unless the destination
+// has been connected. A client that does not speak SOCKS sees the failure as if it had connected by itself.
+func (socksConnection *socksConnection) resetUnlessConnected() {
+	if socksConnection.rep.Load() == int32(repSucceeded) {
+		return
+	}
+	if tcpConn, ok := socksConnection.acceptedConn.(*net.TCPConn); ok {
+		tcpConn.SetLinger(0)
+	}
+}
+
+// handleUDP sends the datagram from the client to the destination server.
+// The first datagram to a destination creates a socket for it, and the replies from
+// the destination are relayed back to the client until the association ends.
 func (socksConnection *socksConnection) handleUDP(datagram *datagram) {
-	if socksConnection.udpAssociation.destConn == nil {
-		conn, err := net.Dial("udp", datagram.destAddress())
-		if err != nil {
-			socksConnection.logWithLevel(logLevelError, fmt.Sprintf("Error: %v", err))
+	udpAssociation := socksConnection.udpAssociation.Load()
+	defer recoverDatagram(udpAssociation.getClientAddr())
+	destAddress := datagram.destAddress()
+
+	if !destinationAllowed(socksConnection.getInfo().attributes.allowedDestinations, destAddress) {
+		metricACLDenials.WithLabelValues("destination").Inc()
+		metricUDPDatagrams.WithLabelValues(metricDirectionUp, metricUDPDropped).Inc()
+		socksConnection.logSubsystem(logSubsystemUDP, logLevelDebug, "A UDP datagram to a destination not allowed has been dropped.",
+			map[string]interface{}{"to": destAddress})
+		return
+	}
+
+	if !socksConnection.rateLimiter.Load().allow(relayUp, int64(len(datagram.data))) {
+		metricUDPDatagrams.WithLabelValues(metricDirectionUp, metricUDPDropped).Inc()
+		socksConnection.logSubsystem(logSubsystemUDP, logLevelDebug, "A UDP datagram over the rate limit has been dropped.",
+			map[string]interface{}{"to": destAddress, "size": len(datagram.data)})
+		return
+	}
+
+	destConn, created, err := udpAssociation.destConnFor(destAddress)
+	if err != nil {
+		metricUDPDatagrams.WithLabelValues(metricDirectionUp, metricUDPDropped).Inc()
+		if err != errUDPAssociationEnded {
+			socksConnection.logSubsystem(logSubsystemUDP, logLevelError,
+				fmt.Sprintf("Failed to create a UDP socket to '%s': %v", destAddress, err), nil)
+		}
+		return
+	}
+	if created {
+		socksConnection.logSubsystem(logSubsystemUDP, logLevelInfo,
+			fmt.Sprintf("A UDP socket has been created to: %s, from: %s", destAddress, destConn.LocalAddr().String()), nil)
+
+		go socksConnection.relayUDPFromDest(udpAssociation, destAddress, destConn, datagram.dst)
+	}
+
+	if _, err := destConn.Write(datagram.data); err != nil {
+		metricUDPDatagrams.WithLabelValues(metricDirectionUp, metricUDPDropped).Inc()
+		socksConnection.logSubsystem(logSubsystemUDP, logLevelError, "Failed to write UDP data to the destination.",
+			map[string]interface{}{"to": destAddress, "error": err.Error()})
+		return
+	}
+	metricUDPDatagrams.WithLabelValues(metricDirectionUp, metricUDPRelayed).Inc()
+	socksConnection.countBytes(cmdAssociate, int64(len(datagram.data)), 0)
+	socksConnection.logSubsystem(logSubsystemUDP, logLevelDebug, "A UDP data has been sent to the destination.",
+		map[string]interface{}{"to": destAddress, "size": len(datagram.data), "data": datagram.data})
+}
+
+// relayUDPFromDest sends the datagrams from the destination server to the client.
+// It owns destConn and closes it when it returns.
+func (socksConnection *socksConnection) relayUDPFromDest(udpAssociation *udpAssociation, destAddress string, destConn *net.UDPConn, dst dst) {
+	var closeReason string
+	defer func() {
+		udpAssociation.removeDestConn(destAddress, destConn)
+		if closeReason != "" {
+			socksConnection.logSubsystem(logSubsystemUDP, logLevelInfo,
+				fmt.Sprintf("UDP connection to '%s' has been closed. Reason: %s", destAddress, closeReason), nil)
+		} else {
+			socksConnection.logSubsystem(logSubsystemUDP, logLevelInfo, "UDP connection has been closed.", nil)
+		}
+	}()
+
+	buf := make([]byte, maxUDPPayloadSize)
+	for {
+		if err := destConn.SetReadDeadline(deadlineAfter(time.Now(), socksConnection.timeouts().UDPIdle.value())); err != nil {
 			return
 		}
 
-		socksConnection.logWithLevel(logLevelInfo,
-			fmt.Sprintf("A UDP socket has been created to: %s, from: %s", datagram.destAddress(), conn.LocalAddr().String()))
-
-		socksConnection.udpAssociation.destConn = conn.(*net.UDPConn)
-
-		// Send the datagram from the destination server to the client
-
-		go func() {
-			defer func() {
-				socksConnection.udpAssociation.destConn.Close()
-				socksConnection.udpAssociation.destConn = nil
-				socksConnection.logWithLevel(logLevelInfo, "UDP connection has been closed.")
-			}()
-
-			for {
-				select {
-				case <-socksConnection.udpAssociation.association:
-					socksConnection.logWithLevel(logLevelInfo, "UDP association has been closed.")
-					return
-				default:
-					if err := conn.SetDeadline(time.Now().Add(time.Duration(udpTimeout) * time.Second)); err != nil {
-						return
-					}
-
-					buf := make([]byte, 65507) // 65507 is the maximum UDP payload size
-					socksConnection.logWithLevel(logLevelInfo,
-						fmt.Sprintf("Waiting for a UDP data from %s", socksConnection.udpAssociation.destConn.RemoteAddr().String()))
-					n, err := socksConnection.udpAssociation.destConn.Read(buf)
-					if err != nil {
-						socksConnection.logWithLevel(logLevelError,
-							fmt.Sprintf("Failed to read UDP data from '%s': %v",
-								socksConnection.udpAssociation.destConn.RemoteAddr().String(), err))
-						return
-					}
-
-					socksConnection.logWithLevel(logLevelInfo,
-						fmt.Sprintf("A UDP data received from '%s': %v", socksConnection.udpAssociation.destConn.RemoteAddr().String(), buf[:n]))
-
-					datagramSentToClient := newDatagram(datagram.dst, buf[:n])
-
-					if _, err := socksConnection.server.udpConn.WriteToUDP(
-						datagramSentToClient.bytes(),
-						socksConnection.udpAssociation.clientAddr); err != nil {
-						socksConnection.logWithLevel(logLevelError,
-							fmt.Sprintf("Failed to write UDP data to '%s': %v", socksConnection.udpAssociation.clientAddr, err))
-						return
-					}
+		n, err := destConn.Read(buf)
+		if err != nil {
+			select {
+			case <-udpAssociation.association:
+				socksConnection.logSubsystem(logSubsystemUDP, logLevelInfo, "UDP association has been closed.", nil)
+			default:
+				if errors.Is(err, os.ErrDeadlineExceeded) {
+					// The destination has been idle, which is how the sockets to the destinations expire.
+					closeReason = closeReasonUDPIdleTimeout
+				} else {
+					socksConnection.logSubsystem(logSubsystemUDP, logLevelError,
+						fmt.Sprintf("Failed to read UDP data from '%s': %v", destAddress, err), nil)
 				}
 			}
-		}()
-	}
+			return
+		}
 
-	// Send the datagram from the client to the destination server
+		udpAssociation.touch()
 
-	select {
-	case <-socksConnection.udpAssociation.association:
-		socksConnection.logWithLevel(logLevelInfo, "UDP association has been closed.")
-		return
-	default:
-		_, err := socksConnection.udpAssociation.destConn.Write(datagram.data)
+		socksConnection.logSubsystem(logSubsystemUDP, logLevelDebug, "A UDP data has been received from the destination.",
+			map[string]interface{}{"from": destAddress, "size": n, "data": buf[:n]})
+
+		if !socksConnection.rateLimiter.Load().allow(relayDown, int64(n)) {
+			metricUDPDatagrams.WithLabelValues(metricDirectionDown, metricUDPDropped).Inc()
+			socksConnection.logSubsystem(logSubsystemUDP, logLevelDebug, "A UDP datagram over the rate limit has been dropped.",
+				map[string]interface{}{"from": destAddress, "size": n})
+			continue
+		}
+
+		datagramSentToClient, err := newDatagram(dst, buf[:n]).bytes()
 		if err != nil {
-			socksConnection.logWithLevel(logLevelError,
-				fmt.Sprintf("Failed to write UDP data to '%s': %v",
-					socksConnection.udpAssociation.destConn.RemoteAddr().String(), err))
+			metricUDPDatagrams.WithLabelValues(metricDirectionDown, metricUDPDropped).Inc()
+			socksConnection.logSubsystem(logSubsystemUDP, logLevelError, "Failed to encode the UDP datagram to the client.",
+				map[string]interface{}{"error": err.Error()})
+			return
+		}
+
+		clientAddr := udpAssociation.getClientAddr()
+		if _, err := socksConnection.udpConn.WriteToUDP(datagramSentToClient, clientAddr); err != nil {
+			metricUDPDatagrams.WithLabelValues(metricDirectionDown, metricUDPDropped).Inc()
+			socksConnection.logSubsystem(logSubsystemUDP, logLevelError, "Failed to write UDP data to the client.",
+				map[string]interface{}{"to": clientAddr.String(), "error": err.Error()})
 			return
 		}
-		socksConnection.logWithLevel(logLevelInfo,
-			fmt.Sprintf("A UDP data sent to '%s': %v", socksConnection.udpAssociation.destConn.RemoteAddr().String(), datagram.data))
+		metricUDPDatagrams.WithLabelValues(metricDirectionDown, metricUDPRelayed).Inc()
+		socksConnection.countBytes(cmdAssociate, 0, int64(n))
 	}
 }
@@ -3,34 +3,200 @@ package mysocks
 import (
 	"fmt"
 	"net"
+	"sort"
+	"sync"
 )
 
+// socksConnections is the registry of the active sessions.
+// The accept goroutine adds sessions, the session goroutines remove them and register their
+// UDP associations, and the UDP goroutine looks the associations up, so every access is
+// guarded by mutex.
 type socksConnections struct {
-	connections map[string]*socksConnection
+	mutex sync.Mutex
+	// all holds every active session.
+	all map[*socksConnection]struct{}
+	// udpByClientAddr holds the sessions with a UDP association, keyed by the client UDP address.
+	udpByClientAddr map[string]*socksConnection
+	// pendingUDPByIP holds the sessions with a UDP association whose client UDP port is not known yet,
+	// keyed by the client IP in the order of registration.
+	pendingUDPByIP map[string][]*socksConnection
+	// empty is closed when there is no active session, and replaced when one is added.
+	empty chan struct{}
 }
 
 func newSocksConnections() *socksConnections {
+	empty := make(chan struct{})
+	close(empty)
 	return &socksConnections{
-		connections: make(map[string]*socksConnection),
+		all:             make(map[*socksConnection]struct{}),
+		udpByClientAddr: make(map[string]*socksConnection),
+		pendingUDPByIP:  make(map[string][]*socksConnection),
+		empty:           empty,
 	}
 }
 
 func (socksConnections *socksConnections) add(sc *socksConnection) {
-	sc.logWithLevel(logLevelInfo, fmt.Sprintf("Remote IP remembered: %v", sc.remoteIP()))
-	socksConnections.connections[sc.remoteIP().String()] = sc
+	socksConnections.mutex.Lock()
+	defer socksConnections.mutex.Unlock()
+	if len(socksConnections.all) == 0 {
+		socksConnections.empty = make(chan struct{})
+	}
+	socksConnections.all[sc] = struct{}{}
 }
 
 func (socksConnections *socksConnections) remove(sc *socksConnection) {
-	sc.logWithLevel(logLevelInfo, fmt.Sprintf("Remote IP forgotten: %v", sc.remoteIP()))
-	delete(socksConnections.connections, sc.remoteIP().String())
+	socksConnections.mutex.Lock()
+	defer socksConnections.mutex.Unlock()
+	socksConnections.removeUDPAssociationLocked(sc)
+	if _, ok := socksConnections.all[sc]; !ok {
+		return
+	}
+	delete(socksConnections.all, sc)
+	if len(socksConnections.all) == 0 {
+		close(socksConnections.empty)
+	}
+}
+
+// addUDPAssociation makes the UDP association of the session reachable from the UDP listener.
+// If the client told the port it will send from, only that address is accepted.
+// Otherwise the first unknown address from the client IP is bound to the oldest pending association.
+func (socksConnections *socksConnections) addUDPAssociation(sc *socksConnection) {
+	clientAddr := sc.udpAssociation.Load().clientAddrForAccessLimit
+
+	socksConnections.mutex.Lock()
+	defer socksConnections.mutex.Unlock()
+	if clientAddr.Port != 0 {
+		socksConnections.udpByClientAddr[clientAddr.String()] = sc
+		sc.udpAssociation.Load().setClientAddr(clientAddr)
+		sc.logWithLevel(logLevelInfo, fmt.Sprintf("UDP client address remembered: %v", clientAddr))
+		return
+	}
+	ip := clientAddr.IP.String()
+	socksConnections.pendingUDPByIP[ip] = append(socksConnections.pendingUDPByIP[ip], sc)
+	sc.logWithLevel(logLevelInfo, fmt.Sprintf("UDP client IP remembered: %v", ip))
+}
+
+func (socksConnections *socksConnections) removeUDPAssociation(sc *socksConnection) {
+	socksConnections.mutex.Lock()
+	defer socksConnections.mutex.Unlock()
+	socksConnections.removeUDPAssociationLocked(sc)
+}
+
+func (socksConnections *socksConnections) removeUDPAssociationLocked(sc *socksConnection) {
+	udpAssociation := sc.udpAssociation.Load()
+	if udpAssociation == nil {
+		return
+	}
+	if clientAddr := udpAssociation.getClientAddr(); clientAddr != nil {
+		if socksConnections.udpByClientAddr[clientAddr.String()] == sc {
+			delete(socksConnections.udpByClientAddr, clientAddr.String())
+			sc.logWithLevel(logLevelInfo, fmt.Sprintf("UDP client address forgotten: %v", clientAddr))
+		}
+		return
+	}
+	ip := udpAssociation.clientAddrForAccessLimit.IP.String()
+	pending := socksConnections.pendingUDPByIP[ip]
+	for i, pendingSC := range pending {
+		if pendingSC == sc {
+			pending = append(pending[:i:i], pending[i+1:]...)
+			break
+		}
+	}
+	if len(pending) == 0 {
+		delete(socksConnections.pendingUDPByIP, ip)
+	} else {
+		socksConnections.pendingUDPByIP[ip] = pending
+	}
+}
+
+// getByUDPClientAddr returns the session whose UDP association accepts datagrams from the address,
+// or nil if there is none.
+func (socksConnections *socksConnections) getByUDPClientAddr(clientAddr *net.UDPAddr) *socksConnection {
+	socksConnections.mutex.Lock()
+	defer socksConnections.mutex.Unlock()
+	if sc, ok := socksConnections.udpByClientAddr[clientAddr.String()]; ok {
+		return sc
+	}
+
+	ip := clientAddr.IP.String()
+	pending := socksConnections.pendingUDPByIP[ip]
+	if len(pending) == 0 {
+		return nil
+	}
+	sc := pending[0]
+	if len(pending) == 1 {
+		delete(socksConnections.pendingUDPByIP, ip)
+	} else {
+		socksConnections.pendingUDPByIP[ip] = pending[1:]
+	}
+	socksConnections.udpByClientAddr[clientAddr.String()] = sc
+	sc.udpAssociation.Load().setClientAddr(clientAddr)
+	sc.logWithLevel(logLevelInfo, fmt.Sprintf("UDP client address remembered: %v", clientAddr))
+	return sc
+}
+
+// count returns the number of active sessions.
+func (socksConnections *socksConnections) count() int {
+	socksConnections.mutex.Lock()
+	defer socksConnections.mutex.Unlock()
+	return len(socksConnections.all)
+}
+
+// drained returns a channel that is closed when there is no active session.
+func (socksConnections *socksConnections) drained() <-chan struct{} {
+	socksConnections.mutex.Lock()
+	defer socksConnections.mutex.Unlock()
+	return socksConnections.empty
+}
+
+// closeAll closes the client connections of all the active sessions
+// and returns how many of them were closed.
+func (socksConnections *socksConnections) closeAll() int {
+	socksConnections.mutex.Lock()
+	defer socksConnections.mutex.Unlock()
+	for sc := range socksConnections.all {
+		sc.kill(closeReasonServerClosed)
+	}
+	return len(socksConnections.all)
 }
 
-func (socksConnections *socksConnections) get(remoteIP net.IP) *socksConnection {
-	return socksConnections.connections[remoteIP.String()]
+// list returns the active sessions in the order they were started.
+func (socksConnections *socksConnections) list() []*socksConnection {
+	socksConnections.mutex.Lock()
+	defer socksConnections.mutex.Unlock()
+	list := make([]*socksConnection, 0, len(socksConnections.all))
+	for sc := range socksConnections.all {
+		list = append(list, sc)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].startedAt.Before(list[j].startedAt)
+	})
+	return list
+}
+
+// getByID returns the active session with the ID, or nil if there is none.
+func (socksConnections *socksConnections) getByID(id string) *socksConnection {
+	socksConnections.mutex.Lock()
+	defer socksConnections.mutex.Unlock()
+	for sc := range socksConnections.all {
+		if sc.id == id {
+			return sc
+		}
+	}
+	return nil
 }
 
-func (socksConnections *socksConnections) closeAll() {
-	for _, sc := range socksConnections.connections {
-		(*sc.clientTCPConn).Close()
+// closeByUser closes the client connections of the active sessions of the user
+// and returns how many of them were closed.
+func (socksConnections *socksConnections) closeByUser(userName string, reason string) int {
+	socksConnections.mutex.Lock()
+	defer socksConnections.mutex.Unlock()
+	closed := 0
+	for sc := range socksConnections.all {
+		if sc.getInfo().userName == userName {
+			sc.kill(reason)
+			closed++
+		}
 	}
+	return closed
 }
@@ -0,0 +1,206 @@
+package mysocks
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jfuruya/mysocks/socks5wire"
+)
+
+// Run with `go test -race` to detect data races between the sessions.
+
+const (
+	stressConnectSessions = 2000
+	stressUDPSessions     = 1000
+	// stressConcurrency is kept below the goroutine limit of the race detector.
+	stressConcurrency = 200
+)
+
+func startUDPEchoServer(t *testing.T) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, maxUDPPayloadSize)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP(buf[:n], addr)
+		}
+	}()
+	return conn
+}
+
+// runConcurrently runs the function for each index with the limited concurrency
+// and reports the errors.
+func runConcurrently(t *testing.T, count int, f func(i int) error) {
+	var waitGroup sync.WaitGroup
+	semaphore := make(chan struct{}, stressConcurrency)
+	errs := make(chan error, count)
+	for i := 0; i < count; i++ {
+		waitGroup.Add(1)
+		semaphore <- struct{}{}
+		go func(i int) {
+			defer waitGroup.Done()
+			defer func() { <-semaphore }()
+			if err := f(i); err != nil {
+				errs <- fmt.Errorf("session %d: %w", i, err)
+			}
+		}(i)
+	}
+	waitGroup.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func waitForSessionsToEnd(t *testing.T) {
+	select {
+	case <-server.socksConnections.drained():
+	case <-time.After(10 * time.Second):
+		t.Fatalf("%d sessions are still active", server.socksConnections.count())
+	}
+}
+
+func stressSessions(count int) int {
+	if testing.Short() {
+		return count / 10
+	}
+	return count
+}
+
+func TestStressConnect(t *testing.T) {
+	StartServer()
+	defer StopServer()
+
+	echoServer := startEchoServer(t)
+	defer echoServer.Close()
+
+	dialer := dialerThrough("", "")
+
+	runConcurrently(t, stressSessions(stressConnectSessions), func(i int) error {
+		conn, err := dialer.Dial("tcp", echoServer.Addr().String())
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+		message := bytes.Repeat([]byte(fmt.Sprintf("%08d", i)), 512)
+		if _, err := conn.Write(message); err != nil {
+			return err
+		}
+		received := make([]byte, len(message))
+		if _, err := io.ReadFull(conn, received); err != nil {
+			return err
+		}
+		if !bytes.Equal(received, message) {
+			return fmt.Errorf("unexpected echo")
+		}
+		return nil
+	})
+
+	waitForSessionsToEnd(t)
+}
+
+func TestStressUDPAssociate(t *testing.T) {
+	StartServer()
+	defer StopServer()
+
+	echoServer := startUDPEchoServer(t)
+	defer echoServer.Close()
+	echoAddr := echoServer.LocalAddr().(*net.UDPAddr)
+
+	runConcurrently(t, stressSessions(stressUDPSessions), func(i int) error {
+		udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			return err
+		}
+		defer udpConn.Close()
+
+		tcpConn, err := associateUDP(udpConn.LocalAddr().(*net.UDPAddr))
+		if err != nil {
+			return err
+		}
+		defer tcpConn.Close()
+
+		proxyUDPAddr, err := net.ResolveUDPAddr("udp", proxyAddress)
+		if err != nil {
+			return err
+		}
+
+		header := []byte{0x00, 0x00, 0x00, atypIPv4}
+		header = append(header, echoAddr.IP.To4()...)
+		header = binary.BigEndian.AppendUint16(header, uint16(echoAddr.Port))
+
+		for j := 0; j < 3; j++ {
+			payload := []byte(fmt.Sprintf("session %d datagram %d", i, j))
+			if _, err := udpConn.WriteToUDP(append(header, payload...), proxyUDPAddr); err != nil {
+				return err
+			}
+
+			udpConn.SetReadDeadline(time.Now().Add(10 * time.Second))
+			buf := make([]byte, 1024)
+			n, _, err := udpConn.ReadFromUDP(buf)
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(buf[:n], append(header, payload...)) {
+				return fmt.Errorf("unexpected datagram: %v", buf[:n])
+			}
+		}
+		return nil
+	})
+
+	waitForSessionsToEnd(t)
+}
+
+// associateUDP sends a UDP ASSOCIATE request that tells the address the client sends datagrams from.
+func associateUDP(clientAddr *net.UDPAddr) (net.Conn, error) {
+	conn, err := net.Dial("tcp", proxyAddress)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	if _, err := conn.Write([]byte{fiexedVer, 0x01, noAuthRequired}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	negotiationReply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, negotiationReply); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	request := []byte{fiexedVer, cmdAssociate, fixedRsv, atypIPv4}
+	request = append(request, clientAddr.IP.To4()...)
+	request = binary.BigEndian.AppendUint16(request, uint16(clientAddr.Port))
+	if _, err := conn.Write(request); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	reply, err := socks5wire.ReadReply(conn, make([]byte, socks5wire.MaxReplyLen))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if reply.Rep != repSucceeded {
+		conn.Close()
+		return nil, fmt.Errorf("UDP ASSOCIATE failed: %#v", reply.Rep)
+	}
+
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
@@ -0,0 +1,112 @@
+package mysocks
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// timeouts are the time limits of a session. Zero means no limit once they are in effect.
+// In the configuration file, an omitted timeout inherits the global one and 0 disables it.
+type timeouts struct {
+	// Handshake limits the negotiation, the authentication and the request.
+	Handshake duration `json:"handshake"`
+	// Connect limits the connection to the destination.
+	Connect duration `json:"connect"`
+	// TCPIdle limits the time without any data in both directions of a CONNECT.
+	TCPIdle duration `json:"tcpIdle"`
+	// UDPIdle limits the time without any datagram in a UDP association.
+	UDPIdle duration `json:"udpIdle"`
+	// Lifetime limits the whole session regardless of the activity.
+	Lifetime duration `json:"lifetime"`
+}
+
+const (
+	defaultHandshakeTimeout = 10 * time.Second
+	defaultConnectTimeout   = 10 * time.Second
+	defaultTCPIdleTimeout   = 60 * time.Second
+	defaultUDPIdleTimeout   = 60 * time.Second
+)
+
+// globalTimeouts returns the timeouts from the environment variables, falling back to
+// the ones in the configuration file and then to the defaults.
+func globalTimeouts(fromFile timeouts) timeouts {
+	return timeouts{
+		Handshake: duration(durationEnv("MYSOCKS_HANDSHAKE_TIMEOUT", fromFile.Handshake.or(defaultHandshakeTimeout))),
+		Connect:   duration(durationEnv("MYSOCKS_CONNECT_TIMEOUT", fromFile.Connect.or(defaultConnectTimeout))),
+		TCPIdle:   duration(durationEnv("MYSOCKS_TCP_IDLE_TIMEOUT", fromFile.TCPIdle.or(defaultTCPIdleTimeout))),
+		UDPIdle:   duration(durationEnv("MYSOCKS_UDP_IDLE_TIMEOUT", fromFile.UDPIdle.or(defaultUDPIdleTimeout))),
+		Lifetime:  duration(durationEnv("MYSOCKS_SESSION_LIFETIME", fromFile.Lifetime.or(0))),
+	}
+}
+
+// overriddenBy returns the timeouts with the values set in the given ones applied.
+func (t timeouts) overriddenBy(other timeouts) timeouts {
+	return timeouts{
+		Handshake: duration(other.Handshake.or(t.Handshake.value())),
+		Connect:   duration(other.Connect.or(t.Connect.value())),
+		TCPIdle:   duration(other.TCPIdle.or(t.TCPIdle.value())),
+		UDPIdle:   duration(other.UDPIdle.or(t.UDPIdle.value())),
+		Lifetime:  duration(other.Lifetime.or(t.Lifetime.value())),
+	}
+}
+
+// duration is a time.Duration written as "30s" or as a number of seconds in JSON.
+// The zero value means that it is not set, and durationDisabled that it is set to 0.
+type duration time.Duration
+
+// durationDisabled is a duration set to 0 in JSON, which disables the timeout instead of inheriting one.
+const durationDisabled duration = -1
+
+func (d duration) value() time.Duration {
+	if d == durationDisabled {
+		return 0
+	}
+	return time.Duration(d)
+}
+
+// or returns the duration if it is set, and defaultValue otherwise.
+func (d duration) or(defaultValue time.Duration) time.Duration {
+	if d == 0 {
+		return defaultValue
+	}
+	return d.value()
+}
+
+func (d *duration) UnmarshalJSON(bytes []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(bytes, &value); err != nil {
+		return err
+	}
+	switch value := value.(type) {
+	case float64:
+		*d = duration(time.Duration(value * float64(time.Second)))
+	case string:
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		*d = duration(parsed)
+	default:
+		return fmt.Errorf("invalid duration: %s", string(bytes))
+	}
+	if *d < 0 {
+		return fmt.Errorf("negative duration: %s", string(bytes))
+	}
+	if *d == 0 {
+		*d = durationDisabled
+	}
+	return nil
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.value().String())
+}
+
+// deadlineAfter returns the deadline for the given timeout, or the zero time for no timeout.
+func deadlineAfter(start time.Time, timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return start.Add(timeout)
+}
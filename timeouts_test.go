@@ -0,0 +1,220 @@
+package mysocks
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// timeToClose reads the connection until it is closed, and returns how long it has taken.
+func timeToClose(t *testing.T, conn net.Conn) time.Duration {
+	startedAt := time.Now()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	_, err := io.Copy(io.Discard, conn)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal("The connection expected to be closed by the server")
+	}
+	return time.Since(startedAt)
+}
+
+func TestTimeoutsOverriddenBy(t *testing.T) {
+	var config config
+	if err := json.Unmarshal([]byte(`{
+		"timeouts": {"connect": "5s", "tcpIdle": "2m"},
+		"users": {"alice": {"timeouts": {"tcpIdle": 0, "lifetime": 3600}}}
+	}`), &config); err != nil {
+		t.Fatal(err)
+	}
+	global := timeouts{
+		Handshake: duration(config.Timeouts.Handshake.or(defaultHandshakeTimeout)),
+		Connect:   duration(config.Timeouts.Connect.or(defaultConnectTimeout)),
+		TCPIdle:   duration(config.Timeouts.TCPIdle.or(defaultTCPIdleTimeout)),
+	}
+	overridden := global.overriddenBy(config.Users["alice"].Timeouts)
+
+	// Omitted timeouts are inherited, and 0 disables the global one.
+	expected := []struct {
+		name     string
+		timeout  duration
+		expected time.Duration
+	}{
+		{"handshake", overridden.Handshake, defaultHandshakeTimeout},
+		{"connect", overridden.Connect, 5 * time.Second},
+		{"tcpIdle", overridden.TCPIdle, 0},
+		{"lifetime", overridden.Lifetime, time.Hour},
+	}
+	for _, test := range expected {
+		if value := test.timeout.value(); value != test.expected {
+			t.Fatalf("%s: %v expected, but got %v", test.name, test.expected, value)
+		}
+	}
+
+	var negative duration
+	if err := json.Unmarshal([]byte(`"-1s"`), &negative); err == nil {
+		t.Fatal("An error expected for a negative duration")
+	}
+}
+
+func TestSessionTimeouts(t *testing.T) {
+	configPath := t.TempDir() + "/config.json"
+	writeConfig(t, configPath, `{
+		"timeouts": {"handshake": "300ms", "tcpIdle": "300ms", "udpIdle": "300ms"},
+		"users": {
+			"idle": {"password": "idle-password"},
+			"slow": {"password": "slow-password", "timeouts": {"connect": "200ms"}},
+			"quiet": {"password": "quiet-password", "timeouts": {"tcpIdle": 0, "lifetime": "900ms"}},
+			"busy": {"password": "busy-password", "timeouts": {"lifetime": "600ms"}}
+		}
+	}`)
+	os.Setenv("MYSOCKS_CONFIG", configPath)
+	defer os.Setenv("MYSOCKS_CONFIG", "")
+
+	// The dial to blackhole.test takes the connect timeout given by the server.
+	dialTimeouts := make(chan time.Duration, 1)
+	os.Setenv("MYSOCKS_PORT", "0")
+	testServer := NewServer()
+	testServer.dial = func(network string, address string, timeout time.Duration) (net.Conn, error) {
+		if host, _, _ := net.SplitHostPort(address); host == "blackhole.test" {
+			dialTimeouts <- timeout
+			if timeout <= 0 {
+				return nil, errors.New("no connect timeout")
+			}
+			time.Sleep(timeout)
+			return nil, &net.OpError{Op: "dial", Net: network, Err: os.ErrDeadlineExceeded}
+		}
+		return net.DialTimeout(network, address, timeout)
+	}
+	startTestServer(testServer)
+	defer StopServer()
+
+	echoServer := startEchoServer(t)
+	defer echoServer.Close()
+
+	// Handshake: nothing is sent after connecting.
+	conn, err := net.Dial("tcp", proxyAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := timeToClose(t, conn); elapsed < 200*time.Millisecond || elapsed > 5*time.Second {
+		t.Fatalf("The handshake expected to time out after 300ms, but took %v", elapsed)
+	}
+	conn.Close()
+
+	// Connect: the destination does not answer.
+	rep, err := requestThrough("slow", "slow-password", connectRequestTo(t, "blackhole.test:80"))
+	if err != nil || rep != repHostUnreach {
+		t.Fatalf("Host unreachable expected, but got %#x %v", rep, err)
+	}
+	if timeout := <-dialTimeouts; timeout != 200*time.Millisecond {
+		t.Fatalf("The connect timeout of 200ms expected, but got %v", timeout)
+	}
+
+	// TCP idle: nothing is relayed after the reply.
+	conn, rep, err = sessionThrough("idle", "idle-password", connectRequestTo(t, echoServer.Addr().String()))
+	if err != nil || rep != repSucceeded {
+		t.Fatalf("Unexpected reply: %#x %v", rep, err)
+	}
+	if elapsed := timeToClose(t, conn); elapsed < 200*time.Millisecond || elapsed > 5*time.Second {
+		t.Fatalf("The relay expected to time out after 300ms, but took %v", elapsed)
+	}
+	conn.Close()
+
+	// The idle timeout disabled for the user leaves the session to its lifetime.
+	conn, rep, err = sessionThrough("quiet", "quiet-password", connectRequestTo(t, echoServer.Addr().String()))
+	if err != nil || rep != repSucceeded {
+		t.Fatalf("Unexpected reply: %#x %v", rep, err)
+	}
+	if elapsed := timeToClose(t, conn); elapsed < 700*time.Millisecond || elapsed > 5*time.Second {
+		t.Fatalf("The session expected to end by its lifetime of 900ms, but took %v", elapsed)
+	}
+	conn.Close()
+
+	// Lifetime: the session is closed although data are flowing.
+	conn, rep, err = sessionThrough("busy", "busy-password", connectRequestTo(t, echoServer.Addr().String()))
+	if err != nil || rep != repSucceeded {
+		t.Fatalf("Unexpected reply: %#x %v", rep, err)
+	}
+	go func(conn net.Conn) {
+		for {
+			if _, err := conn.Write([]byte("ping")); err != nil {
+				return
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}(conn)
+	if elapsed := timeToClose(t, conn); elapsed < 400*time.Millisecond || elapsed > 5*time.Second {
+		t.Fatalf("The session expected to end by its lifetime of 600ms, but took %v", elapsed)
+	}
+	conn.Close()
+
+	// UDP idle: no datagram is relayed in the association.
+	associateRequest := []byte{fiexedVer, cmdAssociate, fixedRsv, atypIPv4, 0, 0, 0, 0, 0, 0}
+	conn, rep, err = sessionThrough("idle", "idle-password", associateRequest)
+	if err != nil || rep != repSucceeded {
+		t.Fatalf("Unexpected reply: %#x %v", rep, err)
+	}
+	if elapsed := timeToClose(t, conn); elapsed < 200*time.Millisecond || elapsed > 5*time.Second {
+		t.Fatalf("The association expected to time out after 300ms, but took %v", elapsed)
+	}
+	conn.Close()
+
+	waitForSessionsToEnd(t)
+}
+
+func TestUDPIdleTimeoutIsNotAnError(t *testing.T) {
+	configPath := t.TempDir() + "/config.json"
+	writeConfig(t, configPath, `{"timeouts": {"udpIdle": "300ms"}}`)
+	os.Setenv("MYSOCKS_CONFIG", configPath)
+	defer os.Setenv("MYSOCKS_CONFIG", "")
+
+	previous := loggers.Load()
+	defer loggers.Store(previous)
+	var logs lockedBuffer
+	SetSlogHandler(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	StartServer()
+	defer StopServer()
+
+	echoServer := startUDPEchoServer(t)
+	defer echoServer.Close()
+	echoAddr := echoServer.LocalAddr().(*net.UDPAddr)
+
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpConn.Close()
+	tcpConn, err := associateUDP(udpConn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpConn.Close()
+	proxyUDPAddr, err := net.ResolveUDPAddr("udp", proxyAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header := []byte{0x00, 0x00, 0x00, atypIPv4}
+	header = append(header, echoAddr.IP.To4()...)
+	header = binary.BigEndian.AppendUint16(header, uint16(echoAddr.Port))
+	udpConn.WriteToUDP(append(header, "hello"...), proxyUDPAddr)
+	udpConn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, _, err := udpConn.ReadFromUDP(make([]byte, 64)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The association and the socket to the destination expire together.
+	waitForSessionsToEnd(t)
+	for _, line := range strings.Split(logs.String(), "\n") {
+		if strings.Contains(line, "level=ERROR") {
+			t.Fatalf("The UDP idle timeout expected not to be logged as an error: %s", line)
+		}
+	}
+}
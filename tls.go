@@ -0,0 +1,283 @@
+package mysocks
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync/atomic"
+)
+
+// Modes of the client certificate authentication.
+const (
+	// tlsClientAuthNone does not ask the clients for certificates.
+	tlsClientAuthNone = "none"
+	// tlsClientAuthOptional authenticates the clients that send a certificate,
+	// and lets the others authenticate with the SOCKS5 methods.
+	tlsClientAuthOptional = "optional"
+	// tlsClientAuthRequire rejects the clients without a valid certificate.
+	tlsClientAuthRequire = "require"
+)
+
+// Parts of a client certificate that can be used as the identity of the user.
+const (
+	certificateIdentityCN    = "cn"
+	certificateIdentityEmail = "email"
+	certificateIdentityDNS   = "dns"
+	certificateIdentityURI   = "uri"
+)
+
+// tlsVersions are the values accepted by MYSOCKS_TLS_MIN_VERSION.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func parseTLSVersion(version string) (uint16, error) {
+	value, ok := tlsVersions[version]
+	if !ok {
+		return 0, fmt.Errorf("unknown TLS version: %s", version)
+	}
+	return value, nil
+}
+
+// certificateReloader holds the certificate of the TLS listener, which can be replaced
+// by loading the files again without closing the listener.
+type certificateReloader struct {
+	certFile    string
+	keyFile     string
+	certificate atomic.Pointer[tls.Certificate]
+}
+
+func newCertificateReloader(certFile string, keyFile string) (*certificateReloader, error) {
+	reloader := &certificateReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if err := reloader.reload(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+// reload loads the certificate files. If they can not be loaded, the current certificate is kept.
+func (reloader *certificateReloader) reload() error {
+	certificate, err := tls.LoadX509KeyPair(reloader.certFile, reloader.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load the TLS certificate: %w", err)
+	}
+	reloader.certificate.Store(&certificate)
+	return nil
+}
+
+func (reloader *certificateReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return reloader.certificate.Load(), nil
+}
+
+// clientTrust is what client certificates are verified with.
+type clientTrust struct {
+	roots *x509.CertPool
+	// revoked holds the serial numbers in the CRL, which is issued by crlIssuer.
+	revoked   map[string]bool
+	crlIssuer []byte
+}
+
+// clientCertificateVerifier verifies the client certificates and maps them to user names.
+// The CA bundle and the CRL can be replaced by loading the files again.
+type clientCertificateVerifier struct {
+	mode     string
+	identity string
+	caFile   string
+	crlFile  string
+	trust    atomic.Pointer[clientTrust]
+}
+
+func newClientCertificateVerifier(mode string, identity string, caFile string, crlFile string) (*clientCertificateVerifier, error) {
+	switch mode {
+	case tlsClientAuthOptional, tlsClientAuthRequire:
+	default:
+		return nil, fmt.Errorf("unknown TLS client authentication mode: %s", mode)
+	}
+	switch identity {
+	case certificateIdentityCN, certificateIdentityEmail, certificateIdentityDNS, certificateIdentityURI:
+	default:
+		return nil, fmt.Errorf("unknown client certificate identity: %s", identity)
+	}
+	if caFile == "" {
+		return nil, errors.New("MYSOCKS_TLS_CLIENT_CA_FILE must be set to authenticate clients by certificate")
+	}
+
+	verifier := &clientCertificateVerifier{
+		mode:     mode,
+		identity: identity,
+		caFile:   caFile,
+		crlFile:  crlFile,
+	}
+	if err := verifier.reload(); err != nil {
+		return nil, err
+	}
+	return verifier, nil
+}
+
+// reload loads the CA bundle and the CRL. If they can not be loaded, the current ones are kept.
+func (verifier *clientCertificateVerifier) reload() error {
+	caBytes, err := os.ReadFile(verifier.caFile)
+	if err != nil {
+		return fmt.Errorf("failed to load the client CA bundle: %w", err)
+	}
+	var cas []*x509.Certificate
+	for block, rest := pem.Decode(caBytes); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		ca, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return fmt.Errorf("failed to parse the client CA bundle: %w", err)
+		}
+		cas = append(cas, ca)
+	}
+	if len(cas) == 0 {
+		return fmt.Errorf("no certificate has been found in the client CA bundle: %s", verifier.caFile)
+	}
+
+	trust := &clientTrust{roots: x509.NewCertPool()}
+	for _, ca := range cas {
+		trust.roots.AddCert(ca)
+	}
+
+	if verifier.crlFile != "" {
+		crl, err := loadCRL(verifier.crlFile)
+		if err != nil {
+			return err
+		}
+		if err := checkCRLSignature(crl, cas); err != nil {
+			return err
+		}
+		trust.crlIssuer = crl.RawIssuer
+		trust.revoked = map[string]bool{}
+		for _, entry := range crl.RevokedCertificateEntries {
+			trust.revoked[entry.SerialNumber.String()] = true
+		}
+	}
+
+	verifier.trust.Store(trust)
+	return nil
+}
+
+// loadCRL reads a CRL in PEM or DER.
+func loadCRL(path string) (*x509.RevocationList, error) {
+	crlBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the CRL: %w", err)
+	}
+	if block, _ := pem.Decode(crlBytes); block != nil {
+		crlBytes = block.Bytes
+	}
+	crl, err := x509.ParseRevocationList(crlBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the CRL: %w", err)
+	}
+	return crl, nil
+}
+
+// checkCRLSignature checks that the CRL is signed by one of the CAs.
+func checkCRLSignature(crl *x509.RevocationList, cas []*x509.Certificate) error {
+	for _, ca := range cas {
+		if bytes.Equal(ca.RawSubject, crl.RawIssuer) && crl.CheckSignatureFrom(ca) == nil {
+			return nil
+		}
+	}
+	return errors.New("the CRL is not signed by any CA in the client CA bundle")
+}
+
+// verifyConnection verifies the client certificate, if any, with the current CA bundle and CRL.
+func (verifier *clientCertificateVerifier) verifyConnection(state tls.ConnectionState) error {
+	if len(state.PeerCertificates) == 0 {
+		if verifier.mode == tlsClientAuthRequire {
+			return errors.New("a client certificate is required")
+		}
+		return nil
+	}
+
+	trust := verifier.trust.Load()
+	leaf := state.PeerCertificates[0]
+	intermediates := x509.NewCertPool()
+	for _, certificate := range state.PeerCertificates[1:] {
+		intermediates.AddCert(certificate)
+	}
+	if _, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         trust.roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}); err != nil {
+		return fmt.Errorf("the client certificate can not be verified: %w", err)
+	}
+	if trust.revoked != nil && bytes.Equal(leaf.RawIssuer, trust.crlIssuer) && trust.revoked[leaf.SerialNumber.String()] {
+		return fmt.Errorf("the client certificate has been revoked: %s", leaf.SerialNumber)
+	}
+	if verifier.identityOf(leaf) == "" {
+		return fmt.Errorf("the client certificate has no %s to identify the user", verifier.identity)
+	}
+	return nil
+}
+
+// identityOf returns the user name of the certificate, or an empty string if it has none.
+func (verifier *clientCertificateVerifier) identityOf(certificate *x509.Certificate) string {
+	switch verifier.identity {
+	case certificateIdentityEmail:
+		if len(certificate.EmailAddresses) > 0 {
+			return certificate.EmailAddresses[0]
+		}
+	case certificateIdentityDNS:
+		if len(certificate.DNSNames) > 0 {
+			return certificate.DNSNames[0]
+		}
+	case certificateIdentityURI:
+		if len(certificate.URIs) > 0 {
+			return certificate.URIs[0].String()
+		}
+	default:
+		return certificate.Subject.CommonName
+	}
+	return ""
+}
+
+// newTLSConfig returns the configuration of the TLS listener.
+// clientCertificates may be nil if the clients are not authenticated by certificate,
+// and alpn is the list of the protocols offered in the ALPN extension, which may be empty.
+func newTLSConfig(certificates *certificateReloader, clientCertificates *clientCertificateVerifier,
+	minVersion string, alpn []string) (*tls.Config, error) {
+	version, err := parseTLSVersion(minVersion)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		GetCertificate: certificates.getCertificate,
+		MinVersion:     version,
+		NextProtos:     alpn,
+	}
+	if clientCertificates != nil {
+		// The certificates are verified by VerifyConnection so that the CA bundle can be reloaded.
+		tlsConfig.ClientAuth = tls.RequestClientCert
+		if clientCertificates.mode == tlsClientAuthRequire {
+			tlsConfig.ClientAuth = tls.RequireAnyClientCert
+		}
+		tlsConfig.VerifyConnection = clientCertificates.verifyConnection
+	}
+	return tlsConfig, nil
+}
+
+// listenTLS starts the TLS listener serving SOCKS5 inside TLS.
+func listenTLS(address string, tlsConfig *tls.Config) (net.Listener, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewListener(listener, tlsConfig), nil
+}
@@ -0,0 +1,302 @@
+package mysocks
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jfuruya/mysocks/socks5wire"
+)
+
+// newTestCertificate creates a certificate from the template signed by the parent,
+// or a self-signed one if parent is nil, and returns it with its key in PEM.
+func newTestCertificate(t *testing.T, template *x509.Certificate, parent *x509.Certificate, parentKey crypto.Signer) (*x509.Certificate, *ecdsa.PrivateKey, []byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if template.NotAfter.IsZero() {
+		template.NotBefore = time.Now().Add(-time.Hour)
+		template.NotAfter = time.Now().Add(time.Hour)
+	}
+	if parent == nil {
+		parent = template
+		parentKey = key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certificate, key,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// newServerCertificate creates a self-signed certificate for localhost in the directory
+// and returns it with the paths of the certificate and key files.
+func newServerCertificate(t *testing.T, dir string, serial int64) (*x509.Certificate, string, string) {
+	certificate, _, certPEM, keyPEM := newTestCertificate(t, &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, nil, nil)
+	certPath := dir + "/server.crt"
+	keyPath := dir + "/server.key"
+	if err := os.WriteFile(certPath, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certificate, certPath, keyPath
+}
+
+// connectThrough sends a CONNECT request to the destination without authentication
+// and returns the REP of the reply.
+func connectThrough(conn net.Conn, destination *net.TCPAddr) (byte, error) {
+	if _, err := conn.Write([]byte{fiexedVer, 0x01, noAuthRequired}); err != nil {
+		return 0, err
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 2)); err != nil {
+		return 0, err
+	}
+	return requestConnect(conn, destination)
+}
+
+// requestConnect sends a CONNECT request to the destination after the negotiation
+// and returns the REP of the reply.
+func requestConnect(conn net.Conn, destination *net.TCPAddr) (byte, error) {
+	request := []byte{fiexedVer, cmdConnect, fixedRsv, atypIPv4}
+	request = append(request, destination.IP.To4()...)
+	request = binary.BigEndian.AppendUint16(request, uint16(destination.Port))
+	if _, err := conn.Write(request); err != nil {
+		return 0, err
+	}
+
+	reply, err := socks5wire.ReadReply(conn, make([]byte, socks5wire.MaxReplyLen))
+	if err != nil {
+		return 0, err
+	}
+	return reply.Rep, nil
+}
+
+func TestTLSListener(t *testing.T) {
+	dir := t.TempDir()
+	certificate, certPath, keyPath := newServerCertificate(t, dir, 1)
+	os.Setenv("MYSOCKS_TLS_ADDRESS", "127.0.0.1:0")
+	os.Setenv("MYSOCKS_TLS_CERT_FILE", certPath)
+	os.Setenv("MYSOCKS_TLS_KEY_FILE", keyPath)
+	os.Setenv("MYSOCKS_TLS_MIN_VERSION", "1.3")
+	os.Setenv("MYSOCKS_TLS_ALPN", "socks5")
+	defer func() {
+		for _, name := range []string{"MYSOCKS_TLS_ADDRESS", "MYSOCKS_TLS_CERT_FILE", "MYSOCKS_TLS_KEY_FILE", "MYSOCKS_TLS_MIN_VERSION", "MYSOCKS_TLS_ALPN"} {
+			os.Setenv(name, "")
+		}
+	}()
+
+	StartServer()
+	defer StopServer()
+
+	echoServer := startEchoServer(t)
+	defer echoServer.Close()
+
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(certificate)
+	tlsAddress := server.tlsListener.Addr().String()
+
+	conn, err := tls.Dial("tcp", tlsAddress, &tls.Config{RootCAs: rootCAs, ServerName: "localhost", NextProtos: []string{"socks5"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if protocol := conn.ConnectionState().NegotiatedProtocol; protocol != "socks5" {
+		t.Fatalf("socks5 expected by ALPN, but got %q", protocol)
+	}
+	rep, err := connectThrough(conn, echoServer.Addr().(*net.TCPAddr))
+	if err != nil || rep != repSucceeded {
+		t.Fatalf("CONNECT over TLS failed: %v %#02x", err, rep)
+	}
+	conn.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("hello expected, but got %q: %v", buf, err)
+	}
+
+	// The plaintext listener is still served.
+	plainConn, err := net.Dial("tcp", proxyAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plainConn.Close()
+	if rep, err := connectThrough(plainConn, echoServer.Addr().(*net.TCPAddr)); err != nil || rep != repSucceeded {
+		t.Fatalf("CONNECT over the plaintext listener failed: %v %#02x", err, rep)
+	}
+
+	// TLS 1.2 is below the minimum version.
+	if conn, err := tls.Dial("tcp", tlsAddress, &tls.Config{RootCAs: rootCAs, ServerName: "localhost", MaxVersion: tls.VersionTLS12}); err == nil {
+		conn.Close()
+		t.Fatal("TLS 1.2 should be rejected")
+	}
+
+	// The certificate is replaced on reload.
+	newCertificate, _, _ := newServerCertificate(t, dir, 2)
+	if err := server.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	rootCAs.AddCert(newCertificate)
+	reloadedConn, err := tls.Dial("tcp", tlsAddress, &tls.Config{RootCAs: rootCAs, ServerName: "localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reloadedConn.Close()
+	if serial := reloadedConn.ConnectionState().PeerCertificates[0].SerialNumber; serial.Int64() != 2 {
+		t.Fatalf("The reloaded certificate expected, but got the serial %v", serial)
+	}
+}
+
+func TestTLSClientCertificateAuth(t *testing.T) {
+	dir := t.TempDir()
+	serverCertificate, certPath, keyPath := newServerCertificate(t, dir, 1)
+
+	ca, caKey, caPEM, _ := newTestCertificate(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(10),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}, nil, nil)
+	newClientCertificate := func(serial int64, commonName string) tls.Certificate {
+		certificate, key, _, _ := newTestCertificate(t, &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: commonName},
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}, ca, caKey)
+		return tls.Certificate{Certificate: [][]byte{certificate.Raw}, PrivateKey: key, Leaf: certificate}
+	}
+	validCertificate := newClientCertificate(11, "dave")
+	revokedCertificate := newClientCertificate(12, "eve")
+
+	crl, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number: big.NewInt(1),
+		RevokedCertificateEntries: []x509.RevocationListEntry{
+			{SerialNumber: big.NewInt(12), RevocationTime: time.Now()},
+		},
+		ThisUpdate: time.Now(),
+		NextUpdate: time.Now().Add(time.Hour),
+	}, ca, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caPath := dir + "/ca.crt"
+	crlPath := dir + "/ca.crl"
+	if err := os.WriteFile(caPath, caPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(crlPath, crl, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	variables := map[string]string{
+		"MYSOCKS_TLS_ADDRESS":        "127.0.0.1:0",
+		"MYSOCKS_TLS_CERT_FILE":      certPath,
+		"MYSOCKS_TLS_KEY_FILE":       keyPath,
+		"MYSOCKS_TLS_CLIENT_AUTH":    tlsClientAuthOptional,
+		"MYSOCKS_TLS_CLIENT_CA_FILE": caPath,
+		"MYSOCKS_TLS_CRL_FILE":       crlPath,
+	}
+	for name, value := range variables {
+		os.Setenv(name, value)
+		defer os.Setenv(name, "")
+	}
+
+	StartServer()
+	defer StopServer()
+
+	echoServer := startEchoServer(t)
+	defer echoServer.Close()
+
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(serverCertificate)
+	dial := func(certificates ...tls.Certificate) (*tls.Conn, error) {
+		return tls.Dial("tcp", server.tlsListener.Addr().String(),
+			&tls.Config{RootCAs: rootCAs, ServerName: "localhost", Certificates: certificates})
+	}
+
+	// The certificate identifies the user, and RFC 1929 is skipped even if the client offers it.
+	conn, err := dial(validCertificate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte{fiexedVer, 0x02, noAuthRequired, usernamePasswd})
+	negotiationReply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, negotiationReply); err != nil || negotiationReply[1] != noAuthRequired {
+		t.Fatalf("NO AUTHENTICATION REQUIRED expected, but got %v: %v", negotiationReply, err)
+	}
+	if rep, err := requestConnect(conn, echoServer.Addr().(*net.TCPAddr)); err != nil || rep != repSucceeded {
+		t.Fatalf("CONNECT failed: %v %#02x", err, rep)
+	}
+	userNames := []string{}
+	for _, socksConnection := range server.socksConnections.list() {
+		userNames = append(userNames, socksConnection.getInfo().userName)
+	}
+	if !reflect.DeepEqual(userNames, []string{"dave"}) {
+		t.Fatalf("The session of dave expected, but got %v", userNames)
+	}
+
+	// In the optional mode, the clients without a certificate use the SOCKS5 methods.
+	noCertificateConn, err := dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer noCertificateConn.Close()
+	if rep, err := connectThrough(noCertificateConn, echoServer.Addr().(*net.TCPAddr)); err != nil || rep != repSucceeded {
+		t.Fatalf("CONNECT without a certificate failed: %v %#02x", err, rep)
+	}
+
+	// The revoked certificate is rejected. With TLS 1.3 the client notices it on the first read.
+	revokedConn, err := dial(revokedCertificate)
+	if err == nil {
+		defer revokedConn.Close()
+		_, err = connectThrough(revokedConn, echoServer.Addr().(*net.TCPAddr))
+	}
+	if err == nil {
+		t.Fatal("The revoked certificate should be rejected")
+	}
+}
+
+func TestTLSClientCertificateRequired(t *testing.T) {
+	verifier := &clientCertificateVerifier{mode: tlsClientAuthRequire}
+	if err := verifier.verifyConnection(tls.ConnectionState{}); err == nil {
+		t.Fatal("A connection without a client certificate should be rejected")
+	}
+	verifier.mode = tlsClientAuthOptional
+	if err := verifier.verifyConnection(tls.ConnectionState{}); err != nil {
+		t.Fatalf("A connection without a client certificate should be accepted: %v", err)
+	}
+}
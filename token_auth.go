@@ -0,0 +1,84 @@
+package mysocks
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net"
+)
+
+// The token authentication is a private method (X'80') whose sub-negotiation is modeled on RFC 1929.
+//
+// The client sends:
+//
+//	+----+------+----------+
+//	|VER | TLEN |  TOKEN   |
+//	+----+------+----------+
+//	| 1  |  1   | 1 to 255 |
+//	+----+------+----------+
+//
+// and the server replies with VER and STATUS, where X'00' means success.
+const (
+	fixedTokenAuthVer byte = 0x01
+
+	tokenAuthStatusSuccess byte = 0x00
+	tokenAuthStatusFailure byte = 0x01
+)
+
+// tokenAuthenticator authenticates the users by the tokens in the configuration file.
+// The tokens are looked up in the active configuration, so they can be changed by a reload.
+type tokenAuthenticator struct {
+	server *Server
+}
+
+func (authenticator *tokenAuthenticator) Authenticate(conn net.Conn) (string, net.Conn, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", nil, err
+	}
+	if header[0] != fixedTokenAuthVer {
+		return "", nil, fmt.Errorf("the value of the VER field in the token authentication request is invalid: %d", header[0])
+	}
+	if header[1] == 0 {
+		return "", nil, fmt.Errorf("the value of the TLEN field in the token authentication request is invalid: %d", header[1])
+	}
+	token := make([]byte, int(header[1]))
+	if _, err := io.ReadFull(conn, token); err != nil {
+		return "", nil, err
+	}
+
+	userName := authenticator.server.config.Load().userOfToken(token)
+	status := tokenAuthStatusSuccess
+	if userName == "" {
+		status = tokenAuthStatusFailure
+	}
+	if _, err := conn.Write([]byte{fixedTokenAuthVer, status}); err != nil {
+		return "", nil, err
+	}
+	if userName == "" {
+		return "", nil, ErrAuthenticationFailed
+	}
+	return userName, nil, nil
+}
+
+// userOfToken returns the user whose tokens include the token, or an empty string.
+func (config *config) userOfToken(token []byte) string {
+	for userName, userConfig := range config.Users {
+		for _, userToken := range userConfig.Tokens {
+			if subtle.ConstantTimeCompare([]byte(userToken), token) == 1 {
+				return userName
+			}
+		}
+	}
+	return ""
+}
+
+// hasTokens reports whether any user has a token, in which case the token authentication is offered.
+func (config *config) hasTokens() bool {
+	for _, userConfig := range config.Users {
+		if len(userConfig.Tokens) > 0 {
+			return true
+		}
+	}
+	return false
+}
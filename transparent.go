@@ -0,0 +1,110 @@
+package mysocks
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/jfuruya/mysocks/socks5wire"
+)
+
+// Transparent proxying serves the clients whose connections are diverted to the server by the firewall,
+// such as iptables REDIRECT or TPROXY, instead of being sent as SOCKS requests. The destination is the one
+// the client originally connected to, and it goes through the same ACL and relay as CONNECT.
+
+// Modes of the transparent TCP listener.
+const (
+	// transparentModeRedirect recovers the destination of the connections redirected by NAT with SO_ORIGINAL_DST.
+	transparentModeRedirect = "redirect"
+	// transparentModeTProxy accepts the connections diverted by TPROXY, whose local address is the destination.
+	transparentModeTProxy = "tproxy"
+)
+
+var (
+	errTransparentNotSupported = errors.New("transparent proxying is supported only on Linux")
+	errTransparentModeUnknown  = errors.New("unknown transparent mode")
+	errNoOriginalDestination   = errors.New("the original destination is unknown")
+)
+
+// serveTransparent accepts the connections diverted to the listener until it is closed.
+// destinationOf recovers the original destination of each connection.
+func (server *Server) serveTransparent(listener net.Listener, destinationOf func(net.Conn) (*net.TCPAddr, error)) {
+	listenerAddr := listener.Addr().(*net.TCPAddr)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if server.isStopping() {
+				logInfo("Transparent server has stopped accepting connections.", nil)
+			} else {
+				logError(fmt.Sprintf("Failed to accept transparent connection: %v", err), nil)
+			}
+			return
+		}
+
+		logInfo(fmt.Sprintf("A new transparent connection has been received from: %v", conn.RemoteAddr()), nil)
+
+		socksConnection := newSocksConnection(&conn, server, nil)
+		socksConnection.withoutSocks = true
+
+		server.socksConnections.add(socksConnection)
+
+		go func() {
+			defer server.socksConnections.remove(socksConnection)
+			socksConnection.handleTransparent(listenerAddr, destinationOf)
+		}()
+	}
+}
+
+// handleTransparent relays the connection to its original destination as a CONNECT request.
+func (socksConnection *socksConnection) handleTransparent(listenerAddr *net.TCPAddr, destinationOf func(net.Conn) (*net.TCPAddr, error)) {
+	defer socksConnection.end()
+
+	destination, err := destinationOf(socksConnection.acceptedConn)
+	if err != nil {
+		socksConnection.setCloseReason(closeReasonNoOriginalDst)
+		socksConnection.logSubsystem(logSubsystemHandshake, logLevelWarn, "Failed to recover the original destination.",
+			map[string]interface{}{"error": err.Error()})
+		return
+	}
+	if isTransparentLoop(destination, listenerAddr) {
+		// The client has connected to the listener itself, which would be relayed to the listener again.
+		metricACLDenials.WithLabelValues("destination").Inc()
+		socksConnection.setCloseReason(closeReasonNotAllowed)
+		socksConnection.logWithLevel(logLevelWarn, fmt.Sprintf("The destination is the transparent listener itself: %s", destination))
+		return
+	}
+
+	socksConnection.setAttributes(userAttributes{allowedDestinations: socksConnection.server.transparentAllowedDestinations})
+	socksConnection.logSubsystem(logSubsystemHandshake, logLevelInfo,
+		fmt.Sprintf("The original destination has been recovered: %s", destination), nil)
+
+	socksConnection.process(newConnectRequestTo(socks5wire.IPAddr(destination.IP, destination.Port), socksConnection))
+	socksConnection.resetUnlessConnected()
+}
+
+// isTransparentLoop reports whether the destination is the address the transparent listener is bound to.
+func isTransparentLoop(destination *net.TCPAddr, listenerAddr *net.TCPAddr) bool {
+	if destination.Port != listenerAddr.Port {
+		return false
+	}
+	return listenerAddr.IP.IsUnspecified() || destination.IP.Equal(listenerAddr.IP)
+}
+
+// newTransparentUDPRelay returns the relay of the datagrams diverted by TPROXY to their original destinations.
+// replyConnFor returns a socket that sends from the original destination to the client.
+func newTransparentUDPRelay(server *Server, conn *net.UDPConn,
+	replyConnFor func(destination string, client *net.UDPAddr) (*net.UDPConn, error)) *udpFlowRelay {
+	listenerAddr := conn.LocalAddr().(*net.UDPAddr)
+	return newUDPFlowRelay(server, conn, "transparent", nil, func(client *net.UDPAddr, destination string) bool {
+		destinationAddr, err := net.ResolveUDPAddr("udp", destination)
+		if err != nil {
+			return false
+		}
+		if isTransparentLoop(&net.TCPAddr{IP: destinationAddr.IP, Port: destinationAddr.Port}, &net.TCPAddr{IP: listenerAddr.IP, Port: listenerAddr.Port}) ||
+			!destinationAllowed(server.transparentAllowedDestinations, destination) {
+			metricACLDenials.WithLabelValues("destination").Inc()
+			return false
+		}
+		return true
+	}, replyConnFor)
+}
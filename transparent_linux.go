@@ -0,0 +1,200 @@
+//go:build linux
+
+package mysocks
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// listenTransparent listens for the connections diverted in the mode, and returns how their
+// original destinations are recovered.
+func listenTransparent(address string, mode string) (net.Listener, func(net.Conn) (*net.TCPAddr, error), error) {
+	switch mode {
+	case transparentModeRedirect:
+		listener, err := net.Listen("tcp", address)
+		return listener, originalDestination, err
+	case transparentModeTProxy:
+		listenConfig := net.ListenConfig{Control: controlTransparent(false)}
+		listener, err := listenConfig.Listen(context.Background(), "tcp", address)
+		return listener, localDestination, err
+	default:
+		return nil, nil, fmt.Errorf("%w: %q", errTransparentModeUnknown, mode)
+	}
+}
+
+// listenTransparentUDP listens for the datagrams diverted by TPROXY.
+func listenTransparentUDP(address string) (*net.UDPConn, error) {
+	listenConfig := net.ListenConfig{Control: controlTransparent(true)}
+	conn, err := listenConfig.ListenPacket(context.Background(), "udp", address)
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+// controlTransparent lets the socket use addresses that are not local, which the sockets accepting
+// TPROXY and sending from the original destinations need. With recvOrigDstAddr, the original
+// destinations of the datagrams are received as control messages.
+func controlTransparent(recvOrigDstAddr bool) func(network string, address string, c syscall.RawConn) error {
+	return func(network string, address string, c syscall.RawConn) error {
+		var sockoptErr error
+		err := c.Control(func(fd uintptr) {
+			sockoptErr = setTransparent(int(fd), recvOrigDstAddr)
+		})
+		if err != nil {
+			return err
+		}
+		return sockoptErr
+	}
+}
+
+func setTransparent(fd int, recvOrigDstAddr bool) error {
+	domain, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_DOMAIN)
+	if err != nil {
+		return err
+	}
+	options := [][2]int{{unix.SOL_IP, unix.IP_TRANSPARENT}}
+	if recvOrigDstAddr {
+		options = append(options, [2]int{unix.SOL_IP, unix.IP_RECVORIGDSTADDR})
+	}
+	if domain == unix.AF_INET6 {
+		options = append(options, [2]int{unix.SOL_IPV6, unix.IPV6_TRANSPARENT})
+		if recvOrigDstAddr {
+			options = append(options, [2]int{unix.SOL_IPV6, unix.IPV6_RECVORIGDSTADDR})
+		}
+	}
+	for _, option := range options {
+		if err := unix.SetsockoptInt(fd, option[0], option[1], 1); err != nil {
+			return fmt.Errorf("failed to make the socket transparent, which needs CAP_NET_ADMIN: %w", err)
+		}
+	}
+	return nil
+}
+
+// originalDestination returns the destination of a connection before it was redirected by NAT.
+func originalDestination(conn net.Conn) (*net.TCPAddr, error) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil, errNoOriginalDestination
+	}
+	rawConn, err := tcpConn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var destination *net.TCPAddr
+	var sockoptErr error
+	err = rawConn.Control(func(fd uintptr) {
+		if conn.LocalAddr().(*net.TCPAddr).IP.To4() != nil {
+			// sockaddr_in is read into the 16 bytes of the address of ipv6_mreq.
+			var mreq *unix.IPv6Mreq
+			mreq, sockoptErr = unix.GetsockoptIPv6Mreq(int(fd), unix.SOL_IP, unix.SO_ORIGINAL_DST)
+			if sockoptErr == nil {
+				destination = &net.TCPAddr{
+					IP:   net.IP(append([]byte{}, mreq.Multiaddr[4:8]...)),
+					Port: int(binary.BigEndian.Uint16(mreq.Multiaddr[2:4])),
+				}
+			}
+			return
+		}
+		var info *unix.IPv6MTUInfo
+		info, sockoptErr = unix.GetsockoptIPv6MTUInfo(int(fd), unix.SOL_IPV6, unix.SO_ORIGINAL_DST)
+		if sockoptErr == nil {
+			// The port is kept in the network byte order as it is in the kernel.
+			port := binary.NativeEndian.AppendUint16(nil, info.Addr.Port)
+			destination = &net.TCPAddr{
+				IP:   net.IP(append([]byte{}, info.Addr.Addr[:]...)),
+				Port: int(binary.BigEndian.Uint16(port)),
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if sockoptErr != nil {
+		return nil, fmt.Errorf("%w: %v", errNoOriginalDestination, sockoptErr)
+	}
+	return destination, nil
+}
+
+// localDestination returns the destination of a connection accepted by TPROXY, which is its local address.
+func localDestination(conn net.Conn) (*net.TCPAddr, error) {
+	destination, ok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return nil, errNoOriginalDestination
+	}
+	return destination, nil
+}
+
+// readTransparentDatagram reads a datagram diverted by TPROXY with the client and the original destination.
+func readTransparentDatagram(conn *net.UDPConn, buf []byte) (int, *net.UDPAddr, *net.UDPAddr, error) {
+	oob := make([]byte, 128)
+	n, oobn, _, client, err := conn.ReadMsgUDP(buf, oob)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	destination, err := parseOrigDstAddr(oob[:oobn])
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	return n, client, destination, nil
+}
+
+// parseOrigDstAddr returns the original destination in the IP_ORIGDSTADDR or IPV6_ORIGDSTADDR control message.
+func parseOrigDstAddr(oob []byte) (*net.UDPAddr, error) {
+	messages, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, err
+	}
+	for _, message := range messages {
+		data := message.Data
+		switch {
+		case message.Header.Level == unix.SOL_IP && message.Header.Type == unix.IP_ORIGDSTADDR && len(data) >= unix.SizeofSockaddrInet4:
+			return &net.UDPAddr{
+				IP:   net.IP(append([]byte{}, data[4:8]...)),
+				Port: int(binary.BigEndian.Uint16(data[2:4])),
+			}, nil
+		case message.Header.Level == unix.SOL_IPV6 && message.Header.Type == unix.IPV6_ORIGDSTADDR && len(data) >= unix.SizeofSockaddrInet6:
+			return &net.UDPAddr{
+				IP:   net.IP(append([]byte{}, data[8:24]...)),
+				Port: int(binary.BigEndian.Uint16(data[2:4])),
+			}, nil
+		}
+	}
+	return nil, errNoOriginalDestination
+}
+
+// transparentReplyConn returns a socket connected to the client from the original destination,
+// so that the client takes the replies for the ones from the destination.
+func transparentReplyConn(destination string, client *net.UDPAddr) (*net.UDPConn, error) {
+	destinationAddr, err := net.ResolveUDPAddr("udp", destination)
+	if err != nil {
+		return nil, err
+	}
+	dialer := net.Dialer{
+		LocalAddr: destinationAddr,
+		Control: func(network string, address string, c syscall.RawConn) error {
+			var sockoptErr error
+			err := c.Control(func(fd uintptr) {
+				if sockoptErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1); sockoptErr == nil {
+					sockoptErr = setTransparent(int(fd), false)
+				}
+			})
+			if err != nil {
+				return err
+			}
+			return sockoptErr
+		},
+	}
+	conn, err := dialer.Dial("udp", client.String())
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
@@ -0,0 +1,187 @@
+//go:build linux
+
+package mysocks
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"testing"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// controlMessage returns the control message of the level and the type carrying data.
+func controlMessage(level int32, typ int32, data []byte) []byte {
+	oob := make([]byte, unix.CmsgSpace(len(data)))
+	header := (*unix.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	header.Level = level
+	header.Type = typ
+	header.SetLen(unix.CmsgLen(len(data)))
+	copy(oob[unix.CmsgLen(0):], data)
+	return oob
+}
+
+func TestParseOrigDstAddr(t *testing.T) {
+	sockaddr4 := make([]byte, unix.SizeofSockaddrInet4)
+	binary.NativeEndian.PutUint16(sockaddr4, unix.AF_INET)
+	binary.BigEndian.PutUint16(sockaddr4[2:], 53)
+	copy(sockaddr4[4:], net.IPv4(192, 0, 2, 1).To4())
+
+	sockaddr6 := make([]byte, unix.SizeofSockaddrInet6)
+	binary.NativeEndian.PutUint16(sockaddr6, unix.AF_INET6)
+	binary.BigEndian.PutUint16(sockaddr6[2:], 443)
+	copy(sockaddr6[8:], net.ParseIP("2001:db8::1"))
+
+	tests := []struct {
+		oob      []byte
+		expected string
+	}{
+		{controlMessage(unix.SOL_IP, unix.IP_ORIGDSTADDR, sockaddr4), "192.0.2.1:53"},
+		{controlMessage(unix.SOL_IPV6, unix.IPV6_ORIGDSTADDR, sockaddr6), "[2001:db8::1]:443"},
+		{append(controlMessage(unix.SOL_IP, unix.IP_TTL, []byte{64, 0, 0, 0}), controlMessage(unix.SOL_IP, unix.IP_ORIGDSTADDR, sockaddr4)...), "192.0.2.1:53"},
+	}
+	for _, test := range tests {
+		addr, err := parseOrigDstAddr(test.oob)
+		if err != nil || addr.String() != test.expected {
+			t.Fatalf("%s expected, but got %v %v", test.expected, addr, err)
+		}
+	}
+
+	for _, oob := range [][]byte{nil, controlMessage(unix.SOL_IP, unix.IP_TTL, []byte{64, 0, 0, 0}), controlMessage(unix.SOL_IP, unix.IP_ORIGDSTADDR, sockaddr4[:4])} {
+		if addr, err := parseOrigDstAddr(oob); err == nil {
+			t.Fatalf("An error expected, but got %v", addr)
+		}
+	}
+}
+
+// startTransparentServer starts the server with the transparent listeners in the mode on the loopback address.
+// It skips the test if the process is not allowed to make the sockets transparent.
+func startTransparentServer(t *testing.T, mode string) {
+	t.Setenv("MYSOCKS_TRANSPARENT_ADDRESS", "127.0.0.1:0")
+	t.Setenv("MYSOCKS_TRANSPARENT_MODE", mode)
+	t.Setenv("MYSOCKS_TRANSPARENT_UDP_ADDRESS", "127.0.0.1:0")
+	StartServer()
+	select {
+	case <-server.Ready():
+	default:
+		t.Skip("The transparent listeners need CAP_NET_ADMIN")
+	}
+}
+
+func TestTransparentTProxyListener(t *testing.T) {
+	startTransparentServer(t, transparentModeTProxy)
+	defer StopServer()
+
+	// Without TPROXY rules, the original destination of a connection is the listener itself.
+	conn, err := net.Dial("tcp", server.transparentListener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("The connection to the listener itself expected to be closed")
+	}
+
+	// The original destination of a datagram is received with it.
+	udpConn, err := listenTransparentUDP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpConn.Close()
+	client, err := net.DialUDP("udp", nil, udpConn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.Write([]byte("datagram"))
+	udpConn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	n, from, destination, err := readTransparentDatagram(udpConn, make([]byte, 64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len("datagram") || from.String() != client.LocalAddr().String() || destination.String() != udpConn.LocalAddr().String() {
+		t.Fatalf("Unexpected datagram: %d bytes from %v to %v", n, from, destination)
+	}
+
+	waitForSessionsToEnd(t)
+}
+
+// TestTransparentRedirectInNamespace redirects a connection with iptables in a new network namespace,
+// where the test runs again as root.
+func TestTransparentRedirectInNamespace(t *testing.T) {
+	if os.Getenv("MYSOCKS_TEST_NETNS") == "" {
+		if os.Geteuid() != 0 {
+			t.Skip("A network namespace needs root")
+		}
+		for _, command := range []string{"unshare", "ip", "iptables"} {
+			if _, err := exec.LookPath(command); err != nil {
+				t.Skipf("%s is not available", command)
+			}
+		}
+		cmd := exec.Command("unshare", "--net", os.Args[0], "-test.run=^TestTransparentRedirectInNamespace$", "-test.v")
+		cmd.Env = append(os.Environ(), "MYSOCKS_TEST_NETNS=1")
+		if output, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("%v\n%s", err, output)
+		}
+		return
+	}
+
+	run := func(name string, args ...string) {
+		if output, err := exec.Command(name, args...).CombinedOutput(); err != nil {
+			t.Fatalf("%s %v: %v\n%s", name, args, err, output)
+		}
+	}
+	// The client and the destination have addresses of their own, so that only the connections
+	// from the client are redirected.
+	run("ip", "link", "set", "lo", "up")
+	run("ip", "addr", "add", "192.0.2.10/32", "dev", "lo")
+	run("ip", "addr", "add", "192.0.2.20/32", "dev", "lo")
+
+	destination, err := net.Listen("tcp", "192.0.2.10:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := destination.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	defer destination.Close()
+
+	startTransparentServer(t, transparentModeRedirect)
+	defer StopServer()
+
+	port := server.transparentListener.Addr().(*net.TCPAddr).Port
+	run("iptables", "-t", "nat", "-A", "OUTPUT", "-p", "tcp", "-s", "192.0.2.20", "-d", "192.0.2.10",
+		"-j", "REDIRECT", "--to-ports", strconv.Itoa(port))
+
+	dialer := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 20)}}
+	conn, err := dialer.Dial("tcp", destination.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	conn.Write([]byte("redirected"))
+	echoed := make([]byte, len("redirected"))
+	if _, err := io.ReadFull(conn, echoed); err != nil || string(echoed) != "redirected" {
+		t.Fatalf("The message expected to be echoed, but got %q %v", echoed, err)
+	}
+	conn.Close()
+
+	waitForSessionsToEnd(t)
+}
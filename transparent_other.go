@@ -0,0 +1,21 @@
+//go:build !linux
+
+package mysocks
+
+import "net"
+
+func listenTransparent(address string, mode string) (net.Listener, func(net.Conn) (*net.TCPAddr, error), error) {
+	return nil, nil, errTransparentNotSupported
+}
+
+func listenTransparentUDP(address string) (*net.UDPConn, error) {
+	return nil, errTransparentNotSupported
+}
+
+func readTransparentDatagram(conn *net.UDPConn, buf []byte) (int, *net.UDPAddr, *net.UDPAddr, error) {
+	return 0, nil, nil, errTransparentNotSupported
+}
+
+func transparentReplyConn(destination string, client *net.UDPAddr) (*net.UDPConn, error) {
+	return nil, errTransparentNotSupported
+}
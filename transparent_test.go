@@ -0,0 +1,162 @@
+package mysocks
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// startTransparentListener serves the connections to a new listener as if they had been diverted to destination.
+func startTransparentListener(t *testing.T, destination *net.TCPAddr, destinationErr error) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if destination == nil && destinationErr == nil {
+		destination = listener.Addr().(*net.TCPAddr)
+	}
+	go server.serveTransparent(listener, func(net.Conn) (*net.TCPAddr, error) {
+		return destination, destinationErr
+	})
+	return listener
+}
+
+func TestTransparentConnect(t *testing.T) {
+	StartServer()
+	defer StopServer()
+
+	echoServer := startEchoServer(t)
+	defer echoServer.Close()
+	closedListener := startEchoServer(t)
+	closedListener.Close()
+
+	allowed, err := parseDestinationPatterns([]string{"127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.transparentAllowedDestinations = allowed
+
+	listener := startTransparentListener(t, echoServer.Addr().(*net.TCPAddr), nil)
+	defer listener.Close()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	message := []byte("diverted")
+	conn.Write(message)
+	echoed := make([]byte, len(message))
+	if _, err := io.ReadFull(conn, echoed); err != nil || string(echoed) != string(message) {
+		t.Fatalf("The message expected to be echoed, but got %q %v", echoed, err)
+	}
+	conn.Close()
+
+	tests := []struct {
+		name           string
+		destination    *net.TCPAddr
+		destinationErr error
+	}{
+		{"not allowed", &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 80}, nil},
+		{"connection refused", closedListener.Addr().(*net.TCPAddr), nil},
+		{"loop", nil, nil},
+		{"unknown destination", nil, errNoOriginalDestination},
+	}
+	for _, test := range tests {
+		listener := startTransparentListener(t, test.destination, test.destinationErr)
+		defer listener.Close()
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if errors.Is(err, syscall.ECONNRESET) {
+			// The connection has been reset before the dial returned.
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		if n, err := conn.Read(make([]byte, 1)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("%s: the connection expected to be closed, but read %d bytes: %v", test.name, n, err)
+		}
+	}
+
+	waitForSessionsToEnd(t)
+}
+
+func TestTransparentUDP(t *testing.T) {
+	StartServer()
+	defer StopServer()
+
+	echoServer := startUDPEchoServer(t)
+	defer echoServer.Close()
+
+	allowed, err := parseDestinationPatterns([]string{echoServer.LocalAddr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.transparentAllowedDestinations = allowed
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The replies are sent from the sockets of the flows, which stand in for the ones bound to the destinations.
+	relay := newTransparentUDPRelay(server, conn, func(destination string, client *net.UDPAddr) (*net.UDPConn, error) {
+		return net.DialUDP("udp", nil, client)
+	})
+	defer relay.close()
+	go relay.serve(func(buf []byte) (int, *net.UDPAddr, string, error) {
+		n, client, err := conn.ReadFromUDP(buf)
+		return n, client, echoServer.LocalAddr().String(), err
+	})
+
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(10 * time.Second))
+	buf := make([]byte, 64)
+	for _, message := range []string{"first", "second"} {
+		if _, err := client.WriteToUDP([]byte(message), conn.LocalAddr().(*net.UDPAddr)); err != nil {
+			t.Fatal(err)
+		}
+		n, _, err := client.ReadFromUDP(buf)
+		if err != nil || string(buf[:n]) != message {
+			t.Fatalf("%q expected to be echoed, but got %q %v", message, buf[:n], err)
+		}
+	}
+
+	// The datagrams to the destinations not allowed and to the listener itself make no flow.
+	relay.handle([]byte("denied"), client.LocalAddr().(*net.UDPAddr), "192.0.2.1:53")
+	relay.handle([]byte("loop"), client.LocalAddr().(*net.UDPAddr), conn.LocalAddr().String())
+	relay.mutex.Lock()
+	flows := len(relay.flows)
+	relay.mutex.Unlock()
+	if flows != 1 {
+		t.Fatalf("1 flow expected, but got %d", flows)
+	}
+}
+
+func TestIsTransparentLoop(t *testing.T) {
+	listenerAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1081}
+	wildcardAddr := &net.TCPAddr{IP: net.IPv4zero, Port: 1081}
+	tests := []struct {
+		destination  *net.TCPAddr
+		listenerAddr *net.TCPAddr
+		loop         bool
+	}{
+		{&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1081}, listenerAddr, true},
+		{&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 80}, listenerAddr, false},
+		{&net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1081}, listenerAddr, false},
+		{&net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1081}, wildcardAddr, true},
+	}
+	for _, test := range tests {
+		if loop := isTransparentLoop(test.destination, test.listenerAddr); loop != test.loop {
+			t.Fatalf("%v to %v: %v expected, but got %v", test.destination, test.listenerAddr, test.loop, loop)
+		}
+	}
+}
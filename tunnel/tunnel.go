@@ -0,0 +1,592 @@
+// Package tunnel multiplexes streams over one connection, as the reverse tunnels of mysocks do.
+// The server opens a stream for each connection it accepts for the client, and the client accepts them.
+// An OPEN sent to the server breaks the protocol.
+//
+// Each frame is TYPE (1 byte), STREAM ID (4 bytes), LENGTH (2 bytes) and the payload. A stream is opened
+// with OPEN carrying the address of the remote peer, its data are sent with DATA, and a side that has no more
+// data to send sends CLOSE. RESET aborts a stream. Each side may send up to Window bytes of a stream that the
+// other has not read yet, and the reader grants more with WINDOW carrying the number of bytes read.
+package tunnel
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Frame types.
+const (
+	frameOpen   byte = 0x01
+	frameData   byte = 0x02
+	frameClose  byte = 0x03
+	frameReset  byte = 0x04
+	frameWindow byte = 0x05
+)
+
+const (
+	headerLen = 1 + 4 + 2
+	// maxPayloadLen is the largest payload of a DATA frame.
+	maxPayloadLen = 16 * 1024
+	// Window is the number of bytes of a stream that may be sent ahead of the reader.
+	Window = 256 * 1024
+	// maxRefusedStreams is the number of the RESETs of refused streams that may wait to be sent.
+	maxRefusedStreams = 256
+)
+
+var (
+	// ErrSessionClosed is returned when the session has been closed or its connection has failed.
+	ErrSessionClosed = errors.New("tunnel: the session has been closed")
+	// ErrStreamReset is returned when the other side has aborted the stream.
+	ErrStreamReset = errors.New("tunnel: the stream has been reset")
+)
+
+// ProtocolError is a frame that breaks the protocol, after which the session is closed.
+type ProtocolError struct {
+	Message string
+}
+
+func (err *ProtocolError) Error() string {
+	return "tunnel: " + err.Message
+}
+
+// Session is one side of the tunnel. Its methods may be called from multiple goroutines.
+type Session struct {
+	conn net.Conn
+
+	writeMutex sync.Mutex
+
+	// acceptsStreams is false on the server, which refuses the streams opened by the other side.
+	acceptsStreams bool
+
+	mutex    sync.Mutex
+	streams  map[uint32]*Stream
+	nextID   uint32
+	accepted chan *Stream
+	// refused are the IDs of the streams whose RESETs are to be sent by writeResets.
+	refused        []uint32
+	refusedPending chan struct{}
+	done           chan struct{}
+	err            error
+}
+
+// Server returns the side of the tunnel that opens streams. It reads the connection until it is closed.
+func Server(conn net.Conn) *Session {
+	return newSession(conn, 1, false)
+}
+
+// Client returns the side of the tunnel that accepts streams. It reads the connection until it is closed.
+func Client(conn net.Conn) *Session {
+	return newSession(conn, 2, true)
+}
+
+// newSession returns a session whose streams have odd or even IDs from firstID, so that both sides can open them.
+func newSession(conn net.Conn, firstID uint32, acceptsStreams bool) *Session {
+	session := &Session{
+		conn:           conn,
+		acceptsStreams: acceptsStreams,
+		streams:        make(map[uint32]*Stream),
+		nextID:         firstID,
+		accepted:       make(chan *Stream, 16),
+		refusedPending: make(chan struct{}, 1),
+		done:           make(chan struct{}),
+	}
+	go session.readFrames()
+	go session.writeResets()
+	return session
+}
+
+// Open opens a stream for the connection from remoteAddr, which the other side accepts.
+func (session *Session) Open(remoteAddr net.Addr) (*Stream, error) {
+	session.mutex.Lock()
+	if session.err != nil {
+		session.mutex.Unlock()
+		return nil, ErrSessionClosed
+	}
+	stream := newStream(session, session.nextID, remoteAddr)
+	session.streams[stream.id] = stream
+	session.nextID += 2
+	session.mutex.Unlock()
+
+	if err := session.writeFrame(frameOpen, stream.id, []byte(remoteAddr.String())); err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+// Accept waits for a stream opened by the other side. Only the client accepts streams.
+func (session *Session) Accept() (*Stream, error) {
+	select {
+	case stream := <-session.accepted:
+		return stream, nil
+	case <-session.done:
+		return nil, session.Err()
+	}
+}
+
+// Done is closed when the session has been closed.
+func (session *Session) Done() <-chan struct{} {
+	return session.done
+}
+
+// Err returns why the session has been closed, or nil if it is open.
+func (session *Session) Err() error {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	return session.err
+}
+
+// Close closes the connection and all the streams.
+func (session *Session) Close() error {
+	session.closeWithError(ErrSessionClosed)
+	return nil
+}
+
+func (session *Session) closeWithError(err error) {
+	session.mutex.Lock()
+	if session.err != nil {
+		session.mutex.Unlock()
+		return
+	}
+	session.err = err
+	streams := session.streams
+	session.streams = make(map[uint32]*Stream)
+	session.mutex.Unlock()
+
+	close(session.done)
+	session.conn.Close()
+	for _, stream := range streams {
+		stream.notify()
+	}
+}
+
+// NumStreams returns the number of the streams that have not been closed by both sides.
+func (session *Session) NumStreams() int {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	return len(session.streams)
+}
+
+func (session *Session) writeFrame(frameType byte, id uint32, payload []byte) error {
+	frame := make([]byte, headerLen, headerLen+len(payload))
+	frame[0] = frameType
+	binary.BigEndian.PutUint32(frame[1:5], id)
+	binary.BigEndian.PutUint16(frame[5:7], uint16(len(payload)))
+	frame = append(frame, payload...)
+
+	session.writeMutex.Lock()
+	defer session.writeMutex.Unlock()
+	if _, err := session.conn.Write(frame); err != nil {
+		session.closeWithError(fmt.Errorf("%w: %v", ErrSessionClosed, err))
+		return ErrSessionClosed
+	}
+	return nil
+}
+
+func (session *Session) readFrames() {
+	header := make([]byte, headerLen)
+	payload := make([]byte, 0xffff)
+	for {
+		if _, err := io.ReadFull(session.conn, header); err != nil {
+			session.closeWithError(fmt.Errorf("%w: %v", ErrSessionClosed, err))
+			return
+		}
+		frameType := header[0]
+		id := binary.BigEndian.Uint32(header[1:5])
+		length := int(binary.BigEndian.Uint16(header[5:7]))
+		if _, err := io.ReadFull(session.conn, payload[:length]); err != nil {
+			session.closeWithError(fmt.Errorf("%w: %v", ErrSessionClosed, err))
+			return
+		}
+		if err := session.handleFrame(frameType, id, payload[:length]); err != nil {
+			session.closeWithError(err)
+			return
+		}
+	}
+}
+
+func (session *Session) handleFrame(frameType byte, id uint32, payload []byte) error {
+	if frameType == frameOpen {
+		return session.handleOpen(id, payload)
+	}
+
+	session.mutex.Lock()
+	stream, ok := session.streams[id]
+	session.mutex.Unlock()
+	if !ok {
+		// The stream has already been removed, and the frames sent before the other side knew it are ignored.
+		return nil
+	}
+
+	switch frameType {
+	case frameData:
+		return stream.receive(payload)
+	case frameClose:
+		stream.receiveClose()
+	case frameReset:
+		stream.receiveReset()
+	case frameWindow:
+		if len(payload) != 4 {
+			return &ProtocolError{Message: fmt.Sprintf("WINDOW of %d bytes", len(payload))}
+		}
+		stream.grant(int(binary.BigEndian.Uint32(payload)))
+	default:
+		return &ProtocolError{Message: fmt.Sprintf("unknown frame type %#02x", frameType)}
+	}
+	return nil
+}
+
+func (session *Session) handleOpen(id uint32, payload []byte) error {
+	if !session.acceptsStreams {
+		return &ProtocolError{Message: fmt.Sprintf("OPEN of stream %d to the side that does not accept streams", id)}
+	}
+	session.mutex.Lock()
+	if _, ok := session.streams[id]; ok || id%2 == session.nextID%2 {
+		session.mutex.Unlock()
+		return &ProtocolError{Message: fmt.Sprintf("OPEN of stream %d in use or of this side", id)}
+	}
+	stream := newStream(session, id, addr(payload))
+	session.streams[id] = stream
+	session.mutex.Unlock()
+
+	select {
+	case session.accepted <- stream:
+	default:
+		// Nobody is accepting, so the stream is refused instead of blocking the other streams.
+		session.removeStream(stream)
+		return session.refuse(id)
+	}
+	return nil
+}
+
+// refuse queues the RESET of the stream for writeResets, so that reading the frames does not wait for
+// the other side to read. The session is closed if the other side keeps opening streams without reading.
+func (session *Session) refuse(id uint32) error {
+	session.mutex.Lock()
+	if len(session.refused) >= maxRefusedStreams {
+		session.mutex.Unlock()
+		return &ProtocolError{Message: "too many streams refused"}
+	}
+	session.refused = append(session.refused, id)
+	session.mutex.Unlock()
+
+	select {
+	case session.refusedPending <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// writeResets sends the RESETs of the refused streams until the session is closed.
+func (session *Session) writeResets() {
+	for {
+		select {
+		case <-session.refusedPending:
+		case <-session.done:
+			return
+		}
+		session.mutex.Lock()
+		refused := session.refused
+		session.refused = nil
+		session.mutex.Unlock()
+		for _, id := range refused {
+			if err := session.writeFrame(frameReset, id, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (session *Session) removeStream(stream *Stream) {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	if session.streams[stream.id] == stream {
+		delete(session.streams, stream.id)
+	}
+}
+
+// addr is the address of the remote peer of a stream, as the other side told it.
+type addr string
+
+func (addr addr) Network() string {
+	return "tcp"
+}
+
+func (addr addr) String() string {
+	return string(addr)
+}
+
+// Stream is a connection multiplexed in a session.
+type Stream struct {
+	session    *Session
+	id         uint32
+	remoteAddr net.Addr
+
+	mutex sync.Mutex
+	// readable and writable are signaled when the state of the stream changes.
+	readable chan struct{}
+	writable chan struct{}
+	buf      []byte
+	// unacknowledged is the number of bytes read since the last WINDOW.
+	unacknowledged int
+	// credit is the number of bytes that may be sent before the other side grants more.
+	credit        int
+	readDeadline  time.Time
+	writeDeadline time.Time
+	// remoteClosed is true when the other side has sent CLOSE, and localClosed when this side has.
+	remoteClosed bool
+	localClosed  bool
+	reset        bool
+	closed       bool
+}
+
+func newStream(session *Session, id uint32, remoteAddr net.Addr) *Stream {
+	return &Stream{
+		session:    session,
+		id:         id,
+		remoteAddr: remoteAddr,
+		readable:   make(chan struct{}, 1),
+		writable:   make(chan struct{}, 1),
+		credit:     Window,
+	}
+}
+
+// notify wakes up the reader and the writer to check the state of the stream.
+func (stream *Stream) notify() {
+	select {
+	case stream.readable <- struct{}{}:
+	default:
+	}
+	select {
+	case stream.writable <- struct{}{}:
+	default:
+	}
+}
+
+func (stream *Stream) receive(data []byte) error {
+	stream.mutex.Lock()
+	if len(stream.buf)+len(data) > Window {
+		stream.mutex.Unlock()
+		return &ProtocolError{Message: fmt.Sprintf("stream %d has exceeded the window", stream.id)}
+	}
+	if !stream.closed {
+		stream.buf = append(stream.buf, data...)
+	}
+	stream.mutex.Unlock()
+	stream.notify()
+	return nil
+}
+
+func (stream *Stream) receiveClose() {
+	stream.mutex.Lock()
+	stream.remoteClosed = true
+	bothClosed := stream.localClosed
+	stream.mutex.Unlock()
+	if bothClosed {
+		stream.session.removeStream(stream)
+	}
+	stream.notify()
+}
+
+func (stream *Stream) receiveReset() {
+	stream.mutex.Lock()
+	stream.reset = true
+	stream.mutex.Unlock()
+	stream.session.removeStream(stream)
+	stream.notify()
+}
+
+func (stream *Stream) grant(n int) {
+	stream.mutex.Lock()
+	stream.credit += n
+	stream.mutex.Unlock()
+	stream.notify()
+}
+
+// wait waits for the stream to be signaled on ready until the deadline.
+func (stream *Stream) wait(ready chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-ready:
+		return nil
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	case <-stream.session.done:
+		// The buffered data can still be read.
+		return nil
+	}
+}
+
+func (stream *Stream) Read(b []byte) (int, error) {
+	for {
+		stream.mutex.Lock()
+		switch {
+		case stream.closed:
+			stream.mutex.Unlock()
+			return 0, net.ErrClosed
+		case len(stream.buf) > 0:
+			n := copy(b, stream.buf)
+			stream.buf = stream.buf[n:]
+			if len(stream.buf) == 0 {
+				stream.buf = nil
+			}
+			stream.unacknowledged += n
+			var acknowledged int
+			if stream.unacknowledged >= Window/2 && !stream.remoteClosed {
+				acknowledged, stream.unacknowledged = stream.unacknowledged, 0
+			}
+			stream.mutex.Unlock()
+			if acknowledged > 0 {
+				stream.session.writeFrame(frameWindow, stream.id, binary.BigEndian.AppendUint32(nil, uint32(acknowledged)))
+			}
+			return n, nil
+		case stream.reset:
+			stream.mutex.Unlock()
+			return 0, ErrStreamReset
+		case stream.remoteClosed:
+			stream.mutex.Unlock()
+			return 0, io.EOF
+		}
+		deadline := stream.readDeadline
+		stream.mutex.Unlock()
+
+		if stream.session.Err() != nil {
+			return 0, ErrSessionClosed
+		}
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+		if err := stream.wait(stream.readable, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (stream *Stream) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		stream.mutex.Lock()
+		switch {
+		case stream.closed || stream.localClosed:
+			stream.mutex.Unlock()
+			return written, net.ErrClosed
+		case stream.reset:
+			stream.mutex.Unlock()
+			return written, ErrStreamReset
+		case stream.credit > 0:
+			n := min(len(b)-written, stream.credit, maxPayloadLen)
+			stream.credit -= n
+			stream.mutex.Unlock()
+			if err := stream.session.writeFrame(frameData, stream.id, b[written:written+n]); err != nil {
+				return written, err
+			}
+			written += n
+			continue
+		}
+		deadline := stream.writeDeadline
+		stream.mutex.Unlock()
+
+		if stream.session.Err() != nil {
+			return written, ErrSessionClosed
+		}
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return written, os.ErrDeadlineExceeded
+		}
+		if err := stream.wait(stream.writable, deadline); err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// CloseWrite tells the other side that no more data will be sent.
+func (stream *Stream) CloseWrite() error {
+	stream.mutex.Lock()
+	if stream.closed || stream.localClosed || stream.reset {
+		stream.mutex.Unlock()
+		return nil
+	}
+	stream.localClosed = true
+	bothClosed := stream.remoteClosed
+	stream.mutex.Unlock()
+
+	if bothClosed {
+		stream.session.removeStream(stream)
+	}
+	stream.notify()
+	return stream.session.writeFrame(frameClose, stream.id, nil)
+}
+
+// Close closes the stream. The other side reads EOF once it has read the data sent.
+// If the other side may still send data, the stream is reset instead, as TCP does.
+func (stream *Stream) Close() error {
+	stream.mutex.Lock()
+	remoteClosed := stream.remoteClosed
+	stream.mutex.Unlock()
+	if !remoteClosed {
+		return stream.Reset()
+	}
+
+	err := stream.CloseWrite()
+	stream.mutex.Lock()
+	stream.closed = true
+	stream.buf = nil
+	stream.mutex.Unlock()
+	stream.notify()
+	return err
+}
+
+// Reset aborts the stream in both directions.
+func (stream *Stream) Reset() error {
+	stream.mutex.Lock()
+	if stream.reset || (stream.localClosed && stream.remoteClosed) {
+		stream.mutex.Unlock()
+		return nil
+	}
+	stream.reset = true
+	stream.closed = true
+	stream.buf = nil
+	stream.mutex.Unlock()
+	stream.session.removeStream(stream)
+	stream.notify()
+	return stream.session.writeFrame(frameReset, stream.id, nil)
+}
+
+func (stream *Stream) LocalAddr() net.Addr {
+	return stream.session.conn.LocalAddr()
+}
+
+// RemoteAddr returns the address of the peer that connected to the server for the stream.
+func (stream *Stream) RemoteAddr() net.Addr {
+	return stream.remoteAddr
+}
+
+func (stream *Stream) SetDeadline(t time.Time) error {
+	stream.SetReadDeadline(t)
+	return stream.SetWriteDeadline(t)
+}
+
+func (stream *Stream) SetReadDeadline(t time.Time) error {
+	stream.mutex.Lock()
+	stream.readDeadline = t
+	stream.mutex.Unlock()
+	stream.notify()
+	return nil
+}
+
+func (stream *Stream) SetWriteDeadline(t time.Time) error {
+	stream.mutex.Lock()
+	stream.writeDeadline = t
+	stream.mutex.Unlock()
+	stream.notify()
+	return nil
+}
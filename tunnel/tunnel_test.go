@@ -0,0 +1,292 @@
+package tunnel
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// connPair returns the two ends of a TCP connection over the loopback.
+func connPair(t *testing.T) (net.Conn, net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	dialed, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return accepted, dialed
+}
+
+// sessionPair returns the server and the client of a tunnel.
+func sessionPair(t *testing.T) (*Session, *Session) {
+	serverConn, clientConn := connPair(t)
+	server := Server(serverConn)
+	client := Client(clientConn)
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+	return server, client
+}
+
+// openPair opens a stream on the server and accepts it on the client.
+func openPair(t *testing.T, server *Session, client *Session, remoteAddr string) (*Stream, *Stream) {
+	opened, err := server.Open(addr(remoteAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := client.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return opened, accepted
+}
+
+func TestStreams(t *testing.T) {
+	server, client := sessionPair(t)
+
+	streams := make([][2]*Stream, 3)
+	for i := range streams {
+		remoteAddr := net.JoinHostPort("192.0.2.1", string(rune('1'+i)))
+		opened, accepted := openPair(t, server, client, remoteAddr)
+		if accepted.RemoteAddr().String() != remoteAddr {
+			t.Fatalf("%s expected, but got %s", remoteAddr, accepted.RemoteAddr())
+		}
+		streams[i] = [2]*Stream{opened, accepted}
+	}
+	if n := server.NumStreams(); n != len(streams) {
+		t.Fatalf("%d streams expected, but got %d", len(streams), n)
+	}
+
+	// The streams are written in the reverse order and read independently.
+	for i := len(streams) - 1; i >= 0; i-- {
+		opened, accepted := streams[i][0], streams[i][1]
+		message := []byte{'a' + byte(i)}
+		if _, err := opened.Write(message); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := accepted.Write(bytes.ToUpper(message)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, pair := range streams {
+		opened, accepted := pair[0], pair[1]
+		opened.CloseWrite()
+		received, err := io.ReadAll(accepted)
+		if err != nil || string(received) != string(rune('a'+i)) {
+			t.Fatalf("%c expected, but got %q: %v", 'a'+i, received, err)
+		}
+		// The stream is half closed, so the other direction still works.
+		accepted.Write([]byte("!"))
+		accepted.Close()
+		received, err = io.ReadAll(opened)
+		if err != nil || string(received) != string(rune('A'+i))+"!" {
+			t.Fatalf("%c! expected, but got %q: %v", 'A'+i, received, err)
+		}
+		opened.Close()
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for server.NumStreams() != 0 || client.NumStreams() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("The streams expected to be removed, but %d and %d are left", server.NumStreams(), client.NumStreams())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWindow(t *testing.T) {
+	server, client := sessionPair(t)
+	opened, accepted := openPair(t, server, client, "192.0.2.1:1")
+
+	// Nothing is read, so the writer is blocked once the window is used up.
+	data := bytes.Repeat([]byte("0123456789abcdef"), 3*Window/16)
+	opened.SetWriteDeadline(time.Now().Add(200 * time.Millisecond))
+	n, err := opened.Write(data)
+	if !errors.Is(err, os.ErrDeadlineExceeded) || n != Window {
+		t.Fatalf("%d bytes and a timeout expected, but got %d bytes: %v", Window, n, err)
+	}
+
+	opened.SetWriteDeadline(time.Time{})
+	go func() {
+		opened.Write(data[n:])
+		opened.CloseWrite()
+	}()
+	received, err := io.ReadAll(accepted)
+	if err != nil || !bytes.Equal(received, data) {
+		t.Fatalf("%d bytes expected, but got %d bytes: %v", len(data), len(received), err)
+	}
+}
+
+func TestReset(t *testing.T) {
+	server, client := sessionPair(t)
+	opened, accepted := openPair(t, server, client, "192.0.2.1:1")
+
+	// The stream is closed while the other side may still send, which resets it.
+	accepted.Close()
+	if _, err := opened.Read(make([]byte, 1)); !errors.Is(err, ErrStreamReset) {
+		t.Fatalf("A reset expected, but got %v", err)
+	}
+	if _, err := opened.Write([]byte("late")); !errors.Is(err, ErrStreamReset) {
+		t.Fatalf("A reset expected, but got %v", err)
+	}
+	if _, err := accepted.Read(make([]byte, 1)); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("A closed stream expected, but got %v", err)
+	}
+}
+
+func TestReadDeadline(t *testing.T) {
+	server, client := sessionPair(t)
+	opened, accepted := openPair(t, server, client, "192.0.2.1:1")
+
+	accepted.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := accepted.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("A timeout expected, but got %v", err)
+	}
+
+	// Moving the deadline wakes up the reader.
+	accepted.SetReadDeadline(time.Time{})
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		accepted.SetReadDeadline(time.Now())
+	}()
+	if _, err := accepted.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("A timeout expected, but got %v", err)
+	}
+
+	accepted.SetReadDeadline(time.Time{})
+	opened.Write([]byte("x"))
+	if _, err := accepted.Read(make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSessionClose(t *testing.T) {
+	server, client := sessionPair(t)
+	opened, accepted := openPair(t, server, client, "192.0.2.1:1")
+	opened.Write([]byte("buffered"))
+	opened.CloseWrite()
+
+	// The data received before the session is closed can still be read.
+	time.Sleep(50 * time.Millisecond)
+	server.Close()
+	select {
+	case <-client.Done():
+	case <-time.After(10 * time.Second):
+		t.Fatal("The client expected to be closed with the connection")
+	}
+	received, err := io.ReadAll(accepted)
+	if err != nil || string(received) != "buffered" {
+		t.Fatalf("buffered expected, but got %q: %v", received, err)
+	}
+
+	if _, err := client.Accept(); !errors.Is(err, ErrSessionClosed) {
+		t.Fatalf("A closed session expected, but got %v", err)
+	}
+	if _, err := server.Open(addr("192.0.2.1:2")); !errors.Is(err, ErrSessionClosed) {
+		t.Fatalf("A closed session expected, but got %v", err)
+	}
+	if _, err := accepted.Write([]byte("x")); !errors.Is(err, ErrSessionClosed) {
+		t.Fatalf("A closed session expected, but got %v", err)
+	}
+}
+
+func TestProtocolError(t *testing.T) {
+	for _, frame := range [][]byte{
+		{0x7f, 0, 0, 0, 1, 0, 0},
+		// OPEN of an ID of the client itself.
+		{frameOpen, 0, 0, 0, 2, 0, 0},
+	} {
+		serverConn, clientConn := connPair(t)
+		client := Client(clientConn)
+		if frame[0] != frameOpen {
+			// Frames of unknown streams are ignored, so the stream is opened first.
+			serverConn.Write([]byte{frameOpen, 0, 0, 0, 1, 0, 0})
+			client.Accept()
+		}
+		serverConn.Write(frame)
+		select {
+		case <-client.Done():
+		case <-time.After(10 * time.Second):
+			t.Fatalf("%x: the session expected to be closed", frame)
+		}
+		var protocolErr *ProtocolError
+		if !errors.As(client.Err(), &protocolErr) {
+			t.Fatalf("%x: a protocol error expected, but got %v", frame, client.Err())
+		}
+		serverConn.Close()
+	}
+}
+
+func TestServerRefusesOpen(t *testing.T) {
+	serverConn, clientConn := connPair(t)
+	defer clientConn.Close()
+	server := Server(serverConn)
+	clientConn.Write([]byte{frameOpen, 0, 0, 0, 2, 0, 0})
+	select {
+	case <-server.Done():
+	case <-time.After(10 * time.Second):
+		t.Fatal("The session expected to be closed")
+	}
+	var protocolErr *ProtocolError
+	if !errors.As(server.Err(), &protocolErr) || server.NumStreams() != 0 {
+		t.Fatalf("A protocol error expected without streams, but got %v with %d streams", server.Err(), server.NumStreams())
+	}
+}
+
+func TestRefusedStreamsDoNotBlockReading(t *testing.T) {
+	// The writes on a pipe block until the other end reads them.
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	client := Client(clientConn)
+	defer client.Close()
+
+	// The streams beyond the ones waiting to be accepted are refused while the server is not reading.
+	written := make(chan error, 1)
+	go func() {
+		for id := uint32(1); id <= 2*16+1; id += 2 {
+			frame := []byte{frameOpen, 0, 0, 0, 0, 0, 0}
+			frame[4] = byte(id)
+			if _, err := serverConn.Write(frame); err != nil {
+				written <- err
+				return
+			}
+		}
+		_, err := serverConn.Write([]byte{frameData, 0, 0, 0, 1, 0, 2, 'h', 'i'})
+		written <- err
+	}()
+	select {
+	case err := <-written:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("The frames expected to be read while the RESET is not")
+	}
+
+	stream, err := client.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make([]byte, 2)
+	if _, err := io.ReadFull(stream, received); err != nil || string(received) != "hi" {
+		t.Fatalf("The data expected to be received, but got %q: %v", received, err)
+	}
+
+	serverConn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	frame := make([]byte, headerLen)
+	if _, err := io.ReadFull(serverConn, frame); err != nil || frame[0] != frameReset || frame[4] != 2*16+1 {
+		t.Fatalf("The RESET of the refused stream expected, but got %x: %v", frame, err)
+	}
+}
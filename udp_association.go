@@ -1,22 +1,134 @@
 package mysocks
 
-import "net"
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
 
+var errUDPAssociationEnded = errors.New("the UDP association has ended")
+
+// udpAssociation owns the sockets used to relay the datagrams of one UDP ASSOCIATE session.
+// The UDP goroutine of the server and the relay goroutines share it, so its mutable state
+// is guarded by mutex.
 type udpAssociation struct {
-	clientAddr               *net.UDPAddr
+	// clientAddrForAccessLimit is the address the client will send datagrams from.
+	// Its port is 0 if the client did not tell it.
 	clientAddrForAccessLimit *net.UDPAddr
-	association              chan byte
-	destConn                 *net.UDPConn
+	// association is closed when the association ends.
+	association chan byte
+	idleTimeout time.Duration
+	idleTimer   *time.Timer
+	// dial connects the sockets to the destinations.
+	dial func(network string, address string) (net.Conn, error)
+
+	mutex      sync.Mutex
+	clientAddr *net.UDPAddr
+	// destConns are the sockets connected to each destination, keyed by the destination address.
+	destConns map[string]*net.UDPConn
+	ended     bool
 }
 
 func newUDPAssociation(clientAddrForAccessLimit *net.UDPAddr) *udpAssociation {
 	return &udpAssociation{
 		clientAddrForAccessLimit: clientAddrForAccessLimit,
 		association:              make(chan byte),
+		destConns:                make(map[string]*net.UDPConn),
+		dial:                     net.Dial,
+	}
+}
+
+// startIdleTimer calls onIdle when no datagram has been relayed for the timeout.
+func (udpAssociation *udpAssociation) startIdleTimer(timeout time.Duration, onIdle func()) {
+	if timeout <= 0 {
+		return
+	}
+	udpAssociation.idleTimeout = timeout
+	udpAssociation.idleTimer = time.AfterFunc(timeout, onIdle)
+}
+
+// touch postpones the idle timeout because a datagram has been relayed.
+func (udpAssociation *udpAssociation) touch() {
+	if udpAssociation.idleTimer != nil {
+		udpAssociation.idleTimer.Reset(udpAssociation.idleTimeout)
+	}
+}
+
+func (udpAssociation *udpAssociation) setClientAddr(clientAddr *net.UDPAddr) {
+	udpAssociation.mutex.Lock()
+	defer udpAssociation.mutex.Unlock()
+	udpAssociation.clientAddr = clientAddr
+}
+
+func (udpAssociation *udpAssociation) getClientAddr() *net.UDPAddr {
+	udpAssociation.mutex.Lock()
+	defer udpAssociation.mutex.Unlock()
+	return udpAssociation.clientAddr
+}
+
+// destConnFor returns the socket connected to the destination, creating it if needed.
+// created is true when the caller is responsible for reading from the new socket.
+// The destination is resolved and dialed without the lock, so that a slow lookup does not stall
+// the other datagrams of the association.
+func (udpAssociation *udpAssociation) destConnFor(destAddress string) (destConn *net.UDPConn, created bool, err error) {
+	udpAssociation.mutex.Lock()
+	if udpAssociation.ended {
+		udpAssociation.mutex.Unlock()
+		return nil, false, errUDPAssociationEnded
 	}
+	if destConn, ok := udpAssociation.destConns[destAddress]; ok {
+		udpAssociation.mutex.Unlock()
+		return destConn, false, nil
+	}
+	udpAssociation.mutex.Unlock()
+
+	conn, err := udpAssociation.dial("udp", destAddress)
+	if err != nil {
+		return nil, false, err
+	}
+	dialedConn := conn.(*net.UDPConn)
+
+	udpAssociation.mutex.Lock()
+	defer udpAssociation.mutex.Unlock()
+	if udpAssociation.ended {
+		dialedConn.Close()
+		return nil, false, errUDPAssociationEnded
+	}
+	if destConn, ok := udpAssociation.destConns[destAddress]; ok {
+		// Another datagram to the destination has created the socket meanwhile.
+		dialedConn.Close()
+		return destConn, false, nil
+	}
+	udpAssociation.destConns[destAddress] = dialedConn
+	return dialedConn, true, nil
+}
+
+// removeDestConn closes the socket and forgets it if it is still the one for the destination.
+func (udpAssociation *udpAssociation) removeDestConn(destAddress string, destConn *net.UDPConn) {
+	udpAssociation.mutex.Lock()
+	defer udpAssociation.mutex.Unlock()
+
+	if udpAssociation.destConns[destAddress] == destConn {
+		delete(udpAssociation.destConns, destAddress)
+	}
+	destConn.Close()
 }
 
 func (udpAssociation *udpAssociation) end() {
+	if udpAssociation.idleTimer != nil {
+		udpAssociation.idleTimer.Stop()
+	}
+
+	udpAssociation.mutex.Lock()
+	defer udpAssociation.mutex.Unlock()
+
+	if udpAssociation.ended {
+		return
+	}
+	udpAssociation.ended = true
 	close(udpAssociation.association)
-	udpAssociation.destConn.Close()
+	for _, destConn := range udpAssociation.destConns {
+		destConn.Close()
+	}
 }
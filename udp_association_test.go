@@ -0,0 +1,71 @@
+package mysocks
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDestConnForDialsWithoutLock(t *testing.T) {
+	udpEchoServer := startUDPEchoServer(t)
+	defer udpEchoServer.Close()
+
+	// The lookup of slow.test does not finish until it is released.
+	release := make(chan struct{})
+	udpAssociation := newUDPAssociation(nil)
+	udpAssociation.dial = func(network string, address string) (net.Conn, error) {
+		if host, _, _ := net.SplitHostPort(address); host == "slow.test" {
+			<-release
+			return net.Dial(network, udpEchoServer.LocalAddr().String())
+		}
+		return net.Dial(network, address)
+	}
+
+	var waitGroup sync.WaitGroup
+	slowResults := make(chan *net.UDPConn, 2)
+	for i := 0; i < 2; i++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			destConn, _, err := udpAssociation.destConnFor("slow.test:53")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			slowResults <- destConn
+		}()
+	}
+
+	// The other destinations are not blocked by the slow lookup.
+	done := make(chan error, 1)
+	go func() {
+		_, created, err := udpAssociation.destConnFor(udpEchoServer.LocalAddr().String())
+		if err == nil && !created {
+			t.Error("The socket expected to be created")
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("The destination expected to be dialed while another one is being resolved")
+	}
+
+	// Both datagrams to slow.test get the same socket.
+	close(release)
+	waitGroup.Wait()
+	close(slowResults)
+	first, second := <-slowResults, <-slowResults
+	if first == nil || first != second {
+		t.Fatalf("The same socket expected, but got %p and %p", first, second)
+	}
+
+	udpAssociation.end()
+	if _, _, err := udpAssociation.destConnFor("slow.test:53"); err != errUDPAssociationEnded {
+		t.Fatalf("errUDPAssociationEnded expected, but got %v", err)
+	}
+}
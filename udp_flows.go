@@ -0,0 +1,327 @@
+package mysocks
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// udpFlowRelay relays the datagrams of clients that do not speak SOCKS, such as the ones diverted by TPROXY
+// and the ones to UDP forwards. Each pair of a client and a destination is a flow with its own socket to the destination.
+type udpFlowRelay struct {
+	server *Server
+	conn   *net.UDPConn
+	// kind tells the relay in the logs.
+	kind string
+	// fields are added to the logs of the relay, such as the name of the forward.
+	fields map[string]interface{}
+	// allowed reports whether the datagrams from the client to the destination may be relayed.
+	allowed func(client *net.UDPAddr, destination string) bool
+	// replyConnFor returns the socket the replies are sent to the client from.
+	// If it is nil, the replies are sent from conn.
+	replyConnFor func(destination string, client *net.UDPAddr) (*net.UDPConn, error)
+	// dial connects the sockets to the destinations.
+	dial func(network string, address string) (net.Conn, error)
+
+	mutex  sync.Mutex
+	flows  map[string]*udpFlow
+	closed bool
+}
+
+// udpFlow is the relay between a client and a destination.
+type udpFlow struct {
+	key         string
+	client      *net.UDPAddr
+	destination string
+	destConn    *net.UDPConn
+	// replyConn is the socket of the flow the replies are sent from, or nil if they are sent from the socket of the relay.
+	replyConn   *net.UDPConn
+	rateLimiter *sessionRateLimiter
+	closeOnce   sync.Once
+	// id, startedAt and the bytes are recorded in the access log when the flow is closed.
+	id        string
+	startedAt time.Time
+	bytesUp   atomic.Int64
+	bytesDown atomic.Int64
+}
+
+func newUDPFlowRelay(server *Server, conn *net.UDPConn, kind string, fields map[string]interface{},
+	allowed func(client *net.UDPAddr, destination string) bool,
+	replyConnFor func(destination string, client *net.UDPAddr) (*net.UDPConn, error)) *udpFlowRelay {
+	return &udpFlowRelay{
+		server:       server,
+		conn:         conn,
+		kind:         kind,
+		fields:       fields,
+		allowed:      allowed,
+		replyConnFor: replyConnFor,
+		dial:         net.Dial,
+		flows:        make(map[string]*udpFlow),
+	}
+}
+
+// serve relays the datagrams read by readDatagram until the socket is closed.
+// readDatagram returns the client and the destination of each datagram.
+func (relay *udpFlowRelay) serve(readDatagram func(buf []byte) (int, *net.UDPAddr, string, error)) {
+	buf := make([]byte, maxUDPPayloadSize)
+	for {
+		n, client, destination, err := readDatagram(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				logInfo(fmt.Sprintf("The %s UDP server has been stopped.", relay.kind), nil)
+				return
+			}
+			metricUDPDatagrams.WithLabelValues(metricDirectionUp, metricUDPDropped).Inc()
+			logSubsystem(logSubsystemUDP, logLevelWarn, fmt.Sprintf("Failed to read a %s UDP datagram.", relay.kind),
+				relay.logFields(map[string]interface{}{"error": err.Error()}))
+			continue
+		}
+		relay.handle(buf[:n], client, destination)
+	}
+}
+
+// handle sends a datagram from the client to the destination.
+func (relay *udpFlowRelay) handle(data []byte, client *net.UDPAddr, destination string) {
+	defer recoverDatagram(client)
+
+	if !relay.allowed(client, destination) {
+		metricUDPDatagrams.WithLabelValues(metricDirectionUp, metricUDPDropped).Inc()
+		logSubsystem(logSubsystemUDP, logLevelDebug, fmt.Sprintf("A %s UDP datagram not allowed has been dropped.", relay.kind),
+			relay.logFields(map[string]interface{}{"from": client.String(), "to": destination}))
+		return
+	}
+
+	flow, err := relay.flowFor(client, destination)
+	if err != nil {
+		metricUDPDatagrams.WithLabelValues(metricDirectionUp, metricUDPDropped).Inc()
+		logSubsystem(logSubsystemUDP, logLevelError, fmt.Sprintf("Failed to create a %s UDP flow to '%s': %v", relay.kind, destination, err),
+			relay.logFields(map[string]interface{}{"from": client.String()}))
+		return
+	}
+	relay.sendToDestination(flow, data)
+}
+
+// flowFor returns the flow between the client and the destination, creating it if needed.
+// The destination is dialed without the lock, so that a slow lookup does not stall the other flows.
+func (relay *udpFlowRelay) flowFor(client *net.UDPAddr, destination string) (*udpFlow, error) {
+	key := client.String() + " " + destination
+
+	relay.mutex.Lock()
+	if relay.closed {
+		relay.mutex.Unlock()
+		return nil, net.ErrClosed
+	}
+	if flow, ok := relay.flows[key]; ok {
+		relay.mutex.Unlock()
+		return flow, nil
+	}
+	relay.mutex.Unlock()
+
+	conn, err := relay.dial("udp", destination)
+	if err != nil {
+		return nil, err
+	}
+	flow := &udpFlow{
+		key:         key,
+		client:      client,
+		destination: destination,
+		destConn:    conn.(*net.UDPConn),
+		id:          newSessionID(),
+		startedAt:   time.Now(),
+	}
+	if relay.replyConnFor != nil {
+		replyConn, err := relay.replyConnFor(destination, client)
+		if err != nil {
+			flow.destConn.Close()
+			return nil, err
+		}
+		flow.replyConn = replyConn
+	}
+
+	relay.mutex.Lock()
+	if relay.closed {
+		relay.mutex.Unlock()
+		flow.closeSockets()
+		return nil, net.ErrClosed
+	}
+	if existing, ok := relay.flows[key]; ok {
+		relay.mutex.Unlock()
+		// Another datagram has created the flow meanwhile.
+		flow.closeSockets()
+		return existing, nil
+	}
+	flow.rateLimiter = relay.server.rateLimiters.newSessionRateLimiter("", client.IP.String(), rateLimit{})
+	relay.flows[key] = flow
+	relay.mutex.Unlock()
+	relay.touch(flow)
+
+	logSubsystem(logSubsystemUDP, logLevelInfo, fmt.Sprintf("A %s UDP flow has been created to: %s", relay.kind, destination),
+		relay.flowLogFields(flow, nil))
+
+	go relay.relayFromDest(flow)
+	if flow.replyConn != nil {
+		go relay.relayFromReplyConn(flow)
+	}
+	return flow, nil
+}
+
+// touch postpones the idle timeout of the flow.
+func (relay *udpFlowRelay) touch(flow *udpFlow) {
+	flow.destConn.SetReadDeadline(deadlineAfter(time.Now(), relay.server.timeoutsFor("").UDPIdle.value()))
+}
+
+func (relay *udpFlowRelay) sendToDestination(flow *udpFlow, data []byte) {
+	if !flow.rateLimiter.allow(relayUp, int64(len(data))) {
+		metricUDPDatagrams.WithLabelValues(metricDirectionUp, metricUDPDropped).Inc()
+		return
+	}
+	if _, err := flow.destConn.Write(data); err != nil {
+		metricUDPDatagrams.WithLabelValues(metricDirectionUp, metricUDPDropped).Inc()
+		logSubsystem(logSubsystemUDP, logLevelError, fmt.Sprintf("Failed to write %s UDP data to the destination.", relay.kind),
+			relay.flowLogFields(flow, map[string]interface{}{"error": err.Error()}))
+		return
+	}
+	flow.bytesUp.Add(int64(len(data)))
+	relay.touch(flow)
+	metricUDPDatagrams.WithLabelValues(metricDirectionUp, metricUDPRelayed).Inc()
+	metricBytes.WithLabelValues(cmdName(cmdAssociate), metricDirectionUp).Add(float64(len(data)))
+}
+
+// relayFromDest sends the datagrams from the destination to the client until the flow is idle or closed.
+func (relay *udpFlowRelay) relayFromDest(flow *udpFlow) {
+	closeReason := closeReasonCompleted
+	defer func() {
+		relay.removeFlow(flow, closeReason)
+	}()
+
+	buf := make([]byte, maxUDPPayloadSize)
+	for {
+		n, err := flow.destConn.Read(buf)
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				closeReason = closeReasonUDPIdleTimeout
+			}
+			return
+		}
+		relay.touch(flow)
+
+		if !flow.rateLimiter.allow(relayDown, int64(n)) {
+			metricUDPDatagrams.WithLabelValues(metricDirectionDown, metricUDPDropped).Inc()
+			continue
+		}
+		if flow.replyConn != nil {
+			_, err = flow.replyConn.Write(buf[:n])
+		} else {
+			_, err = relay.conn.WriteToUDP(buf[:n], flow.client)
+		}
+		if err != nil {
+			metricUDPDatagrams.WithLabelValues(metricDirectionDown, metricUDPDropped).Inc()
+			logSubsystem(logSubsystemUDP, logLevelError, fmt.Sprintf("Failed to write %s UDP data to the client.", relay.kind),
+				relay.flowLogFields(flow, map[string]interface{}{"error": err.Error()}))
+			return
+		}
+		flow.bytesDown.Add(int64(n))
+		metricUDPDatagrams.WithLabelValues(metricDirectionDown, metricUDPRelayed).Inc()
+		metricBytes.WithLabelValues(cmdName(cmdAssociate), metricDirectionDown).Add(float64(n))
+	}
+}
+
+// relayFromReplyConn sends the datagrams that the kernel delivers to the reply socket of the flow.
+// A socket bound to the original destination of TPROXY may receive them instead of the listener once it exists.
+func (relay *udpFlowRelay) relayFromReplyConn(flow *udpFlow) {
+	defer relay.removeFlow(flow, closeReasonCompleted)
+
+	buf := make([]byte, maxUDPPayloadSize)
+	for {
+		n, err := flow.replyConn.Read(buf)
+		if err != nil {
+			return
+		}
+		relay.sendToDestination(flow, buf[:n])
+	}
+}
+
+// removeFlow closes the sockets of the flow, forgets it and records it in the access log.
+func (relay *udpFlowRelay) removeFlow(flow *udpFlow, closeReason string) {
+	flow.closeOnce.Do(func() {
+		relay.mutex.Lock()
+		if relay.flows[flow.key] == flow {
+			delete(relay.flows, flow.key)
+		}
+		relay.mutex.Unlock()
+
+		flow.closeSockets()
+		relay.server.rateLimiters.release(flow.rateLimiter)
+		logSubsystem(logSubsystemUDP, logLevelInfo,
+			fmt.Sprintf("The %s UDP flow to %s has been closed. Reason: %s", relay.kind, flow.destination, closeReason),
+			relay.flowLogFields(flow, nil))
+		if relay.server.accessLog != nil {
+			relay.server.accessLog.write(relay.accessRecord(flow, closeReason))
+		}
+	})
+}
+
+// accessRecord returns the record of the flow for the access log, where a flow is a UDP ASSOCIATE without a reply.
+func (relay *udpFlowRelay) accessRecord(flow *udpFlow, closeReason string) accessRecord {
+	return accessRecord{
+		Time:          time.Now(),
+		SessionID:     flow.id,
+		ClientAddress: flow.client.String(),
+		Command:       cmdName(cmdAssociate),
+		Destination:   flow.destination,
+		ResolvedIP:    flow.destConn.RemoteAddr().(*net.UDPAddr).IP.String(),
+		Route:         routeDirect,
+		Rep:           -1,
+		BytesUp:       flow.bytesUp.Load(),
+		BytesDown:     flow.bytesDown.Load(),
+		DurationMs:    float64(time.Since(flow.startedAt)) / float64(time.Millisecond),
+		CloseReason:   closeReason,
+	}
+}
+
+// logFields returns the given fields with the ones of the relay added.
+func (relay *udpFlowRelay) logFields(fields map[string]interface{}) map[string]interface{} {
+	if fields == nil {
+		fields = map[string]interface{}{}
+	}
+	for key, value := range relay.fields {
+		fields[key] = value
+	}
+	return fields
+}
+
+// flowLogFields returns the given fields with the ones of the relay and the flow added.
+func (relay *udpFlowRelay) flowLogFields(flow *udpFlow, fields map[string]interface{}) map[string]interface{} {
+	fields = relay.logFields(fields)
+	fields["sessionID"] = flow.id
+	fields["from"] = flow.client.String()
+	fields["to"] = flow.destination
+	return fields
+}
+
+func (flow *udpFlow) closeSockets() {
+	flow.destConn.Close()
+	if flow.replyConn != nil {
+		flow.replyConn.Close()
+	}
+}
+
+// close closes the socket and all the flows.
+func (relay *udpFlowRelay) close() {
+	relay.mutex.Lock()
+	relay.closed = true
+	flows := make([]*udpFlow, 0, len(relay.flows))
+	for _, flow := range relay.flows {
+		flows = append(flows, flow)
+	}
+	relay.mutex.Unlock()
+
+	relay.conn.Close()
+	for _, flow := range flows {
+		relay.removeFlow(flow, closeReasonServerClosed)
+	}
+}
@@ -0,0 +1,75 @@
+package mysocks
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFlowForDialsWithoutLock(t *testing.T) {
+	udpEchoServer := startUDPEchoServer(t)
+	defer udpEchoServer.Close()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay := newUDPFlowRelay(NewServer(), conn, "test", nil, func(*net.UDPAddr, string) bool { return true }, nil)
+	defer relay.close()
+
+	// The lookup of slow.test does not finish until it is released.
+	release := make(chan struct{})
+	relay.dial = func(network string, address string) (net.Conn, error) {
+		if host, _, _ := net.SplitHostPort(address); host == "slow.test" {
+			<-release
+			return net.Dial(network, udpEchoServer.LocalAddr().String())
+		}
+		return net.Dial(network, address)
+	}
+
+	client := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	var waitGroup sync.WaitGroup
+	slowResults := make(chan *udpFlow, 2)
+	for i := 0; i < 2; i++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			flow, err := relay.flowFor(client, "slow.test:53")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			slowResults <- flow
+		}()
+	}
+
+	// The flows to the other destinations are not blocked by the slow lookup.
+	done := make(chan error, 1)
+	go func() {
+		_, err := relay.flowFor(client, udpEchoServer.LocalAddr().String())
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("The destination expected to be dialed while another one is being resolved")
+	}
+
+	// Both datagrams to slow.test get the same flow.
+	close(release)
+	waitGroup.Wait()
+	close(slowResults)
+	first, second := <-slowResults, <-slowResults
+	if first == nil || first != second {
+		t.Fatalf("The same flow expected, but got %p and %p", first, second)
+	}
+
+	relay.close()
+	if _, err := relay.flowFor(client, "slow.test:53"); err != net.ErrClosed {
+		t.Fatalf("net.ErrClosed expected, but got %v", err)
+	}
+}
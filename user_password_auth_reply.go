@@ -3,6 +3,8 @@ package mysocks
 import (
 	"fmt"
 	"io"
+
+	"github.com/jfuruya/mysocks/socks5wire"
 )
 
 type userPasswordAuthReply struct {
@@ -27,13 +29,13 @@ func newUserPasswordAuthReply(authSuccess bool, socksConnection *socksConnection
 }
 
 func (userPasswordAuthReply *userPasswordAuthReply) WriteTo(w io.Writer) (int64, error) {
-	n, err := w.Write([]byte{userPasswordAuthReply.ver, userPasswordAuthReply.status})
+	n, err := w.Write(socks5wire.AppendUserPasswordReply(nil, socks5wire.UserPasswordReply{Status: userPasswordAuthReply.status}))
 	if err != nil {
 		return 0, err
 	}
 
-	userPasswordAuthReply.socksConnection.logWithLevel(logLevelInfo,
-		fmt.Sprintf("Uer password authentication reply sent. VER: %#v STATUS: %#v", userPasswordAuthReply.ver, userPasswordAuthReply.status))
+	userPasswordAuthReply.socksConnection.logSubsystem(logSubsystemHandshake, logLevelInfo,
+		fmt.Sprintf("Uer password authentication reply sent. VER: %#v STATUS: %#v", userPasswordAuthReply.ver, userPasswordAuthReply.status), nil)
 
 	return int64(n), nil
 }
@@ -0,0 +1,177 @@
+package mysocks
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Policies applied when the webhook can not be consulted.
+const (
+	// webhookFailClosed denies the authentication.
+	webhookFailClosed = "closed"
+	// webhookFailOpen allows the authentication without any attribute.
+	webhookFailOpen = "open"
+)
+
+// webhookCacheMaxEntries is the number of cached decisions above which the expired ones are removed.
+const webhookCacheMaxEntries = 10000
+
+// webhookRequest is the body POSTed to the webhook.
+type webhookRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	ClientIP string `json:"clientIP"`
+	Method   string `json:"method"`
+}
+
+// webhookResponse is the body expected from the webhook.
+type webhookResponse struct {
+	Allow               bool      `json:"allow"`
+	Groups              []string  `json:"groups"`
+	RateLimit           rateLimit `json:"rateLimit"`
+	AllowedDestinations []string  `json:"allowedDestinations"`
+	// TTL overrides the time in seconds for which the decision is cached.
+	TTL *int `json:"ttl"`
+}
+
+type webhookCacheEntry struct {
+	decision  authDecision
+	expiresAt time.Time
+}
+
+// webhookAuthenticator verifies the credentials by POSTing them to an HTTP endpoint.
+// The decisions are cached by the credentials and the client IP.
+type webhookAuthenticator struct {
+	url           string
+	token         string
+	client        *http.Client
+	allowTTL      time.Duration
+	denyTTL       time.Duration
+	failurePolicy string
+
+	cacheMutex sync.Mutex
+	cache      map[[sha256.Size]byte]webhookCacheEntry
+}
+
+func newWebhookAuthenticator(url string, token string, timeout time.Duration, allowTTL time.Duration, denyTTL time.Duration, failurePolicy string) (*webhookAuthenticator, error) {
+	switch failurePolicy {
+	case webhookFailClosed, webhookFailOpen:
+	default:
+		return nil, fmt.Errorf("unknown failure policy of the authentication webhook: %s", failurePolicy)
+	}
+	return &webhookAuthenticator{
+		url:           url,
+		token:         token,
+		client:        &http.Client{Timeout: timeout},
+		allowTTL:      allowTTL,
+		denyTTL:       denyTTL,
+		failurePolicy: failurePolicy,
+		cache:         map[[sha256.Size]byte]webhookCacheEntry{},
+	}, nil
+}
+
+func (authenticator *webhookAuthenticator) authenticate(check credentialsCheck) (authDecision, error) {
+	request := webhookRequest{
+		Username: check.userName,
+		Password: check.password,
+		ClientIP: check.clientIP.String(),
+		Method:   methodName(check.method),
+	}
+	// The password is hashed with the rest so that it is not kept in memory.
+	key := sha256.Sum256([]byte(request.Username + "\x00" + request.Password + "\x00" + request.ClientIP))
+	if decision, ok := authenticator.cached(key); ok {
+		return decision, nil
+	}
+
+	decision, ttl, err := authenticator.post(request)
+	if err != nil {
+		metricAuthBackendErrors.WithLabelValues("webhook").Inc()
+		return authDecision{allowed: authenticator.failurePolicy == webhookFailOpen}, err
+	}
+	if ttl > 0 {
+		authenticator.store(key, decision, ttl)
+	}
+	return decision, nil
+}
+
+// post asks the webhook and returns the decision with the time for which it can be cached.
+func (authenticator *webhookAuthenticator) post(request webhookRequest) (authDecision, time.Duration, error) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return authDecision{}, 0, err
+	}
+	httpRequest, err := http.NewRequest(http.MethodPost, authenticator.url, bytes.NewReader(body))
+	if err != nil {
+		return authDecision{}, 0, err
+	}
+	httpRequest.Header.Set("Content-Type", "application/json")
+	if authenticator.token != "" {
+		httpRequest.Header.Set("Authorization", "Bearer "+authenticator.token)
+	}
+
+	httpResponse, err := authenticator.client.Do(httpRequest)
+	if err != nil {
+		return authDecision{}, 0, fmt.Errorf("the authentication webhook has failed: %w", err)
+	}
+	defer httpResponse.Body.Close()
+	if httpResponse.StatusCode != http.StatusOK {
+		return authDecision{}, 0, fmt.Errorf("the authentication webhook has returned the status %d", httpResponse.StatusCode)
+	}
+	var response webhookResponse
+	if err := json.NewDecoder(httpResponse.Body).Decode(&response); err != nil {
+		return authDecision{}, 0, fmt.Errorf("failed to parse the response of the authentication webhook: %w", err)
+	}
+
+	ttl := authenticator.denyTTL
+	if response.Allow {
+		ttl = authenticator.allowTTL
+	}
+	if response.TTL != nil {
+		ttl = time.Duration(*response.TTL) * time.Second
+	}
+	if !response.Allow {
+		return authDecision{}, ttl, nil
+	}
+
+	allowedDestinations, err := parseDestinationPatterns(response.AllowedDestinations)
+	if err != nil {
+		return authDecision{}, 0, fmt.Errorf("the authentication webhook has returned %w", err)
+	}
+	return authDecision{
+		allowed: true,
+		attributes: userAttributes{
+			groups:              response.Groups,
+			rateLimit:           response.RateLimit,
+			allowedDestinations: allowedDestinations,
+		},
+	}, ttl, nil
+}
+
+func (authenticator *webhookAuthenticator) cached(key [sha256.Size]byte) (authDecision, bool) {
+	authenticator.cacheMutex.Lock()
+	defer authenticator.cacheMutex.Unlock()
+	entry, ok := authenticator.cache[key]
+	if !ok || time.Now().After(entry.expiresAt) {
+		return authDecision{}, false
+	}
+	return entry.decision, true
+}
+
+func (authenticator *webhookAuthenticator) store(key [sha256.Size]byte, decision authDecision, ttl time.Duration) {
+	authenticator.cacheMutex.Lock()
+	defer authenticator.cacheMutex.Unlock()
+	now := time.Now()
+	if len(authenticator.cache) >= webhookCacheMaxEntries {
+		for key, entry := range authenticator.cache {
+			if now.After(entry.expiresAt) {
+				delete(authenticator.cache, key)
+			}
+		}
+	}
+	authenticator.cache[key] = webhookCacheEntry{decision: decision, expiresAt: now.Add(ttl)}
+}
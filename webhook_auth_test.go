@@ -0,0 +1,136 @@
+package mysocks
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWebhookAuth(t *testing.T) {
+	allowedEchoServer := startEchoServer(t)
+	defer allowedEchoServer.Close()
+	otherEchoServer := startEchoServer(t)
+	defer otherEchoServer.Close()
+
+	var calls atomic.Int32
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if r.Header.Get("Authorization") != "Bearer webhook-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var request webhookRequest
+		json.NewDecoder(r.Body).Decode(&request)
+		if request.Username != "frank" || request.Password != "frank-password" || request.Method != "username_password" || request.ClientIP != "127.0.0.1" {
+			json.NewEncoder(w).Encode(webhookResponse{Allow: false})
+			return
+		}
+		json.NewEncoder(w).Encode(webhookResponse{
+			Allow:               true,
+			Groups:              []string{"staff"},
+			AllowedDestinations: []string{allowedEchoServer.Addr().String()},
+		})
+	}))
+	defer webhook.Close()
+
+	os.Setenv("MYSOCKS_AUTH_WEBHOOK_URL", webhook.URL)
+	os.Setenv("MYSOCKS_AUTH_WEBHOOK_TOKEN", "webhook-token")
+	defer os.Setenv("MYSOCKS_AUTH_WEBHOOK_URL", "")
+	defer os.Setenv("MYSOCKS_AUTH_WEBHOOK_TOKEN", "")
+
+	StartServer()
+	defer StopServer()
+
+	dialer := dialerThrough("frank", "frank-password")
+	conn, err := dialer.Dial("tcp", allowedEchoServer.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if sessions := server.socksConnections.list(); len(sessions) != 1 || len(sessions[0].getInfo().attributes.groups) != 1 {
+		t.Fatal("The session should have the groups returned by the webhook")
+	}
+
+	// The destination is not in the allowed ones. The decision is cached.
+	if _, err := dialer.Dial("tcp", otherEchoServer.Addr().String()); err == nil {
+		t.Fatal("The destination should be denied")
+	}
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("The decision should be cached, but the webhook has been called %d times", n)
+	}
+
+	wrongDialer := dialerThrough("frank", "wrong-password")
+	if _, err := wrongDialer.Dial("tcp", allowedEchoServer.Addr().String()); err == nil {
+		t.Fatal("The wrong password should be denied")
+	}
+	if n := calls.Load(); n != 2 {
+		t.Fatalf("The webhook should be called for the other password, but it has been called %d times", n)
+	}
+}
+
+func TestWebhookFailurePolicy(t *testing.T) {
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer webhook.Close()
+
+	check := credentialsCheck{userName: "grace", password: "grace-password", clientIP: net.IPv4(127, 0, 0, 1), method: usernamePasswd}
+	for _, test := range []struct {
+		policy  string
+		allowed bool
+	}{
+		{webhookFailClosed, false},
+		{webhookFailOpen, true},
+	} {
+		authenticator, err := newWebhookAuthenticator(webhook.URL, "", time.Second, time.Minute, time.Minute, test.policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decision, err := authenticator.authenticate(check)
+		if err == nil || decision.allowed != test.allowed {
+			t.Errorf("%s: allowed %v with an error expected, but got %v: %v", test.policy, test.allowed, decision.allowed, err)
+		}
+	}
+
+	if _, err := newWebhookAuthenticator(webhook.URL, "", time.Second, time.Minute, time.Minute, "maybe"); err == nil {
+		t.Error("An unknown policy should be rejected")
+	}
+}
+
+func TestDestinationPattern(t *testing.T) {
+	for _, test := range []struct {
+		pattern     string
+		destination string
+		expected    bool
+	}{
+		{"example.com", "example.com:443", true},
+		{"example.com", "EXAMPLE.com:80", true},
+		{"example.com:443", "example.com:80", false},
+		{"*.example.com", "www.example.com:80", true},
+		{"*.example.com", "example.com:80", false},
+		{"*:53", "192.0.2.1:53", true},
+		{"10.0.0.0/8", "10.1.2.3:22", true},
+		{"10.0.0.0/8", "10.example.com:22", false},
+		{"[2001:db8::1]:443", "[2001:db8:0::1]:443", true},
+		{"192.0.2.1", "192.0.2.2:80", false},
+	} {
+		pattern, err := parseDestinationPattern(test.pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual := pattern.matches(test.destination); actual != test.expected {
+			t.Errorf("%s %s: %v expected, but got %v", test.pattern, test.destination, test.expected, actual)
+		}
+	}
+
+	for _, pattern := range []string{"", "example.com:http", "10.0.0.0/33"} {
+		if _, err := parseDestinationPattern(pattern); err == nil {
+			t.Errorf("%q should be rejected", pattern)
+		}
+	}
+}
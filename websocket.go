@@ -0,0 +1,128 @@
+package mysocks
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// SOCKS5 over WebSocket serves the clients behind firewalls that only pass HTTP. The binary messages
+// carry the bytes of a SOCKS5 session as they are, so the sessions are handled as the ones over TCP.
+
+var errWebSocketOriginNotAllowed = errors.New("the origin is not allowed")
+
+// webSocketListener accepts the WebSocket connections on the path as the connections of a net.Listener.
+type webSocketListener struct {
+	tcpListener    net.Listener
+	httpServer     *http.Server
+	allowedOrigins []string
+	conns          chan net.Conn
+	closed         chan struct{}
+	closeOnce      sync.Once
+}
+
+func listenWebSocket(address string, path string, allowedOrigins []string) (*webSocketListener, error) {
+	tcpListener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	listener := &webSocketListener{
+		tcpListener:    tcpListener,
+		allowedOrigins: allowedOrigins,
+		conns:          make(chan net.Conn),
+		closed:         make(chan struct{}),
+	}
+	mux := http.NewServeMux()
+	mux.Handle(path, websocket.Server{Handshake: listener.checkOrigin, Handler: listener.handle})
+	listener.httpServer = &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go listener.httpServer.Serve(tcpListener)
+	return listener, nil
+}
+
+// checkOrigin rejects the handshake unless the Origin header is one of the allowed origins, if any are given.
+func (listener *webSocketListener) checkOrigin(config *websocket.Config, req *http.Request) error {
+	if len(listener.allowedOrigins) == 0 {
+		return nil
+	}
+	origin := req.Header.Get("Origin")
+	for _, allowed := range listener.allowedOrigins {
+		if strings.EqualFold(origin, allowed) {
+			return nil
+		}
+	}
+	metricACLDenials.WithLabelValues("origin").Inc()
+	logSubsystem(logSubsystemHandshake, logLevelWarn, "The origin of the WebSocket connection is not allowed.",
+		map[string]interface{}{"origin": origin, "clientAddress": req.RemoteAddr})
+	return errWebSocketOriginNotAllowed
+}
+
+// handle passes the connection to Accept, and waits for it to be closed, since it is closed when handle returns.
+func (listener *webSocketListener) handle(ws *websocket.Conn) {
+	ws.PayloadType = websocket.BinaryFrame
+	remoteAddr, err := net.ResolveTCPAddr("tcp", ws.Request().RemoteAddr)
+	if err != nil {
+		return
+	}
+	localAddr, _ := ws.Request().Context().Value(http.LocalAddrContextKey).(net.Addr)
+	conn := &webSocketConn{Conn: ws, remoteAddr: remoteAddr, localAddr: localAddr, closed: make(chan struct{})}
+
+	select {
+	case listener.conns <- conn:
+	case <-listener.closed:
+		return
+	}
+	<-conn.closed
+}
+
+func (listener *webSocketListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-listener.conns:
+		return conn, nil
+	case <-listener.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting new connections. The accepted ones are kept until they are closed.
+func (listener *webSocketListener) Close() error {
+	var err error
+	listener.closeOnce.Do(func() {
+		close(listener.closed)
+		err = listener.httpServer.Close()
+	})
+	return err
+}
+
+func (listener *webSocketListener) Addr() net.Addr {
+	return listener.tcpListener.Addr()
+}
+
+// webSocketConn is a WebSocket connection whose addresses are the ones of the TCP connection under it.
+type webSocketConn struct {
+	*websocket.Conn
+	remoteAddr net.Addr
+	localAddr  net.Addr
+	closeOnce  sync.Once
+	closed     chan struct{}
+}
+
+func (conn *webSocketConn) Close() error {
+	err := conn.Conn.Close()
+	conn.closeOnce.Do(func() {
+		close(conn.closed)
+	})
+	return err
+}
+
+func (conn *webSocketConn) RemoteAddr() net.Addr {
+	return conn.remoteAddr
+}
+
+func (conn *webSocketConn) LocalAddr() net.Addr {
+	return conn.localAddr
+}
@@ -0,0 +1,104 @@
+package mysocks
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jfuruya/mysocks/client"
+)
+
+func TestWebSocketListener(t *testing.T) {
+	variables := map[string]string{
+		"MYSOCKS_WEBSOCKET_ADDRESS":         "127.0.0.1:0",
+		"MYSOCKS_WEBSOCKET_PATH":            "/socks",
+		"MYSOCKS_WEBSOCKET_ALLOWED_ORIGINS": "https://allowed.example, http://127.0.0.1",
+	}
+	for name, value := range variables {
+		os.Setenv(name, value)
+		defer os.Setenv(name, "")
+	}
+
+	StartServer()
+	defer StopServer()
+
+	echoServer := startEchoServer(t)
+	defer echoServer.Close()
+
+	endpoint := "ws://" + server.webSocketListener.Addr().String() + "/socks"
+	echoThrough := func(proxyDialer *client.WebSocketDialer) error {
+		dialer := &client.Dialer{ProxyDialer: proxyDialer, HandshakeTimeout: 10 * time.Second}
+		conn, err := dialer.DialContext(context.Background(), "tcp", echoServer.Addr().String())
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		conn.Write([]byte("over websocket"))
+		echoed := make([]byte, len("over websocket"))
+		if _, err := io.ReadFull(conn, echoed); err != nil || string(echoed) != "over websocket" {
+			t.Fatalf("The message expected to be echoed, but got %q %v", echoed, err)
+		}
+		return nil
+	}
+
+	// The origin of the URL, http://127.0.0.1:PORT, is not allowed, since the port differs.
+	for _, proxyDialer := range []*client.WebSocketDialer{
+		{URL: endpoint, Origin: "https://allowed.example"},
+		{URL: endpoint, Origin: "https://ALLOWED.example"},
+	} {
+		if err := echoThrough(proxyDialer); err != nil {
+			t.Fatalf("%s: %v", proxyDialer.Origin, err)
+		}
+	}
+	for _, proxyDialer := range []*client.WebSocketDialer{
+		{URL: endpoint},
+		{URL: endpoint, Origin: "https://denied.example"},
+		{URL: "ws://" + server.webSocketListener.Addr().String() + "/other", Origin: "https://allowed.example"},
+	} {
+		if err := echoThrough(proxyDialer); err == nil {
+			t.Fatalf("%s from %s expected to be rejected", proxyDialer.URL, proxyDialer.Origin)
+		}
+	}
+
+	// The local client mode exposes a plain SOCKS5 port.
+	localListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyDialer := &client.WebSocketDialer{URL: endpoint, Origin: "http://127.0.0.1"}
+	served := make(chan error, 1)
+	go func() {
+		served <- proxyDialer.Serve(localListener)
+	}()
+	conn, err := connectRequestThrough(t, localListener.Addr().String(), echoServer.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("local"))
+	echoed := make([]byte, len("local"))
+	if _, err := io.ReadFull(conn, echoed); err != nil || string(echoed) != "local" {
+		t.Fatalf("The message expected to be echoed, but got %q %v", echoed, err)
+	}
+	conn.Close()
+	localListener.Close()
+	if err := <-served; err != nil {
+		t.Fatalf("Serve expected to return nil when the listener is closed, but got %v", err)
+	}
+
+	waitForSessionsToEnd(t)
+}
+
+// connectRequestThrough connects to the destination through the SOCKS5 server at the address.
+func connectRequestThrough(t *testing.T, proxyAddress string, destination string) (net.Conn, error) {
+	dialer := &client.Dialer{ProxyAddress: proxyAddress, HandshakeTimeout: 10 * time.Second}
+	conn, err := dialer.DialContext(context.Background(), "tcp", destination)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	return conn, nil
+}